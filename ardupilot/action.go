@@ -30,8 +30,47 @@ import (
 	"github.com/zyxkad/drone"
 )
 
+// SetFence replaces the fence with an inclusion polygon and enables it
 func (d *Drone) SetFence(ctx context.Context, vectors []*drone.Gps) error {
-	return errors.New("Not implemented")
+	if len(vectors) < 3 {
+		return errors.New("Fence polygon requires at least 3 vertices")
+	}
+	if len(vectors) > 0xff {
+		return errors.New("Too much fence vertices")
+	}
+	if err := d.WriteMessage(&common.MessageMissionClearAll{
+		TargetSystem:    (byte)(d.ID()),
+		TargetComponent: d.component,
+		MissionType:     common.MAV_MISSION_TYPE_FENCE,
+	}); err != nil {
+		return err
+	}
+	if err := d.WriteMessage(&common.MessageMissionCount{
+		TargetSystem:    (byte)(d.ID()),
+		TargetComponent: d.component,
+		Count:           (uint16)(len(vectors)),
+		MissionType:     common.MAV_MISSION_TYPE_FENCE,
+	}); err != nil {
+		return err
+	}
+	for i, pos := range vectors {
+		lat, lon := pos.ToWGS84()
+		if err := d.WriteMessage(&common.MessageMissionItemInt{
+			TargetSystem:    (byte)(d.ID()),
+			TargetComponent: d.component,
+			Seq:             (uint16)(i),
+			Frame:           common.MAV_FRAME_GLOBAL_INT,
+			Command:         common.MAV_CMD_NAV_FENCE_POLYGON_VERTEX_INCLUSION,
+			Param1:          (float32)(len(vectors)),
+			X:               lat,
+			Y:               lon,
+			MissionType:     common.MAV_MISSION_TYPE_FENCE,
+		}); err != nil {
+			return err
+		}
+	}
+	return d.SendCommandLongOrError(ctx, nil, common.MAV_CMD_DO_FENCE_ENABLE, 0x01, (float32)(common.FENCE_TYPE_ALL),
+		0, 0, 0, 0, 0)
 }
 
 func (d *Drone) DisableFence(ctx context.Context) error {
@@ -234,6 +273,77 @@ func (d *Drone) SetMission(ctx context.Context, path []*drone.Gps) error {
 	return nil
 }
 
+// SetTimedMission uploads the waypoints with a DO_CHANGE_SPEED item before each of them
+// The item with sequence 0 is the home position for ArduPilot, so the first waypoint is duplicated there
+func (d *Drone) SetTimedMission(ctx context.Context, items []*drone.MissionItem) error {
+	if len(items) == 0 {
+		return errors.New("Mission is empty")
+	}
+	count := len(items)*2 + 1
+	if count > 0xffff {
+		return errors.New("Too much mission items")
+	}
+	if err := d.WriteMessage(&common.MessageMissionClearAll{
+		TargetSystem:    (byte)(d.ID()),
+		TargetComponent: d.component,
+		MissionType:     common.MAV_MISSION_TYPE_MISSION,
+	}); err != nil {
+		return err
+	}
+	d.missionAck.Store(nil)
+	if err := d.WriteMessage(&common.MessageMissionCount{
+		TargetSystem:    (byte)(d.ID()),
+		TargetComponent: d.component,
+		Count:           (uint16)(count),
+		MissionType:     common.MAV_MISSION_TYPE_MISSION,
+	}); err != nil {
+		return err
+	}
+	writeWaypoint := func(seq int, item *drone.MissionItem) error {
+		lat, lon := item.Pos.ToWGS84()
+		return d.WriteMessage(&common.MessageMissionItemInt{
+			TargetSystem:    (byte)(d.ID()),
+			TargetComponent: d.component,
+			Seq:             (uint16)(seq),
+			Frame:           common.MAV_FRAME_GLOBAL_INT,
+			Command:         common.MAV_CMD_NAV_WAYPOINT,
+			Autocontinue:    1,
+			Param1:          (float32)((time.Duration)(item.Delay).Seconds()),
+			X:               lat,
+			Y:               lon,
+			Z:               item.Pos.Alt,
+			MissionType:     common.MAV_MISSION_TYPE_MISSION,
+		})
+	}
+	if err := writeWaypoint(0, items[0]); err != nil {
+		return err
+	}
+	for i, item := range items {
+		speed := item.Speed
+		if speed <= 0 {
+			speed = -1 // no change
+		}
+		if err := d.WriteMessage(&common.MessageMissionItemInt{
+			TargetSystem:    (byte)(d.ID()),
+			TargetComponent: d.component,
+			Seq:             (uint16)(i*2 + 1),
+			Frame:           common.MAV_FRAME_MISSION,
+			Command:         common.MAV_CMD_DO_CHANGE_SPEED,
+			Autocontinue:    1,
+			Param1:          1, // ground speed
+			Param2:          speed,
+			Param3:          -1,
+			MissionType:     common.MAV_MISSION_TYPE_MISSION,
+		}); err != nil {
+			return err
+		}
+		if err := writeWaypoint(i*2+2, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *Drone) StartMission(ctx context.Context, startId, endId int) error {
 	if err := d.SendCommandLongOrError(ctx, nil, common.MAV_CMD_MISSION_START,
 		(float32)(startId), (float32)(endId), 0, 0, 0, 0, 0); err != nil {
@@ -79,6 +79,19 @@ func (d *Drone) sendCommandLongCh(
 	return ch, nil
 }
 
+// expectCommandAck registers a receiver of the command's acknowledge without sending the command
+// It is used when the command is broadcasted or sent at a specific time
+func (d *Drone) expectCommandAck(cmd common.MAV_CMD) (<-chan *common.MessageCommandAck, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if _, ok := d.commandAcks[cmd]; ok {
+		return nil, errCommandPending
+	}
+	ch := make(chan *common.MessageCommandAck, 1)
+	d.commandAcks[cmd] = ch
+	return ch, nil
+}
+
 func (d *Drone) sendCommandLongMessage(
 	cmd common.MAV_CMD,
 	confirm uint8,
@@ -227,6 +240,16 @@ func (d *Drone) SendCommandLongOrError(
 	return nil
 }
 
+// ExecuteCommand sends a COMMAND_LONG with at most 7 arguments, missing arguments are zero
+func (d *Drone) ExecuteCommand(ctx context.Context, cmd int, args ...float32) error {
+	if len(args) > 7 {
+		return errors.New("Too many command arguments")
+	}
+	var a [7]float32
+	copy(a[:], args)
+	return d.SendCommandLongOrError(ctx, nil, (common.MAV_CMD)(cmd), a[0], a[1], a[2], a[3], a[4], a[5], a[6])
+}
+
 func (d *Drone) SendRequestMessage(ctx context.Context, id uint32) error {
 	return d.SendCommandLongOrError(ctx, nil, common.MAV_CMD_REQUEST_MESSAGE, (float32)(id), 0, 0, 0, 0, 0, 1)
 }
@@ -0,0 +1,171 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ardupilot
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/gomavlib/v3"
+	"github.com/bluenviron/gomavlib/v3/pkg/dialects/common"
+	"github.com/bluenviron/gomavlib/v3/pkg/message"
+
+	"github.com/zyxkad/drone"
+)
+
+const (
+	// duplicateWindow is the period which the evidences are counted in
+	duplicateWindow = time.Second * 10
+	// duplicateReportInterval limits how often a duplicated system ID is reported
+	duplicateReportInterval = time.Second * 30
+	// duplicateJumpDistance is the distance between two positions which cannot be the same vehicle
+	duplicateJumpDistance = 15
+)
+
+type heartbeatSig struct {
+	typ        common.MAV_TYPE
+	autopilot  common.MAV_AUTOPILOT
+	customMode uint32
+	state      common.MAV_STATE
+	armed      bool
+}
+
+type channelSeq struct {
+	last       byte
+	frames     int
+	backward   int
+	heartbeats int
+}
+
+// duplicateDetector finds more than one vehicle sending with the same system ID
+// Two vehicles interleave their frames, so the evidences are:
+//   - the sequence number goes backward frequently on a channel
+//   - the heartbeats alternate between two states, or arrive faster than a vehicle sends
+//   - the position jumps back and forth between two places
+//
+// The frames of the same vehicle received from multiple channels are counted per channel, so they are not reported
+type duplicateDetector struct {
+	mux         sync.Mutex
+	windowStart time.Time
+	channels    map[*gomavlib.Channel]*channelSeq
+	heartbeats  [2]heartbeatSig // the last and the one before it
+	hbCount     int
+	hbFlips     int
+	positions   [2]*drone.Gps
+	posFlips    int
+	reportedAt  time.Time
+	reasons     []string
+}
+
+func newDuplicateDetector() *duplicateDetector {
+	return &duplicateDetector{
+		channels: make(map[*gomavlib.Channel]*channelSeq),
+	}
+}
+
+// observe records a frame, it returns the evidences when a window ends with a duplication should be reported
+func (t *duplicateDetector) observe(ch *gomavlib.Channel, seq byte, msg message.Message, now time.Time) []string {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	var reasons []string
+	if t.windowStart.IsZero() {
+		t.windowStart = now
+	} else if now.Sub(t.windowStart) >= duplicateWindow {
+		reasons = t.evaluate(now.Sub(t.windowStart))
+		t.reasons = reasons
+		t.windowStart = now
+		t.hbFlips, t.posFlips = 0, 0
+		clear(t.channels)
+		if len(reasons) > 0 && now.Sub(t.reportedAt) >= duplicateReportInterval {
+			t.reportedAt = now
+		} else {
+			reasons = nil
+		}
+	}
+
+	cs, ok := t.channels[ch]
+	if !ok {
+		cs = &channelSeq{last: seq - 1}
+		t.channels[ch] = cs
+	}
+	cs.frames++
+	if diff := seq - cs.last; diff == 0 || diff >= 0x80 {
+		cs.backward++
+	}
+	cs.last = seq
+
+	switch msg := msg.(type) {
+	case *common.MessageHeartbeat:
+		cs.heartbeats++
+		sig := heartbeatSig{
+			typ:        msg.Type,
+			autopilot:  msg.Autopilot,
+			customMode: msg.CustomMode,
+			state:      msg.SystemStatus,
+			armed:      msg.BaseMode&common.MAV_MODE_FLAG_SAFETY_ARMED != 0,
+		}
+		if t.hbCount >= 2 && sig != t.heartbeats[0] && sig == t.heartbeats[1] {
+			t.hbFlips++
+		}
+		t.heartbeats[0], t.heartbeats[1] = sig, t.heartbeats[0]
+		t.hbCount++
+	case *common.MessageGlobalPositionInt:
+		pos := drone.GPSFromWGS84(msg.Lat, msg.Lon, msg.Alt)
+		if last, prev := t.positions[0], t.positions[1]; last != nil && prev != nil {
+			if pos.DistanceTo(last) > duplicateJumpDistance && pos.DistanceTo(prev) < duplicateJumpDistance/3 {
+				t.posFlips++
+			}
+		}
+		t.positions[0], t.positions[1] = pos, t.positions[0]
+	}
+	return reasons
+}
+
+// evaluate requires at least two kinds of evidences, since each of them may happen on a bad link
+func (t *duplicateDetector) evaluate(window time.Duration) []string {
+	var reasons []string
+	var frames, backward int
+	maxHeartbeats := 0
+	for _, cs := range t.channels {
+		frames += cs.frames
+		backward += cs.backward
+		maxHeartbeats = max(maxHeartbeats, cs.heartbeats)
+	}
+	if backward >= 5 && backward*10 >= frames {
+		reasons = append(reasons, fmt.Sprintf("sequence number went backward %d times in %d frames", backward, frames))
+	}
+	// ArduPilot sends heartbeat at 1Hz
+	if rate := (float64)(maxHeartbeats) / window.Seconds(); t.hbFlips >= 3 || rate > 1.7 {
+		reasons = append(reasons, fmt.Sprintf("heartbeats conflicted %d times at %.1f Hz", t.hbFlips, rate))
+	}
+	if t.posFlips >= 3 {
+		reasons = append(reasons, fmt.Sprintf("position jumped back and forth %d times", t.posFlips))
+	}
+	if len(reasons) < 2 {
+		return nil
+	}
+	return reasons
+}
+
+// Duplicated returns the evidences found in the last window, it's empty if the system ID is not duplicated
+func (d *Drone) Duplicated() []string {
+	d.duplicates.mux.Lock()
+	defer d.duplicates.mux.Unlock()
+	return d.duplicates.reasons
+}
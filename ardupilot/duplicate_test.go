@@ -0,0 +1,148 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ardupilot_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluenviron/gomavlib/v3"
+	"github.com/bluenviron/gomavlib/v3/pkg/dialects/common"
+	"github.com/bluenviron/gomavlib/v3/pkg/message"
+
+	"github.com/zyxkad/drone/ardupilot"
+)
+
+// testVehicle sends a heartbeat every second and a position every 250ms
+type testVehicle struct {
+	ch   *gomavlib.Channel
+	seq  byte
+	mode uint32
+	lat  int32
+}
+
+func (v *testVehicle) frames(tick int) []message.Message {
+	msgs := []message.Message{&common.MessageGlobalPositionInt{Lat: v.lat, Lon: 1200000000, Alt: 10000}}
+	if tick%4 == 0 {
+		msgs = append(msgs, &common.MessageHeartbeat{
+			Type:       common.MAV_TYPE_QUADROTOR,
+			Autopilot:  common.MAV_AUTOPILOT_ARDUPILOTMEGA,
+			CustomMode: v.mode,
+		})
+	}
+	return msgs
+}
+
+// runDetector feeds the vehicles' frames interleaved for the duration, and returns all reported evidences
+func runDetector(d *ardupilot.DuplicateDetector, start time.Time, dur time.Duration, vehicles ...*testVehicle) (reports [][]string) {
+	tick := 0
+	for at := (time.Duration)(0); at <= dur; at += time.Millisecond * 250 {
+		now := start.Add(at)
+		for _, v := range vehicles {
+			for _, msg := range v.frames(tick) {
+				if reasons := d.Observe(v.ch, v.seq, msg, now); reasons != nil {
+					reports = append(reports, reasons)
+				}
+				v.seq++
+			}
+		}
+		tick++
+	}
+	return
+}
+
+func TestDuplicateSingleVehicle(t *testing.T) {
+	d := ardupilot.NewDuplicateDetector()
+	v := &testVehicle{ch: new(gomavlib.Channel), lat: 300000000}
+	if reports := runDetector(d, time.Now(), time.Second*25, v); len(reports) != 0 {
+		t.Errorf("Single vehicle is reported: %v", reports)
+	}
+}
+
+func TestDuplicateMultipleChannels(t *testing.T) {
+	// the same vehicle received from two links must not be counted as a sequence jump
+	d := ardupilot.NewDuplicateDetector()
+	a, b := new(gomavlib.Channel), new(gomavlib.Channel)
+	start := time.Now()
+	var seq byte
+	for at := (time.Duration)(0); at <= time.Second*25; at += time.Millisecond * 250 {
+		msg := &common.MessageGlobalPositionInt{Lat: 300000000, Lon: 1200000000}
+		if r := d.Observe(a, seq, msg, start.Add(at)); r != nil {
+			t.Fatalf("Reported at %v: %v", at, r)
+		}
+		if r := d.Observe(b, seq, msg, start.Add(at+time.Millisecond*5)); r != nil {
+			t.Fatalf("Reported at %v: %v", at, r)
+		}
+		seq++
+	}
+}
+
+func TestDuplicateInterleave(t *testing.T) {
+	d := ardupilot.NewDuplicateDetector()
+	ch := new(gomavlib.Channel)
+	a := &testVehicle{ch: ch, seq: 0, mode: 4, lat: 300000000}
+	b := &testVehicle{ch: ch, seq: 100, mode: 5, lat: 300000000}
+	start := time.Now()
+	reports := runDetector(d, start, time.Second*25, a, b)
+	// the second window ends in 30s after the first report, so it's not reported again
+	if len(reports) != 1 {
+		t.Fatalf("Expected 1 report, got %v", reports)
+	}
+	joined := strings.Join(reports[0], "; ")
+	if !strings.Contains(joined, "sequence number") || !strings.Contains(joined, "heartbeats") {
+		t.Errorf("Unexpected evidences: %s", joined)
+	}
+	if strings.Contains(joined, "position") {
+		t.Errorf("Vehicles at the same place should not report position jumps: %s", joined)
+	}
+}
+
+func TestDuplicatePositionJump(t *testing.T) {
+	d := ardupilot.NewDuplicateDetector()
+	ch := new(gomavlib.Channel)
+	// same heartbeat, but about 110m apart
+	a := &testVehicle{ch: ch, seq: 0, mode: 4, lat: 300000000}
+	b := &testVehicle{ch: ch, seq: 100, mode: 4, lat: 300010000}
+	reports := runDetector(d, time.Now(), time.Second*11, a, b)
+	if len(reports) != 1 {
+		t.Fatalf("Expected 1 report, got %v", reports)
+	}
+	joined := strings.Join(reports[0], "; ")
+	if !strings.Contains(joined, "position jumped") || !strings.Contains(joined, "sequence number") {
+		t.Errorf("Unexpected evidences: %s", joined)
+	}
+}
+
+func TestDuplicateLossyLink(t *testing.T) {
+	// a bad link reorders frames, but it's only one kind of evidence
+	d := ardupilot.NewDuplicateDetector()
+	ch := new(gomavlib.Channel)
+	start := time.Now()
+	var seq byte
+	for i := range 200 {
+		s := seq
+		if i%5 == 0 {
+			s -= 2
+		}
+		msg := &common.MessageGlobalPositionInt{Lat: 300000000, Lon: 1200000000}
+		if r := d.Observe(ch, s, msg, start.Add((time.Duration)(i)*time.Millisecond*100)); r != nil {
+			t.Fatalf("Reported at frame %d: %v", i, r)
+		}
+		seq++
+	}
+}
@@ -0,0 +1,37 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ardupilot
+
+import (
+	"time"
+
+	"github.com/bluenviron/gomavlib/v3"
+	"github.com/bluenviron/gomavlib/v3/pkg/message"
+)
+
+// DuplicateDetector exposes duplicateDetector to the tests
+type DuplicateDetector struct {
+	t *duplicateDetector
+}
+
+func NewDuplicateDetector() *DuplicateDetector {
+	return &DuplicateDetector{newDuplicateDetector()}
+}
+
+func (d *DuplicateDetector) Observe(ch *gomavlib.Channel, seq byte, msg message.Message, now time.Time) []string {
+	return d.t.observe(ch, seq, msg, now)
+}
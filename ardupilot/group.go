@@ -0,0 +1,239 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ardupilot
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/bluenviron/gomavlib/v3/pkg/dialects/common"
+
+	"github.com/zyxkad/drone"
+)
+
+var _ drone.GroupActionAbility = (*Controller)(nil)
+
+type groupCommand struct {
+	cmd    common.MAV_CMD
+	params [7]float32
+}
+
+func groupCommandOf(action drone.DroneAction) (groupCommand, bool) {
+	switch action {
+	case drone.ActionArm:
+		return groupCommand{common.MAV_CMD_COMPONENT_ARM_DISARM, [7]float32{1}}, true
+	case drone.ActionDisarm:
+		return groupCommand{common.MAV_CMD_COMPONENT_ARM_DISARM, [7]float32{0}}, true
+	case drone.ActionHome:
+		return groupCommand{common.MAV_CMD_NAV_RETURN_TO_LAUNCH, [7]float32{}}, true
+	case drone.ActionLand:
+		return groupCommand{common.MAV_CMD_NAV_LAND, [7]float32{}}, true
+	case drone.ActionTakeoff:
+		return groupCommand{common.MAV_CMD_NAV_TAKEOFF, [7]float32{0, 0, 0, drone.NaN, 0, 0, 2.5}}, true
+	case drone.ActionHold:
+		return groupCommand{common.MAV_CMD_DO_PAUSE_CONTINUE, [7]float32{0}}, true
+	case drone.ActionStartMission:
+		return groupCommand{common.MAV_CMD_MISSION_START, [7]float32{0, 0}}, true
+	}
+	return groupCommand{}, false
+}
+
+func (g groupCommand) message(target *Drone) *common.MessageCommandLong {
+	msg := &common.MessageCommandLong{
+		Command: g.cmd,
+		Param1:  g.params[0],
+		Param2:  g.params[1],
+		Param3:  g.params[2],
+		Param4:  g.params[3],
+		Param5:  g.params[4],
+		Param6:  g.params[5],
+		Param7:  g.params[6],
+	}
+	if target != nil {
+		msg.TargetSystem = (uint8)(target.id)
+		msg.TargetComponent = target.component
+	}
+	return msg
+}
+
+// ExecuteGroupAction sends the action's command once to each drone, timed to arrive at action.At
+// If the drones are all the drones of the controller, the command is broadcasted to system 0,
+// so a shared radio link delivers it to every drone at the same time
+// The command is not resent, a lost command is reported as missed
+func (c *Controller) ExecuteGroupAction(ctx context.Context, drones []drone.Drone, action *drone.GroupAction) (*drone.GroupActionResult, error) {
+	gc, ok := groupCommandOf(action.Action)
+	if !ok {
+		return nil, drone.ErrUnsupportedAction
+	}
+	if action.Deadline.IsZero() {
+		action.Deadline = action.At.Add(time.Second)
+	}
+	targets := make([]*Drone, 0, len(drones))
+	for _, d := range drones {
+		ad, ok := d.(*Drone)
+		if !ok || ad.controller != c {
+			return nil, fmt.Errorf("Drone %d is not controlled by this controller", d.ID())
+		}
+		targets = append(targets, ad)
+	}
+	latencies := make(map[*Drone]time.Duration, len(targets))
+	for _, d := range targets {
+		latencies[d] = drone.Latency(d)
+	}
+	// send to the slowest drone first
+	slices.SortFunc(targets, func(a, b *Drone) int {
+		return cmp.Compare(latencies[b], latencies[a])
+	})
+	if len(targets) > 0 && time.Until(action.At.Add(-latencies[targets[0]])) < 0 {
+		return nil, drone.ErrActionTooLate
+	}
+
+	res := drone.NewGroupActionResult(action, len(targets))
+	res.Broadcast = len(targets) > 1 && c.isAllDrones(targets)
+
+	acks := make(map[*Drone]<-chan *common.MessageCommandAck, len(targets))
+	for _, d := range targets {
+		ch, err := d.expectCommandAck(gc.cmd)
+		if err != nil {
+			res.Errors[d.id] = err.Error()
+			continue
+		}
+		acks[d] = ch
+	}
+	defer func() {
+		for d := range acks {
+			d.cancelCommand(gc.cmd)
+		}
+	}()
+
+	var slowest time.Duration
+	if len(targets) > 0 {
+		slowest = latencies[targets[0]]
+	}
+	for _, d := range targets {
+		uncertainty := latencies[d]
+		if clock := d.GetClock(); clock.Ready() {
+			uncertainty = (time.Duration)(clock.Estimate().Uncertainty)
+		}
+		if res.Broadcast {
+			// the broadcast is sent for the slowest drone, others may execute earlier
+			uncertainty += slowest - latencies[d]
+		}
+		res.Uncertainty = max(res.Uncertainty, (drone.Duration)(uncertainty))
+	}
+
+	if res.Broadcast {
+		if err := waitUntil(ctx, action.At.Add(-slowest)); err != nil {
+			return nil, err
+		}
+		if err := c.writeMessage(nil, gc.message(nil)); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, d := range targets {
+			if _, ok := acks[d]; !ok {
+				continue
+			}
+			if err := waitUntil(ctx, action.At.Add(-latencies[d])); err != nil {
+				return nil, err
+			}
+			if err := d.WriteMessage(gc.message(d)); err != nil {
+				res.Errors[d.id] = err.Error()
+				d.cancelCommand(gc.cmd)
+				delete(acks, d)
+			}
+		}
+	}
+
+	handleAck := func(d *Drone, ack *common.MessageCommandAck) {
+		delete(acks, d)
+		if ack.Result == common.MAV_RESULT_IN_PROGRESS {
+			// the drone is still executing, stop listening the later acknowledges
+			d.cancelCommand(gc.cmd)
+		} else if ack.Result != common.MAV_RESULT_ACCEPTED {
+			res.Errors[d.id] = (&MavResultError{ack.Result}).Error()
+			return
+		}
+		d.afterGroupAction(action.Action)
+		res.Acked = append(res.Acked, d.id)
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, action.Deadline)
+	defer cancel()
+	for _, d := range targets {
+		ch, ok := acks[d]
+		if !ok {
+			continue
+		}
+		select {
+		case ack := <-ch:
+			handleAck(d, ack)
+		case <-ctx.Done():
+			// select picks randomly when both are ready, so an ack which already arrived is not missed
+			select {
+			case ack := <-ch:
+				handleAck(d, ack)
+			default:
+				res.Missed = append(res.Missed, d.id)
+			}
+		}
+	}
+	slices.Sort(res.Acked)
+	slices.Sort(res.Missed)
+	return res, nil
+}
+
+// isAllDrones reports whether the drones are every drone of the controller
+func (c *Controller) isAllDrones(drones []*Drone) bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if len(drones) != len(c.drones) {
+		return false
+	}
+	for _, d := range drones {
+		if c.drones[d.id] != d {
+			return false
+		}
+	}
+	return true
+}
+
+// afterGroupAction updates the drone's state as the single drone action does
+func (d *Drone) afterGroupAction(action drone.DroneAction) {
+	switch action {
+	case drone.ActionArm:
+		d.status.Store((uint32)(drone.StatusArmed))
+	case drone.ActionTakeoff:
+		d.status.Store((uint32)(drone.StatusTakenoff))
+	case drone.ActionStartMission:
+		d.missionAck.Store(nil)
+	}
+}
+
+func waitUntil(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
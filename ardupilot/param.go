@@ -0,0 +1,123 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ardupilot
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/bluenviron/gomavlib/v3/pkg/dialects/common"
+)
+
+const (
+	paramRetries = 3
+	paramTimeout = time.Second
+)
+
+// onParamValue is called with d.mux locked
+func (d *Drone) onParamValue(msg *common.MessageParamValue) {
+	waiters := d.paramWaiters[msg.ParamId]
+	delete(d.paramWaiters, msg.ParamId)
+	for _, ch := range waiters {
+		ch <- msg.ParamValue // the channels are buffered
+	}
+}
+
+func (d *Drone) waitParam(name string) (<-chan float32, func()) {
+	ch := make(chan float32, 1)
+	d.mux.Lock()
+	d.paramWaiters[name] = append(d.paramWaiters[name], ch)
+	d.mux.Unlock()
+	return ch, func() {
+		d.mux.Lock()
+		defer d.mux.Unlock()
+		waiters := slices.DeleteFunc(d.paramWaiters[name], func(c chan float32) bool { return c == ch })
+		if len(waiters) == 0 {
+			delete(d.paramWaiters, name)
+		} else {
+			d.paramWaiters[name] = waiters
+		}
+	}
+}
+
+func checkParamName(name string) error {
+	if name == "" || len(name) > 16 {
+		return fmt.Errorf("Invalid parameter name %q", name)
+	}
+	return nil
+}
+
+// sendParamUntilEcho sends the message until a PARAM_VALUE of the parameter is received
+func (d *Drone) sendParamUntilEcho(ctx context.Context, name string, msg any) (float32, error) {
+	for range paramRetries {
+		ch, cancel := d.waitParam(name)
+		if err := d.SendMessage(msg); err != nil {
+			cancel()
+			return 0, err
+		}
+		select {
+		case v := <-ch:
+			cancel()
+			return v, nil
+		case <-time.After(paramTimeout):
+			cancel()
+		case <-ctx.Done():
+			cancel()
+			return 0, ctx.Err()
+		}
+	}
+	return 0, fmt.Errorf("Parameter %s has no response", name)
+}
+
+func (d *Drone) GetParam(ctx context.Context, name string) (float32, error) {
+	if err := checkParamName(name); err != nil {
+		return 0, err
+	}
+	return d.sendParamUntilEcho(ctx, name, &common.MessageParamRequestRead{
+		TargetSystem:    (uint8)(d.id),
+		TargetComponent: d.component,
+		ParamId:         name,
+		ParamIndex:      -1,
+	})
+}
+
+// SetParam sets the parameter as REAL32, ArduPilot converts it to the parameter's real type
+func (d *Drone) SetParam(ctx context.Context, name string, value float32) error {
+	if err := checkParamName(name); err != nil {
+		return err
+	}
+	got, err := d.sendParamUntilEcho(ctx, name, &common.MessageParamSet{
+		TargetSystem:    (uint8)(d.id),
+		TargetComponent: d.component,
+		ParamId:         name,
+		ParamValue:      value,
+		ParamType:       common.MAV_PARAM_TYPE_REAL32,
+	})
+	if err != nil {
+		return err
+	}
+	diff := math.Abs((float64)(got - value))
+	// integer parameters may be rounded or truncated
+	v := (float64)(value)
+	if diff > 1e-4*max(1, math.Abs(v)) && (float64)(got) != math.Round(v) && (float64)(got) != math.Trunc(v) {
+		return fmt.Errorf("Parameter %s is %v after set, expect %v", name, got, value)
+	}
+	return nil
+}
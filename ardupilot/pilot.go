@@ -18,6 +18,7 @@ package ardupilot
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"sync"
@@ -39,6 +40,8 @@ type Drone struct {
 	id         int
 	component  byte
 	bootTime   atomic.Int64 // in µs
+	name       atomic.Pointer[string]
+	uid        atomic.Pointer[string]
 
 	mux sync.RWMutex
 
@@ -47,6 +50,9 @@ type Drone struct {
 	inactiveTimer *time.Timer
 	alive         atomic.Bool
 	pingDur       atomic.Int64 // in µs
+	clock         *drone.ClockEstimator
+	duplicates    *duplicateDetector
+	link          *drone.LinkTracker
 
 	gpsType        common.GPS_FIX_TYPE
 	gps            atomic.Pointer[drone.Gps]
@@ -59,6 +65,7 @@ type Drone struct {
 
 	requestingMsg        map[uint32]chan message.Message
 	commandAcks          map[common.MAV_CMD]chan *common.MessageCommandAck
+	paramWaiters         map[string][]chan float32
 	missionAck           atomic.Pointer[common.MessageMissionAck]
 	missionAckSignal     chan struct{}
 	missionReached       atomic.Int32
@@ -70,6 +77,14 @@ type Drone struct {
 var (
 	_ drone.Drone      = (*Drone)(nil)
 	_ drone.LEDAbility = (*Drone)(nil)
+
+	_ drone.TimedMissionAbility    = (*Drone)(nil)
+	_ drone.ClockAbility           = (*Drone)(nil)
+	_ drone.CommandAbility         = (*Drone)(nil)
+	_ drone.ParamAbility           = (*Drone)(nil)
+	_ drone.IdentityAbility        = (*Drone)(nil)
+	_ drone.LinkAbility            = (*Drone)(nil)
+	_ drone.MessageIntervalAbility = (*Drone)(nil)
 )
 
 type DroneExtraInfo struct {
@@ -88,9 +103,13 @@ func newDrone(c *Controller, channel *gomavlib.Channel, id int, component byte)
 		component:  component,
 
 		activeTimeout: time.Second * 3,
+		clock:         drone.NewClockEstimator(32),
+		duplicates:    newDuplicateDetector(),
+		link:          drone.NewLinkTracker(),
 
 		requestingMsg:        make(map[uint32]chan message.Message),
 		commandAcks:          make(map[common.MAV_CMD]chan *common.MessageCommandAck),
+		paramWaiters:         make(map[string][]chan float32),
 		missionAckSignal:     make(chan struct{}),
 		missionReachedSignal: make(chan int32),
 	}
@@ -114,9 +133,49 @@ func (d *Drone) ID() int {
 }
 
 func (d *Drone) Name() string {
+	if name := d.name.Load(); name != nil {
+		return *name
+	}
 	return fmt.Sprint(d.id)
 }
 
+// SetName sets the display name, an empty name resets to the system ID
+func (d *Drone) SetName(name string) {
+	if name == "" {
+		d.name.Store(nil)
+		return
+	}
+	d.name.Store(&name)
+}
+
+// UID returns the board's unique ID reported by AUTOPILOT_VERSION
+func (d *Drone) UID(ctx context.Context) (string, error) {
+	if uid := d.uid.Load(); uid != nil {
+		return *uid, nil
+	}
+	msg, err := d.RequestMessage(ctx, (*common.MessageAutopilotVersion)(nil).GetID())
+	if err != nil {
+		return "", err
+	}
+	d.storeUID(msg.(*common.MessageAutopilotVersion))
+	if uid := d.uid.Load(); uid != nil {
+		return *uid, nil
+	}
+	return "", errors.New("Drone does not report its UID")
+}
+
+func (d *Drone) storeUID(msg *common.MessageAutopilotVersion) {
+	var uid string
+	if msg.Uid2 != [18]uint8{} {
+		uid = hex.EncodeToString(msg.Uid2[:])
+	} else if msg.Uid != 0 {
+		uid = fmt.Sprintf("%016x", msg.Uid)
+	} else {
+		return
+	}
+	d.uid.Store(&uid)
+}
+
 func (d *Drone) GetGPSType() int {
 	d.mux.RLock()
 	defer d.mux.RUnlock()
@@ -163,6 +222,14 @@ func (d *Drone) GetBootTime() time.Time {
 	return time.UnixMicro(d.bootTime.Load())
 }
 
+func (d *Drone) GetClock() *drone.ClockEstimator {
+	return d.clock
+}
+
+func (d *Drone) GetLinkStats() *drone.LinkStats {
+	return d.link.Stats(time.Now())
+}
+
 func (d *Drone) LastActivate() time.Time {
 	return time.UnixMilli(d.lastActivate.Load())
 }
@@ -195,12 +262,26 @@ func (d *Drone) Ping(ctx context.Context) error {
 	return nil
 }
 
+const (
+	clockWarmupSamples  = 5
+	clockWarmupInterval = time.Millisecond * 300
+)
+
+func (d *Drone) sendTimesync() {
+	d.WriteMessage(&common.MessageTimesync{
+		Tc1:             0,
+		Ts1:             time.Now().UnixNano(),
+		TargetSystem:    (byte)(d.ID()),
+		TargetComponent: d.component,
+	})
+}
+
 func (d *Drone) WriteFrame(msg frame.Frame) error {
-	return d.controller.node.WriteFrameTo(d.channel, msg)
+	return d.controller.writeFrame(d.channel, msg)
 }
 
 func (d *Drone) WriteMessage(msg message.Message) error {
-	return d.controller.node.WriteMessageTo(d.channel, msg)
+	return d.controller.writeMessage(d.channel, msg)
 }
 
 func (d *Drone) SendMessage(msg any) error {
@@ -234,8 +315,9 @@ func (d *Drone) handleMessage(msg message.Message) {
 		go func(ctx context.Context) {
 			tctx, cancel := context.WithTimeout(ctx, time.Second*30)
 			defer cancel()
-			d.UpdateMessageInterval(tctx, (*common.MessageBatteryStatus)(nil).GetID(), time.Millisecond*3000)
-			d.UpdateMessageInterval(tctx, (*common.MessageAttitude)(nil).GetID(), time.Millisecond*500)
+			for id, interval := range d.controller.StreamIntervals() {
+				d.UpdateMessageInterval(tctx, id, interval)
+			}
 		}(d.controller.Context())
 		d.controller.sendEvent(&drone.EventDroneConnected{
 			Drone: d,
@@ -299,7 +381,19 @@ func (d *Drone) handleMessage(msg message.Message) {
 	case *common.MessageTimesync:
 		if msg.Tc1 != 0 {
 			rt := now.UnixNano() - msg.Ts1
+			if rt <= 0 || rt > (int64)(time.Second*5) {
+				// not a reply of our request
+				return
+			}
 			d.pingDur.Store(rt / 2)
+			// ArduPilot replies its time since boot in ns
+			d.clock.AddSample(time.Unix(0, msg.Ts1), now, (time.Duration)(msg.Tc1))
+			boot, _ := d.clock.ToStation(0)
+			d.bootTime.Store(boot.UnixMicro())
+			if d.clock.Estimate().Samples < clockWarmupSamples {
+				// sync faster until the estimator has enough samples
+				time.AfterFunc(clockWarmupInterval, d.sendTimesync)
+			}
 			return
 		}
 		d.WriteMessage(&common.MessageTimesync{
@@ -310,6 +404,9 @@ func (d *Drone) handleMessage(msg message.Message) {
 		})
 		return
 	case *common.MessageSystemTime:
+		if d.clock.Ready() {
+			return
+		}
 		ping := d.pingDur.Load()
 		d.bootTime.Store(now.UnixMicro() - ping - (int64)(msg.TimeBootMs)*1e3) // not msg.TimeUnixUsec because it's not even close (even `now - ping` still not accurate)
 		return
@@ -394,6 +491,10 @@ func (d *Drone) handleMessage(msg message.Message) {
 		d.satelliteCount = (int)(msg.SatellitesVisible)
 	case *common.MessageHomePosition:
 		d.home = drone.GPSFromWGS84(msg.Latitude, msg.Longitude, msg.Altitude)
+	case *common.MessageParamValue:
+		d.onParamValue(msg)
+	case *common.MessageAutopilotVersion:
+		d.storeUID(msg)
 	case *common.MessageCommandAck:
 		if ch, ok := d.commandAcks[msg.Command]; ok {
 			if msg.Result != common.MAV_RESULT_IN_PROGRESS {
@@ -0,0 +1,638 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ardupilot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/gomavlib/v3"
+	"github.com/bluenviron/gomavlib/v3/pkg/dialects/common"
+	"github.com/bluenviron/gomavlib/v3/pkg/frame"
+	"github.com/bluenviron/gomavlib/v3/pkg/message"
+
+	"github.com/zyxkad/drone"
+)
+
+// Priority is the class of an outgoing message, a lower value is sent first
+type Priority int
+
+const (
+	// PriorityCritical is the safety commands such as land, RTL, disarm and mode changes,
+	// they are never delayed by the rate limit
+	PriorityCritical Priority = iota
+	PriorityCommand
+	// PriorityRealtime is the setpoints and time sync, which are useless when late
+	// A queued setpoint is replaced by a newer one of the same message to the same drone
+	PriorityRealtime
+	PriorityRTCM
+	// PriorityBulk is the mission and parameter transfers
+	PriorityBulk
+
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityCritical:
+		return "critical"
+	case PriorityCommand:
+		return "command"
+	case PriorityRealtime:
+		return "realtime"
+	case PriorityRTCM:
+		return "rtcm"
+	case PriorityBulk:
+		return "bulk"
+	}
+	return "unknown"
+}
+
+func isCriticalCommand(cmd common.MAV_CMD, param1 float32) bool {
+	switch cmd {
+	case common.MAV_CMD_NAV_LAND, common.MAV_CMD_NAV_RETURN_TO_LAUNCH, common.MAV_CMD_NAV_LOITER_UNLIM,
+		common.MAV_CMD_DO_SET_MODE, common.MAV_CMD_DO_FLIGHTTERMINATION, common.MAV_CMD_DO_PAUSE_CONTINUE:
+		return true
+	case common.MAV_CMD_COMPONENT_ARM_DISARM:
+		return param1 == 0
+	}
+	return false
+}
+
+// classifyMessage returns the priority of an outgoing message
+func classifyMessage(msg message.Message) Priority {
+	switch msg := msg.(type) {
+	case *common.MessageCommandLong:
+		if isCriticalCommand(msg.Command, msg.Param1) {
+			return PriorityCritical
+		}
+		return PriorityCommand
+	case *common.MessageCommandInt:
+		if isCriticalCommand(msg.Command, msg.Param1) {
+			return PriorityCritical
+		}
+		return PriorityCommand
+	case *common.MessageSetMode:
+		return PriorityCritical
+	case *common.MessageSetPositionTargetGlobalInt, *common.MessageSetPositionTargetLocalNed,
+		*common.MessageSetAttitudeTarget, *common.MessageTimesync, *common.MessageManualControl:
+		return PriorityRealtime
+	case *common.MessageGpsRtcmData:
+		return PriorityRTCM
+	case *common.MessageMissionCount, *common.MessageMissionItemInt, *common.MessageMissionItem,
+		*common.MessageMissionClearAll, *common.MessageMissionRequestList, *common.MessageMissionAck,
+		*common.MessageParamRequestRead, *common.MessageParamRequestList, *common.MessageParamSet:
+		return PriorityBulk
+	}
+	return PriorityCommand
+}
+
+const (
+	// maxQueueDepth is the max queued messages of a class
+	maxQueueDepth = 4096
+	// maxRTCMQueueDepth is smaller since old corrections are useless, the oldest frames are dropped
+	maxRTCMQueueDepth = 64
+)
+
+var ErrQueueFull = errors.New("Outgoing queue is full")
+
+type outItem struct {
+	channel  *gomavlib.Channel
+	msg      message.Message // either an encoded message or a frame.Frame
+	fr       frame.Frame
+	size     int
+	enqueued time.Time
+	// group is shared by the items enqueued together to a channel, such as the fragments of a RTCM frame,
+	// part is the index of the item in its group
+	group uint64
+	part  int
+	// setpoint is set if the item is replaced by a newer one with the same key
+	setpoint *setpointKey
+}
+
+// setpointKey identifies a setpoint stream, which is the message to a drone
+type setpointKey struct {
+	id     uint32
+	target uint8
+}
+
+// setpointKeyOf returns the key of a setpoint message, or nil if the message is not a setpoint
+func setpointKeyOf(msg message.Message) *setpointKey {
+	var target uint8
+	switch msg := msg.(type) {
+	case *common.MessageSetPositionTargetGlobalInt:
+		target = msg.TargetSystem
+	case *common.MessageSetPositionTargetLocalNed:
+		target = msg.TargetSystem
+	case *common.MessageSetAttitudeTarget:
+		target = msg.TargetSystem
+	case *common.MessageManualControl:
+		target = msg.Target
+	default:
+		return nil
+	}
+	return &setpointKey{
+		id:     msg.GetID(),
+		target: target,
+	}
+}
+
+// tokenBucket limits the bytes per second of an endpoint
+type tokenBucket struct {
+	rate   float64 // 0 means unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+	sent   uint64
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	b := &tokenBucket{}
+	b.setRate(rate)
+	b.tokens = b.burst
+	return b
+}
+
+func (b *tokenBucket) setRate(rate float64) {
+	b.rate = max(rate, 0)
+	// allow a burst of 200ms, but at least a full RTCM fragment
+	b.burst = max(b.rate/5, 300)
+	b.tokens = min(b.tokens, b.burst)
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+b.rate*now.Sub(b.last).Seconds())
+	}
+	b.last = now
+}
+
+// wait returns how long until size bytes can be sent
+func (b *tokenBucket) wait(size int) time.Duration {
+	if b.rate == 0 || b.tokens >= (float64)(size) {
+		return 0
+	}
+	return (time.Duration)(((float64)(size) - b.tokens) / b.rate * (float64)(time.Second))
+}
+
+func (b *tokenBucket) take(size int) {
+	b.sent += (uint64)(size)
+	if b.rate != 0 {
+		// critical messages may take more than the bucket has
+		b.tokens -= (float64)(size)
+	}
+}
+
+type queueStats struct {
+	sent    uint64
+	dropped uint64
+	maxWait time.Duration
+	sumWait time.Duration
+}
+
+// scheduler sends the outgoing messages by priority, and limits the rate of each endpoint
+type scheduler struct {
+	node *gomavlib.Node
+
+	mux      sync.Mutex
+	signal   chan struct{}
+	queues   [numPriorities][]*outItem
+	stats    [numPriorities]queueStats
+	channels map[*gomavlib.Channel]struct{}
+	buckets  map[gomavlib.Endpoint]*tokenBucket
+	rates    map[gomavlib.EndpointConf]float64
+	errors   uint64
+	groups   uint64
+}
+
+func newScheduler(node *gomavlib.Node) *scheduler {
+	return &scheduler{
+		node:     node,
+		signal:   make(chan struct{}, 1),
+		channels: make(map[*gomavlib.Channel]struct{}),
+		buckets:  make(map[gomavlib.Endpoint]*tokenBucket),
+		rates:    make(map[gomavlib.EndpointConf]float64),
+	}
+}
+
+func (s *scheduler) addChannel(ch *gomavlib.Channel) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.channels[ch] = struct{}{}
+	e := ch.Endpoint()
+	if _, ok := s.buckets[e]; !ok {
+		s.buckets[e] = newTokenBucket(s.rates[e.Conf()])
+	}
+}
+
+func (s *scheduler) removeChannel(ch *gomavlib.Channel) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.channels, ch)
+	for p, queue := range s.queues {
+		n := 0
+		for _, it := range queue {
+			if it.channel != ch {
+				queue[n] = it
+				n++
+			}
+		}
+		clear(queue[n:])
+		s.stats[p].dropped += (uint64)(len(queue) - n)
+		s.queues[p] = queue[:n]
+	}
+}
+
+func (s *scheduler) setRate(conf gomavlib.EndpointConf, rate float64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.rates[conf] = rate
+	for e, b := range s.buckets {
+		if e.Conf() == conf {
+			b.setRate(rate)
+		}
+	}
+	s.notify()
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// targets returns the channel, or all channels if channel is nil
+// The caller must hold the lock
+func (s *scheduler) targets(channel *gomavlib.Channel) []*gomavlib.Channel {
+	if channel != nil {
+		return []*gomavlib.Channel{channel}
+	}
+	channels := make([]*gomavlib.Channel, 0, len(s.channels))
+	for ch := range s.channels {
+		channels = append(channels, ch)
+	}
+	return channels
+}
+
+// enqueue queues the items as a group to the channel, or all channels if channel is nil
+// Either all the items are queued, or none of them
+func (s *scheduler) enqueue(channel *gomavlib.Channel, items []outItem, prio Priority) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	channels := s.targets(channel)
+	needed := len(items) * len(channels)
+	if prio == PriorityRTCM {
+		if needed > maxRTCMQueueDepth {
+			s.stats[prio].dropped += (uint64)(needed)
+			return ErrQueueFull
+		}
+		for len(s.queues[prio])+needed > maxRTCMQueueDepth {
+			s.dropOldestGroup(prio)
+		}
+	} else {
+		for _, it := range items {
+			if it.setpoint != nil {
+				for _, ch := range channels {
+					s.dropSetpoint(prio, ch, *it.setpoint)
+				}
+			}
+		}
+		if len(s.queues[prio])+needed > maxQueueDepth {
+			s.stats[prio].dropped += (uint64)(needed)
+			return ErrQueueFull
+		}
+	}
+	for _, ch := range channels {
+		s.groups++
+		for i, item := range items {
+			it := item
+			it.channel = ch
+			it.group = s.groups
+			it.part = i
+			s.queues[prio] = append(s.queues[prio], &it)
+		}
+	}
+	s.notify()
+	return nil
+}
+
+// dropOldestGroup drops the oldest group which has not started sending,
+// so the receiver never gets a part of a fragmented RTCM frame
+// The caller must hold the lock
+func (s *scheduler) dropOldestGroup(prio Priority) {
+	queue := s.queues[prio]
+	victim := queue[0].group
+	for _, it := range queue {
+		if it.part == 0 {
+			victim = it.group
+			break
+		}
+	}
+	n := 0
+	for _, it := range queue {
+		if it.group != victim {
+			queue[n] = it
+			n++
+		}
+	}
+	clear(queue[n:])
+	s.stats[prio].dropped += (uint64)(len(queue) - n)
+	s.queues[prio] = queue[:n]
+}
+
+// dropSetpoint drops the queued setpoint of the key to the channel, since it's outdated
+// The caller must hold the lock
+func (s *scheduler) dropSetpoint(prio Priority, channel *gomavlib.Channel, key setpointKey) {
+	queue := s.queues[prio]
+	n := 0
+	for _, it := range queue {
+		if it.channel != channel || it.setpoint == nil || *it.setpoint != key {
+			queue[n] = it
+			n++
+		}
+	}
+	clear(queue[n:])
+	s.stats[prio].dropped += (uint64)(len(queue) - n)
+	s.queues[prio] = queue[:n]
+}
+
+// bypass accounts the bytes sent without queueing, for the messages which must not wait
+func (s *scheduler) bypass(channel *gomavlib.Channel, size int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := time.Now()
+	for _, ch := range s.targets(channel) {
+		if b, ok := s.buckets[ch.Endpoint()]; ok {
+			b.refill(now)
+			b.take(size)
+		}
+	}
+	s.stats[PriorityRealtime].sent++
+}
+
+// next pops the first sendable item of the highest priority
+// An endpoint is blocked for the lower priorities once an item is waiting for it, so the order is kept
+func (s *scheduler) next(now time.Time) (*outItem, time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, b := range s.buckets {
+		b.refill(now)
+	}
+	var (
+		wait    time.Duration = -1
+		blocked map[*tokenBucket]bool
+	)
+	for p := range numPriorities {
+		queue := s.queues[p]
+		for i, it := range queue {
+			b, ok := s.buckets[it.channel.Endpoint()]
+			if !ok {
+				b = newTokenBucket(0)
+				s.buckets[it.channel.Endpoint()] = b
+			}
+			if blocked[b] {
+				continue
+			}
+			if w := b.wait(it.size); w > 0 && p != PriorityCritical {
+				if blocked == nil {
+					blocked = make(map[*tokenBucket]bool)
+				}
+				blocked[b] = true
+				if wait < 0 || w < wait {
+					wait = w
+				}
+				continue
+			}
+			b.take(it.size)
+			copy(queue[i:], queue[i+1:])
+			queue[len(queue)-1] = nil
+			s.queues[p] = queue[:len(queue)-1]
+			st := &s.stats[p]
+			w := now.Sub(it.enqueued)
+			st.sent++
+			st.sumWait += w
+			st.maxWait = max(st.maxWait, w)
+			return it, 0
+		}
+	}
+	return nil, wait
+}
+
+func (s *scheduler) run(ctx context.Context) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		it, wait := s.next(time.Now())
+		if it != nil {
+			var err error
+			if it.fr != nil {
+				err = s.node.WriteFrameTo(it.channel, it.fr)
+			} else {
+				err = s.node.WriteMessageTo(it.channel, it.msg)
+			}
+			if err != nil {
+				s.mux.Lock()
+				s.errors++
+				s.mux.Unlock()
+			}
+			continue
+		}
+		var timeout <-chan time.Time
+		if wait >= 0 {
+			timer.Reset(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-s.signal:
+		case <-timeout:
+		case <-ctx.Done():
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+// QueueStats is the metrics of a priority class
+type QueueStats struct {
+	Class   string         `json:"class"`
+	Depth   int            `json:"depth"`
+	Sent    uint64         `json:"sent"`
+	Dropped uint64         `json:"dropped"`
+	MaxWait drone.Duration `json:"maxWait"`
+	AvgWait drone.Duration `json:"avgWait"`
+}
+
+// EndpointRateStats is the rate limit state of an endpoint
+type EndpointRateStats struct {
+	Endpoint string  `json:"endpoint"`
+	Rate     float64 `json:"rate"` // the limit in bytes per second, 0 means unlimited
+	Tokens   float64 `json:"tokens"`
+	Sent     uint64  `json:"sent"` // in bytes
+}
+
+type SchedulerStats struct {
+	Queues    []QueueStats        `json:"queues"`
+	Endpoints []EndpointRateStats `json:"endpoints"`
+	Errors    uint64              `json:"errors"`
+}
+
+func (s *scheduler) Stats() *SchedulerStats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	stats := &SchedulerStats{
+		Queues: make([]QueueStats, numPriorities),
+		Errors: s.errors,
+	}
+	for p := range numPriorities {
+		st := s.stats[p]
+		qs := QueueStats{
+			Class:   p.String(),
+			Depth:   len(s.queues[p]),
+			Sent:    st.sent,
+			Dropped: st.dropped,
+			MaxWait: (drone.Duration)(st.maxWait),
+		}
+		if st.sent > 0 {
+			qs.AvgWait = (drone.Duration)(st.sumWait / (time.Duration)(st.sent))
+		}
+		stats.Queues[p] = qs
+	}
+	for e, b := range s.buckets {
+		stats.Endpoints = append(stats.Endpoints, EndpointRateStats{
+			Endpoint: endpointName(e.Conf()),
+			Rate:     b.rate,
+			Tokens:   b.tokens,
+			Sent:     b.sent,
+		})
+	}
+	return stats
+}
+
+func endpointName(conf gomavlib.EndpointConf) string {
+	switch c := conf.(type) {
+	case gomavlib.EndpointSerial:
+		return "serial:" + c.Device
+	case *gomavlib.EndpointSerial:
+		return "serial:" + c.Device
+	case gomavlib.EndpointUDPServer:
+		return "udp:" + c.Address
+	case gomavlib.EndpointUDPClient:
+		return "udpc:" + c.Address
+	case gomavlib.EndpointUDPBroadcast:
+		return "udpb:" + c.BroadcastAddress
+	case gomavlib.EndpointTCPServer:
+		return "tcp:" + c.Address
+	case gomavlib.EndpointTCPClient:
+		return "tcpc:" + c.Address
+	case gomavlib.EndpointCustom:
+		return "custom"
+	}
+	return "unknown"
+}
+
+func (c *Controller) encodeMessage(msg message.Message) (*message.MessageRaw, error) {
+	if raw, ok := msg.(*message.MessageRaw); ok {
+		return raw, nil
+	}
+	mp := c.dialectRW.GetMessage(msg.GetID())
+	if mp == nil {
+		return nil, fmt.Errorf("Message %d is not in the dialect", msg.GetID())
+	}
+	return mp.Write(msg, true), nil
+}
+
+// writeMessage queues the message to the channel, or all channels if channel is nil
+func (c *Controller) writeMessage(channel *gomavlib.Channel, msg message.Message) error {
+	raw, err := c.encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	size := drone.MavlinkFrameOverhead + len(raw.Payload)
+	if _, ok := msg.(*common.MessageTimesync); ok {
+		// the round trip time and the clock offset are measured with it, so it must not wait in the queue
+		c.sched.bypass(channel, size)
+		if channel == nil {
+			return c.node.WriteMessageAll(raw)
+		}
+		return c.node.WriteMessageTo(channel, raw)
+	}
+	return c.sched.enqueue(channel, []outItem{{
+		msg:      raw,
+		size:     size,
+		enqueued: time.Now(),
+		setpoint: setpointKeyOf(msg),
+	}}, classifyMessage(msg))
+}
+
+// writeMessages queues the messages as a group, which are either all queued or all dropped,
+// such as the fragments of a RTCM frame
+func (c *Controller) writeMessages(channel *gomavlib.Channel, msgs []message.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	now := time.Now()
+	items := make([]outItem, len(msgs))
+	for i, msg := range msgs {
+		raw, err := c.encodeMessage(msg)
+		if err != nil {
+			return err
+		}
+		items[i] = outItem{
+			msg:      raw,
+			size:     drone.MavlinkFrameOverhead + len(raw.Payload),
+			enqueued: now,
+		}
+	}
+	return c.sched.enqueue(channel, items, classifyMessage(msgs[0]))
+}
+
+// writeFrame queues a frame, which is usually forwarded from another node
+func (c *Controller) writeFrame(channel *gomavlib.Channel, fr frame.Frame) error {
+	msg := fr.GetMessage()
+	size := drone.MavlinkFrameOverhead
+	if raw, ok := msg.(*message.MessageRaw); ok {
+		size += len(raw.Payload)
+	} else if mp := c.dialectRW.GetMessage(msg.GetID()); mp != nil {
+		size += len(mp.Write(msg, true).Payload)
+	}
+	return c.sched.enqueue(channel, []outItem{{
+		fr:       fr,
+		size:     size,
+		enqueued: time.Now(),
+		setpoint: setpointKeyOf(msg),
+	}}, classifyMessage(msg))
+}
+
+// SetEndpointRate limits the bytes per second sent to the endpoint, 0 means unlimited
+// Critical messages are sent regardless of the limit, but they still consume the budget
+func (c *Controller) SetEndpointRate(conf gomavlib.EndpointConf, rate float64) {
+	c.sched.setRate(conf, rate)
+}
+
+// SchedulerStats returns the outgoing queue metrics
+func (c *Controller) SchedulerStats() *SchedulerStats {
+	return c.sched.Stats()
+}
@@ -0,0 +1,249 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ardupilot_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bluenviron/gomavlib/v3"
+	"github.com/bluenviron/gomavlib/v3/pkg/dialects/ardupilotmega"
+	"github.com/bluenviron/gomavlib/v3/pkg/dialects/common"
+	"github.com/bluenviron/gomavlib/v3/pkg/message"
+
+	"github.com/zyxkad/drone/ardupilot"
+)
+
+// newTestLink returns a controller connected to a fake drone, and the messages the drone received
+func newTestLink(t *testing.T, rate float64) (*ardupilot.Controller, gomavlib.EndpointConf, <-chan message.Message) {
+	t.Helper()
+	a, b := net.Pipe()
+	conf := gomavlib.EndpointCustom{ReadWriteCloser: a}
+	c, err := ardupilot.NewController(conf)
+	if err != nil {
+		t.Fatalf("NewController: %v", err)
+	}
+	c.SetEndpointRate(conf, rate)
+	go func() {
+		for range c.Events() {
+		}
+	}()
+	peer, err := gomavlib.NewNode(gomavlib.NodeConf{
+		Endpoints:        []gomavlib.EndpointConf{gomavlib.EndpointCustom{ReadWriteCloser: b}},
+		Dialect:          ardupilotmega.Dialect,
+		OutVersion:       gomavlib.V2,
+		OutSystemID:      1,
+		HeartbeatDisable: true,
+	})
+	if err != nil {
+		c.Close()
+		t.Fatalf("NewNode: %v", err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		peer.Close()
+	})
+	received := make(chan message.Message, 1024)
+	go func() {
+		for event := range peer.Events() {
+			if e, ok := event.(*gomavlib.EventFrame); ok {
+				switch e.Message().(type) {
+				case *common.MessageHeartbeat, *common.MessageTimesync:
+				default:
+					received <- e.Message()
+				}
+			}
+		}
+	}()
+	deadline := time.Now().Add(time.Second)
+	for len(c.SchedulerStats().Endpoints) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Channel is not opened")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return c, conf, received
+}
+
+// collect reads the received messages until none arrives in idle
+func collect(received <-chan message.Message, idle time.Duration) (msgs []message.Message) {
+	for {
+		select {
+		case msg := <-received:
+			msgs = append(msgs, msg)
+		case <-time.After(idle):
+			return
+		}
+	}
+}
+
+func rtcmFrame(n int, b byte) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = b
+	}
+	return buf
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	c, _, received := newTestLink(t, 2000)
+	for i := range 20 {
+		if err := c.BroadcastRTCM(rtcmFrame(100, (byte)(i+1))); err != nil {
+			t.Fatalf("BroadcastRTCM: %v", err)
+		}
+	}
+	c.Broadcast(&common.MessageParamRequestList{TargetSystem: 1})
+	c.Broadcast(&common.MessageSetPositionTargetGlobalInt{TargetSystem: 1})
+	c.Broadcast(&common.MessageCommandLong{TargetSystem: 1, Command: common.MAV_CMD_NAV_LAND})
+
+	msgs := collect(received, time.Second)
+	land, realtime, bulk, lastRTCM, rtcms := -1, -1, -1, -1, 0
+	for i, msg := range msgs {
+		switch msg.(type) {
+		case *common.MessageCommandLong:
+			land = i
+		case *common.MessageSetPositionTargetGlobalInt:
+			realtime = i
+		case *common.MessageParamRequestList:
+			bulk = i
+		case *common.MessageGpsRtcmData:
+			lastRTCM = i
+			rtcms++
+		}
+	}
+	if rtcms != 20 || land < 0 || realtime < 0 || bulk < 0 {
+		t.Fatalf("Missing messages: %d RTCM, land=%d realtime=%d bulk=%d", rtcms, land, realtime, bulk)
+	}
+	if land > realtime {
+		t.Errorf("Critical command is sent after realtime message: %d > %d", land, realtime)
+	}
+	if realtime > lastRTCM {
+		t.Errorf("Realtime message is sent after all RTCM: %d > %d", realtime, lastRTCM)
+	}
+	if bulk < lastRTCM {
+		t.Errorf("Bulk message is sent before RTCM: %d < %d", bulk, lastRTCM)
+	}
+}
+
+func TestSchedulerRTCMDropWholeFrames(t *testing.T) {
+	c, conf, received := newTestLink(t, 1000)
+	const frames = 30
+	for i := range frames {
+		if err := c.BroadcastRTCM(rtcmFrame(600, (byte)(i+1))); err != nil {
+			t.Fatalf("BroadcastRTCM: %v", err)
+		}
+		if i == 0 {
+			// let the first frame start sending, so its rest must not be dropped
+			time.Sleep(time.Millisecond * 50)
+		}
+	}
+	time.Sleep(time.Millisecond * 200)
+	c.SetEndpointRate(conf, 0)
+
+	lengths := make(map[byte]int)
+	fragments := make(map[byte]uint8)
+	for _, msg := range collect(received, time.Millisecond*300) {
+		m, ok := msg.(*common.MessageGpsRtcmData)
+		if !ok {
+			continue
+		}
+		if m.Flags&0x01 == 0 {
+			t.Fatalf("Unexpected unfragmented RTCM with length %d", m.Len)
+		}
+		seq := (m.Flags >> 3) & 0x1f
+		fragments[seq] |= 1 << ((m.Flags >> 1) & 0x03)
+		lengths[seq] += (int)(m.Len)
+	}
+	if len(fragments) == 0 || len(fragments) == frames {
+		t.Fatalf("Expected some of the frames to be dropped, got %d of %d", len(fragments), frames)
+	}
+	for seq, got := range fragments {
+		if got != 0x0f || lengths[seq] != 600 {
+			t.Errorf("Frame %d is incomplete: fragments %04b, %d bytes", seq, got, lengths[seq])
+		}
+	}
+	var rtcmStats ardupilot.QueueStats
+	for _, qs := range c.SchedulerStats().Queues {
+		if qs.Class == "rtcm" {
+			rtcmStats = qs
+		}
+	}
+	if want := (uint64)((frames - len(fragments)) * 4); rtcmStats.Dropped != want {
+		t.Errorf("Expected %d dropped fragments, got %d", want, rtcmStats.Dropped)
+	}
+}
+
+func TestSchedulerRateLimit(t *testing.T) {
+	const rate = 4000
+	c, _, received := newTestLink(t, rate)
+	start := time.Now()
+	const frames = 20
+	for i := range frames {
+		// no trailing zeros, so the payload is not truncated
+		if err := c.BroadcastRTCM(rtcmFrame(170, (byte)(i+1))); err != nil {
+			t.Fatalf("BroadcastRTCM: %v", err)
+		}
+	}
+	var last time.Time
+	for range frames {
+		select {
+		case <-received:
+			last = time.Now()
+		case <-time.After(time.Second * 3):
+			t.Fatalf("Timeout waiting for RTCM")
+		}
+	}
+	// 20 frames of 184 bytes, minus the burst of 800 bytes
+	if elapsed := last.Sub(start); elapsed < time.Millisecond*600 {
+		t.Errorf("Frames are sent too fast: %v", elapsed)
+	}
+	stats := c.SchedulerStats()
+	if len(stats.Endpoints) != 1 {
+		t.Fatalf("Expected 1 endpoint, got %d", len(stats.Endpoints))
+	}
+	if ep := stats.Endpoints[0]; ep.Rate != rate || ep.Sent < frames*184 {
+		t.Errorf("Unexpected endpoint stats %+v", ep)
+	}
+}
+
+func TestSchedulerCoalesceSetpoints(t *testing.T) {
+	c, _, received := newTestLink(t, 500)
+	const n = 20
+	for i := range n {
+		for _, target := range []uint8{1, 2} {
+			c.Broadcast(&common.MessageSetPositionTargetGlobalInt{TargetSystem: target, LatInt: (int32)(i)})
+		}
+	}
+	msgs := collect(received, time.Second)
+	counts := make(map[uint8]int)
+	last := make(map[uint8]int32)
+	for _, msg := range msgs {
+		if sp, ok := msg.(*common.MessageSetPositionTargetGlobalInt); ok {
+			counts[sp.TargetSystem]++
+			last[sp.TargetSystem] = sp.LatInt
+		}
+	}
+	for _, target := range []uint8{1, 2} {
+		if counts[target] == 0 || counts[target] >= n {
+			t.Errorf("Drone %d received %d setpoints, expected the outdated ones dropped", target, counts[target])
+		}
+		if last[target] != n-1 {
+			t.Errorf("Drone %d received the last setpoint %d, want %d", target, last[target], n-1)
+		}
+	}
+}
@@ -19,7 +19,10 @@ package ardupilot
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -48,6 +51,13 @@ type Controller struct {
 
 	bootTime     time.Time
 	rtcmSeqCount atomic.Uint32
+
+	channelMux   sync.Mutex
+	channelStats map[*gomavlib.Channel]*ChannelStats
+
+	streamIntervals atomic.Pointer[map[uint32]time.Duration]
+
+	sched *scheduler
 }
 
 var _ drone.Controller = (*Controller)(nil)
@@ -81,13 +91,40 @@ func NewController(endpoints ...gomavlib.EndpointConf) (*Controller, error) {
 		drones:    make(map[int]*Drone),
 		events:    make(chan drone.Event, 8),
 		bootTime:  time.Now(),
+
+		channelStats: make(map[*gomavlib.Channel]*ChannelStats),
+		sched:        newScheduler(node),
 	}
 	c.ctx, c.cancel = context.WithCancelCause(context.Background())
+	go c.sched.run(c.ctx)
 	go c.handleEvents()
 	go c.sendCyclePackets()
 	return c, nil
 }
 
+// defaultStreamIntervals are requested when a drone connects, unless SetStreamIntervals is called
+var defaultStreamIntervals = map[uint32]time.Duration{
+	(*common.MessageBatteryStatus)(nil).GetID(): time.Millisecond * 3000,
+	(*common.MessageAttitude)(nil).GetID():      time.Millisecond * 500,
+}
+
+// SetStreamIntervals sets the message intervals requested when a drone connects, nil restores the defaults
+// The connected drones are not changed
+func (c *Controller) SetStreamIntervals(intervals map[uint32]time.Duration) {
+	if intervals == nil {
+		c.streamIntervals.Store(nil)
+		return
+	}
+	c.streamIntervals.Store(&intervals)
+}
+
+func (c *Controller) StreamIntervals() map[uint32]time.Duration {
+	if intervals := c.streamIntervals.Load(); intervals != nil {
+		return *intervals
+	}
+	return defaultStreamIntervals
+}
+
 func (c *Controller) Close() error {
 	c.cancel(nil)
 	c.nodeClose()
@@ -136,9 +173,9 @@ func (c *Controller) Events() <-chan drone.Event {
 func (c *Controller) Broadcast(msg any) error {
 	switch msg := msg.(type) {
 	case frame.Frame:
-		return c.node.WriteFrameAll(msg)
+		return c.writeFrame(nil, msg)
 	case message.Message:
-		return c.node.WriteMessageAll(msg)
+		return c.writeMessage(nil, msg)
 	case []byte:
 		fr, err := frame.NewReader(frame.ReaderConf{
 			Reader: bytes.NewReader(msg),
@@ -150,50 +187,57 @@ func (c *Controller) Broadcast(msg any) error {
 		if err != nil {
 			return err
 		}
-		return c.node.WriteFrameAll(f)
+		return c.writeFrame(nil, f)
 	}
 	panic(fmt.Errorf("Unexpected message type %T", msg))
 }
 
-func (c *Controller) encodeRTCMAsMessages(buf []byte) []message.Message {
-	n := len(buf)
+// MaxRTCMLen is the largest RTCM frame which can be sent with GPS_RTCM_DATA
+const MaxRTCMLen = rtcmFragmentLen * 4
 
-	const MAX_MSG_LEN = 180
-	seqCount := (byte)(c.rtcmSeqCount.Add(1)-1) & 0x1f
-	if n <= MAX_MSG_LEN {
+const rtcmFragmentLen = 180
+
+var ErrRTCMTooLarge = errors.New("RTCM frame is larger than 4 fragments")
+
+func (c *Controller) encodeRTCMAsMessages(buf []byte) ([]message.Message, error) {
+	n := len(buf)
+	if n <= rtcmFragmentLen {
 		msg := &common.MessageGpsRtcmData{
-			Flags: seqCount << 3,
-			Len:   (uint8)(n),
+			Len: (uint8)(n),
 		}
 		copy(msg.Data[:], buf)
-		return []message.Message{msg}
+		return []message.Message{msg}, nil
 	}
-	if n > 4*MAX_MSG_LEN {
-		return nil
+	if n > MaxRTCMLen {
+		return nil, ErrRTCMTooLarge
 	}
+	// the sequence ID only identifies fragmented frames, so it is not consumed by the small ones
+	seqCount := (byte)(c.rtcmSeqCount.Add(1)-1) & 0x1f
 	msgs := make([]message.Message, 0, 4)
 	for i := (byte)(0); i < 4; i++ {
 		msg := new(common.MessageGpsRtcmData)
 		msg.Flags = 0x01 | (i << 1) | (seqCount << 3)
-		msg.Len = (uint8)(min(len(buf), MAX_MSG_LEN))
+		msg.Len = (uint8)(min(len(buf), rtcmFragmentLen))
 		copy(msg.Data[:], buf[:msg.Len])
 		buf = buf[msg.Len:]
 		msgs = append(msgs, msg)
-		if msg.Len < MAX_MSG_LEN {
+		// a frame with a length of multiple of the fragment size ends with an empty fragment,
+		// unless it uses all the 4 fragments
+		if msg.Len < rtcmFragmentLen {
 			break
 		}
 	}
-	return msgs
+	return msgs, nil
 }
 
+// BroadcastRTCM sends a RTCM frame to all drones
+// Frames larger than MaxRTCMLen are rejected with ErrRTCMTooLarge, they should be split before
 func (c *Controller) BroadcastRTCM(buf []byte) error {
-	msgs := c.encodeRTCMAsMessages(buf)
-	for _, msg := range msgs {
-		if err := c.node.WriteMessageAll(msg); err != nil {
-			return err
-		}
+	msgs, err := c.encodeRTCMAsMessages(buf)
+	if err != nil {
+		return err
 	}
-	return nil
+	return c.writeMessages(nil, msgs)
 }
 
 func (c *Controller) sendEvent(e drone.Event) {
@@ -230,7 +274,7 @@ func (c *Controller) sendCyclePackets() {
 		if timesyncCt >= 20 {
 			timesyncCt = 0
 			now := time.Now().UnixNano()
-			go c.node.WriteMessageAll(&common.MessageTimesync{
+			c.writeMessage(nil, &common.MessageTimesync{
 				Tc1: 0,
 				Ts1: now,
 			})
@@ -241,31 +285,60 @@ func (c *Controller) sendCyclePackets() {
 func (c *Controller) handleEvent(event gomavlib.Event) {
 	switch event := event.(type) {
 	case *gomavlib.EventChannelOpen:
+		c.sched.addChannel(event.Channel)
 		c.sendEvent(&drone.EventChannelOpen{
 			Endpoint: event.Channel.Endpoint().Conf(),
 			Channel:  event.Channel.String(),
 		})
 	case *gomavlib.EventChannelClose:
+		c.sched.removeChannel(event.Channel)
 		c.sendEvent(&drone.EventChannelClose{
 			Endpoint: event.Channel.Endpoint().Conf(),
 			Channel:  event.Channel.String(),
 		})
+	case *gomavlib.EventParseError:
+		c.updateChannelStats(event.Channel, func(s *ChannelStats) {
+			s.ParseErrors++
+		})
 	case *gomavlib.EventFrame:
+		now := time.Now()
 		msg := event.Message()
+		droneId := (int)(event.SystemID())
+		compId := event.ComponentID()
+		c.mux.RLock()
+		d, ok := c.drones[droneId]
+		c.mux.RUnlock()
+
 		checksum := event.Frame.GetChecksum()
-		if err := c.node.FixFrame(event.Frame); err != nil {
+		if err := c.node.FixFrame(event.Frame); err != nil || checksum != event.Frame.GetChecksum() {
+			if ok {
+				d.link.AddError()
+			}
 			return
 		}
-		if checksum != event.Frame.GetChecksum() {
+		if radio, isradio := msg.(*common.MessageRadioStatus); isradio {
+			// RADIO_STATUS is injected by the radios, which may not use the drone's system ID
+			status := &drone.RadioStatus{
+				RSSI:        radio.Rssi,
+				RemoteRSSI:  radio.Remrssi,
+				Noise:       radio.Noise,
+				RemoteNoise: radio.Remnoise,
+				TxBuf:       radio.Txbuf,
+				RxErrors:    radio.Rxerrors,
+				Fixed:       radio.Fixed,
+				UpdatedAt:   now,
+			}
+			if ok {
+				d.link.SetRadio(status)
+			} else {
+				c.updateChannelStats(event.Channel, func(s *ChannelStats) {
+					s.Radio = status
+				})
+			}
 			return
 		}
 
-		droneId := (int)(event.SystemID())
-		compId := event.ComponentID()
 		if droneId != c.id {
-			c.mux.RLock()
-			d, ok := c.drones[droneId]
-			c.mux.RUnlock()
 			if !ok {
 				if _, isheartbeat := msg.(*common.MessageHeartbeat); !isheartbeat {
 					return
@@ -278,6 +351,13 @@ func (c *Controller) handleEvent(event gomavlib.Event) {
 				c.mux.Unlock()
 			}
 			if d.component == compId {
+				d.link.Observe(event.Channel.String(), event.Frame.GetSequenceNumber(), frameSize(event.Frame), now)
+				if reasons := d.duplicates.observe(event.Channel, event.Frame.GetSequenceNumber(), msg, now); reasons != nil {
+					c.sendEvent(&drone.EventDroneDuplicated{
+						Drone:   d,
+						Reasons: reasons,
+					})
+				}
 				d.handleMessage(msg)
 				c.sendEvent(&drone.EventDroneMessage{
 					Drone:   d,
@@ -289,6 +369,58 @@ func (c *Controller) handleEvent(event gomavlib.Event) {
 	}
 }
 
+// ChannelStats is the statistics of a channel which cannot be attributed to a drone
+type ChannelStats struct {
+	Channel     string             `json:"channel"`
+	ParseErrors uint64             `json:"parseErrors"`
+	Radio       *drone.RadioStatus `json:"radio,omitempty"`
+}
+
+func (c *Controller) updateChannelStats(ch *gomavlib.Channel, update func(*ChannelStats)) {
+	c.channelMux.Lock()
+	defer c.channelMux.Unlock()
+	s, ok := c.channelStats[ch]
+	if !ok {
+		s = &ChannelStats{Channel: ch.String()}
+		c.channelStats[ch] = s
+	}
+	update(s)
+}
+
+// ChannelStats returns the parse errors and the ground radio status of each channel
+func (c *Controller) ChannelStats() []*ChannelStats {
+	c.channelMux.Lock()
+	defer c.channelMux.Unlock()
+	stats := make([]*ChannelStats, 0, len(c.channelStats))
+	for _, s := range c.channelStats {
+		cs := *s
+		stats = append(stats, &cs)
+	}
+	slices.SortFunc(stats, func(a, b *ChannelStats) int {
+		return strings.Compare(a.Channel, b.Channel)
+	})
+	return stats
+}
+
+// frameSize returns the encoded length of a frame whose message is encoded by FixFrame
+func frameSize(f frame.Frame) int {
+	switch f := f.(type) {
+	case *frame.V1Frame:
+		if raw, ok := f.Message.(*message.MessageRaw); ok {
+			return 6 + len(raw.Payload) + 2
+		}
+	case *frame.V2Frame:
+		if raw, ok := f.Message.(*message.MessageRaw); ok {
+			n := 10 + len(raw.Payload) + 2
+			if f.Signature != nil {
+				n += 13
+			}
+			return n
+		}
+	}
+	return 0
+}
+
 func mavlib2DroneEndpoints(endpoints []gomavlib.EndpointConf) []*drone.Endpoint {
 	eps := make([]*drone.Endpoint, len(endpoints))
 	for i, e := range endpoints {
@@ -0,0 +1,197 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package drone
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// ClockEstimator models a remote clock, such as a drone's boot time, against the station clock
+// It filters the round trips of time sync requests, and fits the offset and the drift of the remote clock
+type ClockEstimator struct {
+	window int
+
+	mux     sync.RWMutex
+	samples []clockSample
+	est     ClockEstimate
+	ref     time.Time // the station time where est.Offset is measured
+}
+
+type clockSample struct {
+	at     time.Time     // station time at the middle of the round trip
+	offset time.Duration // remote time - station unix time
+	rtt    time.Duration
+}
+
+// ClockEstimate is the state of a ClockEstimator
+type ClockEstimate struct {
+	// Offset is the remote time minus the station unix time at the last sample
+	Offset Duration `json:"offset"`
+	// Drift is how faster the remote clock runs, in ppm
+	Drift float64 `json:"drift"`
+	// Uncertainty is the estimated max error when converting a time at the last sample
+	Uncertainty Duration `json:"uncertainty"`
+	// RTT is the min round trip time in the window
+	RTT     Duration `json:"rtt"`
+	Samples int      `json:"samples"`
+}
+
+// clockResetThreshold is the difference which considers the remote clock is reset, e.g. rebooted
+const clockResetThreshold = time.Second
+
+// NewClockEstimator creates an estimator which keeps the last window samples
+func NewClockEstimator(window int) *ClockEstimator {
+	if window < 2 {
+		window = 2
+	}
+	return &ClockEstimator{
+		window: window,
+	}
+}
+
+// AddSample adds a round trip which is sent and received at the station time,
+// and remote is the remote clock when the request was answered
+func (e *ClockEstimator) AddSample(sent, received time.Time, remote time.Duration) {
+	rtt := received.Sub(sent)
+	if rtt < 0 {
+		return
+	}
+	mid := sent.Add(rtt / 2)
+	s := clockSample{
+		at:     mid,
+		offset: remote - (time.Duration)(mid.UnixNano()),
+		rtt:    rtt,
+	}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if len(e.samples) > 0 {
+		if diff := s.offset - e.offsetAt(mid); diff > clockResetThreshold || diff < -clockResetThreshold {
+			e.samples = e.samples[:0]
+		}
+	}
+	if len(e.samples) >= e.window {
+		copy(e.samples, e.samples[1:])
+		e.samples = e.samples[:len(e.samples)-1]
+	}
+	e.samples = append(e.samples, s)
+	e.fit()
+}
+
+// fit runs a weighted linear regression on the samples whose round trip is close to the fastest one
+// The faster a round trip is, the less its middle point may be biased, so it has a larger weight
+func (e *ClockEstimator) fit() {
+	minRTT := e.samples[0].rtt
+	for _, s := range e.samples {
+		minRTT = min(minRTT, s.rtt)
+	}
+	limit := minRTT*2 + time.Millisecond*5
+	e.ref = e.samples[len(e.samples)-1].at
+	// the offsets are about 1e18 ns, which float64 cannot hold in sub-microsecond precision,
+	// so the fit runs on the difference to the first sample, and the time is relative to ref
+	y0 := e.samples[0].offset
+
+	var sw, sx, sy, sxx, sxy float64
+	n := 0
+	for _, s := range e.samples {
+		if s.rtt > limit {
+			continue
+		}
+		rtt := max(s.rtt.Seconds(), 1e-4)
+		w := 1 / (rtt * rtt)
+		x := s.at.Sub(e.ref).Seconds()
+		y := (float64)(s.offset - y0)
+		sw += w
+		sx += w * x
+		sy += w * y
+		sxx += w * x * x
+		sxy += w * x * y
+		n++
+	}
+	var a, b float64
+	if d := sw*sxx - sx*sx; n >= 3 && d > 1e-9*sw*sw {
+		b = (sw*sxy - sx*sy) / d
+		a = (sy - b*sx) / sw
+	} else {
+		a = sy / sw
+	}
+	var residual float64
+	for _, s := range e.samples {
+		if s.rtt > limit {
+			continue
+		}
+		rtt := max(s.rtt.Seconds(), 1e-4)
+		r := (float64)(s.offset-y0) - (a + b*s.at.Sub(e.ref).Seconds())
+		residual += r * r / (rtt * rtt)
+	}
+	std := math.Sqrt(residual / sw)
+
+	e.est = ClockEstimate{
+		Offset:      (Duration)(y0 + (time.Duration)(math.Round(a))),
+		Drift:       b / 1e3, // ns per second to ppm
+		Uncertainty: (Duration)(minRTT/2) + (Duration)(std),
+		RTT:         (Duration)(minRTT),
+		Samples:     n,
+	}
+}
+
+func (e *ClockEstimator) offsetAt(t time.Time) time.Duration {
+	return (time.Duration)(e.est.Offset) + (time.Duration)(e.est.Drift*1e3*t.Sub(e.ref).Seconds())
+}
+
+// Ready reports whether the estimator has any sample
+func (e *ClockEstimator) Ready() bool {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return len(e.samples) > 0
+}
+
+// Estimate returns the current offset, drift and uncertainty
+func (e *ClockEstimator) Estimate() ClockEstimate {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.est
+}
+
+// ToRemote converts a station time to the remote clock
+// The returned uncertainty grows with the distance to the last sample, since the drift is not exact
+func (e *ClockEstimator) ToRemote(t time.Time) (remote time.Duration, uncertainty time.Duration) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return (time.Duration)(t.UnixNano()) + e.offsetAt(t), e.uncertaintyAt(t)
+}
+
+// ToStation converts a remote clock to the station time
+func (e *ClockEstimator) ToStation(remote time.Duration) (t time.Time, uncertainty time.Duration) {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	// the drift is tiny, so one iteration is precise enough
+	t = time.Unix(0, (int64)(remote-(time.Duration)(e.est.Offset)))
+	t = time.Unix(0, (int64)(remote-e.offsetAt(t)))
+	return t, e.uncertaintyAt(t)
+}
+
+// uncertaintyAt assumes the drift may be wrong by 10 ppm
+func (e *ClockEstimator) uncertaintyAt(t time.Time) time.Duration {
+	age := t.Sub(e.ref)
+	if age < 0 {
+		age = -age
+	}
+	return (time.Duration)(e.est.Uncertainty) + age/100000
+}
@@ -0,0 +1,103 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package drone_test
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/zyxkad/drone"
+)
+
+func TestClockEstimator(t *testing.T) {
+	const drift = 50e-6 // the drone's clock runs 50 ppm faster
+	rnd := rand.New(rand.NewSource(1))
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	boot := base.Add(-time.Minute)
+	remoteAt := func(t time.Time) time.Duration {
+		d := t.Sub(boot)
+		return d + (time.Duration)((float64)(d)*drift)
+	}
+
+	e := drone.NewClockEstimator(32)
+	if e.Ready() {
+		t.Fatal("Estimator should not be ready without samples")
+	}
+	for i := range 40 {
+		sent := base.Add((time.Duration)(i) * time.Second * 10)
+		up := time.Millisecond*20 + (time.Duration)(rnd.Int63n((int64)(time.Millisecond*5)))
+		down := time.Millisecond*20 + (time.Duration)(rnd.Int63n((int64)(time.Millisecond*5)))
+		if i%4 == 3 {
+			// a delayed reply
+			down += time.Millisecond * 300
+		}
+		e.AddSample(sent, sent.Add(up+down), remoteAt(sent.Add(up)))
+	}
+	est := e.Estimate()
+	if est.Drift < 40 || est.Drift > 60 {
+		t.Errorf("Expected drift about 50 ppm, got %f", est.Drift)
+	}
+	if est.Samples >= 32 {
+		t.Errorf("Delayed replies should be filtered, got %d samples", est.Samples)
+	}
+
+	at := base.Add(time.Second * 400)
+	remote, uncertainty := e.ToRemote(at)
+	if diff := remote - remoteAt(at); diff > uncertainty || diff < -uncertainty {
+		t.Errorf("ToRemote error %s is larger than the uncertainty %s", diff, uncertainty)
+	}
+	if uncertainty > time.Millisecond*30 {
+		t.Errorf("Uncertainty %s is too large", uncertainty)
+	}
+	local, _ := e.ToStation(remote)
+	if diff := local.Sub(at); diff > time.Microsecond || diff < -time.Microsecond {
+		t.Errorf("ToStation(ToRemote(t)) differs %s", diff)
+	}
+
+	// the drone reboots
+	sent := base.Add(time.Second * 500)
+	e.AddSample(sent, sent.Add(time.Millisecond*40), time.Second*3)
+	if est := e.Estimate(); est.Samples != 1 {
+		t.Errorf("Estimator should be reset after the drone reboots, got %d samples", est.Samples)
+	}
+}
+
+func TestClockEstimatorPrecision(t *testing.T) {
+	// symmetric round trips without noise, the fit should be exact
+	const drift = 20e-6
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	boot := base.Add(-time.Hour)
+	remoteAt := func(t time.Time) time.Duration {
+		d := t.Sub(boot)
+		return d + (time.Duration)((float64)(d)*drift)
+	}
+	e := drone.NewClockEstimator(16)
+	for i := range 16 {
+		sent := base.Add((time.Duration)(i) * time.Millisecond * 250)
+		rtt := time.Microsecond * (200 + (time.Duration)(i%3)*10)
+		e.AddSample(sent, sent.Add(rtt), remoteAt(sent.Add(rtt/2)))
+	}
+	at := base.Add(time.Second * 4)
+	remote, _ := e.ToRemote(at)
+	if diff := remote - remoteAt(at); diff > time.Microsecond/10 || diff < -time.Microsecond/10 {
+		t.Errorf("ToRemote error %s is larger than 100ns", diff)
+	}
+	if est := e.Estimate(); est.Drift < 19.9 || est.Drift > 20.1 {
+		t.Errorf("Expected drift 20 ppm, got %f", est.Drift)
+	}
+}
@@ -28,6 +28,7 @@ import (
 
 	"github.com/zyxkad/drone"
 	"github.com/zyxkad/drone/ardupilot"
+	"github.com/zyxkad/drone/ext/rtk"
 )
 
 func (s *Server) buildAPIRoute() {
@@ -43,6 +44,17 @@ func (s *Server) buildAPIRoute() {
 	s.route.HandleFunc("GET /api/satellite/config", s.routeSatelliteConfigGET)
 	s.route.HandleFunc("POST /api/satellite/config", s.routeSatelliteConfigPOST)
 	s.buildAPIDroneRoute()
+	s.buildAPIShowRoute()
+	s.buildAPIArtNetRoute()
+	s.buildAPIEmergencyRoute()
+	s.buildAPISafetyRoute()
+	s.buildAPIFleetRoute()
+	s.buildAPIInventoryRoute()
+	s.buildAPIMaintenanceRoute()
+	s.buildAPIBandwidthRoute()
+	s.buildAPIRTCMRoute()
+	s.buildAPINtripRoute()
+	s.buildAPISiteRoute()
 }
 
 func (s *Server) routePing(rw http.ResponseWriter, req *http.Request) {
@@ -158,22 +170,59 @@ func (s *Server) routeLoraConnectDELETE(rw http.ResponseWriter, req *http.Reques
 	rw.WriteHeader(http.StatusNoContent)
 }
 
+const (
+	RtkSourceSerial = "serial"
+	RtkSourceNtrip  = "ntrip"
+)
+
 type RTKCfgPayload struct {
-	Device        string  `json:"device"`
-	BaudRate      int     `json:"baudRate"`
-	SurveyIn      bool    `json:"surveyIn"`
-	MinDuration   int     `json:"surveyInDur"`
-	AccuracyLimit float32 `json:"surveyInAcc"`
+	Source        string           `json:"source"` // "serial" (default) or "ntrip"
+	Device        string           `json:"device"`
+	BaudRate      int              `json:"baudRate"`
+	SurveyIn      bool             `json:"surveyIn"`
+	MinDuration   int              `json:"surveyInDur"`
+	AccuracyLimit float32          `json:"surveyInAcc"`
+	Site          string           `json:"site"` // saves the survey-in result, or the fixed position if not surveying in
+	Ntrip         *NtripCfgPayload `json:"ntrip,omitempty"`
+}
+
+type NtripCfgPayload struct {
+	Server      string  `json:"server"`
+	Mountpoint  string  `json:"mountpoint"`
+	Username    string  `json:"username"`
+	Password    string  `json:"password,omitempty"`
+	Version     int     `json:"version"`     // default is 2
+	GGAInterval int     `json:"ggaInterval"` // in seconds, default is 10
+	Latitude    float64 `json:"latitude"`    // rover position uploaded to VRS mountpoints
+	Longitude   float64 `json:"longitude"`
+	Altitude    float64 `json:"altitude"`
+}
+
+func (p *NtripCfgPayload) clientConfig() rtk.NtripClientConfig {
+	return rtk.NtripClientConfig{
+		Server:      p.Server,
+		Mountpoint:  p.Mountpoint,
+		Username:    p.Username,
+		Password:    p.Password,
+		Version:     p.Version,
+		GGAInterval: time.Second * (time.Duration)(p.GGAInterval),
+	}
 }
 
 func (s *Server) routeRtkConnectGET(rw http.ResponseWriter, req *http.Request) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	if s.rtk == nil {
+	if s.rtkProxy == nil {
 		writeJson(rw, http.StatusOK, nil)
 		return
 	}
-	writeJson(rw, http.StatusOK, s.rtkCfg)
+	cfg := s.rtkCfg
+	if cfg.Ntrip != nil {
+		ntrip := *cfg.Ntrip
+		ntrip.Password = ""
+		cfg.Ntrip = &ntrip
+	}
+	writeJson(rw, http.StatusOK, cfg)
 }
 
 func (s *Server) routeRtkConnectPOST(rw http.ResponseWriter, req *http.Request) {
@@ -181,46 +230,106 @@ func (s *Server) routeRtkConnectPOST(rw http.ResponseWriter, req *http.Request)
 	if !parseRequestBody(rw, req, &payload) {
 		return
 	}
+	if payload.Source == "" {
+		payload.Source = RtkSourceSerial
+	}
+	if payload.Source == RtkSourceNtrip && payload.Ntrip == nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "BadRequest",
+			Message: "NTRIP config is required",
+		})
+		return
+	}
 
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	if s.rtk != nil {
+	if s.rtkProxy != nil {
 		writeJson(rw, http.StatusConflict, apiRespTargetIsExist)
 		return
 	}
-	s.rtkCfg = payload
-	rtk, err := drone.OpenRTK(drone.RTKConfig{
-		Device:   s.rtkCfg.Device,
-		BaudRate: s.rtkCfg.BaudRate,
-	})
-	if err != nil {
-		writeJson(rw, http.StatusInternalServerError, &APIError{
-			Error:   "TargetSetupError",
-			Message: err.Error(),
+	switch payload.Source {
+	case RtkSourceSerial:
+		r, err := drone.OpenRTK(drone.RTKConfig{
+			Device:   payload.Device,
+			BaudRate: payload.BaudRate,
+		})
+		if err != nil {
+			writeJson(rw, http.StatusInternalServerError, &APIError{
+				Error:   "TargetSetupError",
+				Message: err.Error(),
+			})
+			return
+		}
+		s.rtkSite = nil
+		if !payload.SurveyIn {
+			if payload.Site != "" {
+				s.rtkSite = s.sites.Site(payload.Site)
+			} else {
+				s.rtkSite = s.sites.Selected()
+			}
+			if s.rtkSite == nil && payload.Site != "" {
+				r.Close()
+				writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+				return
+			}
+		}
+		s.rtk = r
+		s.rtkProxy = r.GetProxy()
+	case RtkSourceNtrip:
+		client, err := rtk.DialNtrip(payload.Ntrip.clientConfig())
+		if err != nil {
+			writeJson(rw, http.StatusBadRequest, &APIError{
+				Error:   "TargetSetupError",
+				Message: err.Error(),
+			})
+			return
+		}
+		if payload.Ntrip.Latitude != 0 || payload.Ntrip.Longitude != 0 {
+			client.SetPosition(payload.Ntrip.Latitude, payload.Ntrip.Longitude, payload.Ntrip.Altitude)
+		}
+		payload.SurveyIn = false
+		payload.Site = ""
+		s.rtkSite = nil
+		s.ntrip = client
+		s.rtkProxy = rtk.NewProxy(client)
+		// updated from the client status once connected
+		s.rtkStatus = RtkNone
+	default:
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "BadRequest",
+			Message: "Unknown RTK source " + payload.Source,
 		})
 		return
 	}
-	s.rtk = rtk
+	s.rtkCfg = payload
 	s.rtkClosed = make(chan struct{}, 0)
 	if payload.SurveyIn {
 		s.rtkStatus = RtkSurveyIn
 	}
 	rw.WriteHeader(http.StatusNoContent)
-	go s.processRTKConnect(s.rtk, s.rtkClosed)
-	go s.processRTKUBX(s.rtk, s.rtkClosed)
-	go s.broadcastRTKRTCM(s.rtk, s.rtkClosed)
-	go s.runRTKServer(s.rtk, s.rtkClosed, "tcp", "127.0.0.1:10571")
+	if s.rtk != nil {
+		go s.processRTKConnect(s.rtk, s.rtkClosed)
+		go s.processRTKUBX(s.rtk, s.rtkClosed)
+	}
+	go s.broadcastRTKRTCM(s.rtkProxy, s.rtkClosed)
+	go s.runRTKServer(s.rtkProxy, s.rtkClosed, "tcp", "127.0.0.1:10571")
 }
 
 func (s *Server) routeRtkConnectDELETE(rw http.ResponseWriter, req *http.Request) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	if s.rtk == nil {
+	if s.rtkProxy == nil {
 		writeJson(rw, http.StatusOK, apiRespTargetNotExist)
 		return
 	}
-	s.rtk.Close()
-	s.rtk = nil
+	if s.rtk != nil {
+		s.rtk.Close()
+		s.rtk = nil
+	} else {
+		s.rtkProxy.Close()
+	}
+	s.ntrip = nil
+	s.rtkProxy = nil
 	close(s.rtkClosed)
 	rw.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,177 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/zyxkad/drone/ext/artnet"
+)
+
+func (s *Server) buildAPIArtNetRoute() {
+	s.route.HandleFunc("GET /api/artnet", s.routeArtNetGET)
+	s.route.HandleFunc("POST /api/artnet", s.routeArtNetPOST)
+	s.route.HandleFunc("DELETE /api/artnet", s.routeArtNetDELETE)
+}
+
+func (s *Server) routeArtNetGET(rw http.ResponseWriter, req *http.Request) {
+	s.artnetMux.Lock()
+	listener := s.artnet
+	s.artnetMux.Unlock()
+	if listener == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	writeJson(rw, http.StatusOK, listener.Stat())
+}
+
+func (s *Server) routeArtNetPOST(rw http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		// Addr is the Art-Net listen address, empty means not to listen Art-Net
+		Addr string `json:"addr"`
+		SACN bool   `json:"sacn"`
+		// Patch is used if it's not empty, otherwise a linear patch is generated
+		Patch  artnet.Patch `json:"patch"`
+		Linear struct {
+			FirstDrone int    `json:"firstDrone"`
+			Count      int    `json:"count"`
+			Universe   uint16 `json:"universe"`
+			Channel    int    `json:"channel"`
+		} `json:"linear"`
+		MinInterval int     `json:"minInterval"` // In milliseconds
+		MaxRate     float64 `json:"maxRate"`     // Updates per second
+	}
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	controller := s.Controller()
+	if controller == nil {
+		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
+		return
+	}
+	patch := payload.Patch
+	if len(patch) == 0 {
+		l := payload.Linear
+		if l.Count < 1 {
+			writeJson(rw, http.StatusBadRequest, &APIError{
+				Error:   "ArgumentError",
+				Message: "Nothing is patched",
+			})
+			return
+		}
+		if l.Channel == 0 {
+			l.Channel = 1
+		}
+		patch = artnet.LinearPatch(l.FirstDrone, l.Count, l.Universe, l.Channel)
+	}
+	if payload.Addr == "" && !payload.SACN {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: "Neither Art-Net nor sACN is enabled",
+		})
+		return
+	}
+	if payload.SACN {
+		for _, u := range patch.Universes() {
+			if !artnet.ValidSACNUniverse(u) {
+				writeJson(rw, http.StatusBadRequest, &APIError{
+					Error:   "ArgumentError",
+					Message: fmt.Sprintf("sACN universe %d out of range [1, %d]", u, artnet.MaxSACNUniverse),
+				})
+				return
+			}
+		}
+	}
+
+	s.artnetMux.Lock()
+	defer s.artnetMux.Unlock()
+	if s.artnet != nil {
+		writeJson(rw, http.StatusConflict, apiRespTargetIsExist)
+		return
+	}
+	listener, err := artnet.NewListener(controller, artnet.Config{
+		Patch:       patch,
+		MinInterval: (time.Duration)(payload.MinInterval) * time.Millisecond,
+		MaxRate:     payload.MaxRate,
+	})
+	if err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: err.Error(),
+		})
+		return
+	}
+	ctx, cancel := context.WithCancel(controller.Context())
+	if payload.Addr != "" {
+		// the socket is shared with the Art-Net timecode of the show clock
+		err := s.udp.Listen(ctx, payload.Addr, func(packet []byte) {
+			if f, ok := artnet.DecodeArtDMX(packet); ok {
+				listener.HandleFrame(f)
+			}
+		})
+		if err != nil {
+			cancel()
+			writeJson(rw, http.StatusInternalServerError, &APIError{
+				Error:   "ListenError",
+				Message: fmt.Sprintf("Art-Net: %v", err),
+			})
+			return
+		}
+	}
+	if payload.SACN {
+		if err := listener.ListenSACN(ctx, nil); err != nil {
+			cancel()
+			writeJson(rw, http.StatusInternalServerError, &APIError{
+				Error:   "ListenError",
+				Message: fmt.Sprintf("sACN: %v", err),
+			})
+			return
+		}
+	}
+	go func() {
+		defer cancel()
+		listener.Run(ctx)
+		// the listener also stops with the controller, clear it so a new one can be started
+		s.artnetMux.Lock()
+		defer s.artnetMux.Unlock()
+		if s.artnet == listener {
+			s.artnet = nil
+			s.artnetCancel = nil
+		}
+	}()
+	s.artnet = listener
+	s.artnetCancel = cancel
+	s.Logf(LevelInfo, "DMX input started with %d drones patched", len(patch))
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) routeArtNetDELETE(rw http.ResponseWriter, req *http.Request) {
+	s.artnetMux.Lock()
+	defer s.artnetMux.Unlock()
+	if s.artnet == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	s.artnetCancel()
+	s.artnet = nil
+	s.artnetCancel = nil
+	s.Log(LevelInfo, "DMX input stopped")
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,154 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/zyxkad/drone/ext/bandwidth"
+)
+
+func (s *Server) buildAPIBandwidthRoute() {
+	s.route.HandleFunc("GET /api/bandwidth", s.routeBandwidthGET)
+	s.route.HandleFunc("POST /api/bandwidth/plan", s.routeBandwidthPlanPOST)
+	s.route.HandleFunc("POST /api/bandwidth", s.routeBandwidthPOST)
+	s.route.HandleFunc("DELETE /api/bandwidth", s.routeBandwidthDELETE)
+}
+
+type BandwidthStreamPayload struct {
+	Name        string `json:"name"`
+	MessageID   uint32 `json:"msgid"`
+	Size        int    `json:"size"`
+	PerDrone    bool   `json:"perDrone"`
+	MinInterval int64  `json:"minInterval"` // In milliseconds
+	MaxInterval int64  `json:"maxInterval"` // In milliseconds
+	Essential   bool   `json:"essential"`
+}
+
+type BandwidthPayload struct {
+	Capacity float64 `json:"capacity"` // In bytes per second
+	Reserve  float64 `json:"reserve"`
+	Overhead float64 `json:"overhead"` // In bytes per second per drone
+	// Streams are in priority order, the default streams are used if it's empty
+	Streams []BandwidthStreamPayload `json:"streams"`
+}
+
+func (p *BandwidthPayload) Config() bandwidth.Config {
+	cfg := bandwidth.Config{
+		Capacity:         p.Capacity,
+		Reserve:          p.Reserve,
+		PerDroneOverhead: p.Overhead,
+	}
+	for _, st := range p.Streams {
+		cfg.Streams = append(cfg.Streams, bandwidth.Stream{
+			Name:        st.Name,
+			MessageID:   st.MessageID,
+			Size:        st.Size,
+			PerDrone:    st.PerDrone,
+			MinInterval: (time.Duration)(st.MinInterval) * time.Millisecond,
+			MaxInterval: (time.Duration)(st.MaxInterval) * time.Millisecond,
+			Essential:   st.Essential,
+		})
+	}
+	return cfg
+}
+
+func (s *Server) routeBandwidthGET(rw http.ResponseWriter, req *http.Request) {
+	s.bandwidthMux.Lock()
+	defer s.bandwidthMux.Unlock()
+	if s.bandwidth == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	writeJson(rw, http.StatusOK, Map{
+		"config": s.bandwidthCfg,
+		"plan":   s.bandwidth.Plan(),
+	})
+}
+
+// routeBandwidthPlanPOST previews the plan of a number of drones without applying it
+func (s *Server) routeBandwidthPlanPOST(rw http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		BandwidthPayload
+		Drones int `json:"drones"`
+	}
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	cfg := payload.Config()
+	if err := cfg.Validate(); err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: err.Error(),
+		})
+		return
+	}
+	writeJson(rw, http.StatusOK, bandwidth.MakePlan(cfg, payload.Drones))
+}
+
+func (s *Server) routeBandwidthPOST(rw http.ResponseWriter, req *http.Request) {
+	var payload BandwidthPayload
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	controller := s.Controller()
+	if controller == nil {
+		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
+		return
+	}
+	manager, err := bandwidth.NewManager(controller, payload.Config())
+	if err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	s.bandwidthMux.Lock()
+	defer s.bandwidthMux.Unlock()
+	if s.bandwidthCancel != nil {
+		s.bandwidthCancel()
+	}
+	ctx, cancel := context.WithCancel(controller.Context())
+	s.bandwidth = manager
+	s.bandwidthCancel = cancel
+	s.bandwidthCfg = payload
+	go manager.Run(ctx)
+	s.Logf(LevelInfo, "Bandwidth manager started with capacity %.0f B/s", payload.Capacity)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// routeBandwidthDELETE stops the manager, the drones keep the last intervals until they reconnect
+func (s *Server) routeBandwidthDELETE(rw http.ResponseWriter, req *http.Request) {
+	s.bandwidthMux.Lock()
+	defer s.bandwidthMux.Unlock()
+	if s.bandwidth == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	s.bandwidthCancel()
+	s.bandwidth = nil
+	s.bandwidthCancel = nil
+	if setter, ok := s.Controller().(bandwidth.StreamIntervalSetter); ok {
+		setter.SetStreamIntervals(nil)
+	}
+	s.Log(LevelInfo, "Bandwidth manager stopped")
+	rw.WriteHeader(http.StatusNoContent)
+}
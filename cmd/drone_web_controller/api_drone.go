@@ -18,11 +18,16 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/bluenviron/gomavlib/v3"
 	"github.com/ungerik/go3d/vec3"
 
 	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ardupilot"
 	"github.com/zyxkad/drone/ext/director"
 	"github.com/zyxkad/drone/ext/preflight"
 )
@@ -31,6 +36,11 @@ func (s *Server) buildAPIDroneRoute() {
 	s.route.HandleFunc("POST /api/drone/action", s.routeDroneAction)
 	s.route.HandleFunc("POST /api/drone/mode", s.routeDroneMode)
 	s.route.HandleFunc("POST /api/drone/fence", s.routeDroneFence)
+	s.route.HandleFunc("POST /api/drone/command", s.routeDroneCommand)
+	s.route.HandleFunc("POST /api/drone/led", s.routeDroneLED)
+	s.route.HandleFunc("POST /api/drone/param", s.routeDroneParam)
+	s.route.HandleFunc("GET /api/drone/link", s.routeDroneLink)
+	s.route.HandleFunc("POST /api/drone/link/rate", s.routeDroneLinkRate)
 
 	s.route.HandleFunc("POST /api/director/init", s.routeDirectorInit)
 	s.route.HandleFunc("DELETE /api/director/destroy", s.routeDirectorDestroy)
@@ -50,8 +60,13 @@ type MultiOpResp struct {
 
 func (s *Server) routeDroneAction(rw http.ResponseWriter, req *http.Request) {
 	var payload struct {
+		DroneTargets
 		Action drone.DroneAction `json:"action"`
-		Drones []int             `json:"d"`
+		// At is the unix time in ms to execute the action, Delay is the time in ms from now
+		// The action is synchronized among the drones if either is set
+		At       int64 `json:"at"`
+		Delay    int64 `json:"delay"`
+		Deadline int64 `json:"deadline"` // the time in ms after the action to wait acknowledges
 	}
 	if !parseRequestBody(rw, req, &payload) {
 		return
@@ -66,55 +81,85 @@ func (s *Server) routeDroneAction(rw http.ResponseWriter, req *http.Request) {
 		writeJson(rw, http.StatusBadRequest, apiRespUnsupportedAction)
 		return
 	}
+	drones, ok := s.resolveTargets(rw, controller, &payload.DroneTargets)
+	if !ok {
+		return
+	}
+	if payload.At != 0 || payload.Delay != 0 {
+		s.routeDroneGroupAction(rw, req, controller, payload.Action, drones, payload.At, payload.Delay, payload.Deadline)
+		return
+	}
 	ctx := req.Context()
-	count := 0
+	if resp, ok := runMultiOp(ctx, drones, func(d drone.Drone) error {
+		return action(d, ctx)
+	}); ok {
+		writeJson(rw, http.StatusOK, resp)
+	}
+}
+
+// runMultiOp runs fn on every drone concurrently
+// ok is false if the context is done before all operations are finished
+func runMultiOp(ctx context.Context, drones []drone.Drone, fn func(drone.Drone) error) (resp MultiOpResp, ok bool) {
 	errCh := make(chan error, 0)
-	if payload.Drones == nil {
-		for _, d := range controller.Drones() {
-			count++
-			go func(d drone.Drone) {
-				select {
-				case errCh <- action(d, ctx):
-				case <-ctx.Done():
-				}
-			}(d)
-		}
-	} else {
-		for _, id := range payload.Drones {
-			d := controller.GetDrone(id)
-			if d != nil {
-				count++
-				go func(d drone.Drone) {
-					select {
-					case errCh <- action(d, ctx):
-					case <-ctx.Done():
-					}
-				}(d)
+	for _, d := range drones {
+		go func(d drone.Drone) {
+			select {
+			case errCh <- fn(d):
+			case <-ctx.Done():
 			}
-		}
+		}(d)
 	}
 	errs := make([]string, 0, 2)
-	for range count {
+	for range drones {
 		select {
 		case err := <-errCh:
 			if err != nil {
 				errs = append(errs, err.Error())
 			}
 		case <-ctx.Done():
-			return
+			return MultiOpResp{}, false
 		}
 	}
-	writeJson(rw, http.StatusOK, MultiOpResp{
-		Targets: count,
+	return MultiOpResp{
+		Targets: len(drones),
 		Failed:  len(errs),
 		Errors:  errs,
-	})
+	}, true
+}
+
+func (s *Server) routeDroneGroupAction(
+	rw http.ResponseWriter, req *http.Request,
+	controller drone.Controller, action drone.DroneAction, drones []drone.Drone,
+	at, delay, deadline int64,
+) {
+	ga := &drone.GroupAction{
+		Action: action,
+	}
+	if at != 0 {
+		ga.At = time.UnixMilli(at)
+	} else {
+		ga.At = time.Now().Add((time.Duration)(delay) * time.Millisecond)
+	}
+	if deadline > 0 {
+		ga.Deadline = ga.At.Add((time.Duration)(deadline) * time.Millisecond)
+	}
+	res, err := drone.ExecuteGroupAction(req.Context(), controller, drones, ga)
+	if err != nil {
+		writeJson(rw, http.StatusBadRequest, APIError{
+			Error:   "ActionFailed",
+			Message: err.Error(),
+		})
+		return
+	}
+	s.Logf(LevelInfo, "Group action %s at %s: %d acked, %d missed, %d failed",
+		action, ga.At.Format("15:04:05.000"), len(res.Acked), len(res.Missed), len(res.Errors))
+	writeJson(rw, http.StatusOK, res)
 }
 
 func (s *Server) routeDroneMode(rw http.ResponseWriter, req *http.Request) {
 	var payload struct {
-		Mode   int   `json:"mode"`
-		Drones []int `json:"d"`
+		DroneTargets
+		Mode int `json:"mode"`
 	}
 	if !parseRequestBody(rw, req, &payload) {
 		return
@@ -124,55 +169,144 @@ func (s *Server) routeDroneMode(rw http.ResponseWriter, req *http.Request) {
 		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
 		return
 	}
+	drones, ok := s.resolveTargets(rw, controller, &payload.DroneTargets)
+	if !ok {
+		return
+	}
 	ctx := req.Context()
-	count := 0
-	errCh := make(chan error, 0)
-	if payload.Drones == nil {
-		for _, d := range controller.Drones() {
-			count++
-			go func(d drone.Drone) {
-				select {
-				case errCh <- d.UpdateMode(ctx, payload.Mode):
-				case <-ctx.Done():
-				}
-			}(d)
+	if resp, ok := runMultiOp(ctx, drones, func(d drone.Drone) error {
+		return d.UpdateMode(ctx, payload.Mode)
+	}); ok {
+		writeJson(rw, http.StatusOK, resp)
+	}
+}
+
+func (s *Server) routeDroneFence(rw http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		DroneTargets
+		Drone   int          `json:"drone"` // a single drone, used if it's not zero
+		Disable bool         `json:"disable"`
+		Fence   []*drone.Gps `json:"fence"`
+	}
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	// an empty target means all drones, which is too wide for disabling the fences
+	if payload.Disable && payload.Drone == 0 && payload.IsEmpty() {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: "Disabling fence requires explicit targets",
+		})
+		return
+	}
+	controller := s.Controller()
+	if controller == nil {
+		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
+		return
+	}
+	var drones []drone.Drone
+	if payload.Drone != 0 {
+		d := controller.GetDrone(payload.Drone)
+		if d == nil {
+			writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+			return
 		}
+		drones = []drone.Drone{d}
 	} else {
-		for _, id := range payload.Drones {
-			d := controller.GetDrone(id)
-			if d != nil {
-				count++
-				go func(d drone.Drone) {
-					select {
-					case errCh <- d.UpdateMode(ctx, payload.Mode):
-					case <-ctx.Done():
-					}
-				}(d)
-			}
+		var ok bool
+		if drones, ok = s.resolveTargets(rw, controller, &payload.DroneTargets); !ok {
+			return
 		}
 	}
-	errs := make([]string, 0, 2)
-	for range count {
-		select {
-		case err := <-errCh:
-			if err != nil {
-				errs = append(errs, err.Error())
-			}
-		case <-ctx.Done():
+	ctx := req.Context()
+	switch {
+	case payload.Disable:
+		resp, ok := runMultiOp(ctx, drones, func(d drone.Drone) error {
+			return d.DisableFence(ctx)
+		})
+		if !ok {
 			return
 		}
+		s.Logf(LevelWarn, "Disabled fence for %v", droneIDs(drones))
+		writeJson(rw, http.StatusOK, resp)
+	case len(payload.Fence) >= 3:
+		resp, ok := runMultiOp(ctx, drones, func(d drone.Drone) error {
+			return d.SetFence(ctx, payload.Fence)
+		})
+		if !ok {
+			return
+		}
+		s.Logf(LevelInfo, "Set fence for %v", droneIDs(drones))
+		writeJson(rw, http.StatusOK, resp)
+	default:
+		writeJson(rw, http.StatusBadRequest, apiRespUnsupportedAction)
 	}
-	writeJson(rw, http.StatusOK, MultiOpResp{
-		Targets: count,
-		Failed:  len(errs),
-		Errors:  errs,
+}
+
+const (
+	mavCmdDoFlightTermination     = 185 // MAV_CMD_DO_FLIGHTTERMINATION
+	mavCmdPreflightRebootShutdown = 246 // MAV_CMD_PREFLIGHT_REBOOT_SHUTDOWN
+)
+
+func (s *Server) routeDroneCommand(rw http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		DroneTargets
+		Command int       `json:"cmd"`
+		Args    []float32 `json:"args"`
+	}
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	switch payload.Command {
+	case mavCmdDoFlightTermination:
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: "Flight termination must use the emergency API",
+		})
+		return
+	case mavCmdPreflightRebootShutdown:
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: "Reboot and shutdown are not allowed",
+		})
+		return
+	}
+	// a raw command can do anything, so it is never sent to all drones implicitly
+	if payload.IsEmpty() {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: "Command requires explicit targets",
+		})
+		return
+	}
+	controller := s.Controller()
+	if controller == nil {
+		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
+		return
+	}
+	drones, ok := s.resolveTargets(rw, controller, &payload.DroneTargets)
+	if !ok {
+		return
+	}
+	ctx := req.Context()
+	resp, ok := runMultiOp(ctx, drones, func(d drone.Drone) error {
+		cd, ok := d.(drone.CommandAbility)
+		if !ok {
+			return fmt.Errorf("Drone %d does not support commands", d.ID())
+		}
+		return cd.ExecuteCommand(ctx, payload.Command, payload.Args...)
 	})
+	s.Audit(req, "command", "command %d, args %v, drones %v, failed %d", payload.Command, payload.Args, droneIDs(drones), resp.Failed)
+	if ok {
+		writeJson(rw, http.StatusOK, resp)
+	}
 }
 
-func (s *Server) routeDroneFence(rw http.ResponseWriter, req *http.Request) {
+func (s *Server) routeDroneLED(rw http.ResponseWriter, req *http.Request) {
 	var payload struct {
-		Drone   int  `json:"drone"`
-		Disable bool `json:"disable"`
+		DroneTargets
+		Color    drone.Color `json:"color"`
+		Duration int64       `json:"duration"` // In milliseconds, zero resets the LED
 	}
 	if !parseRequestBody(rw, req, &payload) {
 		return
@@ -182,27 +316,148 @@ func (s *Server) routeDroneFence(rw http.ResponseWriter, req *http.Request) {
 		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
 		return
 	}
-	d := controller.GetDrone(payload.Drone)
-	if d == nil {
-		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+	drones, ok := s.resolveTargets(rw, controller, &payload.DroneTargets)
+	if !ok {
 		return
 	}
-	switch {
-	case payload.Disable:
-		if err := d.DisableFence(context.Background()); err != nil {
-			writeJson(rw, http.StatusInternalServerError, &APIError{
-				Error:   "ActionFailed",
-				Message: err.Error(),
-			})
-			return
+	ctx := req.Context()
+	if resp, ok := runMultiOp(ctx, drones, func(d drone.Drone) error {
+		led, ok := d.(drone.LEDAbility)
+		if !ok {
+			return fmt.Errorf("Drone %d does not support LED", d.ID())
 		}
-		s.Logf(LevelWarn, "Disabled fence for %d", d.ID())
-		rw.WriteHeader(http.StatusNoContent)
-	default:
-		writeJson(rw, http.StatusBadRequest, apiRespUnsupportedAction)
+		if payload.Duration <= 0 {
+			return led.ResetLED(ctx)
+		}
+		return led.ActiveLED(ctx, payload.Color, (time.Duration)(payload.Duration)*time.Millisecond)
+	}); ok {
+		writeJson(rw, http.StatusOK, resp)
 	}
 }
 
+// routeDroneParam reads the parameter if value is not set, otherwise writes the parameter
+func (s *Server) routeDroneParam(rw http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		DroneTargets
+		Name  string   `json:"name"`
+		Value *float32 `json:"value"`
+	}
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	controller := s.Controller()
+	if controller == nil {
+		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
+		return
+	}
+	drones, ok := s.resolveTargets(rw, controller, &payload.DroneTargets)
+	if !ok {
+		return
+	}
+	ctx := req.Context()
+	var (
+		mux    sync.Mutex
+		values = make(map[int]float32, len(drones))
+	)
+	resp, ok := runMultiOp(ctx, drones, func(d drone.Drone) error {
+		pd, ok := d.(drone.ParamAbility)
+		if !ok {
+			return fmt.Errorf("Drone %d does not support parameters", d.ID())
+		}
+		if payload.Value != nil {
+			if err := pd.SetParam(ctx, payload.Name, *payload.Value); err != nil {
+				return fmt.Errorf("Drone %d: %w", d.ID(), err)
+			}
+			return nil
+		}
+		v, err := pd.GetParam(ctx, payload.Name)
+		if err != nil {
+			return fmt.Errorf("Drone %d: %w", d.ID(), err)
+		}
+		mux.Lock()
+		values[d.ID()] = v
+		mux.Unlock()
+		return nil
+	})
+	if !ok {
+		return
+	}
+	if payload.Value != nil {
+		s.Logf(LevelInfo, "Set parameter %s = %v for %v", payload.Name, *payload.Value, droneIDs(drones))
+	}
+	writeJson(rw, http.StatusOK, Map{
+		"targets": resp.Targets,
+		"failed":  resp.Failed,
+		"errors":  resp.Errors,
+		"values":  values,
+	})
+}
+
+// routeDroneLink returns the link statistics of all drones, and the channel statistics if the controller supports
+func (s *Server) routeDroneLink(rw http.ResponseWriter, req *http.Request) {
+	controller := s.Controller()
+	if controller == nil {
+		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
+		return
+	}
+	drones := make(map[int]*drone.LinkStats)
+	for _, d := range controller.Drones() {
+		if la, ok := d.(drone.LinkAbility); ok {
+			drones[d.ID()] = la.GetLinkStats()
+		}
+	}
+	resp := Map{
+		"drones": drones,
+	}
+	if ac, ok := controller.(*ardupilot.Controller); ok {
+		resp["channels"] = ac.ChannelStats()
+		resp["scheduler"] = ac.SchedulerStats()
+	}
+	writeJson(rw, http.StatusOK, resp)
+}
+
+// routeDroneLinkRate limits the outgoing bytes per second of an endpoint, 0 removes the limit
+func (s *Server) routeDroneLinkRate(rw http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		Endpoint int     `json:"endpoint" schema:"endpoint"`
+		Rate     float64 `json:"rate" schema:"rate"`
+	}
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	ac, ok := s.Controller().(*ardupilot.Controller)
+	if !ok {
+		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
+		return
+	}
+	endpoints := ac.Endpoints()
+	if payload.Endpoint < 0 || payload.Endpoint >= len(endpoints) {
+		writeJson(rw, http.StatusBadRequest, APIError{
+			Error:   "EndpointNotExists",
+			Message: fmt.Sprintf("Endpoint index %d out of range", payload.Endpoint),
+		})
+		return
+	}
+	if payload.Rate < 0 {
+		writeJson(rw, http.StatusBadRequest, APIError{
+			Error:   "InvalidRate",
+			Message: "Rate cannot be negative",
+		})
+		return
+	}
+	conf, ok := endpoints[payload.Endpoint].Raw.(gomavlib.EndpointConf)
+	if !ok {
+		writeJson(rw, http.StatusBadRequest, APIError{
+			Error:   "EndpointNotSupported",
+			Message: "Endpoint does not support rate limit",
+		})
+		return
+	}
+	ac.SetEndpointRate(conf, payload.Rate)
+	s.Audit(req, "link-rate", "endpoint %d, rate %.0f B/s", payload.Endpoint, payload.Rate)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
 func (s *Server) directorLogger(log string) {
 	s.Log(LevelInfo, "director:", log)
 	s.directorLastLog.Store(&log)
@@ -246,7 +501,8 @@ func (s *Server) routeDirectorInit(rw http.ResponseWriter, req *http.Request) {
 	if payload.Height != 0 {
 		dt.SetHeight(payload.Height)
 	}
-	dt.UseInspector(preflight.NewGpsTypeChecker(), preflight.NewAttitudeChecker(5, 0.1), preflight.NewBatteryChecker(14))
+	dt.UseInspector(preflight.NewGpsTypeChecker(), preflight.NewAttitudeChecker(5, 0.1), preflight.NewBatteryChecker(14),
+		s.maintenance.NewInspector(func(d drone.Drone) string { return s.droneUID(d.ID()) }))
 	s.director.Store(dt)
 	s.directorTotalSlots.Store((int32)(len(payload.Slots)))
 	s.directorAssigned.Store((int32)(dt.ArrivedIndex() + 1))
@@ -0,0 +1,247 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/emergency"
+	"github.com/zyxkad/drone/ext/show"
+)
+
+func (s *Server) buildAPIEmergencyRoute() {
+	s.route.HandleFunc("POST /api/emergency/rtl/plan", s.routeEmergencyRTLPlan)
+	s.route.HandleFunc("GET /api/emergency/rtl", s.routeEmergencyRTLGET)
+	s.route.HandleFunc("POST /api/emergency/rtl", s.routeEmergencyRTLPOST)
+	s.route.HandleFunc("POST /api/emergency/hold", s.routeEmergencyHold)
+	s.route.HandleFunc("POST /api/emergency/land", s.routeEmergencyLand)
+	s.route.HandleFunc("POST /api/emergency/terminate", s.routeEmergencyTerminate)
+}
+
+type RTLPayload struct {
+	DroneTargets
+	BaseAltitude float32 `json:"baseAltitude"`
+	LayerHeight  float32 `json:"layerHeight"`
+	Layers       int     `json:"layers"`
+	Separation   float32 `json:"separation"`
+	Delay        int64   `json:"delay"` // In milliseconds
+	Radius       float32 `json:"radius"`
+}
+
+func (p *RTLPayload) Config() emergency.RTLConfig {
+	return emergency.RTLConfig{
+		BaseAltitude: p.BaseAltitude,
+		LayerHeight:  p.LayerHeight,
+		Layers:       p.Layers,
+		Separation:   p.Separation,
+		Delay:        (time.Duration)(p.Delay) * time.Millisecond,
+		Radius:       p.Radius,
+	}
+}
+
+func (s *Server) routeEmergencyRTLPlan(rw http.ResponseWriter, req *http.Request) {
+	var payload RTLPayload
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	controller := s.Controller()
+	if controller == nil {
+		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
+		return
+	}
+	drones, ok := s.resolveTargets(rw, controller, &payload.DroneTargets)
+	if !ok {
+		return
+	}
+	writeJson(rw, http.StatusOK, emergency.PlanRTL(drones, payload.Config()))
+}
+
+func (s *Server) routeEmergencyRTLGET(rw http.ResponseWriter, req *http.Request) {
+	s.emergencyMux.Lock()
+	plan := s.rtlPlan
+	s.emergencyMux.Unlock()
+	if plan == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	writeJson(rw, http.StatusOK, plan)
+}
+
+func (s *Server) routeEmergencyRTLPOST(rw http.ResponseWriter, req *http.Request) {
+	var payload RTLPayload
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	controller := s.Controller()
+	if controller == nil {
+		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
+		return
+	}
+	drones, ok := s.resolveTargets(rw, controller, &payload.DroneTargets)
+	if !ok {
+		return
+	}
+	plan := emergency.PlanRTL(drones, payload.Config())
+	ctx, cancel := context.WithCancel(controller.Context())
+
+	s.emergencyMux.Lock()
+	if s.rtlCancel != nil {
+		s.rtlCancel()
+	}
+	s.rtlPlan, s.rtlCancel = plan, cancel
+	s.emergencyMux.Unlock()
+
+	ids := make([]int, len(plan.Steps))
+	for i, st := range plan.Steps {
+		ids[i] = st.Drone
+	}
+	s.Audit(req, "RTL", "drones %v, skipped %v", ids, plan.Skipped)
+	go func() {
+		defer cancel()
+		if err := plan.Execute(ctx, controller); err != nil {
+			s.ToastAndLog(LevelError, "Swarm RTL error", err)
+			return
+		}
+		s.ToastAndLog(LevelInfo, "Swarm RTL", "All drones are landing")
+	}()
+	writeJson(rw, http.StatusOK, plan)
+}
+
+// cancelRTL stops the running swarm RTL, so it does not override an emergency action
+func (s *Server) cancelRTL() {
+	s.emergencyMux.Lock()
+	defer s.emergencyMux.Unlock()
+	if s.rtlCancel != nil {
+		s.rtlCancel()
+		s.rtlCancel = nil
+	}
+}
+
+func (s *Server) routeEmergencyHold(rw http.ResponseWriter, req *http.Request) {
+	s.routeEmergencyAction(rw, req, show.AbortHold, emergency.HoldAll)
+}
+
+func (s *Server) routeEmergencyLand(rw http.ResponseWriter, req *http.Request) {
+	s.routeEmergencyAction(rw, req, show.AbortLand, emergency.LandInPlace)
+}
+
+func (s *Server) routeEmergencyAction(rw http.ResponseWriter, req *http.Request, abort show.AbortMode, action func(context.Context, []drone.Drone) *emergency.Result) {
+	var payload DroneTargets
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	controller := s.Controller()
+	if controller == nil {
+		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
+		return
+	}
+	drones, ok := s.resolveTargets(rw, controller, &payload)
+	if !ok {
+		return
+	}
+	s.cancelRTL()
+	ctx, cancel := context.WithTimeout(req.Context(), time.Second*5)
+	defer cancel()
+	// a running show keeps sending setpoints, which overrides the hold or land command
+	if executor := s.getShowExecutor(); executor != nil {
+		if err := executor.AbortWait(ctx, abort); err != nil {
+			s.Log(LevelError, "Cannot stop the show before emergency action:", err)
+		}
+	}
+	res := action(ctx, drones)
+	s.Audit(req, res.Action, "drones %v, succeeded %v, errors %v", droneIDs(drones), res.Succeeded, res.Errors)
+	writeJson(rw, http.StatusOK, res)
+}
+
+// terminateConfirm is a pending flight termination request
+type terminateConfirm struct {
+	Token   string    `json:"confirm"`
+	Drones  []int     `json:"d"`
+	Expires time.Time `json:"expires"`
+}
+
+const terminateConfirmTimeout = time.Second * 15
+
+// routeEmergencyTerminate requires two requests, and only accepts explicit drone IDs
+// The first request without confirm returns a token, the second request with the token and the same drones executes the termination
+func (s *Server) routeEmergencyTerminate(rw http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		DroneTargets
+		Confirm string `json:"confirm"`
+	}
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	// a selector such as "all" or "-@spares" can match the whole fleet, so only drone IDs are accepted
+	if len(payload.Drones) == 0 || payload.Selector != "" {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: "Flight termination requires explicit drone IDs",
+		})
+		return
+	}
+	controller := s.Controller()
+	if controller == nil {
+		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
+		return
+	}
+	drones, ok := s.resolveTargets(rw, controller, &payload.DroneTargets)
+	if !ok {
+		return
+	}
+	ids := droneIDs(drones)
+	slices.Sort(ids)
+
+	s.emergencyMux.Lock()
+	pending := s.terminateConfirm
+	if payload.Confirm == "" {
+		var buf [8]byte
+		rand.Read(buf[:])
+		pending = &terminateConfirm{
+			Token:   hex.EncodeToString(buf[:]),
+			Drones:  ids,
+			Expires: time.Now().Add(terminateConfirmTimeout),
+		}
+		s.terminateConfirm = pending
+		s.emergencyMux.Unlock()
+		s.Audit(req, "terminate-request", "drones %v", ids)
+		writeJson(rw, http.StatusAccepted, pending)
+		return
+	}
+	s.terminateConfirm = nil
+	s.emergencyMux.Unlock()
+	if pending == nil || pending.Token != payload.Confirm || time.Now().After(pending.Expires) || !slices.Equal(pending.Drones, ids) {
+		s.Audit(req, "terminate-rejected", "drones %v", ids)
+		writeJson(rw, http.StatusForbidden, &APIError{
+			Error:   "ConfirmFailed",
+			Message: "Confirmation is invalid or expired",
+		})
+		return
+	}
+	s.cancelRTL()
+	ctx, cancel := context.WithTimeout(req.Context(), time.Second*5)
+	defer cancel()
+	res := emergency.Terminate(ctx, drones)
+	s.Audit(req, res.Action, "drones %v, succeeded %v, errors %v", ids, res.Succeeded, res.Errors)
+	writeJson(rw, http.StatusOK, res)
+}
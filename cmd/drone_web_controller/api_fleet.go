@@ -0,0 +1,174 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/fleet"
+)
+
+func (s *Server) buildAPIFleetRoute() {
+	s.route.HandleFunc("GET /api/groups", s.routeGroupsGET)
+	s.route.HandleFunc("PUT /api/group/{name}", s.routeGroupPUT)
+	s.route.HandleFunc("DELETE /api/group/{name}", s.routeGroupDELETE)
+	s.route.HandleFunc("PUT /api/tags/{id}", s.routeTagsPUT)
+	s.route.HandleFunc("GET /api/select", s.routeSelect)
+}
+
+// DroneTargets is embedded in the payloads of the routes which operate multiple drones
+// Drones is a list of drone IDs, Selector is a selector expression such as "@left-wing -#spares status:READY"
+// Selector takes precedence, and all drones are selected if neither is set
+type DroneTargets struct {
+	Drones   []int  `json:"d"`
+	Selector string `json:"sel"`
+}
+
+// IsEmpty reports whether no target is given, which selects all drones
+func (t *DroneTargets) IsEmpty() bool {
+	return t.Drones == nil && t.Selector == ""
+}
+
+// selectDrones returns the connected drones of the ids, nil ids means all drones
+func selectDrones(controller drone.Controller, ids []int) []drone.Drone {
+	if ids == nil {
+		return controller.Drones()
+	}
+	drones := make([]drone.Drone, 0, len(ids))
+	for _, id := range ids {
+		if d := controller.GetDrone(id); d != nil {
+			drones = append(drones, d)
+		}
+	}
+	return drones
+}
+
+func (s *Server) selectTargets(controller drone.Controller, t *DroneTargets) ([]drone.Drone, error) {
+	if t.Selector == "" {
+		return selectDrones(controller, t.Drones), nil
+	}
+	sel, err := fleet.ParseSelector(t.Selector)
+	if err != nil {
+		return nil, err
+	}
+	return sel.Select(controller.Drones(), s.groups), nil
+}
+
+// resolveTargets writes an error response if the selector is invalid
+func (s *Server) resolveTargets(rw http.ResponseWriter, controller drone.Controller, t *DroneTargets) ([]drone.Drone, bool) {
+	drones, err := s.selectTargets(controller, t)
+	if err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "SelectorError",
+			Message: err.Error(),
+		})
+		return nil, false
+	}
+	return drones, true
+}
+
+func droneIDs(drones []drone.Drone) []int {
+	ids := make([]int, len(drones))
+	for i, d := range drones {
+		ids[i] = d.ID()
+	}
+	return ids
+}
+
+func (s *Server) routeGroupsGET(rw http.ResponseWriter, req *http.Request) {
+	writeJson(rw, http.StatusOK, Map{
+		"groups": s.groups.Groups(),
+		"tags":   s.groups.AllTags(),
+	})
+}
+
+func (s *Server) routeGroupPUT(rw http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		Drones []int `json:"d"`
+	}
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	name := req.PathValue("name")
+	if err := s.groups.SetGroup(name, payload.Drones); err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: err.Error(),
+		})
+		return
+	}
+	s.Logf(LevelInfo, "Group %s set to %v", name, payload.Drones)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) routeGroupDELETE(rw http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	if _, ok := s.groups.Group(name); !ok {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	if err := s.groups.DeleteGroup(name); err != nil {
+		writeJson(rw, http.StatusInternalServerError, &APIError{
+			Error:   "SaveError",
+			Message: err.Error(),
+		})
+		return
+	}
+	s.Logf(LevelInfo, "Group %s deleted", name)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) routeTagsPUT(rw http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		Tags []string `json:"tags"`
+	}
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	id, err := strconv.Atoi(req.PathValue("id"))
+	if err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: err.Error(),
+		})
+		return
+	}
+	if err := s.groups.SetTags(id, payload.Tags); err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: err.Error(),
+		})
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// routeSelect previews which drones a selector selects
+func (s *Server) routeSelect(rw http.ResponseWriter, req *http.Request) {
+	controller := s.Controller()
+	if controller == nil {
+		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
+		return
+	}
+	drones, ok := s.resolveTargets(rw, controller, &DroneTargets{Selector: req.URL.Query().Get("sel")})
+	if !ok {
+		return
+	}
+	writeJson(rw, http.StatusOK, droneIDs(drones))
+}
@@ -0,0 +1,216 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/fleet"
+)
+
+func (s *Server) buildAPIInventoryRoute() {
+	s.route.HandleFunc("GET /api/inventory", s.routeInventoryGET)
+	s.route.HandleFunc("PUT /api/inventory/{uid}", s.routeInventoryPUT)
+	s.route.HandleFunc("DELETE /api/inventory/{uid}", s.routeInventoryDELETE)
+	s.route.HandleFunc("POST /api/inventory/{uid}/battery", s.routeInventoryBatteryPOST)
+	s.route.HandleFunc("POST /api/drone/sysid", s.routeDroneSysIDPOST)
+}
+
+type DroneIdentityMsg struct {
+	Id       int             `json:"id"`
+	Name     string          `json:"name"`
+	UID      string          `json:"uid"`
+	Airframe *fleet.Airframe `json:"airframe"`
+}
+
+// droneUID returns the board UID of a connected drone, or an empty string if it's not bound yet
+func (s *Server) droneUID(id int) string {
+	uid, _ := s.droneUIDs.Load(id)
+	str, _ := uid.(string)
+	return str
+}
+
+// bindDrone names the new connected drone after its airframe in the inventory
+func (s *Server) bindDrone(ctx context.Context, d drone.Drone) {
+	if _, ok := d.(drone.IdentityAbility); !ok {
+		return
+	}
+	tctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	a, err := s.inventory.Bind(tctx, d)
+	cancel()
+	if a == nil {
+		s.Logf(LevelWarn, "Cannot identify drone %d: %v", d.ID(), err)
+		return
+	}
+	if err != nil {
+		s.ToastAndLog(LevelWarn, "Airframe mismatch", err.Error())
+	} else {
+		s.Logf(LevelInfo, "Drone %d is airframe %s (%s)", d.ID(), a.Name, a.UID)
+	}
+	s.droneUIDs.Store(d.ID(), a.UID)
+	for _, issue := range s.maintenance.Check(a.UID) {
+		s.ToastAndLog(LevelWarn, "Maintenance required", issue.String())
+	}
+	s.BroadcastEvent("drone-identity", &DroneIdentityMsg{
+		Id:       d.ID(),
+		Name:     d.Name(),
+		UID:      a.UID,
+		Airframe: a,
+	})
+}
+
+func (s *Server) routeInventoryGET(rw http.ResponseWriter, req *http.Request) {
+	airframes := s.inventory.Airframes()
+	connected := make(map[string]int)
+	s.droneUIDs.Range(func(id, uid any) bool {
+		connected[uid.(string)] = id.(int)
+		return true
+	})
+	writeJson(rw, http.StatusOK, Map{
+		"airframes": airframes,
+		"connected": connected,
+	})
+}
+
+func (s *Server) routeInventoryPUT(rw http.ResponseWriter, req *http.Request) {
+	var payload fleet.Airframe
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	payload.UID = req.PathValue("uid")
+	if err := s.inventory.Put(&payload); err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: err.Error(),
+		})
+		return
+	}
+	a := s.inventory.Get(payload.UID)
+	s.Logf(LevelInfo, "Airframe %s (%s) updated", a.Name, a.UID)
+	if controller := s.Controller(); controller != nil {
+		for _, d := range controller.Drones() {
+			if s.droneUID(d.ID()) != a.UID {
+				continue
+			}
+			if ia, ok := d.(drone.IdentityAbility); ok {
+				ia.SetName(a.Name)
+			}
+			s.BroadcastEvent("drone-identity", &DroneIdentityMsg{
+				Id:       d.ID(),
+				Name:     d.Name(),
+				UID:      a.UID,
+				Airframe: a,
+			})
+		}
+	}
+	writeJson(rw, http.StatusOK, a)
+}
+
+func (s *Server) routeInventoryDELETE(rw http.ResponseWriter, req *http.Request) {
+	uid := req.PathValue("uid")
+	if s.inventory.Get(uid) == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	if err := s.inventory.Delete(uid); err != nil {
+		writeJson(rw, http.StatusInternalServerError, &APIError{
+			Error:   "SaveError",
+			Message: err.Error(),
+		})
+		return
+	}
+	s.Logf(LevelInfo, "Airframe %s deleted", uid)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// routeInventoryBatteryPOST records the pack installed to the airframe, so its usage is counted to the right pack
+func (s *Server) routeInventoryBatteryPOST(rw http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		Battery string `json:"battery"` // empty means unknown
+	}
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	uid := req.PathValue("uid")
+	if s.inventory.Get(uid) == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	if err := s.inventory.InstallBattery(uid, payload.Battery); err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: err.Error(),
+		})
+		return
+	}
+	s.Logf(LevelInfo, "Airframe %s installed battery %q", uid, payload.Battery)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// routeDroneSysIDPOST changes a drone's system ID and reboots it
+// It responds after the drone reconnected with the new ID and is verified
+func (s *Server) routeDroneSysIDPOST(rw http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		Drone   int   `json:"drone"`
+		SysID   int   `json:"sysid"`
+		Timeout int64 `json:"timeout"` // in ms, default is 60s
+	}
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	controller := s.Controller()
+	if controller == nil {
+		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
+		return
+	}
+	d := controller.GetDrone(payload.Drone)
+	if d == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	timeout := time.Second * 60
+	if payload.Timeout > 0 {
+		timeout = (time.Duration)(payload.Timeout) * time.Millisecond
+	}
+	uid := s.droneUID(d.ID())
+	s.Audit(req, "sysid", "drone %d (%s) -> %d", d.ID(), uid, payload.SysID)
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	nd, err := fleet.ReassignSystemID(ctx, controller, d, payload.SysID)
+	if err != nil {
+		s.Logf(LevelError, "Cannot change system ID of drone %d to %d: %v", d.ID(), payload.SysID, err)
+		writeJson(rw, http.StatusInternalServerError, &APIError{
+			Error:   "ReassignError",
+			Message: err.Error(),
+		})
+		return
+	}
+	if a := s.inventory.Get(uid); a != nil && a.SysID == payload.Drone {
+		a.SysID = payload.SysID
+		if err := s.inventory.Put(a); err != nil {
+			s.Log(LevelError, "Cannot update inventory:", err)
+		}
+	}
+	s.ToastAndLogf(LevelInfo, "System ID changed", "Drone %d is now %d", payload.Drone, nd.ID())
+	writeJson(rw, http.StatusOK, Map{
+		"id":   nd.ID(),
+		"name": nd.Name(),
+	})
+}
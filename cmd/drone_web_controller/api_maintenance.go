@@ -0,0 +1,68 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/zyxkad/drone/ext/fleet"
+)
+
+func (s *Server) buildAPIMaintenanceRoute() {
+	s.route.HandleFunc("GET /api/maintenance", s.routeMaintenanceGET)
+	s.route.HandleFunc("POST /api/maintenance/config", s.routeMaintenanceConfigPOST)
+	s.route.HandleFunc("DELETE /api/maintenance/{kind}/{id}", s.routeMaintenanceDELETE)
+}
+
+func (s *Server) routeMaintenanceGET(rw http.ResponseWriter, req *http.Request) {
+	writeJson(rw, http.StatusOK, Map{
+		"config":    s.maintenance.Config(),
+		"airframes": s.maintenance.Airframes(),
+		"batteries": s.maintenance.Batteries(),
+		"issues":    s.maintenance.Issues(),
+	})
+}
+
+func (s *Server) routeMaintenanceConfigPOST(rw http.ResponseWriter, req *http.Request) {
+	var payload fleet.MaintenanceConfig
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	if err := s.maintenance.SetConfig(payload); err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: err.Error(),
+		})
+		return
+	}
+	s.Log(LevelInfo, "Maintenance thresholds updated")
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// routeMaintenanceDELETE resets the statistics after the airframe is serviced or the battery is replaced
+func (s *Server) routeMaintenanceDELETE(rw http.ResponseWriter, req *http.Request) {
+	kind, id := req.PathValue("kind"), req.PathValue("id")
+	if err := s.maintenance.Reset(kind, id); err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: err.Error(),
+		})
+		return
+	}
+	s.Audit(req, "maintenance-reset", "%s %s", kind, id)
+	rw.WriteHeader(http.StatusNoContent)
+}
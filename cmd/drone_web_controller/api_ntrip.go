@@ -0,0 +1,271 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/zyxkad/drone/ext/rtk"
+)
+
+func (s *Server) buildAPINtripRoute() {
+	s.route.HandleFunc("GET /api/ntrip/caster", s.routeNtripCasterGET)
+	s.route.HandleFunc("POST /api/ntrip/caster", s.routeNtripCasterPOST)
+	s.route.HandleFunc("DELETE /api/ntrip/caster", s.routeNtripCasterDELETE)
+	s.route.HandleFunc("GET /api/ntrip/client", s.routeNtripClientGET)
+	s.route.HandleFunc("POST /api/ntrip/client/position", s.routeNtripClientPositionPOST)
+	s.route.HandleFunc("POST /api/ntrip/sourcetable", s.routeNtripSourcetablePOST)
+}
+
+type NtripUserPayload struct {
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+}
+
+type NtripCasterPayload struct {
+	Address    string             `json:"address"`    // default is ":2101"
+	Mountpoint string             `json:"mountpoint"` // default is "DRONE"
+	Identifier string             `json:"identifier"`
+	Country    string             `json:"country"`
+	Latitude   float64            `json:"latitude"`
+	Longitude  float64            `json:"longitude"`
+	Users      []NtripUserPayload `json:"users"` // no authentication if empty
+}
+
+func (p *NtripCasterPayload) setDefaults() {
+	if p.Address == "" {
+		p.Address = ":2101"
+	}
+	if p.Mountpoint == "" {
+		p.Mountpoint = "DRONE"
+	}
+}
+
+func (s *Server) routeNtripCasterGET(rw http.ResponseWriter, req *http.Request) {
+	s.casterMux.Lock()
+	defer s.casterMux.Unlock()
+	if s.caster == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	cfg := s.casterCfg
+	cfg.Users = make([]NtripUserPayload, len(s.casterCfg.Users))
+	for i, u := range s.casterCfg.Users {
+		cfg.Users[i] = NtripUserPayload{Username: u.Username}
+	}
+	writeJson(rw, http.StatusOK, Map{
+		"config":  cfg,
+		"mounts":  s.caster.Mounts(),
+		"clients": s.caster.Clients(),
+	})
+}
+
+func (s *Server) routeNtripCasterPOST(rw http.ResponseWriter, req *http.Request) {
+	var payload NtripCasterPayload
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	payload.setDefaults()
+	users := make(map[string]string, len(payload.Users))
+	for _, u := range payload.Users {
+		if u.Username == "" || strings.Contains(u.Username, ":") {
+			writeJson(rw, http.StatusBadRequest, APIError{
+				Error:   "InvalidUser",
+				Message: "Username cannot be empty or contain ':'",
+			})
+			return
+		}
+		users[u.Username] = u.Password
+	}
+
+	caster := rtk.NewCaster("drone/" + Version)
+	caster.SetUsers(users)
+	if err := caster.AddMount(s.casterMount(payload)); err != nil {
+		writeJson(rw, http.StatusBadRequest, APIError{
+			Error:   "InvalidMountpoint",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	s.casterMux.Lock()
+	defer s.casterMux.Unlock()
+	if s.casterCancel != nil {
+		s.casterCancel()
+		// wait for the listener to be released, since the new one may use the same address
+		<-s.casterDone
+	}
+	l, err := net.Listen("tcp", payload.Address)
+	if err != nil {
+		s.caster = nil
+		s.casterCancel = nil
+		writeJson(rw, http.StatusInternalServerError, APIError{
+			Error:   "TargetSetupError",
+			Message: err.Error(),
+		})
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	s.caster = caster
+	s.casterCancel = cancel
+	s.casterDone = done
+	s.casterCfg = payload
+	go func() {
+		defer close(done)
+		if err := caster.Serve(ctx, l); err != nil {
+			s.Logf(LevelError, "NTRIP caster closed: %v", err)
+		}
+	}()
+	s.Logf(LevelInfo, "NTRIP caster started at %s/%s", l.Addr(), payload.Mountpoint)
+	s.Audit(req, "ntrip-caster-start", "address %s, mountpoint %s, %d users", payload.Address, payload.Mountpoint, len(users))
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) routeNtripCasterDELETE(rw http.ResponseWriter, req *http.Request) {
+	s.casterMux.Lock()
+	defer s.casterMux.Unlock()
+	if s.caster == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	s.casterCancel()
+	s.caster = nil
+	s.casterCancel = nil
+	s.Audit(req, "ntrip-caster-stop", "caster stopped")
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// routeNtripClientGET returns the status of the NTRIP client used as the RTCM source
+func (s *Server) routeNtripClientGET(rw http.ResponseWriter, req *http.Request) {
+	s.mux.RLock()
+	client := s.ntrip
+	s.mux.RUnlock()
+	if client == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	cfg := client.Config()
+	cfg.Password = ""
+	writeJson(rw, http.StatusOK, Map{
+		"config": cfg,
+		"status": client.Status(),
+	})
+}
+
+type NtripPositionPayload struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+// routeNtripClientPositionPOST updates the rover position uploaded to VRS mountpoints
+func (s *Server) routeNtripClientPositionPOST(rw http.ResponseWriter, req *http.Request) {
+	var payload NtripPositionPayload
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	s.mux.Lock()
+	client := s.ntrip
+	if client != nil && s.rtkCfg.Ntrip != nil {
+		ntrip := *s.rtkCfg.Ntrip
+		ntrip.Latitude, ntrip.Longitude, ntrip.Altitude = payload.Latitude, payload.Longitude, payload.Altitude
+		s.rtkCfg.Ntrip = &ntrip
+	}
+	s.mux.Unlock()
+	if client == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	client.SetPosition(payload.Latitude, payload.Longitude, payload.Altitude)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+type NtripSourcetablePayload struct {
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Version  int    `json:"version"` // default is 2
+}
+
+// routeNtripSourcetablePOST fetches the sourcetable of a remote caster for browsing mountpoints
+func (s *Server) routeNtripSourcetablePOST(rw http.ResponseWriter, req *http.Request) {
+	var payload NtripSourcetablePayload
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	if payload.Server == "" {
+		writeJson(rw, http.StatusBadRequest, APIError{
+			Error:   "BadRequest",
+			Message: "Server address is required",
+		})
+		return
+	}
+	table, err := rtk.FetchSourcetable(req.Context(), rtk.NtripClientConfig{
+		Server:   payload.Server,
+		Username: payload.Username,
+		Password: payload.Password,
+		Version:  payload.Version,
+	})
+	if err != nil {
+		writeJson(rw, http.StatusBadGateway, APIError{
+			Error:   "SourcetableError",
+			Message: err.Error(),
+		})
+		return
+	}
+	writeJson(rw, http.StatusOK, table)
+}
+
+func (s *Server) casterMount(cfg NtripCasterPayload) *rtk.Mountpoint {
+	s.mux.RLock()
+	sateCfg := s.satelliteCfg
+	s.mux.RUnlock()
+	var systems []string
+	if sateCfg.GPS {
+		systems = append(systems, "GPS")
+	}
+	if sateCfg.GLONASS {
+		systems = append(systems, "GLO")
+	}
+	if sateCfg.Galileo {
+		systems = append(systems, "GAL")
+	}
+	if sateCfg.BeiDou {
+		systems = append(systems, "BDS")
+	}
+	return &rtk.Mountpoint{
+		Name:          cfg.Mountpoint,
+		Identifier:    cfg.Identifier,
+		FormatDetails: "1005(5),1077(1),1087(1),1097(1),1127(1),1230(5)",
+		NavSystem:     strings.Join(systems, "+"),
+		Country:       cfg.Country,
+		Latitude:      cfg.Latitude,
+		Longitude:     cfg.Longitude,
+		Source:        s.casterSource,
+	}
+}
+
+// casterSource returns the proxy of the active RTCM source
+func (s *Server) casterSource() *rtk.Proxy {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.rtkProxy
+}
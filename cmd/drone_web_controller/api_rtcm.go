@@ -0,0 +1,150 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-gnss/rtcm/rtcm3"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ardupilot"
+	"github.com/zyxkad/drone/ext/bandwidth"
+	"github.com/zyxkad/drone/ext/rtk"
+)
+
+func (s *Server) buildAPIRTCMRoute() {
+	s.route.HandleFunc("GET /api/rtk/rtcm", s.routeRTCMGET)
+	s.route.HandleFunc("POST /api/rtk/rtcm", s.routeRTCMPOST)
+	s.route.HandleFunc("GET /api/rtk/transcode", s.routeRTCMTranscodeGET)
+	s.route.HandleFunc("POST /api/rtk/transcode", s.routeRTCMTranscodePOST)
+}
+
+type RTCMPolicyPayload struct {
+	// Budget is in bytes per second, 0 follows the rtcm stream of the bandwidth plan, or unlimited
+	Budget float64 `json:"budget"`
+	// Intervals is the min interval in milliseconds of each message number
+	Intervals map[int]int64 `json:"intervals"`
+}
+
+func (s *Server) routeRTCMGET(rw http.ResponseWriter, req *http.Request) {
+	policy := s.rtcmFilter.Policy()
+	payload := RTCMPolicyPayload{
+		Budget:    policy.Budget,
+		Intervals: make(map[int]int64, len(policy.Intervals)),
+	}
+	for num, interval := range policy.Intervals {
+		payload.Intervals[num] = interval.Milliseconds()
+	}
+	writeJson(rw, http.StatusOK, Map{
+		"policy": payload,
+		"budget": s.rtcmFilter.Budget(),
+		"stats":  s.rtcmFilter.Stats(),
+	})
+}
+
+func (s *Server) routeRTCMPOST(rw http.ResponseWriter, req *http.Request) {
+	var payload RTCMPolicyPayload
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	if payload.Budget < 0 {
+		writeJson(rw, http.StatusBadRequest, APIError{
+			Error:   "InvalidBudget",
+			Message: "Budget cannot be negative",
+		})
+		return
+	}
+	policy := rtk.DecimatePolicy{
+		Budget: payload.Budget,
+	}
+	if payload.Intervals == nil {
+		policy.Intervals = rtk.DefaultDecimatePolicy().Intervals
+	} else {
+		policy.Intervals = make(map[int]time.Duration, len(payload.Intervals))
+		for num, interval := range payload.Intervals {
+			policy.Intervals[num] = (time.Duration)(interval) * time.Millisecond
+		}
+	}
+	s.rtcmFilter.SetPolicy(policy)
+	s.updateRTCMBudget()
+	s.Audit(req, "rtcm-policy", "budget %.0f B/s, %d intervals", policy.Budget, len(policy.Intervals))
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) routeRTCMTranscodeGET(rw http.ResponseWriter, req *http.Request) {
+	writeJson(rw, http.StatusOK, Map{
+		"config": s.rtcmCodec.Config(),
+		"stats":  s.rtcmCodec.Stats(),
+	})
+}
+
+func (s *Server) routeRTCMTranscodePOST(rw http.ResponseWriter, req *http.Request) {
+	var payload rtk.TranscodeConfig
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	if payload.MinCNR < 0 || payload.MinElevation < 0 || payload.MinElevation > 90 {
+		writeJson(rw, http.StatusBadRequest, APIError{
+			Error:   "InvalidMask",
+			Message: "C/N0 mask cannot be negative, and elevation mask must be in [0, 90]",
+		})
+		return
+	}
+	s.rtcmCodec.SetConfig(payload)
+	s.Audit(req, "rtcm-transcode", "msm4 %v, min C/N0 %v, min elevation %v", payload.MSM4, payload.MinCNR, payload.MinElevation)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// updateRTCMBudget follows the rtcm stream of the bandwidth plan if the policy does not have a budget
+func (s *Server) updateRTCMBudget() {
+	var budget float64
+	s.bandwidthMux.Lock()
+	if s.bandwidth != nil {
+		if st := s.bandwidth.Plan().Stream(bandwidth.StreamRTCM); st != nil {
+			budget = st.Load
+		}
+	}
+	s.bandwidthMux.Unlock()
+	s.rtcmFilter.SetBudget(budget)
+}
+
+// forwardRTCM transcodes the frame, splits it to fit the MAVLink fragments, and sends it if the policy allows
+func (s *Server) forwardRTCM(ctrl drone.Controller, frame rtcm3.Frame, now time.Time) error {
+	frame, ok := s.rtcmCodec.Transcode(frame)
+	if !ok {
+		return nil
+	}
+	frames, err := rtk.SplitMSM(frame, ardupilot.MaxRTCMLen)
+	if err != nil {
+		return err
+	}
+	size := 0
+	for _, f := range frames {
+		size += (int)(f.Length) + 6
+	}
+	if !s.rtcmFilter.Allow((int)(frame.MessageNumber()), size, now) {
+		return nil
+	}
+	for _, f := range frames {
+		if err := ctrl.BroadcastRTCM(f.Serialize()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/emergency"
+	"github.com/zyxkad/drone/ext/show"
+)
+
+func (s *Server) buildAPISafetyRoute() {
+	s.route.HandleFunc("GET /api/safety", s.routeSafetyGET)
+	s.route.HandleFunc("POST /api/safety", s.routeSafetyPOST)
+	s.route.HandleFunc("DELETE /api/safety", s.routeSafetyDELETE)
+}
+
+type SafetyRulePayload struct {
+	Action  emergency.Action `json:"action"`  // warn, hold, rtl, land or empty to disable
+	Persist int64            `json:"persist"` // In milliseconds
+}
+
+func (p SafetyRulePayload) Config() emergency.RuleConfig {
+	return emergency.RuleConfig{
+		Action:  p.Action,
+		Persist: (time.Duration)(p.Persist) * time.Millisecond,
+	}
+}
+
+type SafetyPayload struct {
+	Interval int64 `json:"interval"` // In milliseconds
+	Recover  int64 `json:"recover"`  // In milliseconds
+
+	Battery           SafetyRulePayload `json:"battery"`
+	BatteryLow        float32           `json:"batteryLow"` // In [0, 1]
+	BatteryHysteresis float32           `json:"batteryHysteresis"`
+
+	Link        SafetyRulePayload `json:"link"`
+	LinkTimeout int64             `json:"linkTimeout"` // In milliseconds
+
+	Fence            SafetyRulePayload `json:"fence"`
+	FencePolygon     []*drone.Gps      `json:"fencePolygon"`
+	FenceMaxAltitude float32           `json:"fenceMaxAltitude"`
+	FenceMargin      float32           `json:"fenceMargin"`
+
+	Error SafetyRulePayload `json:"error"`
+}
+
+func (p *SafetyPayload) Config() emergency.SupervisorConfig {
+	return emergency.SupervisorConfig{
+		Interval:          (time.Duration)(p.Interval) * time.Millisecond,
+		Recover:           (time.Duration)(p.Recover) * time.Millisecond,
+		Battery:           p.Battery.Config(),
+		BatteryLow:        p.BatteryLow,
+		BatteryHysteresis: p.BatteryHysteresis,
+		Link:              p.Link.Config(),
+		LinkTimeout:       (time.Duration)(p.LinkTimeout) * time.Millisecond,
+		Fence:             p.Fence.Config(),
+		FencePolygon:      p.FencePolygon,
+		FenceMaxAltitude:  p.FenceMaxAltitude,
+		FenceMargin:       p.FenceMargin,
+		Error:             p.Error.Config(),
+	}
+}
+
+// maxSafetyEvents is the number of recent events kept for the dashboard
+const maxSafetyEvents = 100
+
+func (s *Server) routeSafetyGET(rw http.ResponseWriter, req *http.Request) {
+	s.safetyMux.Lock()
+	defer s.safetyMux.Unlock()
+	if s.safety == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	writeJson(rw, http.StatusOK, Map{
+		"config": s.safetyCfg,
+		"events": s.safetyEvents,
+	})
+}
+
+func (s *Server) routeSafetyPOST(rw http.ResponseWriter, req *http.Request) {
+	var payload SafetyPayload
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	controller := s.Controller()
+	if controller == nil {
+		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
+		return
+	}
+	cfg := payload.Config()
+	cfg.BeforeAction = s.releaseFromShow
+	supervisor := emergency.NewSupervisor(controller, cfg)
+
+	s.safetyMux.Lock()
+	defer s.safetyMux.Unlock()
+	if s.safetyCancel != nil {
+		s.safetyCancel()
+	}
+	ctx, cancel := context.WithCancel(controller.Context())
+	s.safety = supervisor
+	s.safetyCancel = cancel
+	s.safetyCfg = payload
+	s.safetyEvents = nil
+	go supervisor.Run(ctx)
+	go s.forwardSafetyEvents(ctx, supervisor)
+	s.Audit(req, "safety-start", "battery=%s link=%s fence=%s error=%s",
+		payload.Battery.Action, payload.Link.Action, payload.Fence.Action, payload.Error.Action)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// releaseFromShow stops the running show from overriding the safety action of the drone
+func (s *Server) releaseFromShow(d drone.Drone, action emergency.Action) {
+	executor := s.getShowExecutor()
+	if executor == nil {
+		return
+	}
+	switch executor.State() {
+	case show.StateIdle, show.StateDone, show.StateAborted:
+		return
+	}
+	if executor.Release(d.ID()) {
+		s.Logf(LevelWarn, "Drone %d is released from the show for safety action %s", d.ID(), action)
+	}
+}
+
+func (s *Server) routeSafetyDELETE(rw http.ResponseWriter, req *http.Request) {
+	s.safetyMux.Lock()
+	defer s.safetyMux.Unlock()
+	if s.safety == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	s.safetyCancel()
+	s.safety = nil
+	s.safetyCancel = nil
+	s.Audit(req, "safety-stop", "supervisor stopped")
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) forwardSafetyEvents(ctx context.Context, supervisor *emergency.Supervisor) {
+	for {
+		select {
+		case ev := <-supervisor.Events():
+			s.safetyMux.Lock()
+			if s.safety == supervisor {
+				s.safetyEvents = append(s.safetyEvents, ev)
+				if len(s.safetyEvents) > maxSafetyEvents {
+					s.safetyEvents = s.safetyEvents[len(s.safetyEvents)-maxSafetyEvents:]
+				}
+			}
+			s.safetyMux.Unlock()
+			s.BroadcastEvent("safety", ev)
+			level := LevelWarn
+			if ev.Cleared {
+				level = LevelInfo
+			} else if ev.Error != "" {
+				level = LevelError
+			}
+			s.Log(level, "Safety:", ev)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
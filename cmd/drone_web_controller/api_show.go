@@ -0,0 +1,461 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/artnet"
+	"github.com/zyxkad/drone/ext/show"
+)
+
+func (s *Server) buildAPIShowRoute() {
+	s.route.HandleFunc("POST /api/show/load", s.routeShowLoad)
+	s.route.HandleFunc("GET /api/show/export", s.routeShowExport)
+	s.route.HandleFunc("POST /api/show/validate", s.routeShowValidate)
+	s.route.HandleFunc("POST /api/show/start", s.routeShowStart)
+	s.route.HandleFunc("POST /api/show/pause", s.routeShowPause)
+	s.route.HandleFunc("POST /api/show/resume", s.routeShowResume)
+	s.route.HandleFunc("POST /api/show/abort", s.routeShowAbort)
+	s.route.HandleFunc("GET /api/show/status", s.routeShowStatus)
+	s.route.HandleFunc("GET /api/show/preview", s.routeShowPreview)
+}
+
+func (s *Server) routeShowLoad(rw http.ResponseWriter, req *http.Request) {
+	const maxShowSize = 64 * 1024 * 1024
+	buf, err := io.ReadAll(io.LimitReader(req.Body, maxShowSize))
+	if err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "Cannot read request body",
+			Message: err.Error(),
+		})
+		return
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf), (int64)(len(buf)))
+	if err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "Cannot open show archive",
+			Message: err.Error(),
+		})
+		return
+	}
+	// format is optional, the format will be detected if it's empty
+	loaded, err := show.ReadFormat(req.URL.Query().Get("format"), zr)
+	if err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "Cannot parse show",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	s.showMux.Lock()
+	defer s.showMux.Unlock()
+	if s.showExecutor != nil {
+		switch s.showExecutor.State() {
+		case show.StateIdle, show.StateDone, show.StateAborted:
+		default:
+			writeJson(rw, http.StatusConflict, apiRespTargetIsExist)
+			return
+		}
+	}
+	s.show = loaded
+	s.showExecutor = nil
+	s.Logf(LevelInfo, "Show loaded with %d drones, duration %v", len(loaded.Tracks), loaded.Duration())
+	writeJson(rw, http.StatusOK, Map{
+		"drones":   len(loaded.Tracks),
+		"duration": loaded.Duration().Seconds(),
+	})
+}
+
+func (s *Server) routeShowExport(rw http.ResponseWriter, req *http.Request) {
+	s.showMux.Lock()
+	loaded := s.show
+	s.showMux.Unlock()
+	if loaded == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	var buf bytes.Buffer
+	if err := show.WriteSkyC(&buf, loaded); err != nil {
+		writeJson(rw, http.StatusInternalServerError, &APIError{
+			Error:   "Cannot export show",
+			Message: err.Error(),
+		})
+		return
+	}
+	rw.Header().Set("Content-Type", "application/zip")
+	rw.Header().Set("Content-Disposition", `attachment; filename="show.skyc"`)
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf.Bytes())
+}
+
+func (s *Server) routeShowValidate(rw http.ResponseWriter, req *http.Request) {
+	var payload show.ValidateConfig
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	s.showMux.Lock()
+	loaded := s.show
+	s.showMux.Unlock()
+	if loaded == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	writeJson(rw, http.StatusOK, show.Validate(loaded, payload))
+}
+
+func (s *Server) routeShowStart(rw http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		Origin        drone.Gps    `json:"origin"`
+		Heading       float32      `json:"heading"`
+		Fence         []*drone.Gps `json:"fence"`
+		TakeoffHeight float32      `json:"takeoffHeight"`
+		StartDelay    float64      `json:"startDelay"`
+		BindRadius    float32      `json:"bindRadius"`
+		UseMission    bool         `json:"useMission"`
+		Tolerance     float32      `json:"missionTolerance"`
+		// Clock is optional, the show clock free-runs if it's not set
+		Clock *struct {
+			Source     string  `json:"source"` // "osc" or "artnet"
+			Addr       string  `json:"addr"`
+			OSCAddress string  `json:"oscAddress"`
+			Offset     float64 `json:"offset"` // In seconds
+		} `json:"clock"`
+	}
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	controller := s.Controller()
+	if controller == nil {
+		writeJson(rw, http.StatusConflict, apiRespControllerNotExist)
+		return
+	}
+
+	s.showMux.Lock()
+	defer s.showMux.Unlock()
+	if s.show == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	if s.showExecutor != nil && s.showExecutor.State() != show.StateDone && s.showExecutor.State() != show.StateAborted {
+		writeJson(rw, http.StatusConflict, apiRespTargetIsExist)
+		return
+	}
+	clockCtx, cancelClock := context.WithCancel(context.Background())
+	var clock show.Clock
+	if c := payload.Clock; c != nil {
+		var decoder show.TimecodeDecoder
+		switch c.Source {
+		case "osc":
+			if c.Addr == "" {
+				c.Addr = ":9000"
+			}
+			if c.OSCAddress == "" {
+				c.OSCAddress = "/show/time"
+			}
+			decoder = show.OSCTimeDecoder(c.OSCAddress)
+		case "artnet":
+			if c.Addr == "" {
+				c.Addr = fmt.Sprintf(":%d", artnet.ArtNetPort)
+			}
+			decoder = show.DecodeArtTimeCode
+		default:
+			cancelClock()
+			writeJson(rw, http.StatusBadRequest, &APIError{
+				Error:   "ArgumentError",
+				Message: fmt.Sprintf("Unknown clock source %q", c.Source),
+			})
+			return
+		}
+		tc := show.NewTimecodeClock(show.TimecodeConfig{
+			Offset: (time.Duration)(c.Offset * (float64)(time.Second)),
+		})
+		// the Art-Net port is shared with the DMX input
+		err := s.udp.Listen(clockCtx, c.Addr, func(packet []byte) {
+			if t, ok := decoder(packet); ok {
+				tc.Feed(t, time.Now())
+			}
+		})
+		if err != nil {
+			cancelClock()
+			writeJson(rw, http.StatusInternalServerError, &APIError{
+				Error:   "ShowSetupError",
+				Message: err.Error(),
+			})
+			return
+		}
+		clock = tc
+	}
+	executor, err := show.NewExecutor(controller, s.show, show.Config{
+		Origin:        &payload.Origin,
+		Heading:       payload.Heading,
+		Fence:         payload.Fence,
+		TakeoffHeight: payload.TakeoffHeight,
+		StartDelay:    (time.Duration)(payload.StartDelay * (float64)(time.Second)),
+		Clock:         clock,
+
+		UseMission:       payload.UseMission,
+		MissionTolerance: payload.Tolerance,
+	})
+	if err != nil {
+		cancelClock()
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ShowSetupError",
+			Message: err.Error(),
+		})
+		return
+	}
+	if payload.BindRadius <= 0 {
+		payload.BindRadius = 2
+	}
+	bound, err := executor.BindByHome(payload.BindRadius)
+	if err != nil {
+		cancelClock()
+		writeJson(rw, http.StatusInternalServerError, &APIError{
+			Error:   "ShowSetupError",
+			Message: err.Error(),
+		})
+		return
+	}
+	if bound == 0 {
+		cancelClock()
+		writeJson(rw, http.StatusConflict, &APIError{
+			Error: "NoDroneBound",
+		})
+		return
+	}
+	s.showExecutor = executor
+	go func() {
+		defer cancelClock()
+		s.Logf(LevelWarn, "Show starting with %d drones", bound)
+		if err := executor.Run(context.Background()); err != nil {
+			s.ToastAndLog(LevelError, "Show", "Show stopped:", err)
+			return
+		}
+		s.ToastAndLog(LevelInfo, "Show", "Show finished")
+	}()
+	writeJson(rw, http.StatusOK, Map{
+		"bound": bound,
+	})
+}
+
+func (s *Server) getShowExecutor() *show.Executor {
+	s.showMux.Lock()
+	defer s.showMux.Unlock()
+	return s.showExecutor
+}
+
+func (s *Server) routeShowPause(rw http.ResponseWriter, req *http.Request) {
+	executor := s.getShowExecutor()
+	if executor == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	if err := executor.Pause(); err != nil {
+		writeJson(rw, http.StatusConflict, &APIError{
+			Error:   "ActionFailed",
+			Message: err.Error(),
+		})
+		return
+	}
+	s.Log(LevelWarn, "Show paused")
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) routeShowResume(rw http.ResponseWriter, req *http.Request) {
+	executor := s.getShowExecutor()
+	if executor == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	if err := executor.Resume(); err != nil {
+		writeJson(rw, http.StatusConflict, &APIError{
+			Error:   "ActionFailed",
+			Message: err.Error(),
+		})
+		return
+	}
+	s.Log(LevelWarn, "Show resumed")
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) routeShowAbort(rw http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		Hold bool `json:"hold"`
+	}
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	executor := s.getShowExecutor()
+	if executor == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	mode := show.AbortLand
+	if payload.Hold {
+		mode = show.AbortHold
+	}
+	executor.Abort(mode)
+	s.Logf(LevelWarn, "Show aborted (hold=%v)", payload.Hold)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) routeShowStatus(rw http.ResponseWriter, req *http.Request) {
+	s.showMux.Lock()
+	loaded, executor := s.show, s.showExecutor
+	s.showMux.Unlock()
+	if loaded == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	var data struct {
+		Drones   int        `json:"drones"`
+		Duration float64    `json:"duration"`
+		State    show.State `json:"state"`
+		Time     float64    `json:"time"`
+		Bound    []int      `json:"bound"`
+		// Clock is the state of the external clock, it's null if the clock free-runs
+		Clock *show.TimecodeStat `json:"clock"`
+	}
+	data.Drones = len(loaded.Tracks)
+	data.Duration = loaded.Duration().Seconds()
+	data.State = show.StateIdle
+	data.Bound = make([]int, 0)
+	if executor != nil {
+		data.State = executor.State()
+		data.Time = executor.ShowTime().Seconds()
+		for _, b := range executor.Bindings() {
+			data.Bound = append(data.Bound, b.Drone.ID())
+		}
+		if tc, ok := executor.Config().Clock.(*show.TimecodeClock); ok {
+			stat := tc.Stat()
+			data.Clock = &stat
+		}
+	}
+	writeJson(rw, http.StatusOK, data)
+}
+
+func (s *Server) routeShowPreview(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	parseFloat := func(key string, def float64) (float64, bool) {
+		v := query.Get(key)
+		if v == "" {
+			return def, true
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			writeJson(rw, http.StatusBadRequest, &APIError{
+				Error:   "ArgumentError",
+				Message: fmt.Sprintf("%s: %v", key, err),
+			})
+			return 0, false
+		}
+		return f, true
+	}
+	seconds := func(f float64) time.Duration {
+		return (time.Duration)(f * (float64)(time.Second))
+	}
+
+	s.showMux.Lock()
+	loaded, executor := s.show, s.showExecutor
+	s.showMux.Unlock()
+	if loaded == nil {
+		writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+		return
+	}
+	cfg := show.PreviewConfig{
+		View: (show.View)(query.Get("view")),
+	}
+	if executor != nil {
+		ec := executor.Config()
+		cfg.Origin, cfg.Heading, cfg.Fence = ec.Origin, ec.Heading, ec.Fence
+	}
+	width, ok := parseFloat("width", 0)
+	if !ok {
+		return
+	}
+	height, ok := parseFloat("height", 0)
+	if !ok {
+		return
+	}
+	cfg.Width, cfg.Height = min((int)(width), show.MaxPreviewSize), min((int)(height), show.MaxPreviewSize)
+	previewer, err := show.NewPreviewer(loaded, cfg)
+	if err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if query.Has("gif") {
+		start, ok := parseFloat("start", 0)
+		if !ok {
+			return
+		}
+		end, ok := parseFloat("end", loaded.Duration().Seconds())
+		if !ok {
+			return
+		}
+		step, ok := parseFloat("step", 0.5)
+		if !ok {
+			return
+		}
+		if err := previewer.CheckGIF(seconds(start), seconds(end), seconds(step)); err != nil {
+			writeJson(rw, http.StatusBadRequest, &APIError{
+				Error:   "PreviewError",
+				Message: err.Error(),
+			})
+			return
+		}
+		// the animation may be large, so it is streamed instead of buffered
+		rw.Header().Set("Content-Type", "image/gif")
+		rw.WriteHeader(http.StatusOK)
+		if err := previewer.WriteGIF(rw, seconds(start), seconds(end), seconds(step)); err != nil {
+			s.Logf(LevelWarn, "Cannot write GIF preview: %v", err)
+		}
+		return
+	}
+
+	at, ok := parseFloat("t", 0)
+	if !ok {
+		return
+	}
+	if executor != nil && !query.Has("t") {
+		at = executor.ShowTime().Seconds()
+	}
+	var buf bytes.Buffer
+	if err := previewer.WritePNG(&buf, seconds(at)); err != nil {
+		writeJson(rw, http.StatusInternalServerError, &APIError{
+			Error:   "PreviewError",
+			Message: err.Error(),
+		})
+		return
+	}
+	rw.Header().Set("Content-Type", "image/png")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf.Bytes())
+}
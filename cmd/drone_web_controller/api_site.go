@@ -0,0 +1,164 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/zyxkad/drone/ext/rtk"
+)
+
+func (s *Server) buildAPISiteRoute() {
+	s.route.HandleFunc("GET /api/rtk/sites", s.routeSitesGET)
+	s.route.HandleFunc("POST /api/rtk/sites/select", s.routeSitesSelectPOST)
+	s.route.HandleFunc("PUT /api/rtk/site/{name}", s.routeSitePUT)
+	s.route.HandleFunc("DELETE /api/rtk/site/{name}", s.routeSiteDELETE)
+}
+
+func (s *Server) routeSitesGET(rw http.ResponseWriter, req *http.Request) {
+	var selected string
+	if site := s.sites.Selected(); site != nil {
+		selected = site.Name
+	}
+	s.mux.RLock()
+	active, survey := s.rtkSite, s.rtkSurvey
+	s.mux.RUnlock()
+	writeJson(rw, http.StatusOK, Map{
+		"sites":    s.sites.Sites(),
+		"selected": selected,
+		"active":   active,
+		"survey":   survey,
+	})
+}
+
+type SitePayload struct {
+	ECEF     *rtk.ECEF `json:"ecef,omitempty"`
+	LLA      *rtk.LLA  `json:"lla,omitempty"`
+	Accuracy float64   `json:"accuracy"` // in meters
+	// FromSurvey saves the last survey-in result, the position fields are ignored
+	FromSurvey bool `json:"fromSurvey"`
+}
+
+func (s *Server) routeSitePUT(rw http.ResponseWriter, req *http.Request) {
+	var payload SitePayload
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	site := &rtk.Site{
+		Name:     req.PathValue("name"),
+		Accuracy: payload.Accuracy,
+	}
+	switch {
+	case payload.FromSurvey:
+		s.mux.RLock()
+		survey := s.rtkSurvey
+		s.mux.RUnlock()
+		if survey == nil {
+			writeJson(rw, http.StatusNotFound, &APIError{
+				Error:   "SurveyNotFinished",
+				Message: "No survey-in result is available",
+			})
+			return
+		}
+		c := *survey
+		c.Name = site.Name
+		site = &c
+	case payload.ECEF != nil:
+		site.ECEF = *payload.ECEF
+	case payload.LLA != nil:
+		site.ECEF = payload.LLA.ECEF()
+	default:
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: "Either ecef, lla or fromSurvey is required",
+		})
+		return
+	}
+	if site.Accuracy <= 0 {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: "Accuracy must be positive",
+		})
+		return
+	}
+	if err := s.sites.Put(site); err != nil {
+		writeJson(rw, http.StatusBadRequest, &APIError{
+			Error:   "ArgumentError",
+			Message: err.Error(),
+		})
+		return
+	}
+	s.Audit(req, "rtk-site-put", "site %s, ECEF %.4f %.4f %.4f, accuracy %.4fm", site.Name, site.ECEF.X, site.ECEF.Y, site.ECEF.Z, site.Accuracy)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) routeSiteDELETE(rw http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	if err := s.sites.Delete(name); err != nil {
+		if errors.Is(err, rtk.ErrSiteNotFound) {
+			writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+			return
+		}
+		writeJson(rw, http.StatusInternalServerError, &APIError{
+			Error:   "SaveError",
+			Message: err.Error(),
+		})
+		return
+	}
+	s.Audit(req, "rtk-site-delete", "site %s", name)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// routeSitesSelectPOST selects the site for the base station, and fixes a connected serial base at it
+func (s *Server) routeSitesSelectPOST(rw http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		Name string `json:"name"` // empty clears the selection
+	}
+	if !parseRequestBody(rw, req, &payload) {
+		return
+	}
+	if err := s.sites.Select(payload.Name); err != nil {
+		if errors.Is(err, rtk.ErrSiteNotFound) {
+			writeJson(rw, http.StatusNotFound, apiRespTargetNotExist)
+			return
+		}
+		writeJson(rw, http.StatusInternalServerError, &APIError{
+			Error:   "SaveError",
+			Message: err.Error(),
+		})
+		return
+	}
+	site := s.sites.Selected()
+	s.mux.Lock()
+	r := s.rtk
+	if site == nil {
+		// the base keeps its position until it reconnects
+		s.rtkSite = nil
+		r = nil
+	} else if r != nil && !s.rtkCfg.SurveyIn {
+		s.rtkSite = site
+	} else {
+		r = nil
+	}
+	s.mux.Unlock()
+	if r != nil {
+		go s.applyRTKSite(r, site)
+	}
+	s.Audit(req, "rtk-site-select", "site %q", payload.Name)
+	rw.WriteHeader(http.StatusNoContent)
+}
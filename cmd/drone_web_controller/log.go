@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"time"
@@ -118,6 +119,17 @@ func (s *Server) ToastAndLogf(level LogLevel, title string, format string, args
 	})
 }
 
+var auditLogger *log.Logger
+
+// Audit logs an operation which affects the flight safety, it is also written to the audit log file
+func (s *Server) Audit(req *http.Request, action string, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if auditLogger != nil {
+		auditLogger.Printf("%s %s: %s", req.RemoteAddr, action, msg)
+	}
+	s.Logf(LevelWarn, "[AUDIT] %s from %s: %s", action, req.RemoteAddr, msg)
+}
+
 func initGlobalLogger() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
 	logWriters := []io.Writer{os.Stderr}
@@ -129,6 +141,12 @@ func initGlobalLogger() {
 	if logFileErr != nil {
 		log.Println("Error when opening log file:", logFileErr)
 	}
+	auditFile, err := os.OpenFile(filepath.Join(logsDir, "audit.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Println("Error when opening audit log file:", err)
+	} else {
+		auditLogger = log.New(auditFile, "", log.Ldate|log.Ltime|log.Lmicroseconds)
+	}
 }
 
 func openLogFile(dir string) (fd *os.File, err error) {
@@ -29,10 +29,12 @@ var (
 
 var (
 	logsDir = "logs"
+	dataDir = "data"
 )
 
 func parseFlags() {
 	flag.StringVar(&addr, "addr", addr, "The address the http server going to listen on")
+	flag.StringVar(&dataDir, "data", dataDir, "The directory to store persistent data such as drone groups and inventory")
 	flag.Parse()
 }
 
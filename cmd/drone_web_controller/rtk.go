@@ -25,6 +25,7 @@ import (
 	"github.com/go-gnss/rtcm/rtcm3"
 
 	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/rtk"
 )
 
 type RTKStatus string
@@ -36,8 +37,10 @@ const (
 	RtkOK       RTKStatus = "OK"
 )
 
-func (s *Server) runRTKServer(rtk *drone.RTK, closeSig <-chan struct{}, network string, addr string) {
-	p := rtk.GetProxy()
+// ntripStallTimeout is how long without corrections before the NTRIP stream is no longer OK
+const ntripStallTimeout = time.Second * 5
+
+func (s *Server) runRTKServer(p *rtk.Proxy, closeSig <-chan struct{}, network string, addr string) {
 	l, err := net.Listen(network, addr)
 	if err != nil {
 		s.Logf(LevelError, "Failed to start RTK server: %v", err)
@@ -58,30 +61,57 @@ func (s *Server) runRTKServer(rtk *drone.RTK, closeSig <-chan struct{}, network
 	}
 }
 
-func (s *Server) processRTKConnect(rtk *drone.RTK, closeSig <-chan struct{}) {
-	for version := range rtk.ConnectSignal() {
-		for version != rtk.StatusVersion() {
+func (s *Server) processRTKConnect(r *drone.RTK, closeSig <-chan struct{}) {
+	for version := range r.ConnectSignal() {
+		for version != r.StatusVersion() {
 			select {
-			case version = <-rtk.ConnectSignal():
+			case version = <-r.ConnectSignal():
 			default:
-				version = rtk.StatusVersion()
+				version = r.StatusVersion()
 			}
 		}
 		if version%2 == 1 {
-			if s.rtkCfg.SurveyIn {
-				rtk.StartSurveyIn(time.Second*(time.Duration)(s.rtkCfg.MinDuration), s.rtkCfg.AccuracyLimit)
+			if err := r.EnableSatelliteReport(5); err != nil {
+				s.Log(LevelWarn, "Cannot enable RTK satellite report:", err)
+			}
+			s.mux.RLock()
+			site := s.rtkSite
+			s.mux.RUnlock()
+			if site != nil {
+				s.applyRTKSite(r, site)
+			} else if s.rtkCfg.SurveyIn {
+				r.StartSurveyIn(time.Second*(time.Duration)(s.rtkCfg.MinDuration), s.rtkCfg.AccuracyLimit)
 			}
 		}
 	}
 }
 
-func (s *Server) processRTKUBX(rtk *drone.RTK, closeSig <-chan struct{}) {
-	c := rtk.GetProxy().NewConn()
+// applyRTKSite fixes the base at the site, and activates RTCM without waiting for survey-in
+func (s *Server) applyRTKSite(r *drone.RTK, site *rtk.Site) {
+	status := RtkOK
+	if err := r.SetFixedPosition(site.ECEF, site.Accuracy); err != nil {
+		status = RtkNone
+		s.ToastAndLog(LevelError, "RTK Status", "Cannot set fixed position:", err)
+	} else if err := r.ActivateRTCM(s.satelliteCfg); err != nil {
+		status = RtkReady
+		s.ToastAndLog(LevelError, "RTK Status", "Cannot activate RTCM:", err)
+	} else {
+		s.ToastAndLogf(LevelInfo, "RTK Status", "RTCM activated at site %s", site.Name)
+	}
+	s.mux.Lock()
+	s.rtkStatus = status
+	s.mux.Unlock()
+}
+
+func (s *Server) processRTKUBX(r *drone.RTK, closeSig <-chan struct{}) {
+	c := r.GetProxy().NewConn()
 	defer c.Close()
 	for {
 		select {
 		case msg := <-c.UBXMessages():
 			switch msg := msg.(type) {
+			case *ubx.NavSat:
+				s.satElevation.UpdateNavSat(msg, time.Now())
 			case *ubx.NavSvin:
 				type SurveyInMsg struct {
 					Dur    uint32  `json:"dur"`
@@ -98,8 +128,9 @@ func (s *Server) processRTKUBX(rtk *drone.RTK, closeSig <-chan struct{}) {
 				})
 				var status RTKStatus
 				if msg.Valid == 1 && msg.Active == 0 && s.rtkCfg.SurveyIn {
+					s.saveRTKSurvey(msg)
 					s.Log(LevelWarn, "RTCM ready, activating ...")
-					if err := rtk.ActivateRTCM(s.satelliteCfg); err != nil {
+					if err := r.ActivateRTCM(s.satelliteCfg); err != nil {
 						status = RtkReady
 						s.ToastAndLog(LevelError, "RTK Status", "Cannot activate RTCM:", err)
 					} else {
@@ -121,19 +152,43 @@ func (s *Server) processRTKUBX(rtk *drone.RTK, closeSig <-chan struct{}) {
 	}
 }
 
+// saveRTKSurvey keeps the survey-in result, and saves it to the configured site
+func (s *Server) saveRTKSurvey(msg *ubx.NavSvin) {
+	survey := rtk.SiteFromSurvey(s.rtkCfg.Site, msg, time.Now())
+	s.mux.Lock()
+	last := s.rtkSurvey
+	s.rtkSurvey = survey
+	s.mux.Unlock()
+	if survey.Name == "" || last != nil && last.ECEF == survey.ECEF {
+		return
+	}
+	if err := s.sites.Put(survey); err != nil {
+		s.Logf(LevelError, "Cannot save survey-in result to site %s: %v", survey.Name, err)
+		return
+	}
+	s.Logf(LevelInfo, "Survey-in result saved to site %s, accuracy %.3fm", survey.Name, survey.Accuracy)
+}
+
 type msmData struct {
 	when time.Time
 	msm7 *rtcm3.MessageMsm7
 }
 
-func (s *Server) broadcastRTKRTCM(rtk *drone.RTK, closeSig <-chan struct{}) {
+func (s *Server) broadcastRTKRTCM(p *rtk.Proxy, closeSig <-chan struct{}) {
 	defer func() {
 		s.mux.Lock()
 		defer s.mux.Unlock()
 		s.rtkStatus = RtkNone
 	}()
-	c := rtk.GetProxy().NewConn()
+	c := p.NewConn()
 	defer c.Close()
+	s.mux.RLock()
+	ntrip := s.ntrip
+	s.mux.RUnlock()
+	var (
+		ntripReceived uint64
+		ntripRecvAt   time.Time
+	)
 
 	sateNum2name := []struct {
 		num  int
@@ -229,12 +284,30 @@ func (s *Server) broadcastRTKRTCM(rtk *drone.RTK, closeSig <-chan struct{}) {
 			}
 			if forward {
 				if ctrl := s.Controller(); ctrl != nil {
-					if e := ctrl.BroadcastRTCM(frame.Serialize()); e != nil {
+					if e := s.forwardRTCM(ctrl, frame.Frame, now); e != nil {
 						s.Log(LevelError, "Error when broadcasting RTCM:", e)
 					}
 				}
 			}
-		case <-updateTicker.C:
+		case now := <-updateTicker.C:
+			if ntrip != nil {
+				st := ntrip.Status()
+				if st.Received != ntripReceived {
+					ntripReceived, ntripRecvAt = st.Received, now
+				}
+				status := RtkNone
+				if st.Connected {
+					// corrections from a caster are ready to use once they are flowing
+					status = RtkReady
+					if now.Sub(ntripRecvAt) < ntripStallTimeout {
+						status = RtkOK
+					}
+				}
+				s.mux.Lock()
+				s.rtkStatus = status
+				s.mux.Unlock()
+			}
+			s.updateRTCMBudget()
 			go broadcastRtkStatus()
 		case <-closeSig:
 			return
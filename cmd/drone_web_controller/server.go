@@ -18,7 +18,9 @@ package main
 
 import (
 	"context"
+	"log"
 	"net/http"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -27,7 +29,13 @@ import (
 	"github.com/gorilla/websocket"
 
 	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/artnet"
+	"github.com/zyxkad/drone/ext/bandwidth"
 	"github.com/zyxkad/drone/ext/director"
+	"github.com/zyxkad/drone/ext/emergency"
+	"github.com/zyxkad/drone/ext/fleet"
+	"github.com/zyxkad/drone/ext/rtk"
+	"github.com/zyxkad/drone/ext/show"
 )
 
 type Server struct {
@@ -36,12 +44,20 @@ type Server struct {
 	controller drone.Controller
 
 	rtk          *drone.RTK
+	ntrip        *rtk.NtripClient
+	rtkProxy     *rtk.Proxy // the active RTCM source, either serial base or NTRIP mountpoint
 	rtkCfg       RTKCfgPayload
 	rtkStatus    RTKStatus
 	rtkSvinDur   uint32
 	rtkSvinAcc   float32
 	satelliteCfg drone.SatelliteCfg
 	rtkClosed    chan struct{}
+	rtcmFilter   *rtk.Decimator
+	rtcmCodec    *rtk.Transcoder
+	satElevation *rtk.ElevationTable
+	sites        *rtk.SiteStore
+	rtkSite      *rtk.Site // the fixed position in use, nil when surveying in
+	rtkSurvey    *rtk.Site // the last finished survey-in result
 
 	directorMux          sync.Mutex
 	director             atomic.Pointer[director.Director]
@@ -54,6 +70,43 @@ type Server struct {
 	directorCheckPassed  atomic.Bool
 	directorLastLog      atomic.Pointer[string]
 
+	showMux      sync.Mutex
+	show         *show.Show
+	showExecutor *show.Executor
+
+	artnetMux    sync.Mutex
+	artnet       *artnet.Listener
+	artnetCancel context.CancelFunc
+
+	udp udpHub
+
+	emergencyMux     sync.Mutex
+	rtlPlan          *emergency.RTLPlan
+	rtlCancel        context.CancelFunc
+	terminateConfirm *terminateConfirm
+
+	safetyMux    sync.Mutex
+	safety       *emergency.Supervisor
+	safetyCancel context.CancelFunc
+	safetyCfg    SafetyPayload
+	safetyEvents []*emergency.SafetyEvent
+
+	bandwidthMux    sync.Mutex
+	bandwidth       *bandwidth.Manager
+	bandwidthCancel context.CancelFunc
+	bandwidthCfg    BandwidthPayload
+
+	casterMux    sync.Mutex
+	caster       *rtk.Caster
+	casterCancel context.CancelFunc
+	casterDone   chan struct{}
+	casterCfg    NtripCasterPayload
+
+	groups      *fleet.GroupStore
+	inventory   *fleet.Inventory
+	maintenance *fleet.Maintenance
+	droneUIDs   sync.Map // drone ID -> board UID
+
 	sockets []*aws.WebSocket
 
 	route    *http.ServeMux
@@ -64,6 +117,7 @@ func NewServer() *Server {
 	s := &Server{
 		rtkStatus:    RtkNone,
 		satelliteCfg: drone.SatelliteAll,
+		rtcmFilter:   rtk.NewDecimator(rtk.DefaultDecimatePolicy()),
 		route:        http.NewServeMux(),
 		upgrader: &aws.Upgrader{
 			Upgrader: &websocket.Upgrader{
@@ -74,6 +128,32 @@ func NewServer() *Server {
 			MaxBatchTimeout: time.Millisecond * 100,
 		},
 	}
+	s.satElevation = rtk.NewElevationTable()
+	s.rtcmCodec = rtk.NewTranscoder(rtk.TranscodeConfig{}, s.satElevation.Elevation)
+	groups, err := fleet.OpenGroupStore(filepath.Join(dataDir, "groups.json"))
+	if err != nil {
+		log.Println("Error when loading drone groups:", err)
+		groups, _ = fleet.OpenGroupStore("")
+	}
+	s.groups = groups
+	inventory, err := fleet.OpenInventory(filepath.Join(dataDir, "inventory.json"))
+	if err != nil {
+		log.Println("Error when loading drone inventory:", err)
+		inventory, _ = fleet.OpenInventory("")
+	}
+	s.inventory = inventory
+	maintenance, err := fleet.OpenMaintenance(filepath.Join(dataDir, "maintenance.json"), inventory)
+	if err != nil {
+		log.Println("Error when loading maintenance statistics:", err)
+		maintenance, _ = fleet.OpenMaintenance("", inventory)
+	}
+	s.maintenance = maintenance
+	sites, err := rtk.OpenSiteStore(filepath.Join(dataDir, "rtk_sites.json"))
+	if err != nil {
+		log.Println("Error when loading RTK sites:", err)
+		sites, _ = rtk.OpenSiteStore("")
+	}
+	s.sites = sites
 	s.buildRoute()
 	return s
 }
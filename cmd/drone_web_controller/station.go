@@ -18,6 +18,7 @@ package main
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/LiterMC/go-aws"
@@ -47,11 +48,16 @@ type DronePingMsg struct {
 	BootTime     int64 `json:"bootTime"`
 	Ping         int64 `json:"ping"`
 	LastActivate int64 `json:"lastActivate"`
+
+	Clock *drone.ClockEstimate `json:"clock,omitempty"`
+	Link  *drone.LinkStats     `json:"link,omitempty"`
 }
 
 func (s *Server) sendDroneList(ws *aws.WebSocket) error {
 	type DroneInfo struct {
 		Id           int                `json:"id"`
+		Name         string             `json:"name"`
+		UID          string             `json:"uid,omitempty"`
 		Status       drone.DroneStatus  `json:"status"`
 		Mode         int                `json:"mode"`
 		Battery      *drone.BatteryStat `json:"battery"`
@@ -73,6 +79,8 @@ func (s *Server) sendDroneList(ws *aws.WebSocket) error {
 	for i, d := range drones {
 		droneList[i] = &DroneInfo{
 			Id:           d.ID(),
+			Name:         d.Name(),
+			UID:          s.droneUID(d.ID()),
 			Status:       d.GetStatus(),
 			Mode:         d.GetMode(),
 			Battery:      d.GetBattery(),
@@ -120,18 +128,32 @@ func (s *Server) pollStation(station drone.Controller, eventCh <-chan drone.Even
 				}
 				ctx, cancel := context.WithCancel(ctx)
 				pingTickers[d.ID()] = cancel
+				go s.bindDrone(ctx, d)
 				go func(ctx context.Context, d drone.Drone) {
 					ticker := time.NewTicker(time.Millisecond * 800)
 					defer ticker.Stop()
 					for i := 0; ; i++ {
 						select {
 						case <-ticker.C:
-							s.BroadcastEvent("drone-ping", &DronePingMsg{
+							msg := &DronePingMsg{
 								Id:           d.ID(),
 								BootTime:     d.GetBootTime().UnixMilli(),
 								Ping:         d.GetPing().Microseconds(),
 								LastActivate: d.LastActivate().UnixMilli(),
-							})
+							}
+							if ca, ok := d.(drone.ClockAbility); ok && ca.GetClock().Ready() {
+								est := ca.GetClock().Estimate()
+								msg.Clock = &est
+							}
+							if la, ok := d.(drone.LinkAbility); ok {
+								msg.Link = la.GetLinkStats()
+							}
+							s.BroadcastEvent("drone-ping", msg)
+							if uid := s.droneUID(d.ID()); uid != "" {
+								if err := s.maintenance.Sample(uid, d, time.Now()); err != nil {
+									s.Log(LevelError, "Cannot save maintenance statistics:", err)
+								}
+							}
 							if i%13 == 0 {
 								tctx, cancel := context.WithTimeout(ctx, time.Second*3)
 								d.Ping(tctx)
@@ -146,6 +168,10 @@ func (s *Server) pollStation(station drone.Controller, eventCh <-chan drone.Even
 				d := event.Drone
 				s.BroadcastEvent("drone-disconnected", d.ID())
 				s.Log(LevelWarn, "Drone", d.ID(), "disconnected")
+				s.droneUIDs.Delete(d.ID())
+				if err := s.maintenance.Flush(); err != nil {
+					s.Log(LevelError, "Cannot save maintenance statistics:", err)
+				}
 				if cancel, ok := pingTickers[d.ID()]; ok {
 					delete(pingTickers, d.ID())
 					cancel()
@@ -168,6 +194,12 @@ func (s *Server) pollStation(station drone.Controller, eventCh <-chan drone.Even
 					GPS:     event.GPS,
 					Rotate:  event.Rotate,
 				})
+			case *drone.EventDroneDuplicated:
+				s.BroadcastEvent("drone-duplicated", Map{
+					"id":      event.Drone.ID(),
+					"reasons": event.Reasons,
+				})
+				s.ToastAndLogf(LevelError, "Duplicated system ID", "Drone %d is used by more than one vehicle: %s", event.Drone.ID(), strings.Join(event.Reasons, "; "))
 			case *drone.EventDroneStatusText:
 				lvl := LevelError
 				if event.Severity == 4 {
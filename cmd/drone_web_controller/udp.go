@@ -0,0 +1,114 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// udpHub shares a UDP socket between the handlers listening the same address,
+// such as Art-Net DMX and Art-Net timecode, which are both sent to port 6454
+// Each handler picks its own packets, for Art-Net it's decided by the OpCode
+type udpHub struct {
+	mux     sync.Mutex
+	sockets map[string]*udpSocket
+}
+
+type udpSocket struct {
+	conn     net.PacketConn
+	handlers map[*udpHandler]struct{}
+}
+
+type udpHandler struct {
+	handle func(packet []byte)
+}
+
+// Listen calls handle with the packets received on the address until ctx is done
+// The packet is only valid during the call
+func (h *udpHub) Listen(ctx context.Context, addr string, handle func(packet []byte)) error {
+	uaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	if uaddr.IP.IsUnspecified() {
+		uaddr.IP = nil
+	}
+	key := uaddr.String()
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.sockets == nil {
+		h.sockets = make(map[string]*udpSocket)
+	}
+	sock := h.sockets[key]
+	if sock == nil {
+		conn, err := net.ListenUDP("udp", uaddr)
+		if err != nil {
+			return err
+		}
+		sock = &udpSocket{
+			conn:     conn,
+			handlers: make(map[*udpHandler]struct{}),
+		}
+		h.sockets[key] = sock
+		go h.serve(key, sock)
+	}
+	hd := &udpHandler{handle: handle}
+	sock.handlers[hd] = struct{}{}
+	context.AfterFunc(ctx, func() {
+		h.mux.Lock()
+		defer h.mux.Unlock()
+		delete(sock.handlers, hd)
+		if len(sock.handlers) == 0 {
+			h.closeSocket(key, sock)
+		}
+	})
+	return nil
+}
+
+// closeSocket closes the socket, the caller must hold the lock
+func (h *udpHub) closeSocket(key string, sock *udpSocket) {
+	sock.conn.Close()
+	if h.sockets[key] == sock {
+		delete(h.sockets, key)
+	}
+}
+
+func (h *udpHub) serve(key string, sock *udpSocket) {
+	buf := make([]byte, 1500)
+	var handlers []*udpHandler
+	for {
+		n, _, err := sock.conn.ReadFrom(buf)
+		if err != nil {
+			h.mux.Lock()
+			h.closeSocket(key, sock)
+			h.mux.Unlock()
+			return
+		}
+		h.mux.Lock()
+		handlers = handlers[:0]
+		for hd := range sock.handlers {
+			handlers = append(handlers, hd)
+		}
+		h.mux.Unlock()
+		for _, hd := range handlers {
+			hd.handle(buf[:n])
+		}
+	}
+}
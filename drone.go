@@ -82,10 +82,49 @@ type (
 		DisableFence(ctx context.Context) error
 	}
 
+	// TimedMissionAbility uploads missions which control the speed and hold time of each waypoint
+	TimedMissionAbility interface {
+		// SetTimedMission clear the old mission and push new waypoints
+		// The mission may contain extra items, so use StartMission(ctx, 0, 0) to run the whole mission
+		SetTimedMission(ctx context.Context, items []*MissionItem) error
+	}
+
+	// ClockAbility estimates the drone's clock, so commands can be scheduled at a station time
+	ClockAbility interface {
+		// GetClock returns the estimator of the time since the drone boots
+		GetClock() *ClockEstimator
+	}
+
 	CommandAbility interface {
 		ExecuteCommand(ctx context.Context, cmd int, args ...float32) error
 	}
 
+	// MessageIntervalAbility changes how often the drone sends a message
+	MessageIntervalAbility interface {
+		// UpdateMessageInterval requests the message every dur, a negative dur disables the message
+		UpdateMessageInterval(ctx context.Context, id uint32, dur time.Duration) error
+	}
+
+	// LinkAbility reports the quality of the link to the drone
+	LinkAbility interface {
+		GetLinkStats() *LinkStats
+	}
+
+	// IdentityAbility identifies the physical drone behind the system ID
+	IdentityAbility interface {
+		// UID returns the unique ID of the flight controller board, it's requested if not received yet
+		UID(ctx context.Context) (string, error)
+		// SetName sets the name returned by Name
+		SetName(name string)
+	}
+
+	// ParamAbility reads and writes the drone's onboard parameters
+	ParamAbility interface {
+		GetParam(ctx context.Context, name string) (float32, error)
+		// SetParam writes the parameter and verifies the value echoed by the drone
+		SetParam(ctx context.Context, name string, value float32) error
+	}
+
 	LEDAbility interface {
 		GetLED() Color
 		ActiveLED(ctx context.Context, color Color, dur time.Duration) error
@@ -97,3 +136,12 @@ type (
 		Buzz(ctx context.Context, format string, data []byte) error
 	}
 )
+
+// MissionItem is a waypoint of a timed mission
+type MissionItem struct {
+	Pos *Gps `json:"pos"`
+	// Speed is the ground speed towards Pos in m/s, zero means unchanged
+	Speed float32 `json:"speed"`
+	// Delay is the time the drone holds at Pos after reached
+	Delay Duration `json:"delay"`
+}
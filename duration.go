@@ -0,0 +1,51 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package drone
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Duration is a time.Duration which is encoded in JSON as milliseconds
+// All durations of the API use it, so clients only need to deal with one unit
+// Sub-millisecond parts are kept as the fraction
+type Duration time.Duration
+
+var (
+	_ json.Marshaler   = (Duration)(0)
+	_ json.Unmarshaler = (*Duration)(nil)
+)
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return strconv.AppendFloat(nil, (float64)(d)/(float64)(time.Millisecond), 'f', -1, 64), nil
+}
+
+func (d *Duration) UnmarshalJSON(buf []byte) error {
+	var ms float64
+	if err := json.Unmarshal(buf, &ms); err != nil {
+		return err
+	}
+	*d = (Duration)(math.Round(ms * (float64)(time.Millisecond)))
+	return nil
+}
+
+func (d Duration) String() string {
+	return (time.Duration)(d).String()
+}
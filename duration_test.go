@@ -0,0 +1,53 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package drone_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/zyxkad/drone"
+)
+
+func TestDurationJSON(t *testing.T) {
+	cases := []struct {
+		d    time.Duration
+		json string
+	}{
+		{0, "0"},
+		{time.Second * 8, "8000"},
+		{time.Microsecond * 1250, "1.25"},
+		{-time.Millisecond * 3, "-3"},
+	}
+	for _, c := range cases {
+		data, err := json.Marshal((drone.Duration)(c.d))
+		if err != nil {
+			t.Fatalf("Marshal %v: %v", c.d, err)
+		}
+		if (string)(data) != c.json {
+			t.Errorf("Marshal %v = %s, want %s", c.d, data, c.json)
+		}
+		var d drone.Duration
+		if err := json.Unmarshal(data, &d); err != nil {
+			t.Fatalf("Unmarshal %s: %v", data, err)
+		}
+		if (time.Duration)(d) != c.d {
+			t.Errorf("Unmarshal %s = %v, want %v", data, d, c.d)
+		}
+	}
+}
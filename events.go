@@ -128,3 +128,18 @@ func (*EventDroneStatusText) GetType() string {
 func (e *EventDroneStatusText) String() string {
 	return fmt.Sprintf("<EventDroneStatusText drone=%s message=%q>", e.Drone, e.Message)
 }
+
+// EventDroneDuplicated is sent when more than one vehicle seems to use the same system ID
+type EventDroneDuplicated struct {
+	Drone Drone
+	// Reasons are the evidences of the duplication, such as conflicting heartbeats
+	Reasons []string
+}
+
+func (*EventDroneDuplicated) GetType() string {
+	return "DRONE_DUPLICATED"
+}
+
+func (e *EventDroneDuplicated) String() string {
+	return fmt.Sprintf("<EventDroneDuplicated drone=%s reasons=%q>", e.Drone, e.Reasons)
+}
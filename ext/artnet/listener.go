@@ -0,0 +1,319 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package artnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zyxkad/drone"
+)
+
+// PatchEntry maps three channels of a universe to a drone's LED as red, green and blue
+type PatchEntry struct {
+	Drone    int    `json:"drone"`
+	Universe uint16 `json:"universe"`
+	Channel  int    `json:"channel"` // the red channel, starts from 1
+}
+
+type Patch []PatchEntry
+
+// LinearPatch patches count drones with continuous IDs from firstDrone
+// Each drone takes three channels, a drone which does not fit in the universe is patched to the next universe
+func LinearPatch(firstDrone, count int, universe uint16, channel int) Patch {
+	patch := make(Patch, count)
+	for i := range count {
+		if channel+2 > 512 {
+			universe++
+			channel = 1
+		}
+		patch[i] = PatchEntry{
+			Drone:    firstDrone + i,
+			Universe: universe,
+			Channel:  channel,
+		}
+		channel += 3
+	}
+	return patch
+}
+
+func (p Patch) Validate() error {
+	if len(p) == 0 {
+		return errors.New("Patch is empty")
+	}
+	seen := make(map[int]struct{}, len(p))
+	for _, e := range p {
+		if e.Channel < 1 || e.Channel+2 > 512 {
+			return fmt.Errorf("Drone %d: channel %d out of range [1, 510]", e.Drone, e.Channel)
+		}
+		if _, ok := seen[e.Drone]; ok {
+			return fmt.Errorf("Drone %d is patched more than once", e.Drone)
+		}
+		seen[e.Drone] = struct{}{}
+	}
+	return nil
+}
+
+// Universes returns the patched universes
+func (p Patch) Universes() []uint16 {
+	var universes []uint16
+	for _, e := range p {
+		if !slices.Contains(universes, e.Universe) {
+			universes = append(universes, e.Universe)
+		}
+	}
+	return universes
+}
+
+type Config struct {
+	Patch Patch
+	// MinInterval is the min time between two LED updates of the same drone
+	MinInterval time.Duration
+	// MaxRate is the max LED updates per second of all drones, to not saturate the link
+	MaxRate float64
+	// Hold is the duration passed to ActiveLED, the color is refreshed before it expires
+	Hold time.Duration
+}
+
+func (c *Config) setDefaults() {
+	if c.MinInterval <= 0 {
+		c.MinInterval = time.Millisecond * 200
+	}
+	if c.MaxRate <= 0 {
+		c.MaxRate = 50
+	}
+	if c.Hold <= 0 {
+		c.Hold = time.Second * 10
+	}
+}
+
+type droneLED struct {
+	want     drone.Color
+	sent     drone.Color
+	valid    bool // whether want is received
+	lastSent time.Time
+}
+
+// Listener receives DMX from Art-Net or sACN and pushes the colors to the drones' LED
+type Listener struct {
+	controller drone.Controller
+	cfg        Config
+	universes  map[uint16][]PatchEntry
+
+	mux  sync.Mutex
+	leds map[int]*droneLED
+
+	received atomic.Int64
+	sent     atomic.Int64
+	dropped  atomic.Int64 // the updates replaced by a newer color before sent
+}
+
+func NewListener(controller drone.Controller, cfg Config) (*Listener, error) {
+	if err := cfg.Patch.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.setDefaults()
+	l := &Listener{
+		controller: controller,
+		cfg:        cfg,
+		universes:  make(map[uint16][]PatchEntry),
+		leds:       make(map[int]*droneLED),
+	}
+	for _, e := range cfg.Patch {
+		l.universes[e.Universe] = append(l.universes[e.Universe], e)
+	}
+	return l, nil
+}
+
+type Stat struct {
+	Received int64 `json:"received"`
+	Sent     int64 `json:"sent"`
+	Dropped  int64 `json:"dropped"`
+}
+
+func (l *Listener) Stat() Stat {
+	return Stat{
+		Received: l.received.Load(),
+		Sent:     l.sent.Load(),
+		Dropped:  l.dropped.Load(),
+	}
+}
+
+// HandleFrame applies a DMX frame to the patched drones
+func (l *Listener) HandleFrame(f *DMXFrame) {
+	entries := l.universes[f.Universe]
+	if len(entries) == 0 {
+		return
+	}
+	l.received.Add(1)
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for _, e := range entries {
+		i := e.Channel - 1
+		if i+2 >= len(f.Data) {
+			continue
+		}
+		c := drone.Color{R: f.Data[i], G: f.Data[i+1], B: f.Data[i+2]}
+		led, ok := l.leds[e.Drone]
+		if !ok {
+			led = new(droneLED)
+			l.leds[e.Drone] = led
+		}
+		if led.valid && led.want != c && led.want != led.sent {
+			l.dropped.Add(1)
+		}
+		led.want, led.valid = c, true
+	}
+}
+
+// Serve reads Art-Net and sACN packets from conn until ctx is done or conn is closed
+func (l *Listener) Serve(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if f, ok := DecodeDMX(buf[:n]); ok {
+			l.HandleFrame(f)
+		}
+	}
+}
+
+// ListenArtNet listens Art-Net on the UDP address, the default port is 6454
+func (l *Listener) ListenArtNet(ctx context.Context, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	go l.Serve(ctx, conn)
+	return nil
+}
+
+// ListenSACN joins the multicast groups of the patched universes on the interface
+// iface can be nil to use the system default interface
+func (l *Listener) ListenSACN(ctx context.Context, iface *net.Interface) error {
+	var conns []*net.UDPConn
+	universes := l.cfg.Patch.Universes()
+	for _, u := range universes {
+		if !ValidSACNUniverse(u) {
+			return fmt.Errorf("sACN universe %d out of range [1, %d]", u, MaxSACNUniverse)
+		}
+	}
+	for _, u := range universes {
+		group := &net.UDPAddr{
+			IP:   net.IPv4(239, 255, (byte)(u>>8), (byte)(u)),
+			Port: SACNPort,
+		}
+		conn, err := net.ListenMulticastUDP("udp4", iface, group)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return fmt.Errorf("Cannot join universe %d: %w", u, err)
+		}
+		conns = append(conns, conn)
+	}
+	for _, c := range conns {
+		go l.Serve(ctx, c)
+	}
+	return nil
+}
+
+// Run pushes the colors to the drones until ctx is done
+// A drone is updated when its color changed or the last color is about to expire,
+// and the updates are limited by MinInterval and MaxRate, the drones waited longest are updated first
+func (l *Listener) Run(ctx context.Context) error {
+	const tick = time.Millisecond * 20
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	tokens := 1.0
+	maxTokens := max(1, l.cfg.MaxRate*tick.Seconds()*5)
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		tokens = min(maxTokens, tokens+l.cfg.MaxRate*tick.Seconds())
+		if tokens < 1 {
+			continue
+		}
+		for _, u := range l.pick((int)(tokens)) {
+			dr := l.controller.GetDrone(u.id)
+			if dr == nil {
+				continue
+			}
+			led, ok := dr.(drone.LEDAbility)
+			if !ok {
+				continue
+			}
+			tokens--
+			if err := led.ActiveLED(ctx, u.color, l.cfg.Hold); err != nil {
+				continue
+			}
+			l.sent.Add(1)
+		}
+	}
+}
+
+type ledUpdate struct {
+	id       int
+	color    drone.Color
+	lastSent time.Time
+}
+
+// pick selects at most n drones which need update, and marks them as sent
+func (l *Listener) pick(n int) []ledUpdate {
+	now := time.Now()
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	var updates []ledUpdate
+	for id, led := range l.leds {
+		if !led.valid || now.Sub(led.lastSent) < l.cfg.MinInterval {
+			continue
+		}
+		if led.want == led.sent && now.Sub(led.lastSent) < l.cfg.Hold/2 {
+			continue
+		}
+		updates = append(updates, ledUpdate{id, led.want, led.lastSent})
+	}
+	slices.SortFunc(updates, func(a, b ledUpdate) int {
+		return a.lastSent.Compare(b.lastSent)
+	})
+	if len(updates) > n {
+		updates = updates[:n]
+	}
+	for _, u := range updates {
+		led := l.leds[u.id]
+		led.sent, led.lastSent = u.color, now
+	}
+	return updates
+}
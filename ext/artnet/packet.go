@@ -0,0 +1,105 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package artnet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	ArtNetPort = 6454
+	SACNPort   = 5568
+
+	// MaxSACNUniverse is the last universe of sACN, which starts from 1
+	MaxSACNUniverse = 63999
+)
+
+func ValidSACNUniverse(u uint16) bool {
+	return u >= 1 && u <= MaxSACNUniverse
+}
+
+// DMXFrame is the channel values of a universe
+type DMXFrame struct {
+	Universe uint16
+	Sequence byte
+	Data     []byte // Data[0] is channel 1
+}
+
+var artNetID = []byte("Art-Net\x00")
+
+const artOpDMX = 0x5000
+
+// DecodeArtDMX decodes an ArtDMX packet
+// The universe is Art-Net's 15 bits port address
+func DecodeArtDMX(packet []byte) (*DMXFrame, bool) {
+	if len(packet) < 18 || !bytes.Equal(packet[:8], artNetID) || binary.LittleEndian.Uint16(packet[8:10]) != artOpDMX {
+		return nil, false
+	}
+	length := (int)(binary.BigEndian.Uint16(packet[16:18]))
+	if length > 512 || 18+length > len(packet) {
+		return nil, false
+	}
+	return &DMXFrame{
+		Universe: (uint16)(packet[15]&0x7f)<<8 | (uint16)(packet[14]),
+		Sequence: packet[12],
+		Data:     packet[18 : 18+length],
+	}, true
+}
+
+var sacnID = []byte("ASC-E1.17\x00\x00\x00")
+
+const (
+	sacnVectorRootData    = 0x00000004
+	sacnVectorFramingData = 0x00000002
+	sacnVectorDMPSetProp  = 0x02
+
+	sacnOptionPreview    = 0x80
+	sacnOptionTerminated = 0x40
+)
+
+// DecodeSACN decodes an E1.31 data packet
+// Preview data and stream terminated packets are ignored
+func DecodeSACN(packet []byte) (*DMXFrame, bool) {
+	if len(packet) < 126 || !bytes.Equal(packet[4:16], sacnID) ||
+		binary.BigEndian.Uint32(packet[18:22]) != sacnVectorRootData ||
+		binary.BigEndian.Uint32(packet[40:44]) != sacnVectorFramingData ||
+		packet[117] != sacnVectorDMPSetProp {
+		return nil, false
+	}
+	if packet[112]&(sacnOptionPreview|sacnOptionTerminated) != 0 {
+		return nil, false
+	}
+	count := (int)(binary.BigEndian.Uint16(packet[123:125]))
+	// the first property is the start code, only 0 (DMX dimmer data) is accepted
+	if count < 1 || count > 513 || 125+count > len(packet) || packet[125] != 0 {
+		return nil, false
+	}
+	return &DMXFrame{
+		Universe: binary.BigEndian.Uint16(packet[113:115]),
+		Sequence: packet[111],
+		Data:     packet[126 : 125+count],
+	}, true
+}
+
+// DecodeDMX decodes either an ArtDMX or an E1.31 data packet
+func DecodeDMX(packet []byte) (*DMXFrame, bool) {
+	if f, ok := DecodeArtDMX(packet); ok {
+		return f, true
+	}
+	return DecodeSACN(packet)
+}
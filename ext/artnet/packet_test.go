@@ -0,0 +1,81 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package artnet_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/zyxkad/drone/ext/artnet"
+)
+
+func TestDecodeDMX(t *testing.T) {
+	data := []byte{0xff, 0x80, 0x00, 0x10, 0x20, 0x30}
+
+	art := append([]byte("Art-Net\x00\x00\x50\x00\x0e\x07\x00\x05\x01\x00\x06"), data...)
+	f, ok := artnet.DecodeDMX(art)
+	if !ok || f.Universe != 0x105 || f.Sequence != 7 || !bytes.Equal(f.Data, data) {
+		t.Errorf("Unexpected ArtDMX frame %#v %v", f, ok)
+	}
+
+	sacn := make([]byte, 126+len(data))
+	binary.BigEndian.PutUint16(sacn[0:], 0x0010)
+	copy(sacn[4:], "ASC-E1.17")
+	binary.BigEndian.PutUint32(sacn[18:], 0x04)
+	binary.BigEndian.PutUint32(sacn[40:], 0x02)
+	sacn[111] = 9
+	binary.BigEndian.PutUint16(sacn[113:], 42)
+	sacn[117] = 0x02
+	sacn[118] = 0xa1
+	binary.BigEndian.PutUint16(sacn[121:], 1)
+	binary.BigEndian.PutUint16(sacn[123:], (uint16)(len(data)+1))
+	copy(sacn[126:], data)
+	f, ok = artnet.DecodeDMX(sacn)
+	if !ok || f.Universe != 42 || f.Sequence != 9 || !bytes.Equal(f.Data, data) {
+		t.Errorf("Unexpected sACN frame %#v %v", f, ok)
+	}
+	sacn[112] = 0x40 // stream terminated
+	if _, ok := artnet.DecodeDMX(sacn); ok {
+		t.Errorf("Terminated sACN stream should be ignored")
+	}
+}
+
+func TestLinearPatch(t *testing.T) {
+	patch := artnet.LinearPatch(1, 172, 0, 1)
+	if err := patch.Validate(); err != nil {
+		t.Fatalf("Invalid patch: %v", err)
+	}
+	if e := patch[169]; e.Universe != 0 || e.Channel != 508 {
+		t.Errorf("Unexpected entry %#v", e)
+	}
+	if e := patch[170]; e.Drone != 171 || e.Universe != 1 || e.Channel != 1 {
+		t.Errorf("Unexpected entry %#v", e)
+	}
+	if err := artnet.LinearPatch(1, 0, 0, 1).Validate(); err == nil {
+		t.Errorf("Empty patch should be invalid")
+	}
+
+	l, err := artnet.NewListener(nil, artnet.Config{Patch: patch})
+	if err != nil {
+		t.Fatalf("NewListener: %v", err)
+	}
+	if err := l.ListenSACN(context.Background(), nil); err == nil {
+		t.Errorf("sACN universe 0 should be rejected")
+	}
+}
@@ -0,0 +1,158 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bandwidth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/zyxkad/drone"
+)
+
+// StreamIntervalSetter is a controller which requests the stream intervals when a drone connects
+type StreamIntervalSetter interface {
+	SetStreamIntervals(intervals map[uint32]time.Duration)
+}
+
+// disabledInterval disables a stream with MAV_CMD_SET_MESSAGE_INTERVAL
+const disabledInterval = -time.Microsecond
+
+// Manager keeps the stream intervals of the connected drones following the plan
+type Manager struct {
+	controller drone.Controller
+	cfg        Config
+	interval   time.Duration
+
+	mux     sync.Mutex
+	plan    *Plan
+	applied map[int]map[uint32]time.Duration
+}
+
+func NewManager(controller drone.Controller, cfg Config) (*Manager, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.setDefaults()
+	return &Manager{
+		controller: controller,
+		cfg:        cfg,
+		interval:   time.Second * 2,
+		plan:       MakePlan(cfg, 0),
+		applied:    make(map[int]map[uint32]time.Duration),
+	}, nil
+}
+
+func (m *Manager) Config() Config {
+	return m.cfg
+}
+
+// Plan returns the current plan
+func (m *Manager) Plan() *Plan {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.plan
+}
+
+// Run rebalances the streams when drones join or leave until ctx is done
+func (m *Manager) Run(ctx context.Context) error {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.Rebalance(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Rebalance plans for the connected drones, and sends the intervals which are changed or not applied yet
+func (m *Manager) Rebalance(ctx context.Context) *Plan {
+	var drones []drone.Drone
+	for _, d := range m.controller.Drones() {
+		if d.GetStatus() != drone.StatusNone {
+			drones = append(drones, d)
+		}
+	}
+	plan := MakePlan(m.cfg, len(drones))
+	if setter, ok := m.controller.(StreamIntervalSetter); ok {
+		// a new drone is likely joining, so the next plan is requested at connect, and it's refined at the next rebalance
+		setter.SetStreamIntervals(planIntervals(MakePlan(m.cfg, len(drones)+1)))
+	}
+	intervals := planIntervals(plan)
+
+	m.mux.Lock()
+	m.plan = plan
+	alive := make(map[int]struct{}, len(drones))
+	for _, d := range drones {
+		alive[d.ID()] = struct{}{}
+	}
+	for id := range m.applied {
+		if _, ok := alive[id]; !ok {
+			// apply again when the drone reconnects, since it may be rebooted
+			delete(m.applied, id)
+		}
+	}
+	m.mux.Unlock()
+
+	for _, d := range drones {
+		ia, ok := d.(drone.MessageIntervalAbility)
+		if !ok {
+			continue
+		}
+		for id, interval := range intervals {
+			m.mux.Lock()
+			applied, ok := m.applied[d.ID()][id]
+			m.mux.Unlock()
+			if ok && applied == interval {
+				continue
+			}
+			tctx, cancel := context.WithTimeout(ctx, time.Second*3)
+			err := ia.UpdateMessageInterval(tctx, id, interval)
+			cancel()
+			if err != nil {
+				// retry at the next rebalance
+				continue
+			}
+			m.mux.Lock()
+			if m.applied[d.ID()] == nil {
+				m.applied[d.ID()] = make(map[uint32]time.Duration)
+			}
+			m.applied[d.ID()][id] = interval
+			m.mux.Unlock()
+		}
+	}
+	return plan
+}
+
+// planIntervals returns the intervals of the per-drone streams
+func planIntervals(plan *Plan) map[uint32]time.Duration {
+	intervals := make(map[uint32]time.Duration)
+	for _, s := range plan.Streams {
+		if !s.PerDrone {
+			continue
+		}
+		if s.Interval == 0 {
+			intervals[s.MessageID] = disabledInterval
+		} else {
+			intervals[s.MessageID] = (time.Duration)(s.Interval)
+		}
+	}
+	return intervals
+}
@@ -0,0 +1,227 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package bandwidth plans the telemetry stream rates within a shared radio link
+package bandwidth
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/zyxkad/drone"
+)
+
+// Stream is a message sent periodically over the link
+type Stream struct {
+	Name      string
+	MessageID uint32
+	// Size is the bytes on the air of each message, including the frame overhead
+	Size int
+	// PerDrone is true if every drone sends the stream, otherwise it's sent once for the whole swarm, e.g. RTCM
+	PerDrone bool
+	// MinInterval is the fastest rate the stream needs, MaxInterval is the slowest rate before the stream is disabled
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// Essential streams are never disabled, they keep the slowest rate even if the link is overloaded
+	Essential bool
+}
+
+const (
+	StreamPosition = "position"
+	StreamRTCM     = "rtcm"
+	StreamAttitude = "attitude"
+	StreamBattery  = "battery"
+)
+
+// DefaultStreams are the streams in priority order
+var DefaultStreams = []Stream{
+	{
+		Name:        StreamPosition,
+		MessageID:   33, // GLOBAL_POSITION_INT
+		Size:        28 + drone.MavlinkFrameOverhead,
+		PerDrone:    true,
+		MinInterval: time.Millisecond * 200,
+		MaxInterval: time.Second * 2,
+		// the fences, the show executor and the dashboard depend on the position
+		Essential: true,
+	},
+	{
+		Name:        StreamRTCM,
+		MessageID:   233, // GPS_RTCM_DATA
+		Size:        800, // an epoch of MSM4 for GPS, GLONASS and BeiDou
+		MinInterval: time.Second,
+		MaxInterval: time.Second * 5,
+	},
+	{
+		Name:        StreamAttitude,
+		MessageID:   30, // ATTITUDE
+		Size:        28 + drone.MavlinkFrameOverhead,
+		PerDrone:    true,
+		MinInterval: time.Millisecond * 200,
+		MaxInterval: time.Second * 5,
+	},
+	{
+		Name:        StreamBattery,
+		MessageID:   147, // BATTERY_STATUS
+		Size:        36 + drone.MavlinkFrameOverhead,
+		PerDrone:    true,
+		MinInterval: time.Second,
+		MaxInterval: time.Second * 10,
+	},
+}
+
+type Config struct {
+	// Capacity is the usable throughput of the link in bytes per second
+	// For a LoRa link it's the air data rate divided by 8 and multiplied by the duty cycle
+	Capacity float64
+	// Reserve is the fraction of the capacity kept for commands and acks, default is 0.15
+	Reserve float64
+	// PerDroneOverhead is the bytes per second each drone sends regardless of the plan,
+	// such as HEARTBEAT and SYS_STATUS, default is 60
+	PerDroneOverhead float64
+	// Streams are in priority order, default is DefaultStreams
+	Streams []Stream
+}
+
+func (c *Config) setDefaults() {
+	if c.Reserve <= 0 || c.Reserve >= 1 {
+		c.Reserve = 0.15
+	}
+	if c.PerDroneOverhead <= 0 {
+		c.PerDroneOverhead = 60
+	}
+	if len(c.Streams) == 0 {
+		c.Streams = DefaultStreams
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.Capacity <= 0 {
+		return errors.New("Link capacity must be positive")
+	}
+	for _, s := range c.Streams {
+		if s.Size <= 0 {
+			return fmt.Errorf("Stream %s: size must be positive", s.Name)
+		}
+		if s.MinInterval <= 0 || s.MaxInterval < s.MinInterval {
+			return fmt.Errorf("Stream %s: invalid interval range [%v, %v]", s.Name, s.MinInterval, s.MaxInterval)
+		}
+	}
+	return nil
+}
+
+// StreamPlan is the planned rate of a stream
+type StreamPlan struct {
+	Name      string         `json:"name"`
+	MessageID uint32         `json:"msgid"`
+	PerDrone  bool           `json:"perDrone"`
+	Interval  drone.Duration `json:"interval"` // 0 means the stream is disabled
+	Load      float64        `json:"load"`     // in bytes per second of all drones
+}
+
+type Plan struct {
+	Drones   int           `json:"drones"`
+	Capacity float64       `json:"capacity"`
+	Budget   float64       `json:"budget"` // the capacity left for the streams
+	Used     float64       `json:"used"`
+	Streams  []*StreamPlan `json:"streams"`
+	// Degraded is true if a stream cannot run at its fastest rate
+	Degraded bool `json:"degraded"`
+}
+
+// Stream returns the plan of the named stream
+func (p *Plan) Stream(name string) *StreamPlan {
+	for _, s := range p.Streams {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// planResolution is the step of the planned intervals
+const planResolution = time.Millisecond * 10
+
+// MakePlan distributes the capacity to the streams of the drones
+// First every stream gets its slowest rate in priority order, a stream which does not fit is disabled
+// unless it's essential, then the rest of the budget speeds up the streams in priority order until they reach their fastest rate
+// The plan may use more than the budget because of the essential streams, it's marked degraded in that case
+func MakePlan(cfg Config, drones int) *Plan {
+	cfg.setDefaults()
+	budget := cfg.Capacity*(1-cfg.Reserve) - (float64)(drones)*cfg.PerDroneOverhead
+	plan := &Plan{
+		Drones:   drones,
+		Capacity: cfg.Capacity,
+		Budget:   max(budget, 0),
+		Streams:  make([]*StreamPlan, len(cfg.Streams)),
+	}
+	// perSecond is the bytes of a stream when it's sent once per second
+	perSecond := make([]float64, len(cfg.Streams))
+	for i, s := range cfg.Streams {
+		n := 1
+		if s.PerDrone {
+			n = drones
+		}
+		perSecond[i] = (float64)(s.Size * n)
+		plan.Streams[i] = &StreamPlan{
+			Name:      s.Name,
+			MessageID: s.MessageID,
+			PerDrone:  s.PerDrone,
+		}
+	}
+	for i, s := range cfg.Streams {
+		load := perSecond[i] / s.MaxInterval.Seconds()
+		if load > budget {
+			plan.Degraded = true
+			if !s.Essential {
+				continue
+			}
+		}
+		plan.Streams[i].Interval = (drone.Duration)(s.MaxInterval)
+		plan.Streams[i].Load = load
+		budget -= load
+	}
+	for i, s := range cfg.Streams {
+		sp := plan.Streams[i]
+		if sp.Interval == 0 || perSecond[i] == 0 {
+			continue
+		}
+		if budget <= 0 {
+			if (time.Duration)(sp.Interval) != s.MinInterval {
+				plan.Degraded = true
+			}
+			continue
+		}
+		if load := perSecond[i] / s.MinInterval.Seconds(); load-sp.Load <= budget {
+			budget -= load - sp.Load
+			sp.Interval, sp.Load = (drone.Duration)(s.MinInterval), load
+			continue
+		}
+		plan.Degraded = true
+		rate := (sp.Load + budget) / perSecond[i]
+		interval := (time.Duration)(math.Ceil((float64)(time.Second)/rate/(float64)(planResolution))) * planResolution
+		interval = min(max(interval, s.MinInterval), (time.Duration)(sp.Interval))
+		load := perSecond[i] / interval.Seconds()
+		budget -= load - sp.Load
+		sp.Interval, sp.Load = (drone.Duration)(interval), load
+	}
+	for _, sp := range plan.Streams {
+		plan.Used += sp.Load
+	}
+	return plan
+}
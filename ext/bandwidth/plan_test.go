@@ -0,0 +1,75 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bandwidth_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zyxkad/drone/ext/bandwidth"
+)
+
+func TestMakePlan(t *testing.T) {
+	// about a 20 kbps radio link
+	cfg := bandwidth.Config{Capacity: 2500}
+
+	plan := bandwidth.MakePlan(cfg, 2)
+	if plan.Degraded {
+		t.Fatalf("Two drones should fit in the link: %#v", plan)
+	}
+	for _, s := range plan.Streams {
+		for _, d := range bandwidth.DefaultStreams {
+			if d.Name == s.Name && (time.Duration)(s.Interval) != d.MinInterval {
+				t.Errorf("Stream %s: interval %v, want %v", s.Name, s.Interval, d.MinInterval)
+			}
+		}
+	}
+
+	plan = bandwidth.MakePlan(cfg, 6)
+	if !plan.Degraded {
+		t.Fatal("Six drones should degrade the plan")
+	}
+	if plan.Used > plan.Budget+1e-9 {
+		t.Fatalf("Plan used %f over budget %f", plan.Used, plan.Budget)
+	}
+	pos, rtcm, att, bat := plan.Stream(bandwidth.StreamPosition), plan.Stream(bandwidth.StreamRTCM),
+		plan.Stream(bandwidth.StreamAttitude), plan.Stream(bandwidth.StreamBattery)
+	if (time.Duration)(pos.Interval) != time.Millisecond*200 {
+		t.Errorf("Position should keep the fastest rate, got %v", pos.Interval)
+	}
+	if (time.Duration)(rtcm.Interval) <= time.Second || (time.Duration)(rtcm.Interval) >= time.Second*2 {
+		t.Errorf("RTCM should get the rest of the budget, got %v", rtcm.Interval)
+	}
+	// attitude may get the budget left by the rounding of RTCM interval
+	if (time.Duration)(att.Interval) < time.Second*4 || (time.Duration)(bat.Interval) != time.Second*10 {
+		t.Errorf("Attitude and battery should be about slowest, got %v %v", att.Interval, bat.Interval)
+	}
+
+	plan = bandwidth.MakePlan(cfg, 40)
+	if plan.Budget != 0 || !plan.Degraded {
+		t.Fatalf("Overhead of 40 drones exceeds the link, the plan should be degraded: %#v", plan)
+	}
+	// the position is essential, so it's kept at the slowest rate instead of disabled
+	if pos := plan.Stream(bandwidth.StreamPosition); (time.Duration)(pos.Interval) != time.Second*2 || pos.Load != 40*40/2 {
+		t.Errorf("Position should be kept at the slowest rate, got %v %v", pos.Interval, pos.Load)
+	}
+	for _, name := range []string{bandwidth.StreamRTCM, bandwidth.StreamAttitude, bandwidth.StreamBattery} {
+		if s := plan.Stream(name); s.Interval != 0 {
+			t.Errorf("Stream %s should be disabled, got %v", name, s.Interval)
+		}
+	}
+}
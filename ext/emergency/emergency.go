@@ -0,0 +1,103 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package emergency
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/zyxkad/drone"
+)
+
+// Result reports an emergency action on the drones
+type Result struct {
+	Action    string         `json:"action"`
+	Targets   int            `json:"targets"`
+	Succeeded []int          `json:"succeeded"`
+	Errors    map[int]string `json:"errors"`
+}
+
+// mavCmdDoFlightTermination is MAV_CMD_DO_FLIGHTTERMINATION
+const mavCmdDoFlightTermination = 185
+
+var ErrTerminationUnsupported = errors.New("Drone does not support flight termination")
+
+func forEach(ctx context.Context, action string, drones []drone.Drone, fn func(context.Context, drone.Drone) error) *Result {
+	res := &Result{
+		Action:    action,
+		Targets:   len(drones),
+		Succeeded: make([]int, 0, len(drones)),
+		Errors:    make(map[int]string),
+	}
+	var (
+		wg  sync.WaitGroup
+		mux sync.Mutex
+	)
+	for _, d := range drones {
+		wg.Add(1)
+		go func(d drone.Drone) {
+			defer wg.Done()
+			err := fn(ctx, d)
+			mux.Lock()
+			defer mux.Unlock()
+			if err != nil {
+				res.Errors[d.ID()] = err.Error()
+			} else {
+				res.Succeeded = append(res.Succeeded, d.ID())
+			}
+		}(d)
+	}
+	wg.Wait()
+	slices.Sort(res.Succeeded)
+	return res
+}
+
+// HoldAll makes the drones hold at their current position
+// A drone which cannot pause its current action is switched to LOITER mode
+func HoldAll(ctx context.Context, drones []drone.Drone) *Result {
+	return forEach(ctx, "hold", drones, holdDrone)
+}
+
+func holdDrone(ctx context.Context, d drone.Drone) error {
+	if err := d.Hold(ctx); err != nil {
+		if err2 := d.UpdateMode(ctx, 5 /* LOITER */); err2 != nil {
+			return errors.Join(err, err2)
+		}
+	}
+	return nil
+}
+
+// LandInPlace makes the drones land at their current position
+func LandInPlace(ctx context.Context, drones []drone.Drone) *Result {
+	return forEach(ctx, "land", drones, func(ctx context.Context, d drone.Drone) error {
+		return d.Land(ctx)
+	})
+}
+
+// Terminate stops the drones' motors immediately, the drones will fall
+// It should only be used when a drone is out of control, and the caller must confirm it with the operator
+func Terminate(ctx context.Context, drones []drone.Drone) *Result {
+	return forEach(ctx, "terminate", drones, func(ctx context.Context, d drone.Drone) error {
+		cd, ok := d.(drone.CommandAbility)
+		if !ok {
+			return ErrTerminationUnsupported
+		}
+		return cd.ExecuteCommand(ctx, mavCmdDoFlightTermination, 1)
+	})
+}
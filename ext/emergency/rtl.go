@@ -0,0 +1,259 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package emergency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/zyxkad/drone"
+)
+
+type RTLConfig struct {
+	// BaseAltitude is the altitude above home of the lowest layer, default is 10m
+	BaseAltitude float32
+	// LayerHeight is the altitude difference between two layers, default is 3m
+	LayerHeight float32
+	// Layers is the number of altitude layers, default is 4
+	Layers int
+	// Separation is the min horizontal distance between two paths in the same layer, default is 4m
+	Separation float32
+	// Delay is the time between two drones which have to share a layer with conflicting paths, default is 5s
+	Delay time.Duration
+	// Radius is the distance to consider a waypoint is reached, default is 1m
+	Radius float32
+}
+
+func (c *RTLConfig) setDefaults() {
+	if c.BaseAltitude <= 0 {
+		c.BaseAltitude = 10
+	}
+	if c.LayerHeight <= 0 {
+		c.LayerHeight = 3
+	}
+	if c.Layers <= 0 {
+		c.Layers = 4
+	}
+	if c.Separation <= 0 {
+		c.Separation = 4
+	}
+	if c.Delay <= 0 {
+		c.Delay = time.Second * 5
+	}
+	if c.Radius <= 0 {
+		c.Radius = 1
+	}
+}
+
+// RTLStep is the return path of a drone
+// The drone climbs or descends to Altitude at From, flies to above Home, then lands
+type RTLStep struct {
+	Drone    int            `json:"drone"`
+	From     *drone.Gps     `json:"from"`
+	Home     *drone.Gps     `json:"home"`
+	Layer    int            `json:"layer"`
+	Altitude float32        `json:"altitude"`
+	Delay    drone.Duration `json:"delay"` // the wait before the drone starts to return
+}
+
+type RTLPlan struct {
+	Steps   []*RTLStep `json:"steps"`
+	Skipped []int      `json:"skipped"` // the drones without position or home
+	cfg     RTLConfig
+}
+
+// PlanRTL assigns altitude layers and start delays to the drones, so their return paths do not cross
+// The drones are planned from the lowest to the highest, a drone takes the lowest layer
+// where its path keeps Separation to the other paths, so the drones rarely fly across each other vertically
+// If every layer has a conflict, the drone takes the layer with the least conflicts and waits the conflicting drones
+func PlanRTL(drones []drone.Drone, cfg RTLConfig) *RTLPlan {
+	cfg.setDefaults()
+	plan := &RTLPlan{
+		Steps:   make([]*RTLStep, 0, len(drones)),
+		Skipped: make([]int, 0),
+		cfg:     cfg,
+	}
+	for _, d := range drones {
+		from, home := d.GetGPS(), d.GetHome()
+		if from == nil || home == nil {
+			plan.Skipped = append(plan.Skipped, d.ID())
+			continue
+		}
+		plan.Steps = append(plan.Steps, &RTLStep{
+			Drone: d.ID(),
+			From:  from,
+			Home:  home,
+		})
+	}
+	if len(plan.Steps) == 0 {
+		return plan
+	}
+	slices.SortFunc(plan.Steps, func(a, b *RTLStep) int {
+		if c := a.From.Alt - b.From.Alt; c != 0 {
+			if c < 0 {
+				return -1
+			}
+			return 1
+		}
+		return a.Drone - b.Drone
+	})
+
+	origin := plan.Steps[0].Home
+	type segment struct {
+		a, b [2]float64
+	}
+	segments := make([]segment, len(plan.Steps))
+	for i, s := range plan.Steps {
+		segments[i] = segment{localXY(origin, s.From), localXY(origin, s.Home)}
+	}
+	layers := make([][]int, cfg.Layers)
+	sep := (float64)(cfg.Separation)
+	for i, s := range plan.Steps {
+		best, bestConflicts := 0, -1
+		var bestDelay time.Duration
+		for l, members := range layers {
+			conflicts := 0
+			var delay time.Duration
+			for _, j := range members {
+				if segmentDistance(segments[i].a, segments[i].b, segments[j].a, segments[j].b) < sep {
+					conflicts++
+					delay = max(delay, (time.Duration)(plan.Steps[j].Delay)+cfg.Delay)
+				}
+			}
+			if bestConflicts < 0 || conflicts < bestConflicts {
+				best, bestConflicts, bestDelay = l, conflicts, delay
+			}
+			if conflicts == 0 {
+				break
+			}
+		}
+		layers[best] = append(layers[best], i)
+		s.Layer = best
+		s.Delay = (drone.Duration)(bestDelay)
+		s.Altitude = s.Home.Alt + cfg.BaseAltitude + (float32)(best)*cfg.LayerHeight
+	}
+	return plan
+}
+
+// Execute flies every drone home as planned, and returns when all drones are landing
+func (p *RTLPlan) Execute(ctx context.Context, controller drone.Controller) error {
+	var (
+		wg   sync.WaitGroup
+		mux  sync.Mutex
+		errs []error
+	)
+	for _, s := range p.Steps {
+		d := controller.GetDrone(s.Drone)
+		if d == nil {
+			errs = append(errs, fmt.Errorf("Drone %d not found", s.Drone))
+			continue
+		}
+		wg.Add(1)
+		go func(s *RTLStep) {
+			defer wg.Done()
+			if err := p.executeStep(ctx, d, s); err != nil {
+				mux.Lock()
+				errs = append(errs, fmt.Errorf("Drone %d: %w", s.Drone, err))
+				mux.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (p *RTLPlan) executeStep(ctx context.Context, d drone.Drone, s *RTLStep) error {
+	if err := d.UpdateMode(ctx, 4 /* GUIDED */); err != nil {
+		return fmt.Errorf("Cannot switch to GUIDED: %w", err)
+	}
+	pos := d.GetGPS()
+	if pos == nil {
+		pos = s.From
+	}
+	// hold the current position while waiting other drones
+	hold := pos.Clone()
+	if err := d.MoveTo(ctx, hold); err != nil {
+		return err
+	}
+	if s.Delay > 0 {
+		select {
+		case <-time.After((time.Duration)(s.Delay)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	hold.Alt = s.Altitude
+	if err := d.MoveUntilReached(ctx, hold, p.cfg.Radius); err != nil {
+		return fmt.Errorf("Cannot reach layer altitude: %w", err)
+	}
+	above := s.Home.Clone()
+	above.Alt = s.Altitude
+	if err := d.MoveUntilReached(ctx, above, p.cfg.Radius); err != nil {
+		return fmt.Errorf("Cannot reach home: %w", err)
+	}
+	if err := d.Land(ctx); err != nil {
+		return fmt.Errorf("Cannot land: %w", err)
+	}
+	return nil
+}
+
+// localXY returns the east and north distance in meters from origin
+func localXY(origin, p *drone.Gps) [2]float64 {
+	return [2]float64{
+		(float64)(p.Lon-origin.Lon) * (float64)(origin.LonUnit()),
+		(float64)(p.Lat-origin.Lat) * (float64)(origin.LatUnit()),
+	}
+}
+
+// segmentDistance returns the min distance between segment ab and segment cd
+func segmentDistance(a, b, c, d [2]float64) float64 {
+	if segmentsIntersect(a, b, c, d) {
+		return 0
+	}
+	return min(
+		pointSegmentDistance(a, c, d),
+		pointSegmentDistance(b, c, d),
+		pointSegmentDistance(c, a, b),
+		pointSegmentDistance(d, a, b),
+	)
+}
+
+func pointSegmentDistance(p, a, b [2]float64) float64 {
+	abx, aby := b[0]-a[0], b[1]-a[1]
+	apx, apy := p[0]-a[0], p[1]-a[1]
+	l := abx*abx + aby*aby
+	t := 0.0
+	if l > 0 {
+		t = max(0, min(1, (apx*abx+apy*aby)/l))
+	}
+	return math.Hypot(apx-t*abx, apy-t*aby)
+}
+
+func cross(o, a, b [2]float64) float64 {
+	return (a[0]-o[0])*(b[1]-o[1]) - (a[1]-o[1])*(b[0]-o[0])
+}
+
+func segmentsIntersect(a, b, c, d [2]float64) bool {
+	d1, d2 := cross(c, d, a), cross(c, d, b)
+	d3, d4 := cross(a, b, c), cross(a, b, d)
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
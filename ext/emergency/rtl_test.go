@@ -0,0 +1,106 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package emergency_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/emergency"
+)
+
+type fakeDrone struct {
+	drone.Drone
+	id        int
+	pos, home *drone.Gps
+	battery   *drone.BatteryStat
+	status    drone.DroneStatus
+	active    time.Time
+	actions   chan string
+}
+
+func (d *fakeDrone) ID() int                        { return d.id }
+func (d *fakeDrone) GetGPS() *drone.Gps             { return d.pos }
+func (d *fakeDrone) GetHome() *drone.Gps            { return d.home }
+func (d *fakeDrone) GetBattery() *drone.BatteryStat { return d.battery }
+func (d *fakeDrone) GetStatus() drone.DroneStatus   { return d.status }
+func (d *fakeDrone) LastActivate() time.Time        { return d.active }
+func (d *fakeDrone) Hold(ctx context.Context) error { return d.do("hold") }
+func (d *fakeDrone) Home(ctx context.Context) error { return d.do("rtl") }
+func (d *fakeDrone) Land(ctx context.Context) error { return d.do("land") }
+
+func (d *fakeDrone) do(action string) error {
+	d.actions <- action
+	return nil
+}
+
+var origin = &drone.Gps{Lat: 22.5, Lon: 114.0, Alt: 50}
+
+// at returns the position east and north meters from origin
+func at(east, north, up float32) *drone.Gps {
+	g := origin.Clone()
+	g.MoveToEast(east)
+	g.MoveToNorth(north)
+	g.Alt += up
+	return g
+}
+
+func TestPlanRTL(t *testing.T) {
+	drones := []drone.Drone{
+		// 1 and 2 cross each other
+		&fakeDrone{id: 1, pos: at(0, 20, 10), home: at(20, 0, 0)},
+		&fakeDrone{id: 2, pos: at(20, 20, 12), home: at(0, 0, 0)},
+		// 3 is far from the others
+		&fakeDrone{id: 3, pos: at(100, 20, 15), home: at(100, 0, 0)},
+		&fakeDrone{id: 4, pos: nil, home: at(50, 0, 0)},
+	}
+	plan := emergency.PlanRTL(drones, emergency.RTLConfig{})
+	if len(plan.Skipped) != 1 || plan.Skipped[0] != 4 {
+		t.Errorf("Expected drone 4 skipped, got %v", plan.Skipped)
+	}
+	layers := make(map[int]*emergency.RTLStep)
+	for _, s := range plan.Steps {
+		layers[s.Drone] = s
+	}
+	if layers[1].Layer != 0 || layers[2].Layer != 1 || layers[3].Layer != 0 {
+		t.Errorf("Unexpected layers: 1=%d 2=%d 3=%d", layers[1].Layer, layers[2].Layer, layers[3].Layer)
+	}
+	if diff := layers[2].Altitude - layers[1].Altitude; diff < 2.9 || diff > 3.1 {
+		t.Errorf("Expected 3m between layers, got %f", diff)
+	}
+	for _, s := range plan.Steps {
+		if s.Delay != 0 {
+			t.Errorf("Drone %d should not wait, got %s", s.Drone, s.Delay)
+		}
+	}
+
+	plan = emergency.PlanRTL(drones[:2], emergency.RTLConfig{Layers: 1, Delay: time.Second * 3})
+	if plan.Steps[0].Delay != 0 || (time.Duration)(plan.Steps[1].Delay) != time.Second*3 {
+		t.Errorf("Expected delays 0s and 3s in a single layer, got %s and %s", plan.Steps[0].Delay, plan.Steps[1].Delay)
+	}
+	buf, err := json.Marshal(plan.Steps[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains((string)(buf), `"delay":3000`) || !strings.Contains((string)(buf), `"drone":2`) {
+		t.Errorf("Unexpected step JSON %s", buf)
+	}
+}
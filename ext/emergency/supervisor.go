@@ -0,0 +1,446 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package emergency
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/zyxkad/drone"
+)
+
+// Action is what the supervisor does when a rule is triggered
+type Action string
+
+const (
+	ActionNone Action = ""
+	ActionWarn Action = "warn"
+	ActionHold Action = "hold"
+	ActionRTL  Action = "rtl"
+	ActionLand Action = "land"
+)
+
+// severity orders the actions, a drone is not asked to do a less severe action than it was asked
+func (a Action) severity() int {
+	switch a {
+	case ActionWarn:
+		return 1
+	case ActionHold:
+		return 2
+	case ActionRTL:
+		return 3
+	case ActionLand:
+		return 4
+	}
+	return 0
+}
+
+type RuleName string
+
+const (
+	RuleBattery RuleName = "battery"
+	RuleLink    RuleName = "link"
+	RuleFence   RuleName = "fence"
+	RuleError   RuleName = "error"
+)
+
+type RuleConfig struct {
+	// Action is the action when the rule is triggered, empty disables the rule
+	Action Action
+	// Persist is how long the condition must hold before the rule is triggered
+	Persist time.Duration
+}
+
+type SupervisorConfig struct {
+	// Interval is the time between two evaluations, default is 500ms
+	Interval time.Duration
+	// Recover is how long a condition must be cleared before its rule can be triggered again, default is 5s
+	Recover time.Duration
+
+	Battery RuleConfig
+	// BatteryLow is the remaining fraction in [0, 1] which triggers the rule, default is 0.2
+	BatteryLow float32
+	// BatteryHysteresis is how much the remaining must be higher than BatteryLow to clear the rule, default is 0.05
+	BatteryHysteresis float32
+
+	Link RuleConfig
+	// LinkTimeout is the max time since the drone's last message, default is 3s
+	LinkTimeout time.Duration
+
+	Fence RuleConfig
+	// FencePolygon is the horizontal fence, the rule is not evaluated horizontally if it has less than 3 points
+	FencePolygon []*drone.Gps
+	// FenceMaxAltitude is the max altitude above home, zero means no limit
+	FenceMaxAltitude float32
+	// FenceMargin is how far the drone must return inside the fence to clear the rule, default is 2m
+	FenceMargin float32
+
+	// Error is triggered when the drone's status is Error
+	// The action is only taken if the drone was active before the error
+	Error RuleConfig
+
+	// BeforeAction is called before the supervisor commands a drone, it may be nil
+	// It's used to stop anything else commanding the drone, such as a running show
+	BeforeAction func(d drone.Drone, action Action)
+}
+
+func (c *SupervisorConfig) setDefaults() {
+	if c.Interval <= 0 {
+		c.Interval = time.Millisecond * 500
+	}
+	if c.Recover <= 0 {
+		c.Recover = time.Second * 5
+	}
+	if c.BatteryLow <= 0 {
+		c.BatteryLow = 0.2
+	}
+	if c.BatteryHysteresis <= 0 {
+		c.BatteryHysteresis = 0.05
+	}
+	if c.LinkTimeout <= 0 {
+		c.LinkTimeout = time.Second * 3
+	}
+	if c.FenceMargin <= 0 {
+		c.FenceMargin = 2
+	}
+}
+
+// SafetyEvent is emitted when a rule is triggered or cleared
+type SafetyEvent struct {
+	Time    time.Time `json:"time"`
+	Drone   int       `json:"drone"`
+	Rule    RuleName  `json:"rule"`
+	Action  Action    `json:"action"` // the action taken, empty if the rule is cleared or the action is skipped
+	Cleared bool      `json:"cleared"`
+	Reason  string    `json:"reason"`
+	Error   string    `json:"error,omitempty"` // the error of the action
+}
+
+var _ drone.Event = (*SafetyEvent)(nil)
+
+func (*SafetyEvent) GetType() string {
+	return "SAFETY"
+}
+
+func (e *SafetyEvent) String() string {
+	if e.Cleared {
+		return fmt.Sprintf("Drone %d: %s rule cleared: %s", e.Drone, e.Rule, e.Reason)
+	}
+	s := fmt.Sprintf("Drone %d: %s rule triggered: %s", e.Drone, e.Rule, e.Reason)
+	if e.Action != ActionNone {
+		s += fmt.Sprintf(", action %s", e.Action)
+	}
+	if e.Error != "" {
+		s += ", error: " + e.Error
+	}
+	return s
+}
+
+type ruleState struct {
+	badSince   time.Time
+	clearSince time.Time
+	triggered  bool
+}
+
+type droneState struct {
+	rules map[RuleName]*ruleState
+	taken Action // the most severe action taken in this flight
+	// airborne is whether the drone was active before it went into error
+	airborne bool
+}
+
+// condition is the result of a rule, bad triggers the rule and clear clears the rule
+// A condition is neither bad nor clear in the hysteresis band
+type condition struct {
+	bad, clear bool
+	reason     string
+}
+
+// Supervisor watches every drone of a controller and acts when a rule is triggered
+type Supervisor struct {
+	controller drone.Controller
+	cfg        SupervisorConfig
+	fence      [][2]float64 // in meters, relative to the first point of FencePolygon
+
+	mux    sync.Mutex
+	drones map[int]*droneState
+	events chan *SafetyEvent
+}
+
+func NewSupervisor(controller drone.Controller, cfg SupervisorConfig) *Supervisor {
+	cfg.setDefaults()
+	s := &Supervisor{
+		controller: controller,
+		cfg:        cfg,
+		drones:     make(map[int]*droneState),
+		events:     make(chan *SafetyEvent, 64),
+	}
+	if len(cfg.FencePolygon) >= 3 {
+		s.fence = make([][2]float64, len(cfg.FencePolygon))
+		for i, p := range cfg.FencePolygon {
+			s.fence[i] = localXY(cfg.FencePolygon[0], p)
+		}
+	}
+	return s
+}
+
+func (s *Supervisor) Config() SupervisorConfig {
+	return s.cfg
+}
+
+// Events returns the channel of safety events, events are dropped if the channel is full
+func (s *Supervisor) Events() <-chan *SafetyEvent {
+	return s.events
+}
+
+// Run evaluates the rules every Interval until ctx is done
+func (s *Supervisor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.Check(ctx, now)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Check evaluates the rules of every drone once
+func (s *Supervisor) Check(ctx context.Context, now time.Time) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	seen := make(map[int]struct{})
+	for _, d := range s.controller.Drones() {
+		seen[d.ID()] = struct{}{}
+		st, ok := s.drones[d.ID()]
+		if !ok {
+			st = &droneState{
+				rules: make(map[RuleName]*ruleState),
+			}
+			s.drones[d.ID()] = st
+		}
+		status := d.GetStatus()
+		active := status.IsActive()
+		if status != drone.StatusError {
+			st.airborne = active
+			if !active {
+				// the drone landed, it may take off again
+				st.taken = ActionNone
+			}
+		}
+		s.checkRule(ctx, now, d, st, RuleBattery, s.cfg.Battery, active, s.checkBattery)
+		s.checkRule(ctx, now, d, st, RuleLink, s.cfg.Link, active, s.checkLink)
+		s.checkRule(ctx, now, d, st, RuleFence, s.cfg.Fence, active, s.checkFence)
+		// the drone is not active when it's in error, so the status before the error is used
+		s.checkRule(ctx, now, d, st, RuleError, s.cfg.Error, st.airborne, s.checkError)
+	}
+	for id := range s.drones {
+		if _, ok := seen[id]; !ok {
+			delete(s.drones, id)
+		}
+	}
+}
+
+func (s *Supervisor) checkRule(
+	ctx context.Context, now time.Time,
+	d drone.Drone, st *droneState,
+	name RuleName, rule RuleConfig, active bool,
+	eval func(now time.Time, d drone.Drone) condition,
+) {
+	if rule.Action == ActionNone {
+		return
+	}
+	rs, ok := st.rules[name]
+	if !ok {
+		rs = new(ruleState)
+		st.rules[name] = rs
+	}
+	c := eval(now, d)
+	switch {
+	case c.bad:
+		rs.clearSince = time.Time{}
+		if rs.badSince.IsZero() {
+			rs.badSince = now
+		}
+		if rs.triggered || now.Sub(rs.badSince) < rule.Persist {
+			return
+		}
+		rs.triggered = true
+		ev := &SafetyEvent{
+			Time:   now,
+			Drone:  d.ID(),
+			Rule:   name,
+			Reason: c.reason,
+		}
+		action := rule.Action
+		if action != ActionWarn && (!active || action.severity() <= st.taken.severity()) {
+			// the drone is on the ground, or it's doing a more severe action
+			action = ActionWarn
+		}
+		if action.severity() > st.taken.severity() && action != ActionWarn {
+			st.taken = action
+		}
+		ev.Action = action
+		if action == ActionWarn {
+			s.emit(ev)
+			return
+		}
+		go func() {
+			tctx, cancel := context.WithTimeout(ctx, time.Second*5)
+			defer cancel()
+			if s.cfg.BeforeAction != nil {
+				s.cfg.BeforeAction(d, action)
+			}
+			if err := doAction(tctx, d, action); err != nil {
+				ev.Error = err.Error()
+			}
+			s.emit(ev)
+		}()
+	case c.clear:
+		rs.badSince = time.Time{}
+		if !rs.triggered {
+			return
+		}
+		if rs.clearSince.IsZero() {
+			rs.clearSince = now
+		}
+		if now.Sub(rs.clearSince) < s.cfg.Recover {
+			return
+		}
+		rs.triggered = false
+		rs.clearSince = time.Time{}
+		s.emit(&SafetyEvent{
+			Time:    now,
+			Drone:   d.ID(),
+			Rule:    name,
+			Cleared: true,
+			Reason:  c.reason,
+		})
+	default:
+		rs.clearSince = time.Time{}
+	}
+}
+
+func (s *Supervisor) emit(ev *SafetyEvent) {
+	select {
+	case s.events <- ev:
+	default:
+	}
+}
+
+func doAction(ctx context.Context, d drone.Drone, action Action) error {
+	switch action {
+	case ActionHold:
+		return holdDrone(ctx, d)
+	case ActionRTL:
+		return d.Home(ctx)
+	case ActionLand:
+		return d.Land(ctx)
+	}
+	return nil
+}
+
+func (s *Supervisor) checkBattery(now time.Time, d drone.Drone) condition {
+	bat := d.GetBattery()
+	if bat == nil || bat.Remaining < 0 {
+		return condition{}
+	}
+	reason := fmt.Sprintf("battery remaining %.0f%%, threshold %.0f%%", bat.Remaining*100, s.cfg.BatteryLow*100)
+	return condition{
+		bad:    bat.Remaining < s.cfg.BatteryLow,
+		clear:  bat.Remaining >= s.cfg.BatteryLow+s.cfg.BatteryHysteresis,
+		reason: reason,
+	}
+}
+
+func (s *Supervisor) checkLink(now time.Time, d drone.Drone) condition {
+	age := now.Sub(d.LastActivate())
+	return condition{
+		bad:    age > s.cfg.LinkTimeout,
+		clear:  age <= s.cfg.LinkTimeout/2,
+		reason: fmt.Sprintf("last message %s ago, timeout %s", age.Truncate(time.Millisecond), s.cfg.LinkTimeout),
+	}
+}
+
+func (s *Supervisor) checkFence(now time.Time, d drone.Drone) condition {
+	pos := d.GetGPS()
+	if pos == nil {
+		return condition{}
+	}
+	margin := (float64)(s.cfg.FenceMargin)
+	// dist is positive inside the fence
+	dist := math.Inf(1)
+	var reason string
+	if s.fence != nil {
+		p := localXY(s.cfg.FencePolygon[0], pos)
+		dist = polygonEdgeDistance(p, s.fence)
+		if !pointInPolygon(p, s.fence) {
+			dist = -dist
+			reason = fmt.Sprintf("%.1fm outside the fence", -dist)
+		}
+	}
+	if home := d.GetHome(); home != nil && s.cfg.FenceMaxAltitude > 0 {
+		alt := pos.Alt - home.Alt
+		if left := (float64)(s.cfg.FenceMaxAltitude - alt); left < dist {
+			dist = left
+			if left < 0 {
+				reason = fmt.Sprintf("altitude %.1fm above max %.1fm", alt, s.cfg.FenceMaxAltitude)
+			}
+		}
+	}
+	if reason == "" {
+		reason = "inside the fence"
+	}
+	return condition{
+		bad:    dist < 0,
+		clear:  dist >= margin,
+		reason: reason,
+	}
+}
+
+func (s *Supervisor) checkError(now time.Time, d drone.Drone) condition {
+	err := d.GetStatus() == drone.StatusError
+	return condition{
+		bad:    err,
+		clear:  !err,
+		reason: "status is error",
+	}
+}
+
+func pointInPolygon(p [2]float64, poly [][2]float64) bool {
+	inside := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		a, b := poly[i], poly[j]
+		if (a[1] > p[1]) != (b[1] > p[1]) && p[0] < (b[0]-a[0])*(p[1]-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func polygonEdgeDistance(p [2]float64, poly [][2]float64) float64 {
+	dist := math.Inf(1)
+	for i := range poly {
+		dist = min(dist, pointSegmentDistance(p, poly[i], poly[(i+1)%len(poly)]))
+	}
+	return dist
+}
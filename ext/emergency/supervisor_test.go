@@ -0,0 +1,152 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package emergency_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/emergency"
+)
+
+type fakeController struct {
+	drone.Controller
+	drones []drone.Drone
+}
+
+func (c *fakeController) Drones() []drone.Drone { return c.drones }
+
+func TestSupervisorBattery(t *testing.T) {
+	now := time.Now()
+	d := &fakeDrone{
+		id:      1,
+		pos:     at(0, 0, 10),
+		home:    at(0, 0, 0),
+		battery: &drone.BatteryStat{Remaining: 0.5},
+		status:  drone.StatusTakenoff,
+		active:  now,
+		actions: make(chan string, 4),
+	}
+	s := emergency.NewSupervisor(&fakeController{drones: []drone.Drone{d}}, emergency.SupervisorConfig{
+		Battery: emergency.RuleConfig{Action: emergency.ActionRTL, Persist: time.Second},
+		Recover: time.Second,
+	})
+	ctx := context.Background()
+	step := func(dur time.Duration) {
+		now = now.Add(dur)
+		d.active = now
+		s.Check(ctx, now)
+	}
+
+	step(time.Second)
+	d.battery = &drone.BatteryStat{Remaining: 0.15}
+	step(time.Millisecond * 500)
+	select {
+	case ev := <-s.Events():
+		t.Fatalf("Rule should not trigger before it persists, got %v", ev)
+	default:
+	}
+	step(time.Second)
+	ev := <-s.Events()
+	if ev.Rule != emergency.RuleBattery || ev.Action != emergency.ActionRTL || ev.Cleared {
+		t.Fatalf("Unexpected event %v", ev)
+	}
+	if a := <-d.actions; a != "rtl" {
+		t.Errorf("Expected rtl, got %s", a)
+	}
+
+	// inside the hysteresis band, the rule is not cleared
+	d.battery = &drone.BatteryStat{Remaining: 0.22}
+	step(time.Second * 2)
+	select {
+	case ev := <-s.Events():
+		t.Fatalf("Rule should not clear in the hysteresis band, got %v", ev)
+	default:
+	}
+	d.battery = &drone.BatteryStat{Remaining: 0.3}
+	step(time.Second)
+	step(time.Second)
+	if ev := <-s.Events(); !ev.Cleared {
+		t.Errorf("Expected the rule cleared, got %v", ev)
+	}
+}
+
+func TestSupervisorLinkOnGround(t *testing.T) {
+	now := time.Now()
+	d := &fakeDrone{
+		id:      2,
+		status:  drone.StatusReady,
+		active:  now.Add(-time.Minute),
+		actions: make(chan string, 4),
+	}
+	s := emergency.NewSupervisor(&fakeController{drones: []drone.Drone{d}}, emergency.SupervisorConfig{
+		Link: emergency.RuleConfig{Action: emergency.ActionLand},
+	})
+	s.Check(context.Background(), now)
+	ev := <-s.Events()
+	if ev.Rule != emergency.RuleLink || ev.Action != emergency.ActionWarn {
+		t.Errorf("A drone on the ground should only be warned, got %v", ev)
+	}
+	select {
+	case a := <-d.actions:
+		t.Errorf("Unexpected action %s", a)
+	default:
+	}
+}
+
+func TestSupervisorError(t *testing.T) {
+	now := time.Now()
+	ground := &fakeDrone{id: 3, status: drone.StatusReady, active: now, actions: make(chan string, 4)}
+	flying := &fakeDrone{id: 4, status: drone.StatusTakenoff, active: now, actions: make(chan string, 4)}
+	before := make(chan int, 4)
+	s := emergency.NewSupervisor(&fakeController{drones: []drone.Drone{ground, flying}}, emergency.SupervisorConfig{
+		Error: emergency.RuleConfig{Action: emergency.ActionLand},
+		BeforeAction: func(d drone.Drone, action emergency.Action) {
+			before <- d.ID()
+		},
+	})
+	ctx := context.Background()
+	s.Check(ctx, now)
+	ground.status = drone.StatusError
+	flying.status = drone.StatusError
+	s.Check(ctx, now.Add(time.Second))
+
+	events := map[int]*emergency.SafetyEvent{}
+	for range 2 {
+		ev := <-s.Events()
+		events[ev.Drone] = ev
+	}
+	if ev := events[3]; ev == nil || ev.Action != emergency.ActionWarn {
+		t.Errorf("A drone in error on the ground should only be warned, got %v", ev)
+	}
+	if ev := events[4]; ev == nil || ev.Action != emergency.ActionLand {
+		t.Errorf("A flying drone in error should land, got %v", ev)
+	}
+	if id := <-before; id != 4 {
+		t.Errorf("BeforeAction is called for drone %d", id)
+	}
+	if a := <-flying.actions; a != "land" {
+		t.Errorf("Expected land, got %s", a)
+	}
+	select {
+	case a := <-ground.actions:
+		t.Errorf("Unexpected action %s on the ground", a)
+	default:
+	}
+}
@@ -0,0 +1,155 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fleet
+
+import (
+	"slices"
+	"sync"
+)
+
+// GroupStore keeps named drone groups and drone tags in a JSON file
+type GroupStore struct {
+	path string
+
+	mux    sync.RWMutex
+	groups map[string][]int
+	tags   map[int][]string
+}
+
+var _ Resolver = (*GroupStore)(nil)
+
+type groupFile struct {
+	Groups map[string][]int `json:"groups"`
+	Tags   map[int][]string `json:"tags"`
+}
+
+// OpenGroupStore loads the store from the path, an empty store is created if the file does not exist
+// An empty path creates a store which is not persisted
+func OpenGroupStore(path string) (*GroupStore, error) {
+	s := &GroupStore{
+		path:   path,
+		groups: make(map[string][]int),
+		tags:   make(map[int][]string),
+	}
+	if path == "" {
+		return s, nil
+	}
+	var f groupFile
+	if err := readJSONFile(path, &f); err != nil {
+		return nil, err
+	}
+	for name, ids := range f.Groups {
+		s.groups[name] = ids
+	}
+	for id, tags := range f.Tags {
+		s.tags[id] = tags
+	}
+	return s, nil
+}
+
+// save writes the store to the file, the caller must hold the lock
+func (s *GroupStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	return writeJSONFile(s.path, groupFile{Groups: s.groups, Tags: s.tags})
+}
+
+func (s *GroupStore) Groups() map[string][]int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	groups := make(map[string][]int, len(s.groups))
+	for name, ids := range s.groups {
+		groups[name] = slices.Clone(ids)
+	}
+	return groups
+}
+
+func (s *GroupStore) Group(name string) ([]int, bool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	ids, ok := s.groups[name]
+	return slices.Clone(ids), ok
+}
+
+// SetGroup replaces the group's members, an empty list removes the group
+func (s *GroupStore) SetGroup(name string, ids []int) error {
+	if !validName(name) {
+		return ErrInvalidName
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(ids) == 0 {
+		delete(s.groups, name)
+	} else {
+		ids = slices.Clone(ids)
+		slices.Sort(ids)
+		s.groups[name] = slices.Compact(ids)
+	}
+	return s.save()
+}
+
+func (s *GroupStore) DeleteGroup(name string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.groups[name]; !ok {
+		return nil
+	}
+	delete(s.groups, name)
+	return s.save()
+}
+
+func (s *GroupStore) AllTags() map[int][]string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	tags := make(map[int][]string, len(s.tags))
+	for id, t := range s.tags {
+		tags[id] = slices.Clone(t)
+	}
+	return tags
+}
+
+func (s *GroupStore) Tags(id int) []string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return slices.Clone(s.tags[id])
+}
+
+// SetTags replaces the drone's tags
+func (s *GroupStore) SetTags(id int, tags []string) error {
+	for _, t := range tags {
+		if !validName(t) {
+			return ErrInvalidName
+		}
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(tags) == 0 {
+		delete(s.tags, id)
+	} else {
+		tags = slices.Clone(tags)
+		slices.Sort(tags)
+		s.tags[id] = slices.Compact(tags)
+	}
+	return s.save()
+}
+
+func (s *GroupStore) HasTag(id int, tag string) bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return slices.Contains(s.tags[id], tag)
+}
@@ -0,0 +1,266 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fleet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zyxkad/drone"
+)
+
+// Airframe is a physical drone, identified by its flight controller's unique ID
+type Airframe struct {
+	UID       string   `json:"uid"`
+	Name      string   `json:"name"`
+	Frame     string   `json:"frame,omitempty"`
+	Batteries []string `json:"batteries,omitempty"`
+	// Battery is the pack installed now, one of Batteries
+	Battery string `json:"battery,omitempty"`
+	Notes   string `json:"notes,omitempty"`
+	// SysID is the MAVLink system ID assigned to the airframe, 0 means not assigned
+	SysID int `json:"sysid,omitempty"`
+
+	LastSeen  time.Time `json:"lastSeen,omitempty"`
+	LastSysID int       `json:"lastSysid,omitempty"`
+}
+
+var ErrEmptyUID = errors.New("UID cannot be empty")
+
+// InstalledBattery returns the pack installed now, which is the only pack if there is just one
+// It returns an empty string if the installed pack is unknown
+func (a *Airframe) InstalledBattery() string {
+	if a.Battery != "" {
+		return a.Battery
+	}
+	if len(a.Batteries) == 1 {
+		return a.Batteries[0]
+	}
+	return ""
+}
+
+// Inventory keeps the airframes in a JSON file
+type Inventory struct {
+	path string
+
+	mux       sync.RWMutex
+	airframes map[string]*Airframe
+}
+
+type inventoryFile struct {
+	Airframes []*Airframe `json:"airframes"`
+}
+
+// OpenInventory loads the inventory from the path, an empty inventory is created if the file does not exist
+// An empty path creates an inventory which is not persisted
+func OpenInventory(path string) (*Inventory, error) {
+	v := &Inventory{
+		path:      path,
+		airframes: make(map[string]*Airframe),
+	}
+	if path == "" {
+		return v, nil
+	}
+	var f inventoryFile
+	if err := readJSONFile(path, &f); err != nil {
+		return nil, err
+	}
+	for _, a := range f.Airframes {
+		if a.UID != "" {
+			v.airframes[a.UID] = a
+		}
+	}
+	return v, nil
+}
+
+// save writes the inventory to the file, the caller must hold the lock
+func (v *Inventory) save() error {
+	if v.path == "" {
+		return nil
+	}
+	return writeJSONFile(v.path, inventoryFile{Airframes: v.sorted()})
+}
+
+func (v *Inventory) sorted() []*Airframe {
+	airframes := make([]*Airframe, 0, len(v.airframes))
+	for _, a := range v.airframes {
+		airframes = append(airframes, a)
+	}
+	slices.SortFunc(airframes, func(a, b *Airframe) int {
+		return strings.Compare(a.UID, b.UID)
+	})
+	return airframes
+}
+
+func cloneAirframe(a *Airframe) *Airframe {
+	c := *a
+	c.Batteries = slices.Clone(a.Batteries)
+	return &c
+}
+
+// Airframes returns all airframes sorted by UID
+func (v *Inventory) Airframes() []*Airframe {
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+	airframes := v.sorted()
+	for i, a := range airframes {
+		airframes[i] = cloneAirframe(a)
+	}
+	return airframes
+}
+
+func (v *Inventory) Get(uid string) *Airframe {
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+	a, ok := v.airframes[uid]
+	if !ok {
+		return nil
+	}
+	return cloneAirframe(a)
+}
+
+// BySysID returns the airframe which is assigned to or last seen with the system ID
+func (v *Inventory) BySysID(id int) *Airframe {
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+	var found *Airframe
+	for _, a := range v.airframes {
+		if a.SysID == id {
+			return cloneAirframe(a)
+		}
+		if a.LastSysID == id && (found == nil || a.LastSeen.After(found.LastSeen)) {
+			found = a
+		}
+	}
+	if found == nil {
+		return nil
+	}
+	return cloneAirframe(found)
+}
+
+// Put creates or updates the airframe, the last seen state is kept
+// Two airframes cannot be assigned with the same system ID
+func (v *Inventory) Put(a *Airframe) error {
+	if a.UID == "" {
+		return ErrEmptyUID
+	}
+	if a.SysID < 0 || a.SysID > 255 {
+		return fmt.Errorf("System ID %d out of range [0, 255]", a.SysID)
+	}
+	if a.Battery != "" && !slices.Contains(a.Batteries, a.Battery) {
+		return fmt.Errorf("Battery %s is not one of the airframe's batteries", a.Battery)
+	}
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if a.SysID != 0 {
+		for _, o := range v.airframes {
+			if o.UID != a.UID && o.SysID == a.SysID {
+				return fmt.Errorf("System ID %d is already assigned to %s", a.SysID, o.Name)
+			}
+		}
+	}
+	a = cloneAirframe(a)
+	if old, ok := v.airframes[a.UID]; ok {
+		a.LastSeen, a.LastSysID = old.LastSeen, old.LastSysID
+	}
+	if a.Name == "" {
+		a.Name = defaultAirframeName(a.UID)
+	}
+	v.airframes[a.UID] = a
+	return v.save()
+}
+
+// InstallBattery records the pack installed to the airframe, an empty pack means it's unknown
+func (v *Inventory) InstallBattery(uid string, pack string) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	a, ok := v.airframes[uid]
+	if !ok {
+		return fmt.Errorf("Airframe %s does not exist", uid)
+	}
+	if pack != "" && !slices.Contains(a.Batteries, pack) {
+		return fmt.Errorf("Battery %s is not one of the airframe's batteries", pack)
+	}
+	a.Battery = pack
+	return v.save()
+}
+
+func (v *Inventory) Delete(uid string) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if _, ok := v.airframes[uid]; !ok {
+		return nil
+	}
+	delete(v.airframes, uid)
+	return v.save()
+}
+
+// Seen records the airframe is connected with the system ID, an unknown airframe is added
+func (v *Inventory) Seen(uid string, sysid int) (*Airframe, error) {
+	if uid == "" {
+		return nil, ErrEmptyUID
+	}
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	a, ok := v.airframes[uid]
+	if !ok {
+		a = &Airframe{
+			UID:  uid,
+			Name: defaultAirframeName(uid),
+		}
+		v.airframes[uid] = a
+	}
+	a.LastSeen = time.Now()
+	a.LastSysID = sysid
+	return cloneAirframe(a), v.save()
+}
+
+// defaultAirframeName uses the tail of the UID, which is usually enough to tell the boards apart
+func defaultAirframeName(uid string) string {
+	if len(uid) > 8 {
+		uid = uid[len(uid)-8:]
+	}
+	return "FC-" + strings.ToUpper(uid)
+}
+
+// Bind reads the drone's UID, records it in the inventory and names the drone after its airframe
+// The returned error is not nil if the drone does not report its UID,
+// or its system ID does not match the one assigned to the airframe, in which case the airframe is still returned
+func (v *Inventory) Bind(ctx context.Context, d drone.Drone) (*Airframe, error) {
+	ia, ok := d.(drone.IdentityAbility)
+	if !ok {
+		return nil, errors.New("Drone cannot report its UID")
+	}
+	uid, err := ia.UID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a, err := v.Seen(uid, d.ID())
+	if err != nil {
+		return nil, err
+	}
+	ia.SetName(a.Name)
+	if a.SysID != 0 && a.SysID != d.ID() {
+		return a, fmt.Errorf("Airframe %s is assigned with system ID %d, but connected as %d", a.Name, a.SysID, d.ID())
+	}
+	return a, nil
+}
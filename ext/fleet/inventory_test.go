@@ -0,0 +1,75 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fleet_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/zyxkad/drone/ext/fleet"
+)
+
+type identityDrone struct {
+	fakeDrone
+	uid  string
+	name string
+}
+
+func (d *identityDrone) UID(context.Context) (string, error) { return d.uid, nil }
+func (d *identityDrone) SetName(name string)                 { d.name = name }
+
+func TestInventory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	inv, err := fleet.OpenInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &identityDrone{fakeDrone: fakeDrone{id: 3}, uid: "0011223344556677"}
+	a, err := inv.Bind(context.Background(), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Name != "FC-44556677" || d.name != a.Name || a.LastSysID != 3 {
+		t.Fatalf("Unexpected new airframe %#v, drone name %q", a, d.name)
+	}
+
+	a.Name = "Alpha"
+	a.Batteries = []string{"B-01"}
+	a.SysID = 7
+	if err := inv.Put(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.Put(&fleet.Airframe{UID: "ffff", SysID: 7}); err == nil {
+		t.Fatal("Expected duplicated system ID error")
+	}
+
+	inv, err = fleet.OpenInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err = inv.Bind(context.Background(), d)
+	if err == nil {
+		t.Fatal("Expected system ID mismatch error")
+	}
+	if a == nil || a.Name != "Alpha" || d.name != "Alpha" || len(a.Batteries) != 1 {
+		t.Fatalf("Airframe is not persisted: %#v", a)
+	}
+	if b := inv.BySysID(7); b == nil || b.UID != d.uid {
+		t.Fatalf("BySysID(7) = %#v", b)
+	}
+}
@@ -0,0 +1,392 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fleet
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zyxkad/drone"
+)
+
+// Usage is the accumulated statistics of an airframe or a battery pack
+type Usage struct {
+	ArmedTime  drone.Duration `json:"armedTime"`
+	FlightTime drone.Duration `json:"flightTime"`
+	Takeoffs   int            `json:"takeoffs"`
+	// Cycles is the count of armed sessions which took off
+	Cycles     int       `json:"cycles"`
+	MaxCurrent float32   `json:"maxCurrent"` // In A
+	MinVoltage float32   `json:"minVoltage"` // In V, 0 means never measured
+	Energy     float64   `json:"energy"`     // In Wh
+	LastUsed   time.Time `json:"lastUsed,omitempty"`
+}
+
+type Metric string
+
+const (
+	MetricArmedHours  Metric = "armedHours"
+	MetricFlightHours Metric = "flightHours"
+	MetricTakeoffs    Metric = "takeoffs"
+	MetricCycles      Metric = "cycles"
+	MetricEnergy      Metric = "energy"
+)
+
+func (u *Usage) Value(m Metric) (float64, error) {
+	switch m {
+	case MetricArmedHours:
+		return (time.Duration)(u.ArmedTime).Hours(), nil
+	case MetricFlightHours:
+		return (time.Duration)(u.FlightTime).Hours(), nil
+	case MetricTakeoffs:
+		return (float64)(u.Takeoffs), nil
+	case MetricCycles:
+		return (float64)(u.Cycles), nil
+	case MetricEnergy:
+		return u.Energy, nil
+	}
+	return 0, fmt.Errorf("Unknown metric %q", (string)(m))
+}
+
+// Threshold is a maintenance limit, the airframe or the battery needs service once the metric reaches Max
+type Threshold struct {
+	Metric Metric  `json:"metric"`
+	Max    float64 `json:"max"`
+	// Block prevents the drone from being assigned, otherwise it's only a warning
+	Block bool `json:"block"`
+}
+
+type MaintenanceConfig struct {
+	Airframe []Threshold `json:"airframe"`
+	Battery  []Threshold `json:"battery"`
+}
+
+func (c *MaintenanceConfig) Validate() error {
+	for _, list := range [][]Threshold{c.Airframe, c.Battery} {
+		for _, t := range list {
+			if _, err := (&Usage{}).Value(t.Metric); err != nil {
+				return err
+			}
+			if t.Max <= 0 {
+				return fmt.Errorf("Threshold of %s must be positive", t.Metric)
+			}
+		}
+	}
+	return nil
+}
+
+// MaintenanceIssue is a threshold reached by an airframe or a battery pack
+type MaintenanceIssue struct {
+	Kind  string  `json:"kind"` // "airframe" or "battery"
+	ID    string  `json:"id"`   // the airframe's UID or the battery pack ID
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+	Threshold
+}
+
+func (i *MaintenanceIssue) String() string {
+	return fmt.Sprintf("%s %s: %s %.1f reached limit %.1f", i.Kind, i.Name, i.Metric, i.Value, i.Max)
+}
+
+// takeoffAltitude is the height above home which considers the drone is flying
+const takeoffAltitude = 1
+
+// maxSampleGap is the max time between two samples which is accumulated,
+// a longer gap means the telemetry is lost and the gap is skipped
+const maxSampleGap = time.Second * 5
+
+type usageSession struct {
+	last   time.Time
+	armed  bool
+	flying bool
+	flown  bool // whether the drone took off in this armed session
+	pack   string
+}
+
+// Maintenance accumulates the usage of the airframes and the battery packs from telemetry
+// The battery pack in use is the airframe's installed battery, no pack is counted if it's unknown
+type Maintenance struct {
+	path      string
+	inventory *Inventory
+
+	mux       sync.Mutex
+	cfg       MaintenanceConfig
+	airframes map[string]*Usage
+	batteries map[string]*Usage
+	sessions  map[string]*usageSession
+	dirty     bool
+	lastSave  time.Time
+}
+
+type maintenanceFile struct {
+	Config    MaintenanceConfig `json:"config"`
+	Airframes map[string]*Usage `json:"airframes"`
+	Batteries map[string]*Usage `json:"batteries"`
+}
+
+// OpenMaintenance loads the statistics from the path, an empty path creates a tracker which is not persisted
+func OpenMaintenance(path string, inventory *Inventory) (*Maintenance, error) {
+	m := &Maintenance{
+		path:      path,
+		inventory: inventory,
+		airframes: make(map[string]*Usage),
+		batteries: make(map[string]*Usage),
+		sessions:  make(map[string]*usageSession),
+	}
+	if path == "" {
+		return m, nil
+	}
+	var f maintenanceFile
+	if err := readJSONFile(path, &f); err != nil {
+		return nil, err
+	}
+	m.cfg = f.Config
+	for id, u := range f.Airframes {
+		m.airframes[id] = u
+	}
+	for id, u := range f.Batteries {
+		m.batteries[id] = u
+	}
+	return m, nil
+}
+
+// save writes the statistics to the file, the caller must hold the lock
+func (m *Maintenance) save() error {
+	m.dirty = false
+	m.lastSave = time.Now()
+	if m.path == "" {
+		return nil
+	}
+	return writeJSONFile(m.path, maintenanceFile{
+		Config:    m.cfg,
+		Airframes: m.airframes,
+		Batteries: m.batteries,
+	})
+}
+
+// Flush saves the pending statistics
+func (m *Maintenance) Flush() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if !m.dirty {
+		return nil
+	}
+	return m.save()
+}
+
+func (m *Maintenance) Config() MaintenanceConfig {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.cfg
+}
+
+func (m *Maintenance) SetConfig(cfg MaintenanceConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.cfg = cfg
+	return m.save()
+}
+
+func (m *Maintenance) Airframes() map[string]Usage {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return copyUsages(m.airframes)
+}
+
+func (m *Maintenance) Batteries() map[string]Usage {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return copyUsages(m.batteries)
+}
+
+func copyUsages(usages map[string]*Usage) map[string]Usage {
+	res := make(map[string]Usage, len(usages))
+	for id, u := range usages {
+		res[id] = *u
+	}
+	return res
+}
+
+// Reset clears the statistics of an airframe or a battery pack after it's serviced or replaced
+func (m *Maintenance) Reset(kind string, id string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	switch kind {
+	case "airframe":
+		delete(m.airframes, id)
+	case "battery":
+		delete(m.batteries, id)
+	default:
+		return fmt.Errorf("Unknown kind %q", kind)
+	}
+	return m.save()
+}
+
+func usageOf(usages map[string]*Usage, id string) *Usage {
+	u, ok := usages[id]
+	if !ok {
+		u = new(Usage)
+		usages[id] = u
+	}
+	return u
+}
+
+// Sample accumulates the drone's current telemetry to the airframe of the UID
+// It should be called periodically, about every second
+func (m *Maintenance) Sample(uid string, d drone.Drone, now time.Time) error {
+	if uid == "" {
+		return ErrEmptyUID
+	}
+	var pack string
+	if a := m.inventory.Get(uid); a != nil {
+		pack = a.InstalledBattery()
+	}
+	status := d.GetStatus()
+	armed := status.IsActive()
+	flying := armed && status == drone.StatusTakenoff
+	if pos, home := d.GetGPS(), d.GetHome(); armed && pos != nil && home != nil {
+		flying = pos.Alt-home.Alt > takeoffAltitude
+	}
+	bat := d.GetBattery()
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	s, ok := m.sessions[uid]
+	if !ok {
+		s = &usageSession{last: now}
+		m.sessions[uid] = s
+	}
+	dt := now.Sub(s.last)
+	if dt < 0 || dt > maxSampleGap {
+		dt = 0
+	}
+	s.last = now
+	if pack != s.pack && !s.armed {
+		s.pack = pack
+	}
+
+	usages := []*Usage{usageOf(m.airframes, uid)}
+	if s.pack != "" {
+		usages = append(usages, usageOf(m.batteries, s.pack))
+	}
+	transited := false
+	if armed {
+		takeoff := flying && !s.flying
+		for _, u := range usages {
+			u.ArmedTime += (drone.Duration)(dt)
+			if flying {
+				u.FlightTime += (drone.Duration)(dt)
+			}
+			if takeoff {
+				u.Takeoffs++
+			}
+			if bat != nil && bat.Voltage > 0 {
+				if u.MinVoltage == 0 || bat.Voltage < u.MinVoltage {
+					u.MinVoltage = bat.Voltage
+				}
+				if bat.Current > 0 {
+					u.MaxCurrent = max(u.MaxCurrent, bat.Current)
+					u.Energy += (float64)(bat.Voltage*bat.Current) * dt.Hours()
+				}
+			}
+			u.LastUsed = now
+		}
+		s.flown = s.flown || flying
+		m.dirty = true
+		transited = takeoff || !s.armed
+	} else if s.armed {
+		if s.flown {
+			for _, u := range usages {
+				u.Cycles++
+			}
+		}
+		s.flown = false
+		transited = true
+	}
+	s.armed, s.flying = armed, flying
+	if transited || (m.dirty && now.Sub(m.lastSave) > time.Minute) {
+		return m.save()
+	}
+	return nil
+}
+
+// Check returns the thresholds reached by the airframe and its battery packs
+func (m *Maintenance) Check(uid string) []*MaintenanceIssue {
+	a := m.inventory.Get(uid)
+	name := uid
+	var packs []string
+	if a != nil {
+		name, packs = a.Name, a.Batteries
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	var issues []*MaintenanceIssue
+	check := func(kind string, id, name string, u *Usage, thresholds []Threshold) {
+		if u == nil {
+			return
+		}
+		for _, t := range thresholds {
+			if v, _ := u.Value(t.Metric); v >= t.Max {
+				issues = append(issues, &MaintenanceIssue{
+					Kind:      kind,
+					ID:        id,
+					Name:      name,
+					Value:     v,
+					Threshold: t,
+				})
+			}
+		}
+	}
+	check("airframe", uid, name, m.airframes[uid], m.cfg.Airframe)
+	for _, p := range packs {
+		check("battery", p, p, m.batteries[p], m.cfg.Battery)
+	}
+	return issues
+}
+
+// Issues returns the thresholds reached by all airframes in the inventory
+func (m *Maintenance) Issues() []*MaintenanceIssue {
+	var issues []*MaintenanceIssue
+	for _, a := range m.inventory.Airframes() {
+		issues = append(issues, m.Check(a.UID)...)
+	}
+	return issues
+}
+
+// NewInspector returns a director inspector which rejects the drones with a blocking issue
+// uidOf maps a drone to its airframe's UID, the drones without a known UID are passed
+func (m *Maintenance) NewInspector(uidOf func(drone.Drone) string) func(context.Context, drone.Drone, func(string)) error {
+	return func(ctx context.Context, dr drone.Drone, logger func(string)) error {
+		uid := uidOf(dr)
+		if uid == "" {
+			logger("Airframe is unknown, maintenance is not checked")
+			return nil
+		}
+		for _, issue := range m.Check(uid) {
+			if issue.Block {
+				return fmt.Errorf("Maintenance required: %s", issue)
+			}
+			logger("Maintenance warning: " + issue.String())
+		}
+		return nil
+	}
+}
@@ -0,0 +1,131 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fleet_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/fleet"
+)
+
+type flightDrone struct {
+	fakeDrone
+	voltage, current float32
+	alt              float32
+}
+
+func (d *flightDrone) GetBattery() *drone.BatteryStat {
+	return &drone.BatteryStat{Voltage: d.voltage, Current: d.current, Remaining: -1}
+}
+func (d *flightDrone) GetGPS() *drone.Gps  { return &drone.Gps{Alt: d.alt} }
+func (d *flightDrone) GetHome() *drone.Gps { return &drone.Gps{Alt: 0} }
+
+func TestMaintenance(t *testing.T) {
+	dir := t.TempDir()
+	inv, _ := fleet.OpenInventory("")
+	if err := inv.Put(&fleet.Airframe{UID: "a1", Name: "Alpha", Batteries: []string{"B-01"}}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "maintenance.json")
+	m, err := fleet.OpenMaintenance(path, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetConfig(fleet.MaintenanceConfig{
+		Airframe: []fleet.Threshold{{Metric: fleet.MetricFlightHours, Max: 100}},
+		Battery:  []fleet.Threshold{{Metric: fleet.MetricCycles, Max: 2, Block: true}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &flightDrone{fakeDrone: fakeDrone{id: 1, status: drone.StatusReady}, voltage: 16.8}
+	now := time.Unix(1000, 0)
+	fly := func() {
+		d.status = drone.StatusArmed
+		for i := range 60 {
+			d.alt = 0
+			if i >= 10 && i < 50 {
+				d.alt = 10
+			}
+			d.current = 20
+			d.voltage = 16.8 - (float32)(i)*0.02
+			if err := m.Sample("a1", d, now); err != nil {
+				t.Fatal(err)
+			}
+			now = now.Add(time.Second)
+		}
+		d.status, d.current = drone.StatusReady, 0
+		m.Sample("a1", d, now)
+		now = now.Add(time.Second)
+	}
+	m.Sample("a1", d, now)
+	fly()
+
+	u := m.Airframes()["a1"]
+	if u.Takeoffs != 1 || u.Cycles != 1 || (time.Duration)(u.FlightTime) != 40*time.Second || (time.Duration)(u.ArmedTime) != 59*time.Second {
+		t.Fatalf("Unexpected usage %#v", u)
+	}
+	if u.MaxCurrent != 20 || u.MinVoltage > 15.7 || u.Energy < 5 || u.Energy > 6 {
+		t.Fatalf("Unexpected battery usage %#v", u)
+	}
+	inspect := m.NewInspector(func(drone.Drone) string { return "a1" })
+	if err := inspect(context.Background(), d, func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	fly()
+	if err := inspect(context.Background(), d, func(string) {}); err == nil {
+		t.Fatal("Expected battery cycles to block the drone")
+	}
+
+	m, err = fleet.OpenMaintenance(path, inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := m.Batteries()["B-01"]; b.Cycles != 2 || b.Takeoffs != 2 || (time.Duration)(b.FlightTime) != 80*time.Second {
+		t.Fatalf("Battery usage is not persisted: %#v", b)
+	}
+	if issues := m.Check("a1"); len(issues) != 1 || issues[0].Kind != "battery" {
+		t.Fatalf("Unexpected issues %v", issues)
+	}
+
+	// with more than one pack, only the installed one is counted
+	if err := inv.Put(&fleet.Airframe{UID: "a1", Name: "Alpha", Batteries: []string{"B-01", "B-02"}}); err != nil {
+		t.Fatal(err)
+	}
+	fly()
+	if b := m.Batteries()["B-01"]; b.Cycles != 2 {
+		t.Fatalf("Unknown installed pack should not be counted: %#v", b)
+	}
+	if err := inv.InstallBattery("a1", "B-03"); err == nil {
+		t.Fatal("Expected error installing a pack not belonging to the airframe")
+	}
+	if err := inv.InstallBattery("a1", "B-02"); err != nil {
+		t.Fatal(err)
+	}
+	fly()
+	if b := m.Batteries()["B-02"]; b.Cycles != 1 || (time.Duration)(b.FlightTime) != 40*time.Second {
+		t.Fatalf("Unexpected installed pack usage %#v", b)
+	}
+	if b := m.Batteries()["B-01"]; b.Cycles != 2 {
+		t.Fatalf("Removed pack should not be counted: %#v", b)
+	}
+}
@@ -0,0 +1,244 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fleet
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/zyxkad/drone"
+)
+
+var ErrInvalidName = errors.New("Name can only contain letters, digits, '-', '_' and '.'")
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Resolver resolves the groups and tags in a selector
+type Resolver interface {
+	Group(name string) ([]int, bool)
+	HasTag(id int, tag string) bool
+}
+
+type termKind int
+
+const (
+	termAll termKind = iota
+	termRange
+	termGroup
+	termTag
+)
+
+type term struct {
+	kind     termKind
+	min, max int
+	name     string
+}
+
+func (t *term) match(d drone.Drone, r Resolver) bool {
+	switch t.kind {
+	case termAll:
+		return true
+	case termRange:
+		return t.min <= d.ID() && d.ID() <= t.max
+	case termGroup:
+		ids, _ := r.Group(t.name)
+		return slices.Contains(ids, d.ID())
+	case termTag:
+		return r.HasTag(d.ID(), t.name)
+	}
+	return false
+}
+
+// Selector selects drones by an expression
+//
+// The expression is a list of terms separated by spaces or commas:
+//
+//	12         drone 12
+//	3-8        drones 3 to 8
+//	@name      the drones in group name
+//	#name      the drones with tag name
+//	all, *     all drones
+//	-term      excludes the drones matched by term, e.g. -@spares
+//	status:A|B only the drones whose status is A or B, e.g. status:READY|ARMED
+//	battery<N  only the drones whose battery remaining is less than N percent, battery>N is also supported
+//
+// The selected drones are the union of the including terms, or all drones if there is no including term,
+// minus the excluded drones, then filtered by every filter
+type Selector struct {
+	expr     string
+	includes []*term
+	excludes []*term
+	status   []drone.DroneStatus
+	filters  []func(drone.Drone) bool
+}
+
+var statusNames = map[string]drone.DroneStatus{
+	"N/A":      drone.StatusNone,
+	"NONE":     drone.StatusNone,
+	"UNSTABLE": drone.StatusUnstable,
+	"READY":    drone.StatusReady,
+	"SLEEPING": drone.StatusSleeping,
+	"ARMED":    drone.StatusArmed,
+	"TAKENOFF": drone.StatusTakenoff,
+	"MANUAL":   drone.StatusManual,
+	"ERROR":    drone.StatusError,
+}
+
+func ParseSelector(expr string) (*Selector, error) {
+	s := &Selector{
+		expr: expr,
+	}
+	fields := strings.FieldsFunc(expr, func(r rune) bool {
+		return r == ' ' || r == ',' || r == '\t' || r == '\n'
+	})
+	for _, f := range fields {
+		if name, ok := strings.CutPrefix(f, "status:"); ok {
+			for _, n := range strings.Split(name, "|") {
+				st, ok := statusNames[strings.ToUpper(n)]
+				if !ok {
+					return nil, fmt.Errorf("Unknown status %q", n)
+				}
+				s.status = append(s.status, st)
+			}
+			continue
+		}
+		if v, ok := strings.CutPrefix(f, "battery"); ok && len(v) > 1 && (v[0] == '<' || v[0] == '>') {
+			n, err := strconv.ParseFloat(v[1:], 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid battery filter %q: %w", f, err)
+			}
+			limit := (float32)(n / 100)
+			less := v[0] == '<'
+			s.filters = append(s.filters, func(d drone.Drone) bool {
+				bat := d.GetBattery()
+				if bat == nil || bat.Remaining < 0 {
+					return false
+				}
+				return (bat.Remaining < limit) == less
+			})
+			continue
+		}
+		exclude := false
+		if rest, ok := strings.CutPrefix(f, "-"); ok {
+			exclude, f = true, rest
+		}
+		t, err := parseTerm(f)
+		if err != nil {
+			return nil, err
+		}
+		if exclude {
+			s.excludes = append(s.excludes, t)
+		} else {
+			s.includes = append(s.includes, t)
+		}
+	}
+	return s, nil
+}
+
+func parseTerm(f string) (*term, error) {
+	switch {
+	case f == "":
+		return nil, errors.New("Empty term")
+	case f == "all" || f == "*":
+		return &term{kind: termAll}, nil
+	case f[0] == '@' || f[0] == '#':
+		name := f[1:]
+		if !validName(name) {
+			return nil, fmt.Errorf("Invalid name %q", name)
+		}
+		if f[0] == '@' {
+			return &term{kind: termGroup, name: name}, nil
+		}
+		return &term{kind: termTag, name: name}, nil
+	}
+	lo, hi, isRange := strings.Cut(f, "-")
+	a, err := strconv.Atoi(lo)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid term %q", f)
+	}
+	b := a
+	if isRange {
+		if b, err = strconv.Atoi(hi); err != nil {
+			return nil, fmt.Errorf("Invalid term %q", f)
+		}
+		if b < a {
+			a, b = b, a
+		}
+	}
+	return &term{kind: termRange, min: a, max: b}, nil
+}
+
+func (s *Selector) String() string {
+	return s.expr
+}
+
+// Match reports whether the drone is selected
+func (s *Selector) Match(d drone.Drone, r Resolver) bool {
+	if len(s.includes) > 0 {
+		included := false
+		for _, t := range s.includes {
+			if t.match(d, r) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, t := range s.excludes {
+		if t.match(d, r) {
+			return false
+		}
+	}
+	if len(s.status) > 0 && !slices.Contains(s.status, d.GetStatus()) {
+		return false
+	}
+	for _, f := range s.filters {
+		if !f(d) {
+			return false
+		}
+	}
+	return true
+}
+
+// Select returns the selected drones, sorted by ID
+func (s *Selector) Select(drones []drone.Drone, r Resolver) []drone.Drone {
+	selected := make([]drone.Drone, 0, len(drones))
+	for _, d := range drones {
+		if s.Match(d, r) {
+			selected = append(selected, d)
+		}
+	}
+	slices.SortFunc(selected, func(a, b drone.Drone) int {
+		return a.ID() - b.ID()
+	})
+	return selected
+}
@@ -0,0 +1,111 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fleet_test
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/fleet"
+)
+
+type fakeDrone struct {
+	drone.Drone
+	id      int
+	status  drone.DroneStatus
+	battery float32
+}
+
+func (d *fakeDrone) ID() int                      { return d.id }
+func (d *fakeDrone) GetStatus() drone.DroneStatus { return d.status }
+func (d *fakeDrone) GetBattery() *drone.BatteryStat {
+	return &drone.BatteryStat{Voltage: -1, Current: -1, Remaining: d.battery}
+}
+
+func TestSelector(t *testing.T) {
+	var drones []drone.Drone
+	for i := 1; i <= 10; i++ {
+		st := drone.StatusReady
+		if i%3 == 0 {
+			st = drone.StatusArmed
+		}
+		drones = append(drones, &fakeDrone{id: i, status: st, battery: (float32)(i) / 10})
+	}
+	path := filepath.Join(t.TempDir(), "groups.json")
+	store, err := fleet.OpenGroupStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetGroup("left-wing", []int{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetTags(2, []string{"spares"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetTags(9, []string{"spares", "batch-A"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []struct {
+		expr string
+		ids  []int
+	}{
+		{"", []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{"1, 5 7-8", []int{1, 5, 7, 8}},
+		{"@left-wing", []int{1, 2, 3, 4}},
+		{"@left-wing -#spares", []int{1, 3, 4}},
+		{"#spares", []int{2, 9}},
+		{"-#spares", []int{1, 3, 4, 5, 6, 7, 8, 10}},
+		{"all status:ARMED", []int{3, 6, 9}},
+		{"@left-wing status:ready|armed battery<35", []int{1, 2, 3}},
+		{"battery>75 -10", []int{8, 9}},
+	}
+	for _, d := range data {
+		sel, err := fleet.ParseSelector(d.expr)
+		if err != nil {
+			t.Errorf("Cannot parse %q: %v", d.expr, err)
+			continue
+		}
+		var ids []int
+		for _, dr := range sel.Select(drones, store) {
+			ids = append(ids, dr.ID())
+		}
+		if !slices.Equal(ids, d.ids) {
+			t.Errorf("Select(%q) = %v, expect %v", d.expr, ids, d.ids)
+		}
+	}
+
+	for _, expr := range []string{"@", "status:FLYING", "a-b", "battery<x"} {
+		if _, err := fleet.ParseSelector(expr); err == nil {
+			t.Errorf("Expect error for %q", expr)
+		}
+	}
+
+	// reload from the file
+	reloaded, err := fleet.OpenGroupStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := reloaded.Group("left-wing"); !slices.Equal(ids, []int{1, 2, 3, 4}) {
+		t.Errorf("Reloaded group is %v", ids)
+	}
+	if !reloaded.HasTag(9, "batch-A") {
+		t.Errorf("Reloaded tags are %v", reloaded.AllTags())
+	}
+}
@@ -0,0 +1,97 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fleet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zyxkad/drone"
+)
+
+// ReassignSystemID changes the drone's SYSID_THISMAV, reboots it and waits until it reconnects with the new ID
+// The new drone is verified by its UID and its SYSID_THISMAV parameter
+// The parameter is sent to the system ID, so all the vehicles sharing a duplicated ID will receive it,
+// the other vehicles must be powered off before reassigning a duplicated ID
+func ReassignSystemID(ctx context.Context, c drone.Controller, d drone.Drone, newID int) (drone.Drone, error) {
+	if newID < 1 || newID > 255 {
+		return nil, fmt.Errorf("System ID %d out of range [1, 255]", newID)
+	}
+	if newID == d.ID() {
+		return d, nil
+	}
+	if c.GetDrone(newID) != nil {
+		return nil, fmt.Errorf("System ID %d is already used", newID)
+	}
+	if d.GetStatus().IsActive() {
+		return nil, errors.New("Cannot reassign the system ID of an armed drone")
+	}
+	pa, ok := d.(drone.ParamAbility)
+	if !ok {
+		return nil, errors.New("Drone does not support parameters")
+	}
+	var uid string
+	if ia, ok := d.(drone.IdentityAbility); ok {
+		var err error
+		if uid, err = ia.UID(ctx); err != nil {
+			return nil, fmt.Errorf("Cannot read UID: %w", err)
+		}
+	}
+	if err := pa.SetParam(ctx, "SYSID_THISMAV", (float32)(newID)); err != nil {
+		return nil, fmt.Errorf("Cannot set SYSID_THISMAV: %w", err)
+	}
+	if err := d.Reboot(ctx); err != nil {
+		return nil, fmt.Errorf("Cannot reboot: %w", err)
+	}
+
+	ticker := time.NewTicker(time.Millisecond * 500)
+	defer ticker.Stop()
+	var nd drone.Drone
+	for nd == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Drone did not reconnect as %d: %w", newID, context.Cause(ctx))
+		}
+		nd = c.GetDrone(newID)
+	}
+	if uid != "" {
+		ia, ok := nd.(drone.IdentityAbility)
+		if !ok {
+			return nil, errors.New("Reconnected drone cannot report its UID")
+		}
+		newUID, err := ia.UID(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read UID of the reconnected drone: %w", err)
+		}
+		if newUID != uid {
+			return nil, fmt.Errorf("Drone %d has UID %s, expect %s", newID, newUID, uid)
+		}
+	}
+	if npa, ok := nd.(drone.ParamAbility); ok {
+		v, err := npa.GetParam(ctx, "SYSID_THISMAV")
+		if err != nil {
+			return nil, fmt.Errorf("Cannot verify SYSID_THISMAV: %w", err)
+		}
+		if (int)(v) != newID {
+			return nil, fmt.Errorf("SYSID_THISMAV is %v after reboot, expect %d", v, newID)
+		}
+	}
+	return nd, nil
+}
@@ -0,0 +1,93 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fleet_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/fleet"
+)
+
+type fakeController struct {
+	drone.Controller
+	mux    sync.Mutex
+	drones map[int]drone.Drone
+}
+
+func (c *fakeController) GetDrone(id int) drone.Drone {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.drones[id]
+}
+
+// paramDrone reconnects with SYSID_THISMAV after rebooted
+type paramDrone struct {
+	identityDrone
+	controller *fakeController
+	sysid      float32
+}
+
+func (d *paramDrone) GetParam(ctx context.Context, name string) (float32, error) {
+	return d.sysid, nil
+}
+
+func (d *paramDrone) SetParam(ctx context.Context, name string, value float32) error {
+	d.sysid = value
+	return nil
+}
+
+func (d *paramDrone) Reboot(ctx context.Context) error {
+	nd := &paramDrone{
+		identityDrone: identityDrone{fakeDrone: fakeDrone{id: (int)(d.sysid)}, uid: d.uid},
+		controller:    d.controller,
+		sysid:         d.sysid,
+	}
+	time.AfterFunc(time.Millisecond*100, func() {
+		d.controller.mux.Lock()
+		defer d.controller.mux.Unlock()
+		d.controller.drones[nd.id] = nd
+	})
+	return nil
+}
+
+func TestReassignSystemID(t *testing.T) {
+	c := &fakeController{drones: make(map[int]drone.Drone)}
+	d := &paramDrone{
+		identityDrone: identityDrone{fakeDrone: fakeDrone{id: 1, status: drone.StatusReady}, uid: "abcd"},
+		controller:    c,
+		sysid:         1,
+	}
+	c.drones[1] = d
+	c.drones[2] = &fakeDrone{id: 2}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if _, err := fleet.ReassignSystemID(ctx, c, d, 2); err == nil {
+		t.Fatal("Expected used system ID error")
+	}
+	nd, err := fleet.ReassignSystemID(ctx, c, d, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd.ID() != 5 || nd.(*paramDrone).uid != "abcd" {
+		t.Fatalf("Unexpected reconnected drone %d", nd.ID())
+	}
+}
@@ -0,0 +1,461 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rtk
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// casterWriteTimeout drops a client which cannot receive a frame in time
+const casterWriteTimeout = 10 * time.Second
+
+var (
+	ErrMountExists      = errors.New("Mountpoint already exists")
+	ErrInvalidMountName = errors.New("Mountpoint name is invalid")
+)
+
+// Mountpoint is a RTCM stream of a Caster, which is described by a STR record of the sourcetable
+type Mountpoint struct {
+	Name          string  `json:"name"`
+	Identifier    string  `json:"identifier"` // usually the city name of the base station
+	Format        string  `json:"format"`
+	FormatDetails string  `json:"formatDetails"` // e.g. "1005(5),1077(1)"
+	Carrier       int     `json:"carrier"`       // 0: no, 1: L1, 2: L1 and L2
+	NavSystem     string  `json:"navSystem"`     // e.g. "GPS+GLO+GAL+BDS"
+	Network       string  `json:"network"`
+	Country       string  `json:"country"` // ISO 3166 country code
+	Latitude      float64 `json:"latitude"`
+	Longitude     float64 `json:"longitude"`
+	Generator     string  `json:"generator"`
+	Bitrate       int     `json:"bitrate"`
+
+	// Source returns the proxy of the base station, or nil if it is not connected
+	// Clients receive the frames of the proxy when they connect, and are disconnected when it is closed
+	Source func() *Proxy `json:"-"`
+}
+
+func (m *Mountpoint) setDefaults() {
+	if m.Format == "" {
+		m.Format = "RTCM 3.3"
+	}
+	if m.Carrier == 0 {
+		m.Carrier = 2
+	}
+	if m.Generator == "" {
+		m.Generator = "drone"
+	}
+}
+
+// sanitizeField removes the separators of the sourcetable
+func sanitizeField(s string) string {
+	return strings.NewReplacer(";", ",", "\r", "", "\n", "").Replace(s)
+}
+
+// str formats the STR record of the mountpoint
+func (m *Mountpoint) str(auth bool) string {
+	authType := "N"
+	if auth {
+		authType = "B"
+	}
+	return strings.Join([]string{
+		"STR",
+		sanitizeField(m.Name),
+		sanitizeField(m.Identifier),
+		sanitizeField(m.Format),
+		sanitizeField(m.FormatDetails),
+		fmt.Sprint(m.Carrier),
+		sanitizeField(m.NavSystem),
+		sanitizeField(m.Network),
+		sanitizeField(m.Country),
+		fmt.Sprintf("%.2f", m.Latitude),
+		fmt.Sprintf("%.2f", m.Longitude),
+		"0", // the stream does not require NMEA from the rover
+		"0", // single base solution
+		sanitizeField(m.Generator),
+		"none",
+		authType,
+		"N",
+		fmt.Sprint(m.Bitrate),
+		"",
+	}, ";")
+}
+
+// CasterClient is a rover connected to a Caster
+type CasterClient struct {
+	Mount     string    `json:"mount"`
+	User      string    `json:"user"`
+	Addr      string    `json:"addr"`
+	Agent     string    `json:"agent"`
+	Version   int       `json:"version"` // NTRIP version
+	Connected time.Time `json:"connected"`
+	Sent      uint64    `json:"sent"`    // in bytes
+	LastGGA   string    `json:"lastGGA"` // the last position reported by the rover
+}
+
+type casterClient struct {
+	info    CasterClient
+	sent    atomic.Uint64
+	lastGGA atomic.Pointer[string]
+	cancel  context.CancelFunc
+}
+
+// Caster is a NTRIP v1 and v2 caster which serves the mountpoints over HTTP
+type Caster struct {
+	name string
+
+	mux     sync.RWMutex
+	mounts  map[string]*Mountpoint
+	users   map[string]string
+	clients map[*casterClient]struct{}
+}
+
+var _ http.Handler = (*Caster)(nil)
+
+// NewCaster creates a caster, the name is sent as the server header
+func NewCaster(name string) *Caster {
+	return &Caster{
+		name:    name,
+		mounts:  make(map[string]*Mountpoint),
+		users:   make(map[string]string),
+		clients: make(map[*casterClient]struct{}),
+	}
+}
+
+// SetUsers replaces the users which can access the streams, an empty map disables the authentication
+func (c *Caster) SetUsers(users map[string]string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.users = make(map[string]string, len(users))
+	for u, p := range users {
+		c.users[u] = p
+	}
+}
+
+func (c *Caster) Mounts() []*Mountpoint {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	mounts := make([]*Mountpoint, 0, len(c.mounts))
+	for _, m := range c.mounts {
+		mounts = append(mounts, m)
+	}
+	slices.SortFunc(mounts, func(a, b *Mountpoint) int { return strings.Compare(a.Name, b.Name) })
+	return mounts
+}
+
+func (c *Caster) AddMount(m *Mountpoint) error {
+	if m.Name == "" || strings.ContainsAny(m.Name, "/;? \r\n") {
+		return ErrInvalidMountName
+	}
+	m.setDefaults()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if _, ok := c.mounts[m.Name]; ok {
+		return ErrMountExists
+	}
+	c.mounts[m.Name] = m
+	return nil
+}
+
+// RemoveMount removes the mountpoint and disconnects its clients
+func (c *Caster) RemoveMount(name string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.mounts, name)
+	for client := range c.clients {
+		if client.info.Mount == name {
+			client.cancel()
+		}
+	}
+}
+
+// Close disconnects all clients
+func (c *Caster) Close() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for client := range c.clients {
+		client.cancel()
+	}
+}
+
+// Clients returns a snapshot of the connected clients
+func (c *Caster) Clients() []CasterClient {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	clients := make([]CasterClient, 0, len(c.clients))
+	for client := range c.clients {
+		info := client.info
+		info.Sent = client.sent.Load()
+		if gga := client.lastGGA.Load(); gga != nil {
+			info.LastGGA = *gga
+		}
+		clients = append(clients, info)
+	}
+	slices.SortFunc(clients, func(a, b CasterClient) int { return a.Connected.Compare(b.Connected) })
+	return clients
+}
+
+// Sourcetable returns the sourcetable without the ENDSOURCETABLE line
+func (c *Caster) Sourcetable() string {
+	c.mux.RLock()
+	auth := len(c.users) > 0
+	c.mux.RUnlock()
+	var sb strings.Builder
+	for _, m := range c.Mounts() {
+		sb.WriteString(m.str(auth))
+		sb.WriteString("\r\n")
+	}
+	return sb.String()
+}
+
+func (c *Caster) authorize(req *http.Request) (string, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if len(c.users) == 0 {
+		return "", true
+	}
+	user, pass, ok := req.BasicAuth()
+	if !ok {
+		return user, false
+	}
+	want, ok := c.users[user]
+	return user, ok && subtle.ConstantTimeCompare(([]byte)(pass), ([]byte)(want)) == 1
+}
+
+func ntripVersion(req *http.Request) int {
+	if strings.Contains(strings.ToLower(req.Header.Get("Ntrip-Version")), "ntrip/2") {
+		return 2
+	}
+	return 1
+}
+
+// ntripError replies an error and closes the connection, since NTRIP v2 rovers
+// keep the request body open for GGA uploads and it will never be drained
+func ntripError(rw http.ResponseWriter, msg string, code int) {
+	rw.Header().Set("Connection", "close")
+	http.Error(rw, msg, code)
+}
+
+func (c *Caster) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	version := ntripVersion(req)
+	rw.Header().Set("Server", "NTRIP "+c.name)
+	if version == 2 {
+		rw.Header().Set("Ntrip-Version", "Ntrip/2.0")
+	}
+	if req.Method != http.MethodGet {
+		ntripError(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	c.mux.RLock()
+	mount := c.mounts[name]
+	c.mux.RUnlock()
+	if mount == nil {
+		if name != "" && version == 2 {
+			ntripError(rw, "Mountpoint not found", http.StatusNotFound)
+			return
+		}
+		// NTRIP v1 casters answer the sourcetable for an unknown mountpoint
+		c.serveSourcetable(rw, version)
+		return
+	}
+	user, ok := c.authorize(req)
+	if !ok {
+		rw.Header().Set("WWW-Authenticate", `Basic realm="`+mount.Name+`"`)
+		ntripError(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var proxy *Proxy
+	if mount.Source != nil {
+		proxy = mount.Source()
+	}
+	if proxy == nil {
+		ntripError(rw, "Stream is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	client := &casterClient{
+		info: CasterClient{
+			Mount:     mount.Name,
+			User:      user,
+			Addr:      req.RemoteAddr,
+			Agent:     req.UserAgent(),
+			Version:   version,
+			Connected: time.Now(),
+		},
+		cancel: cancel,
+	}
+	c.mux.Lock()
+	c.clients[client] = struct{}{}
+	c.mux.Unlock()
+	defer func() {
+		c.mux.Lock()
+		delete(c.clients, client)
+		c.mux.Unlock()
+	}()
+
+	if version == 2 {
+		c.serveStreamV2(ctx, rw, req, proxy, client)
+	} else {
+		c.serveStreamV1(ctx, rw, proxy, client)
+	}
+}
+
+func (c *Caster) serveSourcetable(rw http.ResponseWriter, version int) {
+	table := c.Sourcetable() + "ENDSOURCETABLE\r\n"
+	if version == 2 {
+		rw.Header().Set("Content-Type", "gnss/sourcetable")
+		rw.Header().Set("Content-Length", fmt.Sprint(len(table)))
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(([]byte)(table))
+		return
+	}
+	conn, bw, err := http.NewResponseController(rw).Hijack()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(bw, "SOURCETABLE 200 OK\r\nServer: NTRIP %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n", c.name, len(table))
+	bw.WriteString(table)
+	bw.Flush()
+}
+
+// serveStreamV2 streams with HTTP chunked encoding, and the rover may upload NMEA in the request body
+func (c *Caster) serveStreamV2(ctx context.Context, rw http.ResponseWriter, req *http.Request, proxy *Proxy, client *casterClient) {
+	rc := http.NewResponseController(rw)
+	// the rover may send GGA while receiving the stream
+	rc.EnableFullDuplex()
+	rw.Header().Set("Content-Type", "gnss/data")
+	rw.Header().Set("Cache-Control", "no-store, no-cache, max-age=0")
+	rw.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	go readGGA(ctx, bufio.NewReader(req.Body), client)
+	c.stream(ctx, proxy, client, func(buf []byte) error {
+		rc.SetWriteDeadline(time.Now().Add(casterWriteTimeout))
+		if _, err := rw.Write(buf); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+}
+
+// serveStreamV1 streams the raw bytes after an ICY response
+func (c *Caster) serveStreamV1(ctx context.Context, rw http.ResponseWriter, proxy *Proxy, client *casterClient) {
+	conn, bw, err := http.NewResponseController(rw).Hijack()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	if _, err := bw.WriteString("ICY 200 OK\r\n\r\n"); err != nil {
+		return
+	}
+	if err := bw.Flush(); err != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		readGGA(ctx, bw.Reader, client)
+		// the rover has disconnected
+		cancel()
+	}()
+	go func() {
+		<-ctx.Done()
+		conn.SetDeadline(time.Now())
+	}()
+	c.stream(ctx, proxy, client, func(buf []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(casterWriteTimeout))
+		_, err := conn.Write(buf)
+		return err
+	})
+}
+
+func (c *Caster) stream(ctx context.Context, proxy *Proxy, client *casterClient, write func([]byte) error) {
+	pc := proxy.NewConn()
+	defer pc.Close()
+	for {
+		select {
+		case frame := <-pc.RTCMMessages():
+			buf := frame.Serialize()
+			if err := write(buf); err != nil {
+				return
+			}
+			client.sent.Add((uint64)(len(buf)))
+		case <-pc.closedCh:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readGGA records the GGA sentences sent by the rover
+func readGGA(ctx context.Context, r *bufio.Reader, client *casterClient) {
+	for ctx.Err() == nil {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		if len(line) > 6 && line[0] == '$' && line[3:6] == "GGA" {
+			client.lastGGA.Store(&line)
+		}
+	}
+}
+
+// ListenAndServe serves the caster on the address until the context is canceled
+func (c *Caster) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return c.Serve(ctx, l)
+}
+
+// Serve serves the caster on the listener until the context is canceled
+func (c *Caster) Serve(ctx context.Context, l net.Listener) error {
+	server := &http.Server{
+		Handler:           c,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+		// hijacked NTRIP v1 connections are not closed by the server
+		c.Close()
+	}()
+	if err := server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rtk_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-gnss/rtcm/rtcm3"
+
+	"github.com/zyxkad/drone/ext/rtk"
+)
+
+func newTestCaster(t *testing.T) (*rtk.Caster, net.Conn, *httptest.Server) {
+	t.Helper()
+	base, src := net.Pipe()
+	proxy := rtk.NewProxy(src)
+	t.Cleanup(func() {
+		proxy.Close()
+		base.Close()
+	})
+	caster := rtk.NewCaster("test")
+	if err := caster.AddMount(&rtk.Mountpoint{
+		Name:      "BASE",
+		NavSystem: "GPS+GLO",
+		Latitude:  31.23,
+		Longitude: 121.47,
+		Source:    func() *rtk.Proxy { return proxy },
+	}); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(caster)
+	t.Cleanup(server.Close)
+	t.Cleanup(caster.Close)
+	return caster, base, server
+}
+
+// feedFrames writes the frame to the base station until done is closed,
+// since a client only receives the frames after it is connected
+func feedFrames(base net.Conn, frame rtcm3.Frame, done <-chan struct{}) {
+	buf := frame.Serialize()
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+		base.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := base.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+func TestCasterSourcetable(t *testing.T) {
+	_, _, server := newTestCaster(t)
+
+	req, _ := http.NewRequest("GET", server.URL+"/", nil)
+	req.Header.Set("Ntrip-Version", "Ntrip/2.0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "gnss/sourcetable" {
+		t.Errorf("Content-Type is %q", ct)
+	}
+	table := string(body)
+	if !strings.HasPrefix(table, "STR;BASE;") || !strings.Contains(table, ";GPS+GLO;") ||
+		!strings.Contains(table, ";31.23;121.47;") || !strings.HasSuffix(table, "ENDSOURCETABLE\r\n") {
+		t.Errorf("Unexpected sourcetable:\n%s", table)
+	}
+
+	// a v2 client gets 404 for an unknown mountpoint
+	req, _ = http.NewRequest("GET", server.URL+"/NONE", nil)
+	req.Header.Set("Ntrip-Version", "Ntrip/2.0")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Status is %d, want 404", resp.StatusCode)
+	}
+
+	// a v1 client gets the sourcetable
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /NONE HTTP/1.0\r\nUser-Agent: NTRIP test\r\n\r\n")
+	body, _ = io.ReadAll(conn)
+	if !bytes.HasPrefix(body, ([]byte)("SOURCETABLE 200 OK\r\n")) || !bytes.Contains(body, ([]byte)("STR;BASE;")) {
+		t.Errorf("Unexpected v1 sourcetable:\n%s", body)
+	}
+}
+
+func TestCasterStreamV2(t *testing.T) {
+	caster, base, server := newTestCaster(t)
+	caster.SetUsers(map[string]string{"rover": "secret"})
+	frame := readFrame(t, 1077)
+
+	// a rover keeps the request body open for GGA uploads, the error must not wait for it
+	upR, upW := io.Pipe()
+	defer upW.Close()
+	req, _ := http.NewRequest("GET", server.URL+"/BASE", upR)
+	req.Header.Set("Ntrip-Version", "Ntrip/2.0")
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Status is %d, want 401", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest("GET", server.URL+"/BASE", nil)
+	req.Header.Set("Ntrip-Version", "Ntrip/2.0")
+	req.SetBasicAuth("rover", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "gnss/data" {
+		t.Fatalf("Unexpected response: %d %v", resp.StatusCode, resp.Header)
+	}
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("Stream is not chunked: %v", resp.TransferEncoding)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go feedFrames(base, frame, done)
+	got, err := rtcm3.DeserializeFrame(bufio.NewReader(resp.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Serialize(), frame.Serialize()) {
+		t.Errorf("Received frame mismatch")
+	}
+	clients := caster.Clients()
+	if len(clients) != 1 || clients[0].User != "rover" || clients[0].Version != 2 || clients[0].Sent == 0 {
+		t.Errorf("Unexpected clients: %#v", clients)
+	}
+}
+
+func TestCasterStreamV1(t *testing.T) {
+	caster, base, server := newTestCaster(t)
+	frame := readFrame(t, 1005)
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /BASE HTTP/1.0\r\nUser-Agent: NTRIP test\r\n\r\n")
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	if err != nil || status != "ICY 200 OK\r\n" {
+		t.Fatalf("Unexpected status %q: %v", status, err)
+	}
+	if line, _ := br.ReadString('\n'); line != "\r\n" {
+		t.Fatalf("Unexpected header %q", line)
+	}
+	io.WriteString(conn, "$GPGGA,000000.00,3113.800,N,12128.200,E,1,12,1.0,10.0,M,0.0,M,,*65\r\n")
+
+	done := make(chan struct{})
+	defer close(done)
+	go feedFrames(base, frame, done)
+	got, err := rtcm3.DeserializeFrame(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Serialize(), frame.Serialize()) {
+		t.Errorf("Received frame mismatch")
+	}
+	var clients []rtk.CasterClient
+	for range 50 {
+		if clients = caster.Clients(); len(clients) == 1 && clients[0].LastGGA != "" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(clients) != 1 || !strings.HasPrefix(clients[0].LastGGA, "$GPGGA") {
+		t.Errorf("Unexpected clients: %#v", clients)
+	}
+
+	caster.RemoveMount("BASE")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		t.Errorf("Client is not disconnected after the mount is removed: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rtk
+
+import (
+	"sync"
+	"time"
+)
+
+// maxFrameLen is the largest RTCM3 frame
+const maxFrameLen = 1023 + frameOverhead
+
+// DecimatePolicy decides which RTCM frames are forwarded
+//
+// MSM frames carry the corrections and are never dropped. When they exceed the budget,
+// they borrow from the following seconds, and the other messages are deferred until the debt is paid.
+// A deferred message with an interval is sent anyway once it is late by another interval,
+// so the rovers always receive the station position.
+type DecimatePolicy struct {
+	// Budget is the max bytes per second, 0 means unlimited
+	Budget float64
+	// Intervals is the min interval of each message number, messages not listed are sent every time
+	Intervals map[int]time.Duration
+}
+
+// DefaultDecimatePolicy sends the station messages every few seconds, and MSM every epoch
+func DefaultDecimatePolicy() DecimatePolicy {
+	return DecimatePolicy{
+		Intervals: map[int]time.Duration{
+			1005: 5 * time.Second, // station ARP
+			1006: 5 * time.Second, // station ARP with height
+			1007: 10 * time.Second,
+			1008: 10 * time.Second,
+			1033: 10 * time.Second, // receiver and antenna descriptors
+			1230: 5 * time.Second,  // GLONASS code-phase biases
+		},
+	}
+}
+
+// DecimateStats is the counters of a Decimator
+type DecimateStats struct {
+	SentFrames       uint64 `json:"sentFrames"`
+	SentBytes        uint64 `json:"sentBytes"`
+	SkippedFrames    uint64 `json:"skippedFrames"` // not due by the intervals
+	SkippedBytes     uint64 `json:"skippedBytes"`
+	DeferredFrames   uint64 `json:"deferredFrames"` // not MSM, and over the budget
+	DeferredBytes    uint64 `json:"deferredBytes"`
+	OverBudgetFrames uint64 `json:"overBudgetFrames"` // sent with borrowed budget
+	OverBudgetBytes  uint64 `json:"overBudgetBytes"`
+}
+
+// Decimator limits the RTCM frames forwarded to the drones
+type Decimator struct {
+	mux      sync.Mutex
+	policy   DecimatePolicy
+	budget   float64 // the effective budget, see SetBudget
+	tokens   float64
+	last     time.Time
+	lastSent map[int]time.Time
+	stats    DecimateStats
+}
+
+func NewDecimator(policy DecimatePolicy) *Decimator {
+	d := &Decimator{
+		lastSent: make(map[int]time.Time),
+	}
+	d.SetPolicy(policy)
+	return d
+}
+
+func (d *Decimator) Policy() DecimatePolicy {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.policy
+}
+
+func (d *Decimator) SetPolicy(policy DecimatePolicy) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.policy = policy
+	d.budget = policy.Budget
+	d.tokens = d.burst()
+}
+
+// SetBudget changes the budget if the policy does not have one
+func (d *Decimator) SetBudget(budget float64) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.policy.Budget > 0 {
+		return
+	}
+	d.budget = budget
+	d.tokens = min(d.tokens, d.burst())
+}
+
+// Budget returns the effective budget in bytes per second, 0 means unlimited
+func (d *Decimator) Budget() float64 {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.budget
+}
+
+// burst allows one second of budget, but at least a full frame
+func (d *Decimator) burst() float64 {
+	return max(d.budget, maxFrameLen)
+}
+
+// Allow reports whether a frame of the message number with size bytes should be sent
+// A frame which was split should be checked with the total size, so an epoch is never partially sent
+// MSM frames are always allowed, see DecimatePolicy
+func (d *Decimator) Allow(num int, size int, now time.Time) bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if !d.last.IsZero() {
+		d.tokens = min(d.burst(), d.tokens+d.budget*now.Sub(d.last).Seconds())
+	}
+	d.last = now
+
+	if interval, ok := d.policy.Intervals[num]; ok && interval > 0 {
+		if last, ok := d.lastSent[num]; ok && now.Sub(last) < interval {
+			d.stats.SkippedFrames++
+			d.stats.SkippedBytes += (uint64)(size)
+			return false
+		}
+	}
+	if d.budget > 0 {
+		if d.tokens < (float64)(size) {
+			if !IsMSM(num) && !d.overdue(num, now) {
+				// lastSent is not updated, so a due message is retried with the next frame
+				d.stats.DeferredFrames++
+				d.stats.DeferredBytes += (uint64)(size)
+				return false
+			}
+			d.stats.OverBudgetFrames++
+			d.stats.OverBudgetBytes += (uint64)(size)
+		}
+		// the debt is limited to one burst, so a long overload does not defer the other messages forever
+		d.tokens = max(-d.burst(), d.tokens-(float64)(size))
+	}
+	d.lastSent[num] = now
+	d.stats.SentFrames++
+	d.stats.SentBytes += (uint64)(size)
+	return true
+}
+
+// overdue reports whether a message with an interval was not sent for two intervals
+func (d *Decimator) overdue(num int, now time.Time) bool {
+	interval, ok := d.policy.Intervals[num]
+	if !ok || interval <= 0 {
+		return false
+	}
+	last, ok := d.lastSent[num]
+	return !ok || now.Sub(last) >= 2*interval
+}
+
+func (d *Decimator) Stats() DecimateStats {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.stats
+}
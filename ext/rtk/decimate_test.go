@@ -0,0 +1,101 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rtk_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zyxkad/drone/ext/rtk"
+)
+
+func TestDecimatorIntervals(t *testing.T) {
+	d := rtk.NewDecimator(rtk.DefaultDecimatePolicy())
+	now := time.Unix(1000, 0)
+	sent1005 := 0
+	for i := range 10 {
+		at := now.Add((time.Duration)(i) * time.Second)
+		if !d.Allow(1077, 500, at) {
+			t.Errorf("MSM should be sent every epoch, dropped at %d", i)
+		}
+		if d.Allow(1005, 25, at) {
+			sent1005++
+		}
+	}
+	if sent1005 != 2 {
+		t.Errorf("1005 sent %d times, want 2", sent1005)
+	}
+	stats := d.Stats()
+	if stats.SentFrames != 12 || stats.SkippedFrames != 8 || stats.DeferredFrames != 0 {
+		t.Errorf("Unexpected stats: %#v", stats)
+	}
+}
+
+func TestDecimatorBudget(t *testing.T) {
+	policy := rtk.DefaultDecimatePolicy()
+	policy.Budget = 1000
+	d := rtk.NewDecimator(policy)
+	now := time.Unix(1000, 0)
+	var last1005 time.Time
+	for i := range 100 {
+		at := now.Add((time.Duration)(i) * 200 * time.Millisecond)
+		// 2000 B/s of MSM, twice the budget
+		if !d.Allow(1077, 400, at) {
+			t.Fatalf("MSM should never be dropped, dropped at %d", i)
+		}
+		if d.Allow(1005, 25, at) {
+			if !last1005.IsZero() && at.Sub(last1005) > 10*time.Second {
+				t.Errorf("1005 was deferred for %v", at.Sub(last1005))
+			}
+			last1005 = at
+		}
+		d.Allow(1019, 60, at)
+	}
+	stats := d.Stats()
+	if stats.OverBudgetFrames == 0 || stats.OverBudgetBytes > stats.SentBytes {
+		t.Errorf("Expected MSM sent over the budget: %#v", stats)
+	}
+	if stats.DeferredFrames == 0 {
+		t.Errorf("Expected the other messages deferred over the budget: %#v", stats)
+	}
+	if last1005.IsZero() {
+		t.Errorf("1005 was never sent")
+	}
+
+	// within the budget nothing is deferred
+	d = rtk.NewDecimator(policy)
+	for i := range 100 {
+		at := now.Add((time.Duration)(i) * 200 * time.Millisecond)
+		d.Allow(1077, 150, at)
+		d.Allow(1005, 25, at)
+	}
+	if stats := d.Stats(); stats.DeferredFrames != 0 || stats.OverBudgetFrames != 0 {
+		t.Errorf("Unexpected stats: %#v", stats)
+	}
+
+	// a policy without budget follows SetBudget
+	d = rtk.NewDecimator(rtk.DecimatePolicy{})
+	d.SetBudget(500)
+	if d.Budget() != 500 {
+		t.Errorf("Budget is %v, want 500", d.Budget())
+	}
+	d.SetPolicy(rtk.DecimatePolicy{Budget: 800})
+	d.SetBudget(500)
+	if d.Budget() != 800 {
+		t.Errorf("Policy budget should not be overridden, got %v", d.Budget())
+	}
+}
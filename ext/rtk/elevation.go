@@ -0,0 +1,97 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rtk
+
+import (
+	"sync"
+	"time"
+
+	"github.com/daedaleanai/ublox/ubx"
+)
+
+// elevationMaxAge is how long a reported elevation is used
+const elevationMaxAge = 30 * time.Second
+
+type satKey struct {
+	system GNSS
+	sat    int
+}
+
+type elevation struct {
+	deg float64
+	at  time.Time
+}
+
+// ElevationTable keeps the satellite elevations reported by the base receiver with UBX-NAV-SAT
+type ElevationTable struct {
+	mux  sync.RWMutex
+	sats map[satKey]elevation
+}
+
+func NewElevationTable() *ElevationTable {
+	return &ElevationTable{
+		sats: make(map[satKey]elevation),
+	}
+}
+
+// UBXSatellite converts the u-blox GNSS and satellite ID to the system and satellite ID of MSM messages
+func UBXSatellite(gnssId, svId byte) (system GNSS, sat int, ok bool) {
+	switch gnssId {
+	case 0:
+		return GNSSGPS, (int)(svId), svId >= 1 && svId <= 32
+	case 1:
+		// SBAS PRN 120-158
+		return GNSSSBAS, (int)(svId) - 119, svId >= 120 && svId <= 158
+	case 2:
+		return GNSSGalileo, (int)(svId), svId >= 1 && svId <= 36
+	case 3:
+		return GNSSBeiDou, (int)(svId), svId >= 1 && svId <= 63
+	case 5:
+		// QZSS PRN 193-202
+		return GNSSQZSS, (int)(svId), svId >= 1 && svId <= 10
+	case 6:
+		// GLONASS slot, 255 means unknown
+		return GNSSGLONASS, (int)(svId), svId >= 1 && svId <= 32
+	}
+	return 0, 0, false
+}
+
+func (t *ElevationTable) UpdateNavSat(msg *ubx.NavSat, now time.Time) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for _, sv := range msg.Svs {
+		system, sat, ok := UBXSatellite(sv.GnssId, sv.SvId)
+		if !ok || sv.Elev_deg < -90 || sv.Elev_deg > 90 {
+			continue
+		}
+		t.sats[satKey{system, sat}] = elevation{
+			deg: (float64)(sv.Elev_deg),
+			at:  now,
+		}
+	}
+}
+
+// Elevation returns the last reported elevation in degrees, it implements ElevationFunc
+func (t *ElevationTable) Elevation(system GNSS, sat int) (float64, bool) {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	e, ok := t.sats[satKey{system, sat}]
+	if !ok || time.Since(e.at) > elevationMaxAge {
+		return 0, false
+	}
+	return e.deg, true
+}
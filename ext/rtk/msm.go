@@ -0,0 +1,262 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rtk
+
+import (
+	"errors"
+	"math/bits"
+
+	"github.com/go-gnss/rtcm/rtcm3"
+)
+
+// frameOverhead is the RTCM3 frame header and CRC size
+const frameOverhead = 6
+
+var ErrSatelliteTooLarge = errors.New("A single satellite does not fit in the frame")
+
+// IsMSM reports whether the message number is a MSM1-7 message
+func IsMSM(num int) bool {
+	return num >= 1071 && num <= 1137 && num%10 >= 1 && num%10 <= 7
+}
+
+// msmLayout describes the satellites and cells of a MSM header
+type msmLayout struct {
+	nsat, nsig int
+	satBits    []uint64 // the mask bit of each satellite in order
+	rowMasks   []uint64 // the cell mask row of each satellite
+	rowStarts  []int    // the first cell index of each satellite, with the total at the end
+}
+
+func newMsmLayout(h rtcm3.MsmHeader) *msmLayout {
+	l := &msmLayout{
+		nsat: bits.OnesCount64(h.SatelliteMask),
+		nsig: bits.OnesCount32(h.SignalMask),
+	}
+	for i := 63; i >= 0; i-- {
+		if bit := (uint64)(1) << i; h.SatelliteMask&bit != 0 {
+			l.satBits = append(l.satBits, bit)
+		}
+	}
+	rowMask := ((uint64)(1) << l.nsig) - 1
+	cells := 0
+	for r := range l.nsat {
+		row := (h.CellMask >> ((l.nsat - 1 - r) * l.nsig)) & rowMask
+		l.rowMasks = append(l.rowMasks, row)
+		l.rowStarts = append(l.rowStarts, cells)
+		cells += bits.OnesCount64(row)
+	}
+	l.rowStarts = append(l.rowStarts, cells)
+	return l
+}
+
+// cells returns the cell range of the satellites [a, b)
+func (l *msmLayout) cells(a, b int) (int, int) {
+	return l.rowStarts[a], l.rowStarts[b]
+}
+
+// header returns a copy of h which only contains the satellites [a, b)
+func (l *msmLayout) header(h rtcm3.MsmHeader, a, b int, last bool) rtcm3.MsmHeader {
+	h.SatelliteMask = 0
+	h.CellMask = 0
+	for r := a; r < b; r++ {
+		h.SatelliteMask |= l.satBits[r]
+		h.CellMask = (h.CellMask << l.nsig) | l.rowMasks[r]
+	}
+	// all but the last message of an epoch must have the multiple message bit set
+	h.MultipleMessageBit = h.MultipleMessageBit || !last
+	return h
+}
+
+// msmBitSize returns the payload bits of a MSM message with the per satellite and per cell field sizes
+func msmBitSize(nsat, nsig, ncell int, satBits, cellBits int) int {
+	return 169 + nsat*nsig + satBits*nsat + cellBits*ncell
+}
+
+// split groups the satellites greedily so each frame is no larger than maxLen
+func (l *msmLayout) split(maxLen int, satBits, cellBits int) ([][2]int, error) {
+	var ranges [][2]int
+	for a := 0; a < l.nsat; {
+		b := a
+		for b < l.nsat {
+			c0, c1 := l.cells(a, b+1)
+			size := (msmBitSize(b+1-a, l.nsig, c1-c0, satBits, cellBits)+7)/8 + frameOverhead
+			if size > maxLen {
+				break
+			}
+			b++
+		}
+		if b == a {
+			return nil, ErrSatelliteTooLarge
+		}
+		ranges = append(ranges, [2]int{a, b})
+		a = b
+	}
+	return ranges, nil
+}
+
+// SplitMSM splits a MSM4 to MSM7 frame by satellites into frames no larger than maxLen bytes
+// Other frames, and frames already fit, are returned as they are
+func SplitMSM(frame rtcm3.Frame, maxLen int) ([]rtcm3.Frame, error) {
+	if (int)(frame.Length)+frameOverhead <= maxLen {
+		return []rtcm3.Frame{frame}, nil
+	}
+	num := (int)(frame.MessageNumber())
+	if !IsMSM(num) {
+		return []rtcm3.Frame{frame}, nil
+	}
+	switch num % 10 {
+	case 4:
+		msg := rtcm3.DeserializeMessageMsm4(frame.Payload)
+		return splitMsm4(msg, maxLen)
+	case 5:
+		msg := rtcm3.DeserializeMessageMsm5(frame.Payload)
+		return splitMsm5(msg, maxLen)
+	case 6:
+		msg := rtcm3.DeserializeMessageMsm6(frame.Payload)
+		return splitMsm6(msg, maxLen)
+	case 7:
+		msg := rtcm3.DeserializeMessageMsm7(frame.Payload)
+		return splitMsm7(msg, maxLen)
+	}
+	return []rtcm3.Frame{frame}, nil
+}
+
+func splitMsm7(msg rtcm3.MessageMsm7, maxLen int) ([]rtcm3.Frame, error) {
+	l := newMsmLayout(msg.MsmHeader)
+	ranges, err := l.split(maxLen, 36, 80)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([]rtcm3.Frame, 0, len(ranges))
+	for i, r := range ranges {
+		a, b := r[0], r[1]
+		c0, c1 := l.cells(a, b)
+		sat, sig := msg.SatelliteData, msg.SignalData
+		sub := rtcm3.MessageMsm7{
+			MsmHeader: l.header(msg.MsmHeader, a, b, i == len(ranges)-1),
+			SatelliteData: rtcm3.SatelliteDataMsm57{
+				RangeMilliseconds: sat.RangeMilliseconds[a:b],
+				Extended:          sat.Extended[a:b],
+				Ranges:            sat.Ranges[a:b],
+				PhaseRangeRates:   sat.PhaseRangeRates[a:b],
+			},
+			SignalData: rtcm3.SignalDataMsm7{
+				Pseudoranges:    sig.Pseudoranges[c0:c1],
+				PhaseRanges:     sig.PhaseRanges[c0:c1],
+				PhaseRangeLocks: sig.PhaseRangeLocks[c0:c1],
+				HalfCycles:      sig.HalfCycles[c0:c1],
+				Cnrs:            sig.Cnrs[c0:c1],
+				PhaseRangeRates: sig.PhaseRangeRates[c0:c1],
+			},
+		}
+		frames = append(frames, rtcm3.EncapsulateByteArray(sub.Serialize()))
+	}
+	return frames, nil
+}
+
+func splitMsm6(msg rtcm3.MessageMsm6, maxLen int) ([]rtcm3.Frame, error) {
+	l := newMsmLayout(msg.MsmHeader)
+	ranges, err := l.split(maxLen, 18, 65)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([]rtcm3.Frame, 0, len(ranges))
+	for i, r := range ranges {
+		a, b := r[0], r[1]
+		c0, c1 := l.cells(a, b)
+		sat, sig := msg.SatelliteData, msg.SignalData
+		sub := rtcm3.MessageMsm6{
+			MsmHeader: l.header(msg.MsmHeader, a, b, i == len(ranges)-1),
+			SatelliteData: rtcm3.SatelliteDataMsm46{
+				RangeMilliseconds: sat.RangeMilliseconds[a:b],
+				Ranges:            sat.Ranges[a:b],
+			},
+			SignalData: rtcm3.SignalDataMsm6{
+				Pseudoranges:    sig.Pseudoranges[c0:c1],
+				PhaseRanges:     sig.PhaseRanges[c0:c1],
+				PhaseRangeLocks: sig.PhaseRangeLocks[c0:c1],
+				HalfCycles:      sig.HalfCycles[c0:c1],
+				Cnrs:            sig.Cnrs[c0:c1],
+			},
+		}
+		frames = append(frames, rtcm3.EncapsulateByteArray(sub.Serialize()))
+	}
+	return frames, nil
+}
+
+func splitMsm5(msg rtcm3.MessageMsm5, maxLen int) ([]rtcm3.Frame, error) {
+	l := newMsmLayout(msg.MsmHeader)
+	ranges, err := l.split(maxLen, 36, 63)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([]rtcm3.Frame, 0, len(ranges))
+	for i, r := range ranges {
+		a, b := r[0], r[1]
+		c0, c1 := l.cells(a, b)
+		sat, sig := msg.SatelliteData, msg.SignalData
+		sub := rtcm3.MessageMsm5{
+			MsmHeader: l.header(msg.MsmHeader, a, b, i == len(ranges)-1),
+			SatelliteData: rtcm3.SatelliteDataMsm57{
+				RangeMilliseconds: sat.RangeMilliseconds[a:b],
+				Extended:          sat.Extended[a:b],
+				Ranges:            sat.Ranges[a:b],
+				PhaseRangeRates:   sat.PhaseRangeRates[a:b],
+			},
+			SignalData: rtcm3.SignalDataMsm5{
+				Pseudoranges:    sig.Pseudoranges[c0:c1],
+				PhaseRanges:     sig.PhaseRanges[c0:c1],
+				PhaseRangeLocks: sig.PhaseRangeLocks[c0:c1],
+				HalfCycles:      sig.HalfCycles[c0:c1],
+				Cnrs:            sig.Cnrs[c0:c1],
+				PhaseRangeRates: sig.PhaseRangeRates[c0:c1],
+			},
+		}
+		frames = append(frames, rtcm3.EncapsulateByteArray(sub.Serialize()))
+	}
+	return frames, nil
+}
+
+func splitMsm4(msg rtcm3.MessageMsm4, maxLen int) ([]rtcm3.Frame, error) {
+	l := newMsmLayout(msg.MsmHeader)
+	ranges, err := l.split(maxLen, 18, 48)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([]rtcm3.Frame, 0, len(ranges))
+	for i, r := range ranges {
+		a, b := r[0], r[1]
+		c0, c1 := l.cells(a, b)
+		sat, sig := msg.SatelliteData, msg.SignalData
+		sub := rtcm3.MessageMsm4{
+			MsmHeader: l.header(msg.MsmHeader, a, b, i == len(ranges)-1),
+			SatelliteData: rtcm3.SatelliteDataMsm46{
+				RangeMilliseconds: sat.RangeMilliseconds[a:b],
+				Ranges:            sat.Ranges[a:b],
+			},
+			SignalData: rtcm3.SignalDataMsm4{
+				Pseudoranges:    sig.Pseudoranges[c0:c1],
+				PhaseRanges:     sig.PhaseRanges[c0:c1],
+				PhaseRangeLocks: sig.PhaseRangeLocks[c0:c1],
+				HalfCycles:      sig.HalfCycles[c0:c1],
+				Cnrs:            sig.Cnrs[c0:c1],
+			},
+		}
+		frames = append(frames, rtcm3.EncapsulateByteArray(sub.Serialize()))
+	}
+	return frames, nil
+}
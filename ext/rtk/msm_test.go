@@ -0,0 +1,235 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rtk_test
+
+import (
+	"bufio"
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/go-gnss/rtcm/rtcm3"
+
+	"github.com/zyxkad/drone/ext/rtk"
+)
+
+// makeMsm7 returns a GPS MSM7 message with nsat satellites which all track nsig signals
+func makeMsm7(nsat, nsig int) rtcm3.MessageMsm7 {
+	msg := rtcm3.MessageMsm7{
+		MsmHeader: rtcm3.MsmHeader{
+			MessageNumber:      1077,
+			ReferenceStationId: 7,
+			Epoch:              123456,
+		},
+	}
+	for i := range nsat {
+		msg.SatelliteMask |= (uint64)(1) << (63 - i*2)
+		msg.SatelliteData.RangeMilliseconds = append(msg.SatelliteData.RangeMilliseconds, (uint8)(70+i))
+		msg.SatelliteData.Extended = append(msg.SatelliteData.Extended, (uint8)(i%16))
+		msg.SatelliteData.Ranges = append(msg.SatelliteData.Ranges, (uint16)(i*31))
+		msg.SatelliteData.PhaseRangeRates = append(msg.SatelliteData.PhaseRangeRates, (int16)(i*13-100))
+	}
+	for i := range nsig {
+		msg.SignalMask |= (uint32)(1) << (31 - i*3)
+	}
+	for i := range nsat * nsig {
+		msg.CellMask = (msg.CellMask << 1) | 1
+		sig := &msg.SignalData
+		sig.Pseudoranges = append(sig.Pseudoranges, (int32)(i*1000-20000))
+		sig.PhaseRanges = append(sig.PhaseRanges, (int32)(i*3000-50000))
+		sig.PhaseRangeLocks = append(sig.PhaseRangeLocks, (uint16)(i))
+		sig.HalfCycles = append(sig.HalfCycles, i%2 == 0)
+		sig.Cnrs = append(sig.Cnrs, (uint16)(400+i))
+		sig.PhaseRangeRates = append(sig.PhaseRangeRates, (int16)(i*7-300))
+	}
+	return msg
+}
+
+func TestSplitMSM7(t *testing.T) {
+	const maxLen = 720
+	msg := makeMsm7(20, 3)
+	frame := rtcm3.EncapsulateByteArray(msg.Serialize())
+	if (int)(frame.Length)+6 <= maxLen {
+		t.Fatalf("Test frame is too small: %d", frame.Length)
+	}
+
+	frames, err := rtk.SplitMSM(frame, maxLen)
+	if err != nil {
+		t.Fatalf("SplitMSM: %v", err)
+	}
+	if len(frames) < 2 {
+		t.Fatalf("Expected the frame to be split, got %d frames", len(frames))
+	}
+	var (
+		satMask   uint64
+		ranges    []uint16
+		pranges   []int32
+		halfCycle []bool
+	)
+	for i, f := range frames {
+		buf := f.Serialize()
+		if len(buf) > maxLen {
+			t.Errorf("Frame %d is %d bytes", i, len(buf))
+		}
+		parsed, err := rtcm3.DeserializeFrame(bufio.NewReader(bytes.NewReader(buf)))
+		if err != nil {
+			t.Fatalf("Frame %d is invalid: %v", i, err)
+		}
+		sub := rtcm3.DeserializeMessageMsm7(parsed.Payload)
+		if sub.Epoch != msg.Epoch || sub.ReferenceStationId != msg.ReferenceStationId || sub.SignalMask != msg.SignalMask {
+			t.Errorf("Frame %d header mismatch: %#v", i, sub.MsmHeader)
+		}
+		if last := i == len(frames)-1; sub.MultipleMessageBit == last {
+			t.Errorf("Frame %d multiple message bit is %v", i, sub.MultipleMessageBit)
+		}
+		if satMask&sub.SatelliteMask != 0 {
+			t.Errorf("Frame %d repeats satellites", i)
+		}
+		satMask |= sub.SatelliteMask
+		ranges = append(ranges, sub.SatelliteData.Ranges...)
+		pranges = append(pranges, sub.SignalData.Pseudoranges...)
+		halfCycle = append(halfCycle, sub.SignalData.HalfCycles...)
+	}
+	if satMask != msg.SatelliteMask {
+		t.Errorf("Satellite mask is %x, want %x", satMask, msg.SatelliteMask)
+	}
+	if !slices.Equal(ranges, msg.SatelliteData.Ranges) {
+		t.Errorf("Satellite data mismatch: %v", ranges)
+	}
+	if !slices.Equal(pranges, msg.SignalData.Pseudoranges) || !slices.Equal(halfCycle, msg.SignalData.HalfCycles) {
+		t.Errorf("Signal data mismatch")
+	}
+}
+
+func TestSplitMSMKeepsSmallFrames(t *testing.T) {
+	frame := rtcm3.EncapsulateByteArray(makeMsm7(4, 2).Serialize())
+	frames, err := rtk.SplitMSM(frame, 720)
+	if err != nil {
+		t.Fatalf("SplitMSM: %v", err)
+	}
+	if len(frames) != 1 || !bytes.Equal(frames[0].Serialize(), frame.Serialize()) {
+		t.Errorf("Small frame should not be changed")
+	}
+}
+
+func TestSplitMSM5And6(t *testing.T) {
+	const maxLen = 400
+	src := makeMsm7(21, 3)
+	msm5 := rtcm3.MessageMsm5{
+		MsmHeader:     src.MsmHeader,
+		SatelliteData: src.SatelliteData,
+	}
+	msm5.MessageNumber = 1075
+	msm6 := rtcm3.MessageMsm6{
+		MsmHeader: src.MsmHeader,
+		SatelliteData: rtcm3.SatelliteDataMsm46{
+			RangeMilliseconds: src.SatelliteData.RangeMilliseconds,
+			Ranges:            src.SatelliteData.Ranges,
+		},
+	}
+	msm6.MessageNumber = 1076
+	for i, pr := range src.SignalData.Pseudoranges {
+		sig := src.SignalData
+		msm5.SignalData.Pseudoranges = append(msm5.SignalData.Pseudoranges, (int16)(pr/4))
+		msm5.SignalData.PhaseRanges = append(msm5.SignalData.PhaseRanges, sig.PhaseRanges[i])
+		msm5.SignalData.PhaseRangeLocks = append(msm5.SignalData.PhaseRangeLocks, (uint8)(sig.PhaseRangeLocks[i]%16))
+		msm5.SignalData.HalfCycles = append(msm5.SignalData.HalfCycles, sig.HalfCycles[i])
+		msm5.SignalData.Cnrs = append(msm5.SignalData.Cnrs, (uint8)(sig.Cnrs[i]%64))
+		msm5.SignalData.PhaseRangeRates = append(msm5.SignalData.PhaseRangeRates, sig.PhaseRangeRates[i])
+		msm6.SignalData.Pseudoranges = append(msm6.SignalData.Pseudoranges, pr)
+		msm6.SignalData.PhaseRanges = append(msm6.SignalData.PhaseRanges, sig.PhaseRanges[i])
+		msm6.SignalData.PhaseRangeLocks = append(msm6.SignalData.PhaseRangeLocks, sig.PhaseRangeLocks[i])
+		msm6.SignalData.HalfCycles = append(msm6.SignalData.HalfCycles, sig.HalfCycles[i])
+		msm6.SignalData.Cnrs = append(msm6.SignalData.Cnrs, sig.Cnrs[i])
+	}
+
+	split := func(t *testing.T, payload []byte) [][]byte {
+		frame := rtcm3.EncapsulateByteArray(payload)
+		if (int)(frame.Length)+6 <= maxLen {
+			t.Fatalf("Test frame is too small: %d", frame.Length)
+		}
+		frames, err := rtk.SplitMSM(frame, maxLen)
+		if err != nil {
+			t.Fatalf("SplitMSM: %v", err)
+		}
+		if len(frames) < 2 {
+			t.Fatalf("Expected the frame to be split, got %d frames", len(frames))
+		}
+		payloads := make([][]byte, len(frames))
+		for i, f := range frames {
+			buf := f.Serialize()
+			if len(buf) > maxLen {
+				t.Errorf("Frame %d is %d bytes", i, len(buf))
+			}
+			parsed, err := rtcm3.DeserializeFrame(bufio.NewReader(bytes.NewReader(buf)))
+			if err != nil {
+				t.Fatalf("Frame %d is invalid: %v", i, err)
+			}
+			payloads[i] = parsed.Payload
+		}
+		return payloads
+	}
+
+	t.Run("MSM5", func(t *testing.T) {
+		var (
+			satMask  uint64
+			pranges  []int16
+			prrates  []int16
+			extended []uint8
+		)
+		for _, p := range split(t, msm5.Serialize()) {
+			sub := rtcm3.DeserializeMessageMsm5(p)
+			satMask |= sub.SatelliteMask
+			pranges = append(pranges, sub.SignalData.Pseudoranges...)
+			prrates = append(prrates, sub.SignalData.PhaseRangeRates...)
+			extended = append(extended, sub.SatelliteData.Extended...)
+		}
+		if satMask != msm5.SatelliteMask {
+			t.Errorf("Satellite mask is %x, want %x", satMask, msm5.SatelliteMask)
+		}
+		if !slices.Equal(extended, msm5.SatelliteData.Extended) {
+			t.Errorf("Satellite data mismatch: %v", extended)
+		}
+		if !slices.Equal(pranges, msm5.SignalData.Pseudoranges) || !slices.Equal(prrates, msm5.SignalData.PhaseRangeRates) {
+			t.Errorf("Signal data mismatch")
+		}
+	})
+	t.Run("MSM6", func(t *testing.T) {
+		var (
+			satMask uint64
+			ranges  []uint16
+			pranges []int32
+			cnrs    []uint16
+		)
+		for _, p := range split(t, msm6.Serialize()) {
+			sub := rtcm3.DeserializeMessageMsm6(p)
+			satMask |= sub.SatelliteMask
+			ranges = append(ranges, sub.SatelliteData.Ranges...)
+			pranges = append(pranges, sub.SignalData.Pseudoranges...)
+			cnrs = append(cnrs, sub.SignalData.Cnrs...)
+		}
+		if satMask != msm6.SatelliteMask {
+			t.Errorf("Satellite mask is %x, want %x", satMask, msm6.SatelliteMask)
+		}
+		if !slices.Equal(ranges, msm6.SatelliteData.Ranges) {
+			t.Errorf("Satellite data mismatch: %v", ranges)
+		}
+		if !slices.Equal(pranges, msm6.SignalData.Pseudoranges) || !slices.Equal(cnrs, msm6.SignalData.Cnrs) {
+			t.Errorf("Signal data mismatch")
+		}
+	})
+}
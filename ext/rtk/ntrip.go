@@ -0,0 +1,511 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rtk
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daedaleanai/ublox/nmea"
+)
+
+var (
+	ErrMountNotFound = errors.New("Mountpoint not found in the caster")
+	ErrUnauthorized  = errors.New("NTRIP caster rejected the credentials")
+)
+
+// ntripIdleTimeout reconnects a stream which does not receive any data
+const ntripIdleTimeout = 30 * time.Second
+
+type NtripClientConfig struct {
+	// Server is the caster address, such as "caster.example.com:2101" or "http://caster.example.com:2101"
+	Server     string `json:"server"`
+	Mountpoint string `json:"mountpoint"`
+	Username   string `json:"username"`
+	Password   string `json:"password,omitempty"`
+	// Version is the NTRIP version, 1 or 2, default is 2
+	Version int `json:"version"`
+	// GGAInterval is how often the position is uploaded for VRS mountpoints, default is 10s
+	GGAInterval time.Duration `json:"ggaInterval"`
+	MinBackoff  time.Duration `json:"minBackoff"` // default is 1s
+	MaxBackoff  time.Duration `json:"maxBackoff"` // default is 1min
+}
+
+func (c *NtripClientConfig) setDefaults() {
+	if c.Version == 0 {
+		c.Version = 2
+	}
+	if c.GGAInterval <= 0 {
+		c.GGAInterval = 10 * time.Second
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = time.Second
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = max(time.Minute, c.MinBackoff)
+	}
+}
+
+func (c *NtripClientConfig) Validate() error {
+	if c.Server == "" {
+		return errors.New("NTRIP server is empty")
+	}
+	if c.Mountpoint == "" {
+		return errors.New("NTRIP mountpoint is empty")
+	}
+	if c.Version != 1 && c.Version != 2 {
+		return fmt.Errorf("Unsupported NTRIP version %d", c.Version)
+	}
+	return nil
+}
+
+// baseURL returns the caster URL without a path
+func (c *NtripClientConfig) baseURL() string {
+	server := c.Server
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+	return strings.TrimSuffix(server, "/")
+}
+
+// hostPort returns the caster address for a raw TCP connection
+func (c *NtripClientConfig) hostPort() (string, error) {
+	u, err := url.Parse(c.baseURL())
+	if err != nil {
+		return "", err
+	}
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), "2101"), nil
+	}
+	return u.Host, nil
+}
+
+type NtripStatus struct {
+	Connected  bool      `json:"connected"`
+	Since      time.Time `json:"since"` // the time of the last connect or disconnect
+	Received   uint64    `json:"received"`
+	Reconnects int       `json:"reconnects"`
+	LastError  string    `json:"lastError,omitempty"`
+	// Backoff is the wait before the next reconnect
+	Backoff int64 `json:"backoff"` // In milliseconds
+}
+
+// NtripClient receives the RTCM stream of a NTRIP mountpoint, and reconnects with backoff when the stream breaks
+// It implements io.ReadWriteCloser, so it can be the source of a Proxy:
+// reads return the stream, and writes of NMEA GGA sentences update the position uploaded to the caster
+type NtripClient struct {
+	cfg    NtripClientConfig
+	ctx    context.Context
+	cancel context.CancelFunc
+	pr     *io.PipeReader
+	pw     *io.PipeWriter
+
+	gga       atomic.Pointer[ggaSource]
+	ggaSignal chan struct{}
+	ggaMux    sync.Mutex
+	upstream  io.Writer // where the GGA is sent in the current session
+
+	statusMux sync.Mutex
+	status    NtripStatus
+	received  atomic.Uint64
+}
+
+var _ io.ReadWriteCloser = (*NtripClient)(nil)
+
+// DialNtrip starts a NTRIP client, the connection is made in the background
+func DialNtrip(cfg NtripClientConfig) (*NtripClient, error) {
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	c := &NtripClient{
+		cfg:       cfg,
+		ggaSignal: make(chan struct{}, 1),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.pr, c.pw = io.Pipe()
+	go c.run()
+	return c, nil
+}
+
+func (c *NtripClient) Config() NtripClientConfig {
+	return c.cfg
+}
+
+func (c *NtripClient) Status() NtripStatus {
+	c.statusMux.Lock()
+	defer c.statusMux.Unlock()
+	st := c.status
+	st.Received = c.received.Load()
+	return st
+}
+
+func (c *NtripClient) Read(buf []byte) (int, error) {
+	return c.pr.Read(buf)
+}
+
+// Write accepts NMEA GGA sentences as the rover position, other data is ignored
+func (c *NtripClient) Write(buf []byte) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, net.ErrClosed
+	}
+	for _, line := range strings.SplitAfter((string)(buf), "\n") {
+		if len(line) > 6 && line[0] == '$' && line[3:6] == "GGA" {
+			c.setGGA(&ggaSource{
+				sentence: ([]byte)(strings.TrimRight(line, "\r\n") + "\r\n"),
+			})
+		}
+	}
+	return len(buf), nil
+}
+
+// SetPosition sets the position uploaded to the caster, alt is the height above the ellipsoid in meters
+// The GGA sentence is generated with the current time each time it's uploaded
+func (c *NtripClient) SetPosition(lat, lon, alt float64) {
+	c.setGGA(&ggaSource{lat: lat, lon: lon, alt: alt})
+}
+
+// ggaSource is either a GGA sentence written by the rover, or a fixed position
+type ggaSource struct {
+	sentence      []byte
+	lat, lon, alt float64
+}
+
+func (g *ggaSource) build() []byte {
+	if g.sentence != nil {
+		return g.sentence
+	}
+	return FormatGGA(time.Now(), g.lat, g.lon, g.alt)
+}
+
+func (c *NtripClient) setGGA(gga *ggaSource) {
+	c.gga.Store(gga)
+	select {
+	case c.ggaSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (c *NtripClient) Close() error {
+	c.cancel()
+	return c.pr.Close()
+}
+
+func (c *NtripClient) sendGGA() {
+	gga := c.gga.Load()
+	if gga == nil {
+		return
+	}
+	c.ggaMux.Lock()
+	defer c.ggaMux.Unlock()
+	if c.upstream != nil {
+		c.upstream.Write(gga.build())
+	}
+}
+
+func (c *NtripClient) setUpstream(w io.Writer) {
+	c.ggaMux.Lock()
+	defer c.ggaMux.Unlock()
+	c.upstream = w
+}
+
+func (c *NtripClient) setStatus(update func(*NtripStatus)) {
+	c.statusMux.Lock()
+	defer c.statusMux.Unlock()
+	update(&c.status)
+}
+
+func (c *NtripClient) run() {
+	defer c.pw.CloseWithError(net.ErrClosed)
+	backoff := c.cfg.MinBackoff
+	for {
+		start := time.Now()
+		err := c.session()
+		if c.ctx.Err() != nil {
+			return
+		}
+		// a session which lasted a while is not a failure of the caster
+		if time.Since(start) > c.cfg.MaxBackoff {
+			backoff = c.cfg.MinBackoff
+		}
+		c.setStatus(func(st *NtripStatus) {
+			st.Connected = false
+			st.Since = time.Now()
+			st.Reconnects++
+			st.Backoff = backoff.Milliseconds()
+			if err != nil {
+				st.LastError = err.Error()
+			}
+		})
+		select {
+		case <-time.After(backoff):
+		case <-c.ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, c.cfg.MaxBackoff)
+	}
+}
+
+// session connects to the caster, and copies the stream until it breaks
+func (c *NtripClient) session() error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	var (
+		body io.ReadCloser
+		err  error
+	)
+	if c.cfg.Version == 2 {
+		body, err = c.connectV2(ctx)
+	} else {
+		body, err = c.connectV1(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	defer c.setUpstream(nil)
+
+	c.setStatus(func(st *NtripStatus) {
+		st.Connected = true
+		st.Since = time.Now()
+		st.LastError = ""
+		st.Backoff = 0
+	})
+
+	var lastRecv atomic.Int64
+	lastRecv.Store(time.Now().UnixNano())
+	go func() {
+		ticker := time.NewTicker(min(c.cfg.GGAInterval, ntripIdleTimeout/3))
+		defer ticker.Stop()
+		// the caster of a VRS mountpoint does not send anything before it receives the position
+		c.sendGGA()
+		lastGGA := time.Now()
+		for {
+			select {
+			case <-c.ggaSignal:
+				lastGGA = time.Now()
+				c.sendGGA()
+			case now := <-ticker.C:
+				if now.Sub(time.Unix(0, lastRecv.Load())) > ntripIdleTimeout {
+					body.Close()
+					return
+				}
+				if now.Sub(lastGGA) >= c.cfg.GGAInterval {
+					lastGGA = now
+					c.sendGGA()
+				}
+			case <-ctx.Done():
+				body.Close()
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			lastRecv.Store(time.Now().UnixNano())
+			c.received.Add((uint64)(n))
+			if _, err := c.pw.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+}
+
+func (c *NtripClient) connectV2(ctx context.Context) (io.ReadCloser, error) {
+	// the GGA sentences are uploaded with the chunked request body
+	upR, upW := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.cfg.baseURL()+"/"+url.PathEscape(c.cfg.Mountpoint), upR)
+	if err != nil {
+		return nil, err
+	}
+	setNtripHeaders(req.Header, 2, c.cfg.Username, c.cfg.Password)
+	resp, err := ntripHTTPClient.Do(req)
+	if err != nil {
+		upW.Close()
+		return nil, err
+	}
+	if err := checkNtripResponse(resp.StatusCode, resp.Header.Get("Content-Type")); err != nil {
+		resp.Body.Close()
+		upW.Close()
+		return nil, err
+	}
+	c.setUpstream(upW)
+	return &closeBoth{resp.Body, upW}, nil
+}
+
+func (c *NtripClient) connectV1(ctx context.Context) (io.ReadCloser, error) {
+	addr, err := c.cfg.hostPort()
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(ntripIdleTimeout))
+	br, err := ntripRequestV1(conn, "/"+c.cfg.Mountpoint, c.cfg.Username, c.cfg.Password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	c.setUpstream(conn)
+	return &bufferedConn{br, conn}, nil
+}
+
+var ntripHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: ntripIdleTimeout,
+		DisableCompression:    true,
+	},
+}
+
+func setNtripHeaders(h http.Header, version int, username, password string) {
+	h.Set("User-Agent", "NTRIP drone")
+	if version == 2 {
+		h.Set("Ntrip-Version", "Ntrip/2.0")
+	}
+	if username != "" {
+		h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString(([]byte)(username+":"+password)))
+	}
+}
+
+func checkNtripResponse(code int, contentType string) error {
+	switch code {
+	case http.StatusOK:
+		if contentType == "gnss/sourcetable" {
+			return ErrMountNotFound
+		}
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	case http.StatusNotFound:
+		return ErrMountNotFound
+	}
+	return fmt.Errorf("NTRIP caster responded %d %s", code, http.StatusText(code))
+}
+
+// ntripRequestV1 sends a NTRIP v1 request, and reads the response header
+// It returns ErrMountNotFound if the caster responds the sourcetable
+func ntripRequestV1(conn net.Conn, path string, username, password string) (*bufio.Reader, error) {
+	h := make(http.Header)
+	setNtripHeaders(h, 1, username, password)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "GET %s HTTP/1.0\r\n", path)
+	h.Write(&sb)
+	sb.WriteString("\r\n")
+	if _, err := io.WriteString(conn, sb.String()); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	status = strings.TrimSpace(status)
+	// skip the headers
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+	}
+	switch {
+	case status == "ICY 200 OK":
+		return br, nil
+	case strings.HasPrefix(status, "SOURCETABLE"):
+		return br, ErrMountNotFound
+	case strings.HasPrefix(status, "HTTP/"):
+		fields := strings.Fields(status)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Unexpected NTRIP response %q", status)
+		}
+		code, _ := strconv.Atoi(fields[1])
+		return br, checkNtripResponse(code, "")
+	}
+	return nil, fmt.Errorf("Unexpected NTRIP response %q", status)
+}
+
+type closeBoth struct {
+	io.ReadCloser
+	w io.Closer
+}
+
+func (c *closeBoth) Close() error {
+	c.w.Close()
+	return c.ReadCloser.Close()
+}
+
+type bufferedConn struct {
+	br *bufio.Reader
+	net.Conn
+}
+
+func (c *bufferedConn) Read(buf []byte) (int, error) {
+	return c.br.Read(buf)
+}
+
+// FormatGGA formats a NMEA GGA sentence of a RTK fixed position
+func FormatGGA(t time.Time, lat, lon, alt float64) []byte {
+	t = t.UTC()
+	ns, ew := "N", "E"
+	if lat < 0 {
+		ns, lat = "S", -lat
+	}
+	if lon < 0 {
+		ew, lon = "W", -lon
+	}
+	latDeg, lonDeg := math.Floor(lat), math.Floor(lon)
+	buf, _ := nmea.Encode([]string{
+		"GPGGA",
+		fmt.Sprintf("%02d%02d%02d.00", t.Hour(), t.Minute(), t.Second()),
+		fmt.Sprintf("%02.0f%08.5f", latDeg, (lat-latDeg)*60), ns,
+		fmt.Sprintf("%03.0f%08.5f", lonDeg, (lon-lonDeg)*60), ew,
+		"1", "12", "1.0",
+		fmt.Sprintf("%.3f", alt), "M",
+		"0.0", "M",
+		"", "",
+	})
+	return buf
+}
@@ -0,0 +1,194 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rtk_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zyxkad/drone/ext/rtk"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestNtripClient(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		caster, base, server := newTestCaster(t)
+		caster.SetUsers(map[string]string{"rover": "secret"})
+		frame := readFrame(t, 1077)
+		done := make(chan struct{})
+		go feedFrames(base, frame, done)
+
+		client, err := rtk.DialNtrip(rtk.NtripClientConfig{
+			Server:      server.URL,
+			Mountpoint:  "BASE",
+			Username:    "rover",
+			Password:    "secret",
+			Version:     version,
+			MinBackoff:  50 * time.Millisecond,
+			GGAInterval: 500 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetPosition(31.23, 121.47, 10)
+		proxy := rtk.NewProxy(client)
+		conn := proxy.NewConn()
+
+		receive := func() {
+			t.Helper()
+			select {
+			case got := <-conn.RTCMMessages():
+				if !bytes.Equal(got.Serialize(), frame.Serialize()) {
+					t.Errorf("v%d: received frame mismatch", version)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("v%d: no frame received, status %#v", version, client.Status())
+			}
+		}
+		receive()
+		if st := client.Status(); !st.Connected || st.Received == 0 {
+			t.Errorf("v%d: unexpected status %#v", version, st)
+		}
+		waitFor(t, "GGA upload", func() bool {
+			clients := caster.Clients()
+			return len(clients) == 1 && strings.HasPrefix(clients[0].LastGGA, "$GPGGA,") &&
+				strings.Contains(clients[0].LastGGA, ",3113.80000,N,12128.20000,E,")
+		})
+		// the GGA is stamped when it's sent
+		first := caster.Clients()[0].LastGGA
+		waitFor(t, "GGA refresh", func() bool {
+			clients := caster.Clients()
+			return len(clients) == 1 && clients[0].LastGGA != first
+		})
+
+		// the client reconnects after the mountpoint comes back
+		mounts := caster.Mounts()
+		caster.RemoveMount("BASE")
+		waitFor(t, "disconnect", func() bool { return !client.Status().Connected })
+		caster.AddMount(mounts[0])
+		waitFor(t, "reconnect", func() bool { return client.Status().Connected })
+		for len(conn.RTCMMessages()) > 0 {
+			<-conn.RTCMMessages()
+		}
+		receive()
+		if st := client.Status(); st.Reconnects == 0 {
+			t.Errorf("v%d: reconnect is not counted: %#v", version, st)
+		}
+
+		close(done)
+		proxy.Close()
+	}
+}
+
+func TestNtripClientUnauthorized(t *testing.T) {
+	caster, _, server := newTestCaster(t)
+	caster.SetUsers(map[string]string{"rover": "secret"})
+	client, err := rtk.DialNtrip(rtk.NtripClientConfig{
+		Server:     server.URL,
+		Mountpoint: "BASE",
+		Username:   "rover",
+		Password:   "wrong",
+		MinBackoff: 50 * time.Millisecond,
+		MaxBackoff: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	waitFor(t, "reconnects", func() bool { return client.Status().Reconnects >= 3 })
+	st := client.Status()
+	if st.Connected || st.LastError != rtk.ErrUnauthorized.Error() || st.Backoff > 200 {
+		t.Errorf("Unexpected status %#v", st)
+	}
+}
+
+func TestFetchSourcetable(t *testing.T) {
+	caster, _, server := newTestCaster(t)
+	caster.SetUsers(map[string]string{"rover": "secret"})
+	for _, version := range []int{1, 2} {
+		table, err := rtk.FetchSourcetable(context.Background(), rtk.NtripClientConfig{
+			Server:  strings.TrimPrefix(server.URL, "http://"),
+			Version: version,
+		})
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		s := table.Stream("BASE")
+		if s == nil || s.NavSystem != "GPS+GLO" || s.Latitude != 31.23 || s.Authentication != "B" || s.NMEA {
+			t.Errorf("v%d: unexpected stream %#v", version, s)
+		}
+	}
+}
+
+func TestParseSourcetable(t *testing.T) {
+	const table = "CAS;caster.example.com;2101;Example;Operator;0;DEU;50.10;8.70;fallback.example.com;80;misc\r\n" +
+		"NET;EXNET;Operator;B;N;https://example.com;https://example.com/str;https://example.com/reg;none\r\n" +
+		"STR;VRS3;Frankfurt;RTCM 3.2;1004(1),1005(10);2;GPS+GLO;EXNET;DEU;50.10;8.70;1;1;Trimble;none;B;N;9600;vrs;extra\r\n" +
+		"STR;BROKEN;too;short\r\n" +
+		"ENDSOURCETABLE\r\n" +
+		"STR;AFTER;the;end;;;;;;;;;;;;;;;\r\n"
+	st, err := rtk.ParseSourcetable(strings.NewReader(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Casters) != 1 || st.Casters[0].Port != 2101 || st.Casters[0].FallbackPort != 80 {
+		t.Errorf("Unexpected casters %#v", st.Casters)
+	}
+	if len(st.Networks) != 1 || st.Networks[0].Identifier != "EXNET" || st.Networks[0].Fee {
+		t.Errorf("Unexpected networks %#v", st.Networks)
+	}
+	if len(st.Streams) != 1 {
+		t.Fatalf("Unexpected streams %#v", st.Streams)
+	}
+	s := st.Streams[0]
+	if s.Name != "VRS3" || !s.NMEA || s.Solution != 1 || s.Bitrate != 9600 || s.Carrier != 2 || s.Misc != "vrs;extra" {
+		t.Errorf("Unexpected stream %#v", s)
+	}
+}
+
+func TestFormatGGA(t *testing.T) {
+	gga := (string)(rtk.FormatGGA(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), -33.8568, -151.2153, 12.5))
+	if !strings.HasPrefix(gga, "$GPGGA,030405.00,3351.40800,S,15112.91800,W,1,12,1.0,12.500,M,0.0,M,,*") ||
+		!strings.HasSuffix(gga, "\r\n") {
+		t.Errorf("Unexpected GGA %q", gga)
+	}
+	var sum byte
+	for _, c := range ([]byte)(gga[1:strings.IndexByte(gga, '*')]) {
+		sum ^= c
+	}
+	if got := gga[len(gga)-4 : len(gga)-2]; got != strings.ToUpper(hex2(sum)) {
+		t.Errorf("Checksum is %s, want %s", got, hex2(sum))
+	}
+}
+
+func hex2(b byte) string {
+	const digits = "0123456789abcdef"
+	return string([]byte{digits[b>>4], digits[b&0xf]})
+}
@@ -0,0 +1,286 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rtk
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daedaleanai/ublox/ubx"
+)
+
+var (
+	ErrInvalidSiteName = errors.New("Site name is invalid")
+	ErrSiteNotFound    = errors.New("Site not found")
+)
+
+// WGS84 ellipsoid
+const (
+	wgs84A  = 6378137.0
+	wgs84F  = 1 / 298.257223563
+	wgs84E2 = wgs84F * (2 - wgs84F)
+)
+
+// ECEF is a WGS84 earth-centered earth-fixed position in meters
+type ECEF struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+// LLA is a WGS84 position, latitude and longitude are in degrees and altitude is the ellipsoid height in meters
+type LLA struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+	Alt float64 `json:"alt"`
+}
+
+func (p LLA) ECEF() ECEF {
+	lat, lon := p.Lat*math.Pi/180, p.Lon*math.Pi/180
+	sinLat, cosLat := math.Sincos(lat)
+	sinLon, cosLon := math.Sincos(lon)
+	n := wgs84A / math.Sqrt(1-wgs84E2*sinLat*sinLat)
+	return ECEF{
+		X: (n + p.Alt) * cosLat * cosLon,
+		Y: (n + p.Alt) * cosLat * sinLon,
+		Z: (n*(1-wgs84E2) + p.Alt) * sinLat,
+	}
+}
+
+func (p ECEF) LLA() LLA {
+	lon := math.Atan2(p.Y, p.X)
+	r := math.Hypot(p.X, p.Y)
+	lat := math.Atan2(p.Z, r*(1-wgs84E2))
+	var alt float64
+	for range 8 {
+		sinLat, cosLat := math.Sincos(lat)
+		n := wgs84A / math.Sqrt(1-wgs84E2*sinLat*sinLat)
+		// stable near the poles, where r/cos(lat) is not
+		alt = r*cosLat + (p.Z+wgs84E2*n*sinLat)*sinLat - n
+		lat = math.Atan2(p.Z, r*(1-wgs84E2*n/(n+alt)))
+	}
+	return LLA{
+		Lat: lat * 180 / math.Pi,
+		Lon: lon * 180 / math.Pi,
+		Alt: alt,
+	}
+}
+
+// SurveyPosition returns the mean position and its accuracy in meters of a survey-in report
+func SurveyPosition(msg *ubx.NavSvin) (ECEF, float64) {
+	pos := ECEF{
+		X: ((float64)(msg.MeanX_cm) + (float64)(msg.MeanXHP)*0.01) / 100,
+		Y: ((float64)(msg.MeanY_cm) + (float64)(msg.MeanYHP)*0.01) / 100,
+		Z: ((float64)(msg.MeanZ_cm) + (float64)(msg.MeanZHP)*0.01) / 100,
+	}
+	return pos, (float64)(msg.MeanAcc) / 1e4
+}
+
+// splitHP splits v into a standard part in 100*unit and a high precision part in unit, as TMODE3 expects
+func splitHP(v float64, unit float64) (int32, int8) {
+	n := (int64)(math.Round(v / unit))
+	return (int32)(n / 100), (int8)(n % 100)
+}
+
+// FixedTmode3 returns the TMODE3 config which fixes the base at an ECEF position with accuracy in meters
+func FixedTmode3(pos ECEF, acc float64) ubx.CfgTmode3 {
+	cfg := ubx.CfgTmode3{
+		Version:     0x00,
+		Flags:       0x02,
+		FixedPosAcc: (uint32)(math.Round(acc * 1e4)),
+	}
+	cfg.EcefXOrLat, cfg.EcefXOrLatHP = splitHP(pos.X, 1e-4)
+	cfg.EcefYOrLon, cfg.EcefYOrLonHP = splitHP(pos.Y, 1e-4)
+	cfg.EcefZOrAlt_cm, cfg.EcefZOrAltHP = splitHP(pos.Z, 1e-4)
+	return cfg
+}
+
+// Site is a known base station position
+type Site struct {
+	Name     string  `json:"name"`
+	ECEF     ECEF    `json:"ecef"`
+	LLA      LLA     `json:"lla"`      // derived from ECEF
+	Accuracy float64 `json:"accuracy"` // in meters
+	// Surveyed is when the survey-in finished, zero if the position is entered manually
+	Surveyed     time.Time `json:"surveyed"`
+	Duration     uint32    `json:"duration"` // survey-in duration in seconds
+	Observations uint32    `json:"observations"`
+}
+
+// SiteFromSurvey creates a site from the final survey-in report
+func SiteFromSurvey(name string, msg *ubx.NavSvin, now time.Time) *Site {
+	pos, acc := SurveyPosition(msg)
+	return &Site{
+		Name:         name,
+		ECEF:         pos,
+		LLA:          pos.LLA(),
+		Accuracy:     acc,
+		Surveyed:     now,
+		Duration:     msg.Dur_s,
+		Observations: msg.Obs,
+	}
+}
+
+// SiteStore keeps named base station sites and the selected one in a JSON file
+type SiteStore struct {
+	path string
+
+	mux      sync.RWMutex
+	sites    map[string]*Site
+	selected string
+}
+
+type siteFile struct {
+	Sites    []*Site `json:"sites"`
+	Selected string  `json:"selected"`
+}
+
+// OpenSiteStore loads the store from the path, an empty store is created if the file does not exist
+// An empty path creates a store which is not persisted
+func OpenSiteStore(path string) (*SiteStore, error) {
+	s := &SiteStore{
+		path:  path,
+		sites: make(map[string]*Site),
+	}
+	if path == "" {
+		return s, nil
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, err
+	}
+	var f siteFile
+	if err := json.Unmarshal(buf, &f); err != nil {
+		return nil, err
+	}
+	for _, site := range f.Sites {
+		s.sites[site.Name] = site
+	}
+	if _, ok := s.sites[f.Selected]; ok {
+		s.selected = f.Selected
+	}
+	return s, nil
+}
+
+// save writes the store to the file through a temporary file, the caller must hold the lock
+func (s *SiteStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	buf, err := json.MarshalIndent(siteFile{Sites: s.list(), Selected: s.selected}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *SiteStore) list() []*Site {
+	sites := make([]*Site, 0, len(s.sites))
+	for _, site := range s.sites {
+		c := *site
+		sites = append(sites, &c)
+	}
+	slices.SortFunc(sites, func(a, b *Site) int { return strings.Compare(a.Name, b.Name) })
+	return sites
+}
+
+// Sites returns all sites sorted by name
+func (s *SiteStore) Sites() []*Site {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.list()
+}
+
+func (s *SiteStore) Site(name string) *Site {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	site, ok := s.sites[name]
+	if !ok {
+		return nil
+	}
+	c := *site
+	return &c
+}
+
+// Put adds or replaces the site with the same name
+func (s *SiteStore) Put(site *Site) error {
+	if site.Name == "" || len(site.Name) > 64 || strings.ContainsAny(site.Name, "/\r\n") {
+		return ErrInvalidSiteName
+	}
+	c := *site
+	c.LLA = c.ECEF.LLA()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.sites[c.Name] = &c
+	return s.save()
+}
+
+// Delete removes the site, and unselects it if it is selected
+func (s *SiteStore) Delete(name string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.sites[name]; !ok {
+		return ErrSiteNotFound
+	}
+	delete(s.sites, name)
+	if s.selected == name {
+		s.selected = ""
+	}
+	return s.save()
+}
+
+// Select marks the site to be used by the base station, an empty name clears the selection
+func (s *SiteStore) Select(name string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if name != "" {
+		if _, ok := s.sites[name]; !ok {
+			return ErrSiteNotFound
+		}
+	}
+	s.selected = name
+	return s.save()
+}
+
+// Selected returns the selected site, or nil if there is none
+func (s *SiteStore) Selected() *Site {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	site, ok := s.sites[s.selected]
+	if !ok {
+		return nil
+	}
+	c := *site
+	return &c
+}
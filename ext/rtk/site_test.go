@@ -0,0 +1,144 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rtk_test
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daedaleanai/ublox/ubx"
+
+	"github.com/zyxkad/drone/ext/rtk"
+)
+
+func TestLLAToECEF(t *testing.T) {
+	cases := []struct {
+		lla  rtk.LLA
+		ecef rtk.ECEF
+	}{
+		{rtk.LLA{0, 0, 0}, rtk.ECEF{6378137, 0, 0}},
+		{rtk.LLA{0, 90, 100}, rtk.ECEF{0, 6378237, 0}},
+		{rtk.LLA{0, 180, -20}, rtk.ECEF{-6378117, 0, 0}},
+		{rtk.LLA{90, 0, 0}, rtk.ECEF{0, 0, 6356752.3142}},
+		{rtk.LLA{-90, 0, 10}, rtk.ECEF{0, 0, -6356762.3142}},
+	}
+	for _, c := range cases {
+		got := c.lla.ECEF()
+		if math.Abs(got.X-c.ecef.X) > 1e-3 || math.Abs(got.Y-c.ecef.Y) > 1e-3 || math.Abs(got.Z-c.ecef.Z) > 1e-3 {
+			t.Errorf("%v.ECEF() = %v, want %v", c.lla, got, c.ecef)
+		}
+	}
+	for _, p := range []rtk.LLA{
+		{47.3769, 8.5417, 408},
+		{-33.8568, -151.2153, 25},
+		{89.9999, 45, 3000},
+		{-12.5, 0.001, -50},
+	} {
+		back := p.ECEF().LLA()
+		if math.Abs(back.Lat-p.Lat) > 1e-9 || math.Abs(back.Lon-p.Lon) > 1e-9 || math.Abs(back.Alt-p.Alt) > 1e-4 {
+			t.Errorf("%v.ECEF().LLA() = %v", p, back)
+		}
+	}
+}
+
+func TestFixedTmode3(t *testing.T) {
+	cfg := rtk.FixedTmode3(rtk.ECEF{X: 4283035.98551, Y: -643305.78693, Z: 0.00004}, 0.0123)
+	if cfg.Flags != 0x02 || cfg.FixedPosAcc != 123 {
+		t.Errorf("Unexpected flags %#x or accuracy %d", cfg.Flags, cfg.FixedPosAcc)
+	}
+	if cfg.EcefXOrLat != 428303598 || cfg.EcefXOrLatHP != 55 ||
+		cfg.EcefYOrLon != -64330578 || cfg.EcefYOrLonHP != -69 ||
+		cfg.EcefZOrAlt_cm != 0 || cfg.EcefZOrAltHP != 0 {
+		t.Errorf("Unexpected position %#v", cfg)
+	}
+}
+
+func TestSiteFromSurvey(t *testing.T) {
+	now := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	site := rtk.SiteFromSurvey("roof", &ubx.NavSvin{
+		Dur_s:    300,
+		MeanX_cm: 428303598,
+		MeanY_cm: -64330578,
+		MeanZ_cm: 467122509,
+		MeanXHP:  55,
+		MeanYHP:  -69,
+		MeanZHP:  -9,
+		MeanAcc:  1500,
+		Obs:      299,
+		Valid:    1,
+	}, now)
+	want := rtk.ECEF{X: 4283035.9855, Y: -643305.7869, Z: 4671225.0891}
+	if math.Abs(site.ECEF.X-want.X) > 1e-6 || math.Abs(site.ECEF.Y-want.Y) > 1e-6 || math.Abs(site.ECEF.Z-want.Z) > 1e-6 {
+		t.Errorf("Position is %v, want %v", site.ECEF, want)
+	}
+	if site.Accuracy != 0.15 || site.Duration != 300 || site.Observations != 299 || !site.Surveyed.Equal(now) {
+		t.Errorf("Unexpected site %#v", site)
+	}
+	// the fixed position must be the surveyed one without any rounding
+	cfg := rtk.FixedTmode3(site.ECEF, site.Accuracy)
+	hp := func(cm int32, hp int8) int64 { return (int64)(cm)*100 + (int64)(hp) }
+	if hp(cfg.EcefXOrLat, cfg.EcefXOrLatHP) != 428303598*100+55 ||
+		hp(cfg.EcefYOrLon, cfg.EcefYOrLonHP) != -64330578*100-69 ||
+		hp(cfg.EcefZOrAlt_cm, cfg.EcefZOrAltHP) != 467122509*100-9 || cfg.FixedPosAcc != 1500 {
+		t.Errorf("Unexpected TMODE3 %#v", cfg)
+	}
+}
+
+func TestSiteStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sites.json")
+	store, err := rtk.OpenSiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(&rtk.Site{Name: ""}); err != rtk.ErrInvalidSiteName {
+		t.Errorf("Expected ErrInvalidSiteName, got %v", err)
+	}
+	if err := store.Select("field"); err != rtk.ErrSiteNotFound {
+		t.Errorf("Expected ErrSiteNotFound, got %v", err)
+	}
+	field := rtk.LLA{Lat: 31.23, Lon: 121.47, Alt: 12}
+	if err := store.Put(&rtk.Site{Name: "field", ECEF: field.ECEF(), Accuracy: 0.02}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(&rtk.Site{Name: "base", ECEF: rtk.ECEF{X: 6378137}, Accuracy: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Select("field"); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = rtk.OpenSiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sites := store.Sites()
+	if len(sites) != 2 || sites[0].Name != "base" || sites[1].Name != "field" {
+		t.Fatalf("Sites are not persisted: %v", sites)
+	}
+	selected := store.Selected()
+	if selected == nil || selected.Name != "field" || math.Abs(selected.LLA.Lat-field.Lat) > 1e-9 {
+		t.Fatalf("Unexpected selected site %#v", selected)
+	}
+	if err := store.Delete("field"); err != nil {
+		t.Fatal(err)
+	}
+	if store.Selected() != nil || store.Site("field") != nil {
+		t.Error("Deleted site is still selected")
+	}
+}
@@ -0,0 +1,226 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rtk
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SourceStream is a STR record of a sourcetable
+type SourceStream struct {
+	Mountpoint
+	NMEA           bool   `json:"nmea"` // the rover must upload its position, usually for VRS
+	Solution       int    `json:"solution"`
+	Compression    string `json:"compression"`
+	Authentication string `json:"authentication"` // N: none, B: basic, D: digest
+	Fee            bool   `json:"fee"`
+	Misc           string `json:"misc"`
+}
+
+// SourceCaster is a CAS record of a sourcetable
+type SourceCaster struct {
+	Host         string  `json:"host"`
+	Port         int     `json:"port"`
+	Identifier   string  `json:"identifier"`
+	Operator     string  `json:"operator"`
+	NMEA         bool    `json:"nmea"`
+	Country      string  `json:"country"`
+	Latitude     float64 `json:"latitude"`
+	Longitude    float64 `json:"longitude"`
+	FallbackHost string  `json:"fallbackHost"`
+	FallbackPort int     `json:"fallbackPort"`
+	Misc         string  `json:"misc"`
+}
+
+// SourceNetwork is a NET record of a sourcetable
+type SourceNetwork struct {
+	Identifier     string `json:"identifier"`
+	Operator       string `json:"operator"`
+	Authentication string `json:"authentication"`
+	Fee            bool   `json:"fee"`
+	WebNet         string `json:"webNet"`
+	WebStr         string `json:"webStr"`
+	WebReg         string `json:"webReg"`
+	Misc           string `json:"misc"`
+}
+
+type Sourcetable struct {
+	Casters  []*SourceCaster  `json:"casters"`
+	Networks []*SourceNetwork `json:"networks"`
+	Streams  []*SourceStream  `json:"streams"`
+}
+
+// Stream returns the stream of the mountpoint, or nil if not found
+func (t *Sourcetable) Stream(name string) *SourceStream {
+	for _, s := range t.Streams {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// ParseSourcetable parses the records until ENDSOURCETABLE or EOF, unknown and malformed records are skipped
+func ParseSourcetable(r io.Reader) (*Sourcetable, error) {
+	table := new(Sourcetable)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "ENDSOURCETABLE" {
+			return table, nil
+		}
+		fields := strings.Split(line, ";")
+		field := func(i int) string {
+			if i < len(fields) {
+				return fields[i]
+			}
+			return ""
+		}
+		num := func(i int) int {
+			n, _ := strconv.Atoi(field(i))
+			return n
+		}
+		float := func(i int) float64 {
+			n, _ := strconv.ParseFloat(field(i), 64)
+			return n
+		}
+		switch fields[0] {
+		case "STR":
+			if len(fields) < 18 {
+				continue
+			}
+			table.Streams = append(table.Streams, &SourceStream{
+				Mountpoint: Mountpoint{
+					Name:          field(1),
+					Identifier:    field(2),
+					Format:        field(3),
+					FormatDetails: field(4),
+					Carrier:       num(5),
+					NavSystem:     field(6),
+					Network:       field(7),
+					Country:       field(8),
+					Latitude:      float(9),
+					Longitude:     float(10),
+					Generator:     field(13),
+					Bitrate:       num(17),
+				},
+				NMEA:           field(11) == "1",
+				Solution:       num(12),
+				Compression:    field(14),
+				Authentication: field(15),
+				Fee:            field(16) == "Y",
+				Misc:           strings.Join(fields[min(18, len(fields)):], ";"),
+			})
+		case "CAS":
+			if len(fields) < 9 {
+				continue
+			}
+			table.Casters = append(table.Casters, &SourceCaster{
+				Host:         field(1),
+				Port:         num(2),
+				Identifier:   field(3),
+				Operator:     field(4),
+				NMEA:         field(5) == "1",
+				Country:      field(6),
+				Latitude:     float(7),
+				Longitude:    float(8),
+				FallbackHost: field(9),
+				FallbackPort: num(10),
+				Misc:         field(11),
+			})
+		case "NET":
+			if len(fields) < 5 {
+				continue
+			}
+			table.Networks = append(table.Networks, &SourceNetwork{
+				Identifier:     field(1),
+				Operator:       field(2),
+				Authentication: field(3),
+				Fee:            field(4) == "Y",
+				WebNet:         field(5),
+				WebStr:         field(6),
+				WebReg:         field(7),
+				Misc:           field(8),
+			})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// FetchSourcetable downloads the sourcetable of the caster in the config, the mountpoint is ignored
+func FetchSourcetable(ctx context.Context, cfg NtripClientConfig) (*Sourcetable, error) {
+	cfg.setDefaults()
+	if cfg.Server == "" {
+		return nil, errors.New("NTRIP server is empty")
+	}
+	ctx, cancel := context.WithTimeout(ctx, ntripIdleTimeout)
+	defer cancel()
+	if cfg.Version == 1 {
+		return fetchSourcetableV1(ctx, cfg)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.baseURL()+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	setNtripHeaders(req.Header, 2, cfg.Username, cfg.Password)
+	resp, err := ntripHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if err := checkNtripResponse(resp.StatusCode, ""); err != nil {
+			return nil, err
+		}
+	}
+	return ParseSourcetable(resp.Body)
+}
+
+func fetchSourcetableV1(ctx context.Context, cfg NtripClientConfig) (*Sourcetable, error) {
+	addr, err := cfg.hostPort()
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(ntripIdleTimeout))
+	}
+	// the caster responds SOURCETABLE, or HTTP 200 if it does not follow NTRIP v1
+	br, err := ntripRequestV1(conn, "/", cfg.Username, cfg.Password)
+	if err != nil && !errors.Is(err, ErrMountNotFound) {
+		return nil, err
+	}
+	return ParseSourcetable(br)
+}
@@ -0,0 +1,392 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rtk
+
+import (
+	"math/bits"
+	"sync"
+
+	"github.com/go-gnss/rtcm/rtcm3"
+)
+
+// GNSS is a satellite system of MSM messages
+type GNSS int
+
+const (
+	GNSSGPS GNSS = iota
+	GNSSGLONASS
+	GNSSGalileo
+	GNSSSBAS
+	GNSSQZSS
+	GNSSBeiDou
+)
+
+func (g GNSS) String() string {
+	switch g {
+	case GNSSGPS:
+		return "GPS"
+	case GNSSGLONASS:
+		return "GLONASS"
+	case GNSSGalileo:
+		return "Galileo"
+	case GNSSSBAS:
+		return "SBAS"
+	case GNSSQZSS:
+		return "QZSS"
+	case GNSSBeiDou:
+		return "BeiDou"
+	}
+	return "unknown"
+}
+
+// MSMSystem returns the satellite system of a MSM message number
+func MSMSystem(num int) (GNSS, bool) {
+	if !IsMSM(num) {
+		return 0, false
+	}
+	return (GNSS)(num/10 - 107), true
+}
+
+// LockTime returns the minimum lock time in milliseconds of a MSM5/7 lock time indicator (DF407)
+func LockTime(ind uint16) uint32 {
+	if ind < 64 {
+		return (uint32)(ind)
+	}
+	if ind > 704 {
+		ind = 704
+	}
+	k := (ind-64)/32 + 1
+	start := 64 + 32*(k-1)
+	return ((uint32)(ind-start) << k) + (1 << (k + 5))
+}
+
+// LockTimeIndicator returns the MSM1-4 lock time indicator (DF402) of a lock time in milliseconds
+func LockTimeIndicator(ms uint32) uint8 {
+	if ms < 32 {
+		return 0
+	}
+	return (uint8)(min(bits.Len32(ms/32), 15))
+}
+
+// roundShift divides x by 2^n, rounding half away from zero
+func roundShift(x int32, n uint) int32 {
+	half := (int32)(1) << (n - 1)
+	if x < 0 {
+		return -((-x + half) >> n)
+	}
+	return (x + half) >> n
+}
+
+const (
+	invalidPseudorangeMsm7 = -1 << 19
+	invalidPseudorangeMsm4 = -1 << 14
+	invalidPhaseRangeMsm7  = -1 << 23
+	invalidPhaseRangeMsm4  = -1 << 21
+)
+
+// MSM7ToMSM4 converts a MSM7 message to the MSM4 message of the same system
+// The rough ranges are kept, and the fine ranges, lock times and C/N0 are rounded to the MSM4 resolutions
+func MSM7ToMSM4(msg rtcm3.MessageMsm7) rtcm3.MessageMsm4 {
+	out := rtcm3.MessageMsm4{
+		MsmHeader: msg.MsmHeader,
+		SatelliteData: rtcm3.SatelliteDataMsm46{
+			RangeMilliseconds: msg.SatelliteData.RangeMilliseconds,
+			Ranges:            msg.SatelliteData.Ranges,
+		},
+	}
+	out.MessageNumber -= 3
+	sig := msg.SignalData
+	n := len(sig.Pseudoranges)
+	out.SignalData = rtcm3.SignalDataMsm4{
+		Pseudoranges:    make([]int16, n),
+		PhaseRanges:     make([]int32, n),
+		PhaseRangeLocks: make([]uint8, n),
+		HalfCycles:      sig.HalfCycles,
+		Cnrs:            make([]uint8, n),
+	}
+	for i := range n {
+		// DF405 is in 2^-29 ms and DF400 is in 2^-24 ms
+		if pr := sig.Pseudoranges[i]; pr == invalidPseudorangeMsm7 {
+			out.SignalData.Pseudoranges[i] = invalidPseudorangeMsm4
+		} else {
+			out.SignalData.Pseudoranges[i] = (int16)(min(max(roundShift(pr, 5), invalidPseudorangeMsm4+1), -invalidPseudorangeMsm4-1))
+		}
+		// DF406 is in 2^-31 ms and DF401 is in 2^-29 ms
+		if cp := sig.PhaseRanges[i]; cp == invalidPhaseRangeMsm7 {
+			out.SignalData.PhaseRanges[i] = invalidPhaseRangeMsm4
+		} else {
+			out.SignalData.PhaseRanges[i] = min(max(roundShift(cp, 2), invalidPhaseRangeMsm4+1), -invalidPhaseRangeMsm4-1)
+		}
+		out.SignalData.PhaseRangeLocks[i] = LockTimeIndicator(LockTime(sig.PhaseRangeLocks[i]))
+		// DF408 is in 2^-4 dB-Hz and DF403 is in 1 dB-Hz
+		out.SignalData.Cnrs[i] = (uint8)(min((sig.Cnrs[i]+8)>>4, 63))
+	}
+	return out
+}
+
+// msmSelection is the satellites and cells kept from a MSM message
+type msmSelection struct {
+	header rtcm3.MsmHeader
+	sats   []int // the kept satellite indexes
+	cells  []int // the kept cell indexes
+}
+
+// selectMsm removes the cells which keepCell returns false, and the satellites or signals without any cell left
+// keepCell receives the satellite and signal ID which start from 1, and the cell index
+func selectMsm(h rtcm3.MsmHeader, keepCell func(sat, sig, cell int) bool) *msmSelection {
+	l := newMsmLayout(h)
+	var sigIDs []int
+	for i := 31; i >= 0; i-- {
+		if h.SignalMask&((uint32)(1)<<i) != 0 {
+			sigIDs = append(sigIDs, 32-i)
+		}
+	}
+	kept := make([][]bool, l.nsat)
+	var sigUsed uint32
+	cell := 0
+	for r := range l.nsat {
+		sat := 64 - bits.TrailingZeros64(l.satBits[r])
+		kept[r] = make([]bool, l.nsig)
+		for c := range l.nsig {
+			if l.rowMasks[r]&((uint64)(1)<<(l.nsig-1-c)) == 0 {
+				continue
+			}
+			if keepCell(sat, sigIDs[c], cell) {
+				kept[r][c] = true
+				sigUsed |= (uint32)(1) << (32 - sigIDs[c])
+			}
+			cell++
+		}
+	}
+
+	sel := &msmSelection{header: h}
+	sel.header.SatelliteMask = 0
+	sel.header.SignalMask = sigUsed
+	sel.header.CellMask = 0
+	cell = 0
+	for r := range l.nsat {
+		var row uint64
+		rowKept := false
+		for c := range l.nsig {
+			present := l.rowMasks[r]&((uint64)(1)<<(l.nsig-1-c)) != 0
+			if sigUsed&((uint32)(1)<<(32-sigIDs[c])) != 0 {
+				row <<= 1
+				if kept[r][c] {
+					row |= 1
+				}
+			}
+			if present {
+				if kept[r][c] {
+					sel.cells = append(sel.cells, cell)
+					rowKept = true
+				}
+				cell++
+			}
+		}
+		if rowKept {
+			sel.header.SatelliteMask |= l.satBits[r]
+			sel.header.CellMask = (sel.header.CellMask << bits.OnesCount32(sigUsed)) | row
+			sel.sats = append(sel.sats, r)
+		}
+	}
+	return sel
+}
+
+func pick[T any](s []T, indexes []int) []T {
+	out := make([]T, len(indexes))
+	for i, j := range indexes {
+		out[i] = s[j]
+	}
+	return out
+}
+
+func (sel *msmSelection) msm7(msg rtcm3.MessageMsm7) rtcm3.MessageMsm7 {
+	sat, sig := msg.SatelliteData, msg.SignalData
+	return rtcm3.MessageMsm7{
+		MsmHeader: sel.header,
+		SatelliteData: rtcm3.SatelliteDataMsm57{
+			RangeMilliseconds: pick(sat.RangeMilliseconds, sel.sats),
+			Extended:          pick(sat.Extended, sel.sats),
+			Ranges:            pick(sat.Ranges, sel.sats),
+			PhaseRangeRates:   pick(sat.PhaseRangeRates, sel.sats),
+		},
+		SignalData: rtcm3.SignalDataMsm7{
+			Pseudoranges:    pick(sig.Pseudoranges, sel.cells),
+			PhaseRanges:     pick(sig.PhaseRanges, sel.cells),
+			PhaseRangeLocks: pick(sig.PhaseRangeLocks, sel.cells),
+			HalfCycles:      pick(sig.HalfCycles, sel.cells),
+			Cnrs:            pick(sig.Cnrs, sel.cells),
+			PhaseRangeRates: pick(sig.PhaseRangeRates, sel.cells),
+		},
+	}
+}
+
+func (sel *msmSelection) msm4(msg rtcm3.MessageMsm4) rtcm3.MessageMsm4 {
+	sat, sig := msg.SatelliteData, msg.SignalData
+	return rtcm3.MessageMsm4{
+		MsmHeader: sel.header,
+		SatelliteData: rtcm3.SatelliteDataMsm46{
+			RangeMilliseconds: pick(sat.RangeMilliseconds, sel.sats),
+			Ranges:            pick(sat.Ranges, sel.sats),
+		},
+		SignalData: rtcm3.SignalDataMsm4{
+			Pseudoranges:    pick(sig.Pseudoranges, sel.cells),
+			PhaseRanges:     pick(sig.PhaseRanges, sel.cells),
+			PhaseRangeLocks: pick(sig.PhaseRangeLocks, sel.cells),
+			HalfCycles:      pick(sig.HalfCycles, sel.cells),
+			Cnrs:            pick(sig.Cnrs, sel.cells),
+		},
+	}
+}
+
+// ElevationFunc returns the elevation in degrees of a satellite, ok is false if it is unknown
+type ElevationFunc func(system GNSS, sat int) (elev float64, ok bool)
+
+type TranscodeConfig struct {
+	// MSM4 converts MSM7 messages to MSM4
+	MSM4 bool `json:"msm4"`
+	// MinCNR strips the signals with a lower C/N0 in dB-Hz, 0 disables the mask
+	MinCNR float64 `json:"minCnr"`
+	// MinElevation strips the satellites with a lower elevation in degrees, 0 disables the mask
+	// Satellites with unknown elevation are kept
+	MinElevation float64 `json:"minElevation"`
+}
+
+type TranscodeStats struct {
+	Frames          uint64 `json:"frames"`
+	InBytes         uint64 `json:"inBytes"`
+	OutBytes        uint64 `json:"outBytes"`
+	StrippedSats    uint64 `json:"strippedSats"`
+	StrippedSignals uint64 `json:"strippedSignals"`
+}
+
+// Transcoder shrinks the MSM frames before they are sent to the drones
+type Transcoder struct {
+	mux       sync.Mutex
+	cfg       TranscodeConfig
+	elevation ElevationFunc
+	stats     TranscodeStats
+}
+
+func NewTranscoder(cfg TranscodeConfig, elevation ElevationFunc) *Transcoder {
+	return &Transcoder{
+		cfg:       cfg,
+		elevation: elevation,
+	}
+}
+
+func (t *Transcoder) Config() TranscodeConfig {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.cfg
+}
+
+func (t *Transcoder) SetConfig(cfg TranscodeConfig) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.cfg = cfg
+}
+
+func (t *Transcoder) Stats() TranscodeStats {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.stats
+}
+
+// Transcode applies the config to a MSM4 or MSM7 frame, other frames are returned as they are
+// ok is false if no satellite is left, then the frame should not be sent
+func (t *Transcoder) Transcode(frame rtcm3.Frame) (out rtcm3.Frame, ok bool) {
+	num := (int)(frame.MessageNumber())
+	system, isMsm := MSMSystem(num)
+	if !isMsm || (num%10 != 4 && num%10 != 7) {
+		return frame, true
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	cfg := t.cfg
+	if !cfg.MSM4 && cfg.MinCNR <= 0 && (cfg.MinElevation <= 0 || t.elevation == nil) {
+		return frame, true
+	}
+
+	var (
+		msm4 rtcm3.MessageMsm4
+		msm7 rtcm3.MessageMsm7
+		cnrs []float64
+	)
+	if num%10 == 7 {
+		msm7 = rtcm3.DeserializeMessageMsm7(frame.Payload)
+		for _, c := range msm7.SignalData.Cnrs {
+			cnrs = append(cnrs, (float64)(c)/16)
+		}
+	} else {
+		msm4 = rtcm3.DeserializeMessageMsm4(frame.Payload)
+		for _, c := range msm4.SignalData.Cnrs {
+			cnrs = append(cnrs, (float64)(c))
+		}
+	}
+
+	var (
+		header   = msm7.MsmHeader
+		elevKeep = make(map[int]bool)
+		stripped uint64
+	)
+	if num%10 == 4 {
+		header = msm4.MsmHeader
+	}
+	sel := selectMsm(header, func(sat, sig, cell int) bool {
+		if cfg.MinElevation > 0 && t.elevation != nil {
+			keep, ok := elevKeep[sat]
+			if !ok {
+				elev, known := t.elevation(system, sat)
+				keep = !known || elev >= cfg.MinElevation
+				elevKeep[sat] = keep
+			}
+			if !keep {
+				stripped++
+				return false
+			}
+		}
+		// 0 means the C/N0 is not available
+		if cfg.MinCNR > 0 && cnrs[cell] != 0 && cnrs[cell] < cfg.MinCNR {
+			stripped++
+			return false
+		}
+		return true
+	})
+	t.stats.Frames++
+	t.stats.InBytes += (uint64)(frame.Length) + frameOverhead
+	t.stats.StrippedSignals += stripped
+	t.stats.StrippedSats += (uint64)(header.SatelliteCount() - len(sel.sats))
+	if len(sel.sats) == 0 {
+		return frame, false
+	}
+
+	var payload []byte
+	if num%10 == 7 {
+		msm7 = sel.msm7(msm7)
+		if cfg.MSM4 {
+			payload = MSM7ToMSM4(msm7).Serialize()
+		} else {
+			payload = msm7.Serialize()
+		}
+	} else {
+		payload = sel.msm4(msm4).Serialize()
+	}
+	out = rtcm3.EncapsulateByteArray(payload)
+	t.stats.OutBytes += (uint64)(out.Length) + frameOverhead
+	return out, true
+}
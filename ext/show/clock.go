@@ -0,0 +1,345 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package show
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zyxkad/drone"
+)
+
+// Clock provides the show time
+type Clock interface {
+	// ShowTime returns the current show time
+	// running is false when the clock is paused or its source is lost, the drones should hold then
+	ShowTime() (at time.Duration, running bool)
+}
+
+// FreeClock free-runs from the station clock
+type FreeClock struct {
+	startAt  atomic.Int64 // the wall time of show time zero, in µs
+	pausedAt atomic.Int64 // in µs
+	paused   atomic.Bool
+}
+
+var _ Clock = (*FreeClock)(nil)
+
+// Start sets the wall time of show time zero
+func (c *FreeClock) Start(at time.Time) {
+	c.paused.Store(false)
+	c.startAt.Store(at.UnixMicro())
+}
+
+func (c *FreeClock) ShowTime() (time.Duration, bool) {
+	start := c.startAt.Load()
+	if start == 0 {
+		return 0, false
+	}
+	now := time.Now().UnixMicro()
+	paused := c.paused.Load()
+	if paused {
+		now = c.pausedAt.Load()
+	}
+	return (time.Duration)(now-start) * time.Microsecond, !paused
+}
+
+// Pause stops the clock, it returns false if the clock is already paused
+func (c *FreeClock) Pause() bool {
+	if c.paused.Load() {
+		return false
+	}
+	c.pausedAt.Store(time.Now().UnixMicro())
+	c.paused.Store(true)
+	return true
+}
+
+// Resume continues the clock from where it was paused, it returns false if the clock is not paused
+func (c *FreeClock) Resume() bool {
+	if !c.paused.Load() {
+		return false
+	}
+	c.startAt.Add(time.Now().UnixMicro() - c.pausedAt.Load())
+	c.paused.Store(false)
+	return true
+}
+
+// TimecodeDecoder decodes a timecode from a UDP packet, ok is false if the packet is not a timecode
+type TimecodeDecoder func(packet []byte) (tc time.Duration, ok bool)
+
+type TimecodeConfig struct {
+	// Offset is added to the received timecode to get the show time
+	// For example, if the music starts at 01:00:00:00, the offset should be -1h
+	Offset time.Duration
+	// JumpThreshold is the max difference between the timecode and the local estimate
+	// which is smoothed out, a larger difference makes the clock jump to the timecode
+	JumpThreshold time.Duration
+	// Smoothing is the fraction of the difference corrected by each timecode, in (0, 1]
+	Smoothing float64
+	// Freewheel is how long the clock keeps running after the timecode stopped arriving
+	Freewheel time.Duration
+}
+
+func (c *TimecodeConfig) setDefaults() {
+	if c.JumpThreshold <= 0 {
+		c.JumpThreshold = time.Millisecond * 500
+	}
+	if c.Smoothing <= 0 || c.Smoothing > 1 {
+		c.Smoothing = 0.1
+	}
+	if c.Freewheel <= 0 {
+		c.Freewheel = time.Second
+	}
+}
+
+// TimecodeClock follows an external timecode source
+// Small differences are smoothed to filter the network jitter, large differences are applied as jumps
+// The clock is stopped when the timecode stops advancing, or no timecode is received longer than Freewheel
+type TimecodeClock struct {
+	cfg TimecodeConfig
+
+	mux      sync.Mutex
+	base     time.Duration // the estimated timecode at baseAt
+	baseAt   time.Time
+	lastTC   time.Duration
+	lastRecv time.Time
+	advanced bool // whether the last timecode advanced from the previous one
+	jumps    int
+}
+
+var _ Clock = (*TimecodeClock)(nil)
+
+func NewTimecodeClock(cfg TimecodeConfig) *TimecodeClock {
+	cfg.setDefaults()
+	return &TimecodeClock{
+		cfg: cfg,
+	}
+}
+
+// TimecodeStat is the state of a timecode clock
+type TimecodeStat struct {
+	Timecode drone.Duration `json:"timecode"`
+	LastRecv time.Time      `json:"lastRecv"`
+	Running  bool           `json:"running"`
+	Jumps    int            `json:"jumps"`
+}
+
+func (c *TimecodeClock) Stat() TimecodeStat {
+	_, running := c.ShowTime()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return TimecodeStat{
+		Timecode: (drone.Duration)(c.lastTC),
+		LastRecv: c.lastRecv,
+		Running:  running,
+		Jumps:    c.jumps,
+	}
+}
+
+// Feed updates the clock with a timecode received at the wall time
+func (c *TimecodeClock) Feed(tc time.Duration, at time.Time) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.lastRecv.IsZero() {
+		c.base, c.baseAt = tc, at
+		c.lastTC, c.lastRecv = tc, at
+		return
+	}
+	c.advanced = tc != c.lastTC
+	c.lastTC, c.lastRecv = tc, at
+	if !c.advanced {
+		c.base, c.baseAt = tc, at
+		return
+	}
+	predicted := c.base + at.Sub(c.baseAt)
+	diff := tc - predicted
+	if diff > c.cfg.JumpThreshold || diff < -c.cfg.JumpThreshold {
+		c.jumps++
+		c.base = tc
+	} else {
+		c.base = predicted + (time.Duration)((float64)(diff)*c.cfg.Smoothing)
+	}
+	c.baseAt = at
+}
+
+func (c *TimecodeClock) ShowTime() (time.Duration, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.lastRecv.IsZero() {
+		return 0, false
+	}
+	now := time.Now()
+	running := c.advanced && now.Sub(c.lastRecv) <= c.cfg.Freewheel
+	tc := c.base
+	if running {
+		tc += now.Sub(c.baseAt)
+	} else if c.advanced {
+		// the source is lost, stop where the freewheel ends
+		tc += min(now.Sub(c.baseAt), c.cfg.Freewheel)
+	}
+	return tc + c.cfg.Offset, running
+}
+
+// Serve reads timecode packets from conn until ctx is done or conn is closed
+func (c *TimecodeClock) Serve(ctx context.Context, conn net.PacketConn, decoder TimecodeDecoder) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if tc, ok := decoder(buf[:n]); ok {
+			c.Feed(tc, time.Now())
+		}
+	}
+}
+
+// ListenTimecode listens the UDP address and feeds the clock in a new goroutine
+// The listener is closed when ctx is done
+func (c *TimecodeClock) ListenTimecode(ctx context.Context, addr string, decoder TimecodeDecoder) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	go c.Serve(ctx, conn, decoder)
+	return nil
+}
+
+var artNetID = []byte("Art-Net\x00")
+
+const artOpTimeCode = 0x9700
+
+// DecodeArtTimeCode decodes Art-Net's ArtTimeCode packet, which carries SMPTE timecode
+func DecodeArtTimeCode(packet []byte) (time.Duration, bool) {
+	if len(packet) < 19 || !bytes.Equal(packet[:8], artNetID) || binary.LittleEndian.Uint16(packet[8:10]) != artOpTimeCode {
+		return 0, false
+	}
+	frames, seconds, minutes, hours, typ := packet[14], packet[15], packet[16], packet[17], packet[18]
+	var fps float64
+	switch typ {
+	case 0:
+		fps = 24
+	case 1:
+		fps = 25
+	case 2:
+		fps = 30000.0 / 1001
+		// drop frame timecode skips frame 0 and 1 every minute except every tenth minute
+		totalMinutes := (int)(hours)*60 + (int)(minutes)
+		dropped := 2 * (totalMinutes - totalMinutes/10)
+		count := ((int)(hours)*3600+(int)(minutes)*60+(int)(seconds))*30 + (int)(frames) - dropped
+		return (time.Duration)((float64)(count) / fps * (float64)(time.Second)), true
+	case 3:
+		fps = 30
+	default:
+		return 0, false
+	}
+	sec := (int)(hours)*3600 + (int)(minutes)*60 + (int)(seconds)
+	return (time.Duration)(sec)*time.Second + (time.Duration)((float64)(frames)/fps*(float64)(time.Second)), true
+}
+
+// OSCTimeDecoder returns a decoder for OSC messages with the address
+// The first argument is the timecode, floats are in seconds and integers are in milliseconds
+// OSC bundles are searched recursively
+func OSCTimeDecoder(address string) TimecodeDecoder {
+	return func(packet []byte) (time.Duration, bool) {
+		return decodeOSCTime(packet, address)
+	}
+}
+
+var errOSCMalformed = errors.New("Malformed OSC packet")
+
+func decodeOSCTime(packet []byte, address string) (time.Duration, bool) {
+	if bytes.HasPrefix(packet, []byte("#bundle\x00")) {
+		if len(packet) < 16 {
+			return 0, false
+		}
+		// skip the 8 bytes time tag
+		rest := packet[16:]
+		for len(rest) >= 4 {
+			size := (int)(binary.BigEndian.Uint32(rest))
+			rest = rest[4:]
+			if size < 0 || size > len(rest) {
+				return 0, false
+			}
+			if tc, ok := decodeOSCTime(rest[:size], address); ok {
+				return tc, true
+			}
+			rest = rest[size:]
+		}
+		return 0, false
+	}
+	addr, rest, err := readOSCString(packet)
+	if err != nil || addr != address {
+		return 0, false
+	}
+	tags, rest, err := readOSCString(rest)
+	if err != nil || len(tags) < 2 || tags[0] != ',' {
+		return 0, false
+	}
+	switch tags[1] {
+	case 'f':
+		if len(rest) < 4 {
+			return 0, false
+		}
+		v := math.Float32frombits(binary.BigEndian.Uint32(rest))
+		return (time.Duration)((float64)(v) * (float64)(time.Second)), true
+	case 'd':
+		if len(rest) < 8 {
+			return 0, false
+		}
+		v := math.Float64frombits(binary.BigEndian.Uint64(rest))
+		return (time.Duration)(v * (float64)(time.Second)), true
+	case 'i':
+		if len(rest) < 4 {
+			return 0, false
+		}
+		return (time.Duration)((int32)(binary.BigEndian.Uint32(rest))) * time.Millisecond, true
+	case 'h':
+		if len(rest) < 8 {
+			return 0, false
+		}
+		return (time.Duration)((int64)(binary.BigEndian.Uint64(rest))) * time.Millisecond, true
+	}
+	return 0, false
+}
+
+// readOSCString reads a null terminated string which is padded to 4 bytes
+func readOSCString(buf []byte) (string, []byte, error) {
+	i := bytes.IndexByte(buf, 0)
+	if i < 0 {
+		return "", nil, errOSCMalformed
+	}
+	size := (i + 4) &^ 3
+	if size > len(buf) {
+		return "", nil, errOSCMalformed
+	}
+	return (string)(buf[:i]), buf[size:], nil
+}
@@ -0,0 +1,81 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package show_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zyxkad/drone/ext/show"
+)
+
+func TestTimecodeDecoders(t *testing.T) {
+	// 01:02:03:12 at 25 fps
+	art := []byte("Art-Net\x00\x00\x97\x00\x0e\x00\x00\x0c\x03\x02\x01\x01")
+	if tc, ok := show.DecodeArtTimeCode(art); !ok || tc != time.Hour+time.Minute*2+time.Second*3+time.Millisecond*480 {
+		t.Errorf("Unexpected ArtTimeCode %v %v", tc, ok)
+	}
+	// 00:01:00;02 drop frame is the 1800th frame
+	art[14], art[15], art[16], art[17], art[18] = 2, 0, 1, 0, 2
+	if tc, ok := show.DecodeArtTimeCode(art); !ok || tc != (time.Duration)(1800*1001)*time.Second/30000 {
+		t.Errorf("Unexpected drop frame ArtTimeCode %v %v", tc, ok)
+	}
+
+	decode := show.OSCTimeDecoder("/show/time")
+	// "/show/time" ",f" 12.5
+	msg := []byte("/show/time\x00\x00,f\x00\x00\x41\x48\x00\x00")
+	if tc, ok := decode(msg); !ok || tc != time.Millisecond*12500 {
+		t.Errorf("Unexpected OSC time %v %v", tc, ok)
+	}
+	bundle := append([]byte("#bundle\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x14"), msg...)
+	if tc, ok := decode(bundle); !ok || tc != time.Millisecond*12500 {
+		t.Errorf("Unexpected OSC bundle time %v %v", tc, ok)
+	}
+	if _, ok := show.OSCTimeDecoder("/other")(msg); ok {
+		t.Errorf("OSC message with other address should be ignored")
+	}
+}
+
+func TestTimecodeClock(t *testing.T) {
+	clock := show.NewTimecodeClock(show.TimecodeConfig{
+		Offset:    -time.Hour,
+		Freewheel: time.Second,
+	})
+	if _, running := clock.ShowTime(); running {
+		t.Fatalf("Clock should not run before any timecode")
+	}
+	now := time.Now()
+	clock.Feed(time.Hour, now.Add(-time.Millisecond*200))
+	clock.Feed(time.Hour+time.Millisecond*100, now.Add(-time.Millisecond*100))
+	at, running := clock.ShowTime()
+	if !running || at < time.Millisecond*190 || at > time.Millisecond*250 {
+		t.Errorf("Unexpected show time %v %v", at, running)
+	}
+	// jump
+	clock.Feed(time.Hour+time.Second*10, now)
+	if at, _ := clock.ShowTime(); at < time.Second*10 || at > time.Second*10+time.Millisecond*50 {
+		t.Errorf("Expected the clock jumps to 10s, got %v", at)
+	}
+	if s := clock.Stat(); s.Jumps != 1 {
+		t.Errorf("Expected 1 jump, got %d", s.Jumps)
+	}
+	// stopped timecode
+	clock.Feed(time.Hour+time.Second*10, now.Add(time.Millisecond))
+	if _, running := clock.ShowTime(); running {
+		t.Errorf("Clock should stop when the timecode is not advancing")
+	}
+}
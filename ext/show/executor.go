@@ -0,0 +1,684 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package show
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ungerik/go3d/vec3"
+
+	"github.com/zyxkad/drone"
+)
+
+type State string
+
+const (
+	StateIdle    State = "IDLE"
+	StateTakeoff State = "TAKEOFF"
+	StateRunning State = "RUNNING"
+	StatePaused  State = "PAUSED"
+	StateLanding State = "LANDING"
+	StateDone    State = "DONE"
+	StateAborted State = "ABORTED"
+)
+
+// AbortMode decides what the drones will do when the show is aborted
+type AbortMode int
+
+const (
+	AbortLand AbortMode = iota
+	AbortHold
+)
+
+type Config struct {
+	// Origin is the GPS position of the show's (0, 0, 0)
+	Origin *drone.Gps
+	// Heading is the heading of the show's Y+ axis in degrees
+	Heading float32
+	// Fence is uploaded to every drone before takeoff if it's not empty
+	Fence []*drone.Gps
+	// TakeoffHeight is the height the drones will takeoff to before the show starts
+	TakeoffHeight float32
+	// TakeoffInterval is the delay between two drones' takeoff
+	TakeoffInterval time.Duration
+	// StartDelay is the time between the last drone took off and the show time zero
+	// It's ignored when Clock is set
+	StartDelay time.Duration
+	// Clock provides the show time, such as a TimecodeClock following an external source
+	// If it's nil, a FreeClock is used and started after all drones took off
+	Clock Clock
+	// UpdateInterval is the interval between two setpoints
+	UpdateInterval time.Duration
+	// LEDStep is the sample interval when a light program is fading
+	LEDStep time.Duration
+	// LandRadius is the distance a drone need to reach its land position before landing
+	LandRadius float32
+	// UseMission uploads the trajectories as missions and starts them at the same time
+	// instead of streaming setpoints, so the show can continue when the link drops
+	// A mission show cannot be paused, and the missions do not follow the clock after they started
+	UseMission bool
+	// MissionTolerance is the max error of the missions, see MissionConfig.Tolerance
+	MissionTolerance float32
+}
+
+func (c *Config) setDefaults() {
+	if c.TakeoffHeight <= 0 {
+		c.TakeoffHeight = 2.5
+	}
+	if c.TakeoffInterval <= 0 {
+		c.TakeoffInterval = time.Second
+	}
+	if c.StartDelay <= 0 {
+		c.StartDelay = time.Second * 5
+	}
+	if c.UpdateInterval <= 0 {
+		c.UpdateInterval = time.Millisecond * 200
+	}
+	if c.LEDStep <= 0 {
+		c.LEDStep = time.Millisecond * 100
+	}
+	if c.LandRadius <= 0 {
+		c.LandRadius = 0.8
+	}
+}
+
+// Binding connects a drone in the show to a physical drone
+type Binding struct {
+	Index   int
+	Drone   drone.Drone
+	Track   *Track
+	Mission *Mission // only set when Config.UseMission is true
+}
+
+// Executor flies a show on the drones of a controller
+type Executor struct {
+	controller drone.Controller
+	show       *Show
+	cfg        Config
+
+	mux      sync.RWMutex
+	bindings []*Binding
+
+	// releaseMux is held while commanding a drone, so no command is sent after Release returns
+	releaseMux sync.RWMutex
+	released   map[int]bool
+
+	state     atomic.Pointer[State]
+	clock     Clock
+	free      *FreeClock // nil if the clock is external
+	abortMode atomic.Pointer[AbortMode]
+	signal    chan struct{}
+}
+
+func NewExecutor(controller drone.Controller, show *Show, cfg Config) (*Executor, error) {
+	if cfg.Origin == nil {
+		return nil, errors.New("Show origin is required")
+	}
+	cfg.setDefaults()
+	e := &Executor{
+		controller: controller,
+		show:       show,
+		cfg:        cfg,
+		bindings:   make([]*Binding, len(show.Tracks)),
+		released:   make(map[int]bool),
+		signal:     make(chan struct{}, 1),
+		clock:      cfg.Clock,
+	}
+	if e.clock == nil {
+		e.free = new(FreeClock)
+		e.clock = e.free
+	}
+	e.setState(StateIdle)
+	return e, nil
+}
+
+// Config returns the config with defaults applied
+func (e *Executor) Config() Config {
+	return e.cfg
+}
+
+func (e *Executor) State() State {
+	return *e.state.Load()
+}
+
+func (e *Executor) setState(s State) {
+	e.state.Store(&s)
+}
+
+// ShowTime returns the current show time, it's negative before the show starts
+func (e *Executor) ShowTime() time.Duration {
+	at, _ := e.clock.ShowTime()
+	return at
+}
+
+// ToGps converts a position in show coordinate to GPS position
+func (e *Executor) ToGps(p vec3.T) *drone.Gps {
+	return e.cfg.Origin.FromRelatives([]*vec3.T{&p}, e.cfg.Heading)[0]
+}
+
+// Bind binds the show drone at index to the physical drone
+func (e *Executor) Bind(index int, dr drone.Drone) error {
+	if e.State() != StateIdle {
+		return errors.New("Show is already started")
+	}
+	tracks := e.show.Tracks
+	if index < 0 || index >= len(tracks) {
+		return fmt.Errorf("Drone index %d out of range [0, %d)", index, len(tracks))
+	}
+	b := &Binding{
+		Index: index,
+		Drone: dr,
+		Track: tracks[index],
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	for i, o := range e.bindings {
+		if o != nil && o.Drone == dr {
+			e.bindings[i] = nil
+		}
+	}
+	e.bindings[index] = b
+	return nil
+}
+
+// BindByHome binds the controller's drones to the show drones whose home is within maxDist
+// It returns the number of the bound drones
+func (e *Executor) BindByHome(maxDist float32) (int, error) {
+	homes := e.show.GenerateHomeGPSList(e.cfg.Origin, e.cfg.Heading)
+	count := 0
+	for _, dr := range e.controller.Drones() {
+		pos := dr.GetGPS()
+		if pos == nil {
+			continue
+		}
+		best, bestDist := -1, maxDist
+		for i, home := range homes {
+			if dist := pos.DistanceToNoAlt(home); dist <= bestDist {
+				best, bestDist = i, dist
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		if err := e.Bind(best, dr); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Bindings returns the bound drones in the show order
+func (e *Executor) Bindings() []*Binding {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	bindings := make([]*Binding, 0, len(e.bindings))
+	for _, b := range e.bindings {
+		if b != nil {
+			bindings = append(bindings, b)
+		}
+	}
+	return bindings
+}
+
+// UploadFences uploads the configured fence to all bound drones
+func (e *Executor) UploadFences(ctx context.Context) error {
+	if len(e.cfg.Fence) == 0 {
+		return nil
+	}
+	var errs []error
+	for _, b := range e.Bindings() {
+		if err := b.Drone.SetFence(ctx, e.cfg.Fence); err != nil {
+			errs = append(errs, fmt.Errorf("Drone %d: %w", b.Drone.ID(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// UploadMissions converts the bound drones' trajectories to missions and uploads them
+func (e *Executor) UploadMissions(ctx context.Context) error {
+	var errs []error
+	for _, b := range e.Bindings() {
+		m, err := BuildMission(b.Track.Trajectory, MissionConfig{
+			Origin:      e.cfg.Origin,
+			Heading:     e.cfg.Heading,
+			Tolerance:   e.cfg.MissionTolerance,
+			MinAltitude: e.cfg.TakeoffHeight,
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Drone %d: %w", b.Drone.ID(), err))
+			continue
+		}
+		if err := UploadMission(ctx, b.Drone, m); err != nil {
+			errs = append(errs, fmt.Errorf("Drone %d: %w", b.Drone.ID(), err))
+			continue
+		}
+		b.Mission = m
+	}
+	return errors.Join(errs...)
+}
+
+func (e *Executor) notify() {
+	select {
+	case e.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Pause makes all drones hold at their current position, and stops the show clock
+func (e *Executor) Pause() error {
+	if e.State() != StateRunning {
+		return errors.New("Show is not running")
+	}
+	if e.cfg.UseMission {
+		return errors.New("Mission show cannot be paused")
+	}
+	if e.free == nil {
+		return errors.New("Show clock is controlled externally")
+	}
+	if e.free.Pause() {
+		e.notify()
+	}
+	return nil
+}
+
+// Resume continues the show from where it was paused
+func (e *Executor) Resume() error {
+	if e.free == nil {
+		return errors.New("Show clock is controlled externally")
+	}
+	if !e.free.Resume() {
+		return errors.New("Show is not paused")
+	}
+	e.notify()
+	return nil
+}
+
+// Abort stops the show, all drones will either land or hold depends on the mode
+func (e *Executor) Abort(mode AbortMode) {
+	switch e.State() {
+	case StateIdle, StateDone, StateAborted:
+		return
+	}
+	e.abortMode.CompareAndSwap(nil, &mode)
+	e.notify()
+}
+
+// AbortWait aborts the show like Abort, and waits until the executor no longer sends setpoints,
+// so a following command to the drones will not be overridden by the show
+func (e *Executor) AbortWait(ctx context.Context, mode AbortMode) error {
+	e.Abort(mode)
+	ticker := time.NewTicker(time.Millisecond * 20)
+	defer ticker.Stop()
+	for {
+		switch e.State() {
+		case StateIdle, StateDone, StateAborted:
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release stops the executor from commanding the drone, the show continues with the other drones
+// It's used when something else takes over the drone, such as a safety action
+// It returns false if the drone is not bound
+func (e *Executor) Release(id int) bool {
+	bound := false
+	for _, b := range e.Bindings() {
+		if b.Drone.ID() == id {
+			bound = true
+			break
+		}
+	}
+	if !bound {
+		return false
+	}
+	e.releaseMux.Lock()
+	defer e.releaseMux.Unlock()
+	e.released[id] = true
+	return true
+}
+
+// Released returns whether the drone is released by Release
+func (e *Executor) Released(id int) bool {
+	e.releaseMux.RLock()
+	defer e.releaseMux.RUnlock()
+	return e.released[id]
+}
+
+// command calls do if the binding's drone is not released, and blocks Release until do returns
+func (e *Executor) command(b *Binding, do func(dr drone.Drone)) {
+	e.releaseMux.RLock()
+	defer e.releaseMux.RUnlock()
+	if !e.released[b.Drone.ID()] {
+		do(b.Drone)
+	}
+}
+
+func (e *Executor) aborted() bool {
+	return e.abortMode.Load() != nil
+}
+
+// Run takes off the bound drones in sequence, flies the show, and lands them
+// Run blocks until the show is finished or aborted
+func (e *Executor) Run(ctx context.Context) error {
+	if idle := e.state.Load(); *idle != StateIdle || !e.state.CompareAndSwap(idle, ptrTo(StateTakeoff)) {
+		return errors.New("Show is already started")
+	}
+	bindings := e.Bindings()
+	if len(bindings) == 0 {
+		e.setState(StateIdle)
+		return errors.New("No drone is bound")
+	}
+	// nothing has taken off yet, but the executor is aborted and cannot run again, the caller must create a new one
+	if err := e.UploadFences(ctx); err != nil {
+		e.setState(StateAborted)
+		return fmt.Errorf("Cannot upload fence: %w", err)
+	}
+	if e.cfg.UseMission {
+		if err := e.UploadMissions(ctx); err != nil {
+			e.setState(StateAborted)
+			return fmt.Errorf("Cannot upload mission: %w", err)
+		}
+	}
+	if err := e.takeoffAll(ctx, bindings); err != nil {
+		e.finishAbort(bindings)
+		return err
+	}
+	if err := e.runShow(ctx, bindings); err != nil {
+		e.finishAbort(bindings)
+		return err
+	}
+	e.setState(StateLanding)
+	if err := e.landAll(ctx, bindings); err != nil {
+		e.finishAbort(bindings)
+		return err
+	}
+	e.setState(StateDone)
+	return nil
+}
+
+func ptrTo[T any](v T) *T {
+	return &v
+}
+
+// wait waits for the duration, it returns error if the show is aborted or ctx is done
+func (e *Executor) wait(ctx context.Context, dur time.Duration) error {
+	timer := time.NewTimer(dur)
+	defer timer.Stop()
+	for {
+		if e.aborted() {
+			return errAborted
+		}
+		select {
+		case <-timer.C:
+			return nil
+		case <-e.signal:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+var errAborted = errors.New("Show aborted")
+
+func (e *Executor) takeoffAll(ctx context.Context, bindings []*Binding) error {
+	for i, b := range bindings {
+		if i > 0 {
+			if err := e.wait(ctx, e.cfg.TakeoffInterval); err != nil {
+				return err
+			}
+		}
+		dr := b.Drone
+		if e.Released(dr.ID()) {
+			continue
+		}
+		if err := dr.UpdateMode(ctx, 4 /* GUIDED */); err != nil {
+			return fmt.Errorf("Drone %d cannot switch mode to GUIDED: %w", dr.ID(), err)
+		}
+		if err := dr.Arm(ctx); err != nil {
+			return fmt.Errorf("Drone %d cannot arm: %w", dr.ID(), err)
+		}
+		if err := dr.TakeoffWithHeight(ctx, e.cfg.TakeoffHeight); err != nil {
+			return fmt.Errorf("Drone %d cannot takeoff: %w", dr.ID(), err)
+		}
+	}
+	return nil
+}
+
+func (e *Executor) setpoint(b *Binding, at time.Duration) *drone.Gps {
+	var p vec3.T
+	if traj := b.Track.Trajectory; traj != nil {
+		p = traj.PositionAt(at)
+	} else {
+		p = b.Track.Home
+	}
+	p[2] = max(p[2], e.cfg.TakeoffHeight)
+	return e.ToGps(p)
+}
+
+func (e *Executor) startLights(ctx context.Context, bindings []*Binding) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	for _, b := range bindings {
+		led, ok := b.Drone.(drone.LEDAbility)
+		if !ok || b.Track.Lights == nil {
+			continue
+		}
+		go b.Track.Lights.Play(ctx, led, e.clock.ShowTime, e.cfg.LEDStep)
+	}
+	return cancel
+}
+
+func (e *Executor) runShow(ctx context.Context, bindings []*Binding) error {
+	if e.free != nil {
+		e.free.Start(time.Now().Add(e.cfg.StartDelay))
+	}
+	e.setState(StateRunning)
+	end := e.show.Duration()
+	stopLights := e.startLights(ctx, bindings)
+	defer stopLights()
+
+	if e.cfg.UseMission {
+		return e.runMission(ctx, bindings)
+	}
+
+	ticker := time.NewTicker(e.cfg.UpdateInterval)
+	defer ticker.Stop()
+	holding := false
+	for {
+		if e.aborted() {
+			return errAborted
+		}
+		at, running := e.clock.ShowTime()
+		if !running {
+			// paused, or the external clock is not running
+			if !holding {
+				holding = true
+				e.setState(StatePaused)
+				for _, b := range bindings {
+					e.command(b, func(dr drone.Drone) { dr.Hold(ctx) })
+				}
+			}
+		} else {
+			if holding {
+				holding = false
+				e.setState(StateRunning)
+			}
+			if at > end {
+				return nil
+			}
+			for _, b := range bindings {
+				e.command(b, func(dr drone.Drone) { dr.MoveToYaw(ctx, e.setpoint(b, at), e.cfg.Heading) })
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-e.signal:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// runMission starts all missions at their start time and waits until the show ends
+func (e *Executor) runMission(ctx context.Context, bindings []*Binding) error {
+	ctx, cancel := e.abortableContext(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make([]error, len(bindings))
+	for i, b := range bindings {
+		wg.Add(1)
+		go func(i int, b *Binding) {
+			defer wg.Done()
+			if e.waitShowTime(ctx, b.Mission.Start()) != nil || e.Released(b.Drone.ID()) {
+				return
+			}
+			if err := b.Drone.StartMission(ctx, 0, 0); err != nil {
+				errs[i] = fmt.Errorf("Drone %d cannot start mission: %w", b.Drone.ID(), err)
+			}
+		}(i, b)
+	}
+	wg.Wait()
+	if e.aborted() {
+		return errAborted
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if err := e.waitShowTime(ctx, e.show.Duration()); err != nil {
+		if e.aborted() {
+			return errAborted
+		}
+		return err
+	}
+	// switch back to GUIDED, so the drones can be moved to their land position
+	for _, b := range bindings {
+		if e.Released(b.Drone.ID()) {
+			continue
+		}
+		if err := b.Drone.UpdateMode(ctx, 4 /* GUIDED */); err != nil {
+			return fmt.Errorf("Drone %d cannot switch mode to GUIDED: %w", b.Drone.ID(), err)
+		}
+	}
+	return nil
+}
+
+// waitShowTime waits until the show clock is running and reaches at
+func (e *Executor) waitShowTime(ctx context.Context, at time.Duration) error {
+	for {
+		now, running := e.clock.ShowTime()
+		if running && now >= at {
+			return nil
+		}
+		wait := e.cfg.UpdateInterval
+		if running {
+			wait = min(wait, at-now)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// abortableContext returns a context which will be cancelled when the show is aborted
+func (e *Executor) abortableContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		for !e.aborted() {
+			select {
+			case <-e.signal:
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel(errAborted)
+	}()
+	return ctx, func() { cancel(nil) }
+}
+
+func (e *Executor) landAll(ctx context.Context, bindings []*Binding) error {
+	ctx, cancel := e.abortableContext(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make([]error, len(bindings))
+	for i, b := range bindings {
+		if e.Released(b.Drone.ID()) {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, b *Binding) {
+			defer wg.Done()
+			dr := b.Drone
+			target := e.ToGps(b.Track.Landat)
+			if pos := dr.GetGPS(); pos != nil {
+				target.Alt = pos.Alt
+			}
+			if err := dr.MoveWithYawUntilReached(ctx, target, e.cfg.Heading, e.cfg.LandRadius); err != nil {
+				errs[i] = fmt.Errorf("Drone %d cannot reach land position: %w", dr.ID(), err)
+				return
+			}
+			if err := dr.Land(ctx); err != nil {
+				errs[i] = fmt.Errorf("Drone %d cannot land: %w", dr.ID(), err)
+			}
+		}(i, b)
+	}
+	wg.Wait()
+	if e.aborted() {
+		return errAborted
+	}
+	return errors.Join(errs...)
+}
+
+// finishAbort makes all drones hold or land after the show stopped unexpectedly
+func (e *Executor) finishAbort(bindings []*Binding) {
+	e.setState(StateAborted)
+	mode := AbortLand
+	if m := e.abortMode.Load(); m != nil {
+		mode = *m
+	}
+	var wg sync.WaitGroup
+	for _, b := range bindings {
+		if e.Released(b.Drone.ID()) {
+			continue
+		}
+		wg.Add(1)
+		go func(dr drone.Drone) {
+			defer wg.Done()
+			// use a new context since the show's context may already be cancelled
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			defer cancel()
+			switch mode {
+			case AbortHold:
+				dr.Hold(ctx)
+			default:
+				dr.Land(ctx)
+			}
+		}(b.Drone)
+	}
+	wg.Wait()
+}
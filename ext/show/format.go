@@ -0,0 +1,301 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package show
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ungerik/go3d/vec3"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/skybrush"
+)
+
+// Reader reads a show from a file system, such as an opened zip archive or a directory
+type Reader interface {
+	// Detect reports whether the file system looks like this format
+	Detect(fsys fs.FS) bool
+	Read(fsys fs.FS) (*Show, error)
+}
+
+var (
+	readersMux sync.RWMutex
+	readers    []namedReader
+)
+
+type namedReader struct {
+	name string
+	r    Reader
+}
+
+// RegisterReader adds a show format, formats are detected in the order they are registered
+func RegisterReader(name string, r Reader) {
+	readersMux.Lock()
+	defer readersMux.Unlock()
+	for _, n := range readers {
+		if n.name == name {
+			panic(fmt.Errorf("Show reader %q is already registered", name))
+		}
+	}
+	readers = append(readers, namedReader{name, r})
+}
+
+func init() {
+	RegisterReader("skyc", skycReader{})
+	RegisterReader("csv", csvReader{})
+}
+
+var ErrUnknownFormat = errors.New("Unknown show format")
+
+// Read detects the format of the file system and reads the show
+// If the file system only contains a single directory, the directory is read instead
+func Read(fsys fs.FS) (*Show, error) {
+	return ReadFormat("", fsys)
+}
+
+// ReadFormat reads the show with the named reader, an empty name will detect the format
+func ReadFormat(name string, fsys fs.FS) (*Show, error) {
+	fsys, err := unwrapSingleDir(fsys)
+	if err != nil {
+		return nil, err
+	}
+	readersMux.RLock()
+	defer readersMux.RUnlock()
+	for _, n := range readers {
+		if name == "" && n.r.Detect(fsys) || n.name == name {
+			return n.r.Read(fsys)
+		}
+	}
+	if name != "" {
+		return nil, fmt.Errorf("Show format %q is not registered", name)
+	}
+	return nil, ErrUnknownFormat
+}
+
+func unwrapSingleDir(fsys fs.FS) (fs.FS, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		return fs.Sub(fsys, entries[0].Name())
+	}
+	return fsys, nil
+}
+
+// WriteSkyC exports the show as a skyc archive
+func WriteSkyC(w io.Writer, s *Show) error {
+	return skybrush.WriteSkyC(w, s.SkyC())
+}
+
+// skycReader reads Skybrush skyc archives of version 1 and 2
+type skycReader struct{}
+
+func (skycReader) Detect(fsys fs.FS) bool {
+	_, err := fs.Stat(fsys, "show.json")
+	return err == nil
+}
+
+func (skycReader) Read(fsys fs.FS) (*Show, error) {
+	skyc, err := skybrush.ReadSkyC(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return FromSkyC(skyc)
+}
+
+// csvReader reads a directory of CSV files, each file is a drone's track
+// The columns are time, x, y, z, red, green and blue
+// The time is in seconds, or in milliseconds if the header mentions "msec" like Skybrush Studio's export
+// Drones are ordered by their file names, and numbers in the names are compared by value
+type csvReader struct{}
+
+func (csvReader) csvFiles(fsys fs.FS) ([]string, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.EqualFold(path.Ext(e.Name()), ".csv") {
+			names = append(names, e.Name())
+		}
+	}
+	slices.SortFunc(names, naturalCompare)
+	return names, nil
+}
+
+func (r csvReader) Detect(fsys fs.FS) bool {
+	names, err := r.csvFiles(fsys)
+	return err == nil && len(names) > 0
+}
+
+func (r csvReader) Read(fsys fs.FS) (*Show, error) {
+	names, err := r.csvFiles(fsys)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, errors.New("No CSV file found")
+	}
+	s := &Show{
+		Tracks: make([]*Track, len(names)),
+	}
+	for i, name := range names {
+		t, err := readCSVTrack(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		s.Tracks[i] = t
+	}
+	return s, nil
+}
+
+func readCSVTrack(fsys fs.FS, name string) (*Track, error) {
+	fd, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	cr := csv.NewReader(fd)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	type row struct {
+		t     time.Duration
+		pos   vec3.T
+		color drone.Color
+	}
+	var rows []row
+	timeUnit := (float64)(time.Second)
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 4 {
+			return nil, fmt.Errorf("Line %d: expected at least 4 columns, got %d", line, len(record))
+		}
+		if line == 1 {
+			if _, err := strconv.ParseFloat(record[0], 64); err != nil {
+				// header
+				if strings.Contains(strings.ToLower(record[0]), "msec") {
+					timeUnit = (float64)(time.Millisecond)
+				}
+				continue
+			}
+		}
+		var values [7]float64
+		for j := range min(len(record), len(values)) {
+			if values[j], err = strconv.ParseFloat(strings.TrimSpace(record[j]), 64); err != nil {
+				return nil, fmt.Errorf("Line %d column %d: %w", line, j+1, err)
+			}
+		}
+		r := row{
+			t:   (time.Duration)(values[0] * timeUnit),
+			pos: vec3.T{(float32)(values[1]), (float32)(values[2]), (float32)(values[3])},
+		}
+		if len(record) >= 7 {
+			r.color = drone.Color{R: toByte(values[4]), G: toByte(values[5]), B: toByte(values[6])}
+		}
+		if len(rows) > 0 && r.t <= rows[len(rows)-1].t {
+			return nil, fmt.Errorf("Line %d: time is not increasing", line)
+		}
+		rows = append(rows, r)
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("Track is empty")
+	}
+
+	traj := &skybrush.Trajectory{
+		Version: 1,
+		Points:  make([]skybrush.TrajectoryPoint, len(rows)),
+	}
+	lights := &skybrush.LightTimeline{
+		Duration: rows[len(rows)-1].t,
+	}
+	for i, r := range rows {
+		traj.Points[i] = skybrush.TrajectoryPoint{
+			Time: r.t.Seconds(),
+			Pos:  r.pos,
+		}
+		// colors are linear between the rows, so only the rows where the color starts or stops changing are kept
+		changed := i == 0 || r.color != rows[i-1].color || i+1 < len(rows) && r.color != rows[i+1].color
+		if changed {
+			lights.Keyframes = append(lights.Keyframes, skybrush.LightKeyframe{
+				Time:  r.t,
+				Color: r.color,
+				Fade:  i > 0,
+			})
+		}
+	}
+	return &Track{
+		Name:       strings.TrimSuffix(name, path.Ext(name)),
+		Home:       rows[0].pos,
+		Landat:     rows[len(rows)-1].pos,
+		Trajectory: traj,
+		Lights:     lights,
+	}, nil
+}
+
+func toByte(v float64) byte {
+	return (byte)(max(0, min(255, v+0.5)))
+}
+
+// naturalCompare compares the strings with the digit sequences compared by their values
+func naturalCompare(a, b string) int {
+	for a != "" && b != "" {
+		da, db := leadingDigits(a), leadingDigits(b)
+		if da > 0 && db > 0 {
+			na, nb := strings.TrimLeft(a[:da], "0"), strings.TrimLeft(b[:db], "0")
+			if len(na) != len(nb) {
+				return len(na) - len(nb)
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+			a, b = a[da:], b[db:]
+			continue
+		}
+		if a[0] != b[0] {
+			return (int)(a[0]) - (int)(b[0])
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) - len(b)
+}
+
+func leadingDigits(s string) int {
+	i := 0
+	for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,93 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package show_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/show"
+)
+
+func TestReadCSV(t *testing.T) {
+	fsys := fstest.MapFS{
+		"export/Drone 10.csv": {Data: ([]byte)("Time [msec],x [m],y [m],z [m],Red,Green,Blue\n" +
+			"0,3,0,0,0,0,0\n1000,3,0,5,0,0,0\n3000,3,4,5,255,0,0\n")},
+		"export/Drone 2.csv": {Data: ([]byte)("Time [msec],x [m],y [m],z [m],Red,Green,Blue\n" +
+			"0,0,0,0,0,0,0\n1000,0,0,5,0,0,0\n3000,0,4,5,0,0,255\n")},
+	}
+	s, err := show.Read(fsys)
+	if err != nil {
+		t.Fatalf("Cannot read CSV show: %v", err)
+	}
+	if len(s.Tracks) != 2 || s.Tracks[0].Name != "Drone 2" || s.Tracks[1].Name != "Drone 10" {
+		t.Fatalf("Unexpected tracks %#v", s.Tracks)
+	}
+	check := func(s *show.Show) {
+		if d := s.Duration(); d != time.Second*3 {
+			t.Errorf("Expected duration is 3s, got %v", d)
+		}
+		track := s.Tracks[1]
+		if p := track.Trajectory.PositionAt(time.Second * 2); p[0] != 3 || p[1] != 2 || p[2] != 5 {
+			t.Errorf("Unexpected position at 2s: %v", p)
+		}
+		if c := track.Lights.ColorAt(time.Second * 2); c != (drone.Color{R: 0x80}) {
+			t.Errorf("Unexpected color at 2s: %s", c.String())
+		}
+	}
+	check(s)
+
+	var buf bytes.Buffer
+	if err := show.WriteSkyC(&buf, s); err != nil {
+		t.Fatalf("Cannot write skyc: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), (int64)(buf.Len()))
+	if err != nil {
+		t.Fatalf("Cannot open written skyc: %v", err)
+	}
+	s2, err := show.Read(zr)
+	if err != nil {
+		t.Fatalf("Cannot read written skyc: %v", err)
+	}
+	if len(s2.Tracks) != 2 || s2.Tracks[1].Name != "Drone 10" {
+		t.Fatalf("Unexpected tracks %#v", s2.Tracks)
+	}
+	check(s2)
+}
+
+func TestReadSkyCV2(t *testing.T) {
+	fsys := fstest.MapFS{
+		"show.json": {Data: ([]byte)(`{"version": 2, "meta": {"title": "v2"}, "swarm": {"drones": [{"type": "generic", "settings": {
+			"name": "d1", "home": [0, 0, 0], "landAt": [0, 0, 0],
+			"trajectory": {"version": 1, "points": [[0, [0, 0, 0], []], [4, [0, 0, 8], []]], "takeoffTime": 0}
+		}}]}}`)},
+	}
+	s, err := show.ReadFormat("skyc", fsys)
+	if err != nil {
+		t.Fatalf("Cannot read skyc v2: %v", err)
+	}
+	if len(s.Tracks) != 1 || s.Tracks[0].Name != "d1" {
+		t.Fatalf("Unexpected tracks %#v", s.Tracks)
+	}
+	if p := s.Tracks[0].Trajectory.PositionAt(time.Second * 2); p[2] != 4 {
+		t.Errorf("Unexpected position at 2s: %v", p)
+	}
+}
@@ -0,0 +1,146 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package show
+
+import (
+	"bufio"
+	"compress/lzw"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// gifWriter encodes an animated GIF frame by frame, so the frames need not be kept in memory
+// All frames share the global color table and have the same size
+type gifWriter struct {
+	w      *bufio.Writer
+	width  int
+	height int
+}
+
+func newGIFWriter(w io.Writer, width, height int, pal color.Palette) (*gifWriter, error) {
+	if len(pal) != 256 {
+		return nil, errors.New("GIF palette must have 256 colors")
+	}
+	g := &gifWriter{
+		w:      bufio.NewWriter(w),
+		width:  width,
+		height: height,
+	}
+	g.w.WriteString("GIF89a")
+	g.writeUint16(width)
+	g.writeUint16(height)
+	// global color table of 256 colors, 8 bits color resolution
+	g.w.Write([]byte{0xf7, 0x00, 0x00})
+	for _, c := range pal {
+		r, gr, b, _ := c.RGBA()
+		g.w.Write([]byte{(byte)(r >> 8), (byte)(gr >> 8), (byte)(b >> 8)})
+	}
+	// NETSCAPE2.0 application extension, loop forever
+	g.w.Write([]byte{0x21, 0xff, 0x0b})
+	g.w.WriteString("NETSCAPE2.0")
+	g.w.Write([]byte{0x03, 0x01, 0x00, 0x00, 0x00})
+	return g, nil
+}
+
+func (g *gifWriter) writeUint16(v int) {
+	var buf [2]byte
+	binary.LittleEndian.PutUint16(buf[:], (uint16)(v))
+	g.w.Write(buf[:])
+}
+
+// WriteFrame writes an image which uses the global color table, delay is in 1/100 seconds
+func (g *gifWriter) WriteFrame(img *image.Paletted, delay int) error {
+	b := img.Bounds()
+	if b.Dx() != g.width || b.Dy() != g.height {
+		return errors.New("GIF frame size mismatch")
+	}
+	// graphic control extension
+	g.w.Write([]byte{0x21, 0xf9, 0x04, 0x00})
+	g.writeUint16(delay)
+	g.w.Write([]byte{0x00, 0x00})
+	// image descriptor without local color table
+	g.w.WriteByte(0x2c)
+	g.writeUint16(0)
+	g.writeUint16(0)
+	g.writeUint16(g.width)
+	g.writeUint16(g.height)
+	g.w.WriteByte(0x00)
+
+	const litWidth = 8
+	g.w.WriteByte(litWidth)
+	bw := &gifBlockWriter{w: g.w}
+	lw := lzw.NewWriter(bw, lzw.LSB, litWidth)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		off := img.PixOffset(b.Min.X, y)
+		if _, err := lw.Write(img.Pix[off : off+g.width]); err != nil {
+			return err
+		}
+	}
+	if err := lw.Close(); err != nil {
+		return err
+	}
+	return bw.Close()
+}
+
+// Close writes the trailer and flushes, it does not close the underlying writer
+func (g *gifWriter) Close() error {
+	g.w.WriteByte(0x3b)
+	return g.w.Flush()
+}
+
+// gifBlockWriter splits the data into sub-blocks of at most 255 bytes
+type gifBlockWriter struct {
+	w   *bufio.Writer
+	buf [255]byte
+	n   int
+}
+
+func (b *gifBlockWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		n := copy(b.buf[b.n:], p)
+		b.n += n
+		p = p[n:]
+		if b.n == len(b.buf) {
+			if err := b.flush(); err != nil {
+				return total - len(p), err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (b *gifBlockWriter) flush() error {
+	if b.n == 0 {
+		return nil
+	}
+	b.w.WriteByte((byte)(b.n))
+	_, err := b.w.Write(b.buf[:b.n])
+	b.n = 0
+	return err
+}
+
+// Close flushes the last sub-block and writes the block terminator
+func (b *gifBlockWriter) Close() error {
+	if err := b.flush(); err != nil {
+		return err
+	}
+	return b.w.WriteByte(0x00)
+}
@@ -0,0 +1,191 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package show
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/ungerik/go3d/vec3"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/skybrush"
+)
+
+type MissionConfig struct {
+	// Origin is the GPS position of the show's (0, 0, 0)
+	Origin *drone.Gps
+	// Heading is the heading of the show's Y+ axis in degrees
+	Heading float32
+	// Tolerance is the max distance between the mission and the trajectory at the same time, in meters
+	Tolerance float32
+	// SampleInterval is the interval the trajectory is sampled at
+	SampleInterval time.Duration
+	// MinAltitude clamps the trajectory, usually it's the takeoff height
+	MinAltitude float32
+}
+
+func (c *MissionConfig) setDefaults() {
+	if c.Tolerance <= 0 {
+		c.Tolerance = 0.2
+	}
+	if c.SampleInterval <= 0 {
+		c.SampleInterval = time.Millisecond * 100
+	}
+}
+
+// Mission is a trajectory approximated by waypoints flown at constant speed
+type Mission struct {
+	Items []*drone.MissionItem `json:"items"`
+	// Times are the show time when the drone should arrive each item
+	Times []drone.Duration `json:"times"`
+	// MaxError and RMSError are the distance between the mission and the trajectory at the same time, in meters
+	// They do not include the error caused by the drone's acceleration at the waypoints
+	MaxError float32 `json:"maxError"`
+	RMSError float32 `json:"rmsError"`
+
+	points []vec3.T // the waypoints in the show's coordinate
+}
+
+// Start returns the show time when the mission should be started
+func (m *Mission) Start() time.Duration {
+	return (time.Duration)(m.Times[0])
+}
+
+// End returns the show time when the drone arrives the last waypoint
+func (m *Mission) End() time.Duration {
+	return (time.Duration)(m.Times[len(m.Times)-1])
+}
+
+// BuildMission samples the trajectory and picks the least points which keep
+// the linear interpolation between them inside the tolerance
+// A point is dropped when the drone stays there, and the time will be added to the previous waypoint's delay
+func BuildMission(traj *skybrush.Trajectory, cfg MissionConfig) (*Mission, error) {
+	if cfg.Origin == nil {
+		return nil, errors.New("Show origin is required")
+	}
+	if traj == nil || len(traj.Points) == 0 {
+		return nil, errors.New("Trajectory is empty")
+	}
+	cfg.setDefaults()
+
+	start, end := traj.StartTime(), traj.EndTime()
+	n := (int)((end-start)/cfg.SampleInterval) + 1
+	times := make([]time.Duration, 0, n+1)
+	samples := make([]vec3.T, 0, n+1)
+	for at := start; at < end; at += cfg.SampleInterval {
+		times = append(times, at)
+		samples = append(samples, traj.PositionAt(at))
+	}
+	times = append(times, end)
+	samples = append(samples, traj.PositionAt(end))
+	for i := range samples {
+		samples[i][2] = max(samples[i][2], cfg.MinAltitude)
+	}
+
+	// greedy segmentation: extend each segment until a sample deviates more than the tolerance
+	keys := []int{0}
+	for a := 0; a < len(samples)-1; {
+		b := a + 1
+		for b+1 < len(samples) && maxDeviation(times, samples, a, b+1) <= cfg.Tolerance {
+			b++
+		}
+		keys = append(keys, b)
+		a = b
+	}
+
+	m := &Mission{
+		Items:  []*drone.MissionItem{{Pos: toGps(cfg, samples[0])}},
+		Times:  []drone.Duration{(drone.Duration)(times[0])},
+		points: []vec3.T{samples[0]},
+	}
+	for _, k := range keys[1:] {
+		prev := len(m.Items) - 1
+		dist := vec3.Distance(&m.points[prev], &samples[k])
+		if dist < cfg.Tolerance {
+			// the drone stays in place, hold at the previous waypoint instead
+			m.Items[prev].Delay = (drone.Duration)(times[k]) - m.Times[prev]
+			continue
+		}
+		dt := (time.Duration)((drone.Duration)(times[k]) - m.Times[prev] - m.Items[prev].Delay)
+		m.Items = append(m.Items, &drone.MissionItem{
+			Pos:   toGps(cfg, samples[k]),
+			Speed: dist / (float32)(dt.Seconds()),
+		})
+		m.Times = append(m.Times, (drone.Duration)(times[k]))
+		m.points = append(m.points, samples[k])
+	}
+
+	var sum float64
+	for i, at := range times {
+		p := m.localAt(at)
+		d := vec3.Distance(&samples[i], &p)
+		m.MaxError = max(m.MaxError, d)
+		sum += (float64)(d) * (float64)(d)
+	}
+	m.RMSError = (float32)(math.Sqrt(sum / (float64)(len(times))))
+	return m, nil
+}
+
+// localAt returns where the drone following the mission should be at the show time, in the show's coordinate
+func (m *Mission) localAt(showTime time.Duration) vec3.T {
+	at := (drone.Duration)(showTime)
+	prev := m.points[0]
+	depart := m.Times[0] + m.Items[0].Delay
+	for i := 1; i < len(m.Items); i++ {
+		if at <= depart {
+			return prev
+		}
+		next := m.points[i]
+		if at < m.Times[i] {
+			r := (float32)(at-depart) / (float32)(m.Times[i]-depart)
+			return vec3.Interpolate(&prev, &next, r)
+		}
+		prev = next
+		depart = m.Times[i] + m.Items[i].Delay
+	}
+	return prev
+}
+
+func toGps(cfg MissionConfig, p vec3.T) *drone.Gps {
+	return cfg.Origin.FromRelatives([]*vec3.T{&p}, cfg.Heading)[0]
+}
+
+// maxDeviation returns the max distance between the samples in (a, b) and the linear interpolation from a to b
+func maxDeviation(times []time.Duration, samples []vec3.T, a, b int) float32 {
+	var worst float32
+	span := (float32)(times[b] - times[a])
+	for i := a + 1; i < b; i++ {
+		p := vec3.Interpolate(&samples[a], &samples[b], (float32)(times[i]-times[a])/span)
+		worst = max(worst, vec3.Distance(&p, &samples[i]))
+	}
+	return worst
+}
+
+var ErrTimedMissionUnsupported = errors.New("Drone does not support timed missions")
+
+// UploadMission uploads the mission with TimedMissionAbility
+// A drone without it cannot keep the show timing, so ErrTimedMissionUnsupported is returned
+func UploadMission(ctx context.Context, dr drone.Drone, m *Mission) error {
+	tm, ok := dr.(drone.TimedMissionAbility)
+	if !ok {
+		return ErrTimedMissionUnsupported
+	}
+	return tm.SetTimedMission(ctx, m.Items)
+}
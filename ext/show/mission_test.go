@@ -0,0 +1,82 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package show_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ungerik/go3d/vec3"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/show"
+	"github.com/zyxkad/drone/ext/skybrush"
+)
+
+func TestBuildMission(t *testing.T) {
+	traj := &skybrush.Trajectory{
+		Version: 1,
+		Points: []skybrush.TrajectoryPoint{
+			{Time: 0, Pos: vec3.T{0, 0, 5}},
+			{Time: 4, Pos: vec3.T{0, 0, 5}},
+			{Time: 8, Pos: vec3.T{8, 0, 5}},
+			{Time: 12, Pos: vec3.T{8, 8, 5}, Controls: []vec3.T{{12, 0, 5}, {12, 4, 5}}},
+		},
+	}
+	mission, err := show.BuildMission(traj, show.MissionConfig{
+		Origin:    &drone.Gps{Lat: 30, Lon: 120},
+		Tolerance: 0.1,
+	})
+	if err != nil {
+		t.Fatalf("BuildMission: %v", err)
+	}
+	if len(mission.Items) < 3 {
+		t.Fatalf("Expected at least 3 waypoints, got %d", len(mission.Items))
+	}
+	if first := mission.Items[0]; (time.Duration)(first.Delay) != time.Second*4 {
+		t.Errorf("Expected the first waypoint delays 4s, got %v", first.Delay)
+	}
+	// the curve starts tangent to the line, so the line may be extended a little
+	if second, at := mission.Items[1], (time.Duration)(mission.Times[1]); at < time.Second*8 || at > time.Millisecond*8500 ||
+		second.Speed < 1.95 || second.Speed > 2.1 {
+		t.Errorf("Expected the second waypoint reached at about 8s with speed 2, got %v and %f", at, second.Speed)
+	}
+	if mission.MaxError > 0.1 || mission.RMSError > mission.MaxError {
+		t.Errorf("Unexpected error estimate max=%f rms=%f", mission.MaxError, mission.RMSError)
+	}
+	if mission.End() != time.Second*12 {
+		t.Errorf("Expected mission ends at 12s, got %v", mission.End())
+	}
+
+	data, err := json.Marshal(mission)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if s := (string)(data); !strings.Contains(s, `"delay":4000`) || !strings.Contains(s, `"times":[0,8`) {
+		t.Errorf("Durations should be in milliseconds: %s", s)
+	}
+
+	// a drone embedding only drone.Drone has no TimedMissionAbility
+	var plain struct{ drone.Drone }
+	if err := show.UploadMission(context.Background(), plain, mission); !errors.Is(err, show.ErrTimedMissionUnsupported) {
+		t.Errorf("Expected ErrTimedMissionUnsupported, got %v", err)
+	}
+}
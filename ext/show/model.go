@@ -0,0 +1,117 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package show
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ungerik/go3d/vec3"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/skybrush"
+)
+
+// Show is a drone show independent of the file format it was read from
+// All positions are in the show's coordinate, X+ is right, Y+ is front and Z+ is up, in meters
+type Show struct {
+	Tracks []*Track
+}
+
+// Track is the part of a single drone in a show
+type Track struct {
+	Name       string
+	Home       vec3.T
+	Landat     vec3.T
+	Trajectory *skybrush.Trajectory    // nil means the drone does not move
+	Lights     *skybrush.LightTimeline // nil means the drone has no light program
+}
+
+// Duration returns the show time when the last trajectory ends
+func (s *Show) Duration() time.Duration {
+	var dur time.Duration
+	for _, t := range s.Tracks {
+		if t.Trajectory != nil {
+			dur = max(dur, t.Trajectory.EndTime())
+		}
+	}
+	return dur
+}
+
+// GenerateHomeGPSList generates the drone swarm's home GPS list
+// origin is the origin position of the swarm
+// heading is the heading of the swarm in degrees
+func (s *Show) GenerateHomeGPSList(origin *drone.Gps, heading float32) []*drone.Gps {
+	rels := make([]*vec3.T, len(s.Tracks))
+	for i, t := range s.Tracks {
+		rels[i] = &t.Home
+	}
+	return origin.FromRelatives(rels, heading)
+}
+
+// FromSkyC converts a skyc show, the light programs are decoded to timelines
+func FromSkyC(skyc *skybrush.SkyC) (*Show, error) {
+	drones := skyc.Data.Swarm.Drones
+	s := &Show{
+		Tracks: make([]*Track, len(drones)),
+	}
+	for i, d := range drones {
+		t := &Track{
+			Name:       d.Settings.Name,
+			Home:       d.Settings.Home,
+			Landat:     d.Settings.Landat,
+			Trajectory: d.Settings.Trajectory,
+		}
+		if lights := d.Settings.Lights; lights != nil {
+			tl, err := lights.Timeline()
+			if err != nil {
+				return nil, fmt.Errorf("Cannot decode light program of drone %d: %w", i, err)
+			}
+			t.Lights = tl
+		}
+		s.Tracks[i] = t
+	}
+	return s, nil
+}
+
+// SkyC converts the show to a version 1 skyc show
+func (s *Show) SkyC() *skybrush.SkyC {
+	drones := make([]skybrush.DroneData, len(s.Tracks))
+	for i, t := range s.Tracks {
+		d := skybrush.DroneData{
+			Type: "generic",
+			Settings: skybrush.DroneSettings{
+				Name:       t.Name,
+				Home:       t.Home,
+				Landat:     t.Landat,
+				Trajectory: t.Trajectory,
+			},
+		}
+		if t.Lights != nil {
+			d.Settings.Lights = t.Lights.Program()
+		}
+		drones[i] = d
+	}
+	return &skybrush.SkyC{
+		Data: &skybrush.ShowDataV1{
+			Version: 1,
+			Swarm: skybrush.ShowSwarmData{
+				Drones: drones,
+			},
+		},
+	}
+}
@@ -0,0 +1,311 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package show
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/png"
+	"io"
+	"time"
+
+	"github.com/ungerik/go3d/vec3"
+
+	"github.com/zyxkad/drone"
+)
+
+// View is the projection of a preview
+type View string
+
+const (
+	ViewTop   View = "top"   // X to the right, Y to the top
+	ViewFront View = "front" // X to the right, Z to the top
+	ViewSide  View = "side"  // Y to the right, Z to the top
+)
+
+// axes returns the show axes of the image's horizontal and vertical direction
+func (v View) axes() (int, int, error) {
+	switch v {
+	case ViewTop, "":
+		return 0, 1, nil
+	case ViewFront:
+		return 0, 2, nil
+	case ViewSide:
+		return 1, 2, nil
+	}
+	return 0, 0, fmt.Errorf("Unknown view %q", (string)(v))
+}
+
+type PreviewConfig struct {
+	View   View
+	Width  int // default is 640
+	Height int // default is 480
+	// DroneRadius is the radius of a drone's dot in pixels
+	DroneRadius int
+
+	// Origin and Heading georeference the show, Fence is drawn only if both Origin and Fence are set
+	Origin  *drone.Gps
+	Heading float32
+	Fence   []*drone.Gps
+}
+
+func (c *PreviewConfig) setDefaults() {
+	if c.Width <= 0 {
+		c.Width = 640
+	}
+	if c.Height <= 0 {
+		c.Height = 480
+	}
+	if c.DroneRadius <= 0 {
+		c.DroneRadius = 3
+	}
+}
+
+var (
+	previewBackground = color.RGBA{R: 0x18, G: 0x18, B: 0x20, A: 0xff}
+	previewGround     = color.RGBA{R: 0x50, G: 0x50, B: 0x50, A: 0xff}
+	previewHome       = color.RGBA{R: 0x70, G: 0x70, B: 0x80, A: 0xff}
+	previewFence      = color.RGBA{R: 0xe0, G: 0x40, B: 0x30, A: 0xff}
+	previewUnlit      = color.RGBA{R: 0x60, G: 0x60, B: 0x60, A: 0xff}
+)
+
+const (
+	// MaxPreviewSize is the largest width or height of a preview
+	MaxPreviewSize = 4096
+	// maxPreviewFrames and maxPreviewPixels limit the size of an animated preview
+	maxPreviewFrames = 2000
+	maxPreviewPixels = 640 * 480 * maxPreviewFrames
+)
+
+// Previewer renders a show to images without any 3D tool
+type Previewer struct {
+	show   *Show
+	cfg    PreviewConfig
+	u, v   int // the show axes of image's x and y
+	fence  []vec3.T
+	min    [2]float32 // the show position at the image's bottom-left
+	scale  float32    // pixels per meter
+	offset image.Point
+}
+
+func NewPreviewer(show *Show, cfg PreviewConfig) (*Previewer, error) {
+	cfg.setDefaults()
+	if cfg.Width > MaxPreviewSize || cfg.Height > MaxPreviewSize {
+		return nil, fmt.Errorf("Preview size %dx%d is larger than %dx%d", cfg.Width, cfg.Height, MaxPreviewSize, MaxPreviewSize)
+	}
+	u, v, err := cfg.View.axes()
+	if err != nil {
+		return nil, err
+	}
+	p := &Previewer{
+		show: show,
+		cfg:  cfg,
+		u:    u,
+		v:    v,
+	}
+	if cfg.Origin != nil && len(cfg.Fence) >= 3 {
+		p.fence = make([]vec3.T, len(cfg.Fence))
+		for i, g := range cfg.Fence {
+			xy := toLocal(cfg.Origin, cfg.Heading, g)
+			p.fence[i] = vec3.T{(float32)(xy[0]), (float32)(xy[1]), 0}
+		}
+	}
+	p.fit()
+	return p, nil
+}
+
+// fit makes everything may be drawn fit in the image
+func (p *Previewer) fit() {
+	box := vec3.Box{Min: vec3.T{0, 0, 0}, Max: vec3.T{0, 0, 0}}
+	extend := func(b vec3.Box) {
+		for i := range 3 {
+			box.Min[i] = min(box.Min[i], b.Min[i])
+			box.Max[i] = max(box.Max[i], b.Max[i])
+		}
+	}
+	for _, t := range p.show.Tracks {
+		extend(vec3.Box{Min: t.Home, Max: t.Home})
+		if t.Trajectory != nil {
+			extend(t.Trajectory.BoundingBox())
+		}
+	}
+	for _, f := range p.fence {
+		extend(vec3.Box{Min: f, Max: f})
+	}
+	margin := (float32)(p.cfg.DroneRadius + 8)
+	w := max(box.Max[p.u]-box.Min[p.u], 1)
+	h := max(box.Max[p.v]-box.Min[p.v], 1)
+	p.scale = min(((float32)(p.cfg.Width)-margin*2)/w, ((float32)(p.cfg.Height)-margin*2)/h)
+	p.scale = max(p.scale, 0.01)
+	p.min = [2]float32{box.Min[p.u], box.Min[p.v]}
+	// center the content
+	p.offset = image.Pt(
+		(int)(((float32)(p.cfg.Width)-w*p.scale)/2),
+		(int)(((float32)(p.cfg.Height)-h*p.scale)/2),
+	)
+}
+
+func (p *Previewer) project(pos vec3.T) image.Point {
+	x := (pos[p.u] - p.min[0]) * p.scale
+	y := (pos[p.v] - p.min[1]) * p.scale
+	return image.Pt(p.offset.X+(int)(x+0.5), p.cfg.Height-p.offset.Y-(int)(y+0.5))
+}
+
+// Frame renders the show at the show time
+func (p *Previewer) Frame(at time.Duration) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, p.cfg.Width, p.cfg.Height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(previewBackground), image.Point{}, draw.Src)
+
+	if p.v == 2 {
+		ground := p.project(vec3.Zero)
+		drawLine(img, image.Pt(0, ground.Y), image.Pt(p.cfg.Width, ground.Y), previewGround)
+	}
+	if len(p.fence) > 0 {
+		if p.v == 2 {
+			// the fence is a vertical prism in side views
+			lo, hi := p.fence[0][p.u], p.fence[0][p.u]
+			for _, f := range p.fence {
+				lo, hi = min(lo, f[p.u]), max(hi, f[p.u])
+			}
+			var a, b vec3.T
+			a[p.u], b[p.u] = lo, hi
+			pa, pb := p.project(a), p.project(b)
+			drawLine(img, image.Pt(pa.X, 0), image.Pt(pa.X, p.cfg.Height), previewFence)
+			drawLine(img, image.Pt(pb.X, 0), image.Pt(pb.X, p.cfg.Height), previewFence)
+		} else {
+			for i, f := range p.fence {
+				drawLine(img, p.project(p.fence[(i+len(p.fence)-1)%len(p.fence)]), p.project(f), previewFence)
+			}
+		}
+	}
+	for _, t := range p.show.Tracks {
+		c := p.project(t.Home)
+		drawLine(img, image.Pt(c.X-2, c.Y), image.Pt(c.X+2, c.Y), previewHome)
+		drawLine(img, image.Pt(c.X, c.Y-2), image.Pt(c.X, c.Y+2), previewHome)
+	}
+	for _, t := range p.show.Tracks {
+		pos := t.Home
+		if t.Trajectory != nil {
+			pos = t.Trajectory.PositionAt(at)
+		}
+		var led drone.Color
+		if t.Lights != nil {
+			led = t.Lights.ColorAt(at)
+		}
+		var c color.Color = color.RGBA{R: led.R, G: led.G, B: led.B, A: 0xff}
+		if (int)(led.R)+(int)(led.G)+(int)(led.B) < 0x30 {
+			c = previewUnlit
+		}
+		fillCircle(img, p.project(pos), p.cfg.DroneRadius, c)
+	}
+	return img
+}
+
+// WritePNG renders the show at the show time as PNG
+func (p *Previewer) WritePNG(w io.Writer, at time.Duration) error {
+	return png.Encode(w, p.Frame(at))
+}
+
+// CheckGIF returns an error if WriteGIF will reject the arguments or the animation is too large
+func (p *Previewer) CheckGIF(start, end, step time.Duration) error {
+	if step < time.Second/100 {
+		return errors.New("GIF frame step must be at least 10ms")
+	}
+	if end < start {
+		return errors.New("GIF end time is before start time")
+	}
+	n := (end-start)/step + 1
+	if n > maxPreviewFrames {
+		return fmt.Errorf("Too much GIF frames %d, at most %d", n, maxPreviewFrames)
+	}
+	if pixels := (int64)(n) * (int64)(p.cfg.Width*p.cfg.Height); pixels > maxPreviewPixels {
+		return fmt.Errorf("GIF is too large, %d frames of %dx%d", n, p.cfg.Width, p.cfg.Height)
+	}
+	return nil
+}
+
+// WriteGIF renders the show from start to end as an animated GIF
+// The animation plays in real time, step is the show time between two frames
+// Frames are encoded once rendered, so nothing is written if the arguments are rejected by CheckGIF
+func (p *Previewer) WriteGIF(w io.Writer, start, end, step time.Duration) error {
+	if err := p.CheckGIF(start, end, step); err != nil {
+		return err
+	}
+	gw, err := newGIFWriter(w, p.cfg.Width, p.cfg.Height, palette.Plan9)
+	if err != nil {
+		return err
+	}
+	delay := (int)(step / (time.Second / 100))
+	pal := image.NewPaletted(image.Rect(0, 0, p.cfg.Width, p.cfg.Height), palette.Plan9)
+	for at := start; at <= end; at += step {
+		frame := p.Frame(at)
+		draw.Draw(pal, pal.Bounds(), frame, image.Point{}, draw.Src)
+		if err := gw.WriteFrame(pal, delay); err != nil {
+			return err
+		}
+	}
+	return gw.Close()
+}
+
+func fillCircle(img draw.Image, c image.Point, r int, col color.Color) {
+	for y := -r; y <= r; y++ {
+		for x := -r; x <= r; x++ {
+			if x*x+y*y <= r*r {
+				img.Set(c.X+x, c.Y+y, col)
+			}
+		}
+	}
+}
+
+// drawLine draws a line with Bresenham's algorithm
+func drawLine(img draw.Image, a, b image.Point, col color.Color) {
+	dx, dy := absInt(b.X-a.X), -absInt(b.Y-a.Y)
+	sx, sy := 1, 1
+	if a.X > b.X {
+		sx = -1
+	}
+	if a.Y > b.Y {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		img.Set(a.X, a.Y, col)
+		if a == b {
+			return
+		}
+		e2 := e * 2
+		if e2 >= dy {
+			e += dy
+			a.X += sx
+		}
+		if e2 <= dx {
+			e += dx
+			a.Y += sy
+		}
+	}
+}
+
+func absInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
@@ -0,0 +1,89 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package show_test
+
+import (
+	"bytes"
+	"image/color"
+	"image/gif"
+	"testing"
+	"time"
+
+	"github.com/ungerik/go3d/vec3"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/show"
+	"github.com/zyxkad/drone/ext/skybrush"
+)
+
+func TestPreview(t *testing.T) {
+	track := newTestTrack(vec3.T{0, 0, 0}, vec3.T{4, 0, 10})
+	track.Lights = &skybrush.LightTimeline{
+		Keyframes: []skybrush.LightKeyframe{{Time: 0, Color: drone.Color{R: 0xff}}},
+		Duration:  time.Second * 20,
+	}
+	s := &show.Show{
+		Tracks: []*show.Track{track},
+	}
+	for _, view := range []show.View{show.ViewTop, show.ViewFront, show.ViewSide} {
+		p, err := show.NewPreviewer(s, show.PreviewConfig{View: view, Width: 200, Height: 100})
+		if err != nil {
+			t.Fatalf("NewPreviewer: %v", err)
+		}
+		img := p.Frame(time.Second * 10)
+		if b := img.Bounds(); b.Dx() != 200 || b.Dy() != 100 {
+			t.Fatalf("Unexpected image size %v", b)
+		}
+		found := false
+		for y := 0; y < 100 && !found; y++ {
+			for x := 0; x < 200; x++ {
+				if img.At(x, y) == (color.RGBA{R: 0xff, A: 0xff}) {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			t.Errorf("Drone is not drawn in %s view", view)
+		}
+	}
+
+	p, _ := show.NewPreviewer(s, show.PreviewConfig{Width: 64, Height: 48})
+	var buf bytes.Buffer
+	if err := p.WriteGIF(&buf, 0, time.Second*20, time.Second); err != nil {
+		t.Fatalf("WriteGIF: %v", err)
+	}
+	anim, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatalf("Cannot decode GIF: %v", err)
+	}
+	if len(anim.Image) != 21 {
+		t.Errorf("Expected 21 frames, got %d", len(anim.Image))
+	}
+	if anim.Config.Width != 64 || anim.Config.Height != 48 || anim.Delay[0] != 100 {
+		t.Errorf("Unexpected GIF %dx%d with delay %d", anim.Config.Width, anim.Config.Height, anim.Delay[0])
+	}
+
+	if _, err := show.NewPreviewer(s, show.PreviewConfig{Width: show.MaxPreviewSize + 1}); err == nil {
+		t.Errorf("Expected error for preview larger than %d", show.MaxPreviewSize)
+	}
+	big, _ := show.NewPreviewer(s, show.PreviewConfig{Width: show.MaxPreviewSize, Height: show.MaxPreviewSize})
+	buf.Reset()
+	if err := big.WriteGIF(&buf, 0, time.Second*20, time.Second/10); err == nil || buf.Len() != 0 {
+		t.Errorf("Expected too large GIF to be rejected before writing, got %v with %d bytes", err, buf.Len())
+	}
+}
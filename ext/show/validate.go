@@ -0,0 +1,315 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package show
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/ungerik/go3d/vec3"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/skybrush"
+)
+
+// Check names used in Violation
+const (
+	CheckSeparation    = "separation"
+	CheckHVelocity     = "horizontal-velocity"
+	CheckVVelocity     = "vertical-velocity"
+	CheckHAcceleration = "horizontal-acceleration"
+	CheckVAcceleration = "vertical-acceleration"
+	CheckCeiling       = "altitude-ceiling"
+	CheckFloor         = "altitude-floor"
+	CheckTakeoffSpot   = "takeoff-spot"
+	CheckLandingSpot   = "landing-spot"
+	CheckGeofence      = "geofence"
+	CheckTrajectory    = "trajectory"
+)
+
+// ValidateConfig sets the limits of a show
+// A zero limit disables the corresponding check
+type ValidateConfig struct {
+	MinSeparation    float32 `json:"minSeparation"`    // In meters
+	MaxHVelocity     float32 `json:"maxHVelocity"`     // In m/s
+	MaxVVelocity     float32 `json:"maxVVelocity"`     // In m/s
+	MaxHAcceleration float32 `json:"maxHAcceleration"` // In m/s²
+	MaxVAcceleration float32 `json:"maxVAcceleration"` // In m/s²
+	MaxAltitude      float32 `json:"maxAltitude"`      // In meters, relative to the origin
+	MinAltitude      float32 `json:"minAltitude"`      // In meters, relative to the origin; always checked
+	HomeTolerance    float32 `json:"homeTolerance"`    // In meters
+	SampleInterval   float64 `json:"sampleInterval"`   // In seconds, default is 0.1
+
+	// Origin and Heading georeference the show, Fence is checked only if both Origin and Fence are set
+	// Fence is checked in the show's coordinate, the value of a geofence violation is the distance outside
+	Origin  *drone.Gps   `json:"origin"`
+	Heading float32      `json:"heading"`
+	Fence   []*drone.Gps `json:"fence"`
+}
+
+// Violation is a failed check
+// For each check and drone (and the other drone for separation checks), only the worst sample is reported
+type Violation struct {
+	Check string  `json:"check"`
+	Drone int     `json:"drone"`
+	Other int     `json:"other"` // The other drone's index for separation checks, otherwise -1
+	Time  float64 `json:"time"`  // Show time in seconds
+	Value float32 `json:"value"`
+	Limit float32 `json:"limit"`
+}
+
+type Report struct {
+	Passed     bool         `json:"passed"`
+	Drones     int          `json:"drones"`
+	Duration   float64      `json:"duration"` // In seconds
+	Violations []*Violation `json:"violations"`
+}
+
+type violationKey struct {
+	check        string
+	drone, other int
+}
+
+type reportBuilder struct {
+	worst map[violationKey]*Violation
+}
+
+// add records a violation, larger is used to decide which value is worse
+func (b *reportBuilder) add(check string, drone, other int, at time.Duration, value, limit float32, larger bool) {
+	key := violationKey{check, drone, other}
+	if v, ok := b.worst[key]; ok {
+		if larger == (v.Value >= value) {
+			return
+		}
+	}
+	b.worst[key] = &Violation{
+		Check: check,
+		Drone: drone,
+		Other: other,
+		Time:  at.Seconds(),
+		Value: value,
+		Limit: limit,
+	}
+}
+
+// Validate checks the show against the limits
+func Validate(show *Show, cfg ValidateConfig) *Report {
+	if cfg.SampleInterval <= 0 {
+		cfg.SampleInterval = 0.1
+	}
+	interval := (time.Duration)(cfg.SampleInterval * (float64)(time.Second))
+	tracks := show.Tracks
+	end := show.Duration()
+	b := &reportBuilder{
+		worst: make(map[violationKey]*Violation),
+	}
+
+	trajs := make([]*skybrush.Trajectory, len(tracks))
+	for i, t := range tracks {
+		if t.Trajectory == nil || len(t.Trajectory.Points) == 0 {
+			b.add(CheckTrajectory, i, -1, 0, 0, 0, true)
+			continue
+		}
+		trajs[i] = t.Trajectory
+	}
+
+	validateSpots(b, show, cfg)
+
+	var fence [][2]float64
+	if cfg.Origin != nil && len(cfg.Fence) >= 3 {
+		fence = make([][2]float64, len(cfg.Fence))
+		for i, p := range cfg.Fence {
+			fence[i] = toLocal(cfg.Origin, cfg.Heading, p)
+		}
+	}
+
+	positions := make([]vec3.T, len(tracks))
+	lastVel := make([]vec3.T, len(tracks))
+	dt := (float32)(interval.Seconds())
+	for step := 0; ; step++ {
+		at := (time.Duration)(step) * interval
+		if at > end {
+			break
+		}
+		for i, traj := range trajs {
+			if traj == nil {
+				continue
+			}
+			pos := traj.PositionAt(at)
+			positions[i] = pos
+			vel := traj.VelocityAt(at)
+			if cfg.MaxHVelocity > 0 {
+				if v := hypot(vel[0], vel[1]); v > cfg.MaxHVelocity {
+					b.add(CheckHVelocity, i, -1, at, v, cfg.MaxHVelocity, true)
+				}
+			}
+			if cfg.MaxVVelocity > 0 {
+				if v := abs(vel[2]); v > cfg.MaxVVelocity {
+					b.add(CheckVVelocity, i, -1, at, v, cfg.MaxVVelocity, true)
+				}
+			}
+			if step > 0 {
+				acc := vec3.Sub(&vel, &lastVel[i])
+				acc.Scale(1 / dt)
+				if cfg.MaxHAcceleration > 0 {
+					if a := hypot(acc[0], acc[1]); a > cfg.MaxHAcceleration {
+						b.add(CheckHAcceleration, i, -1, at, a, cfg.MaxHAcceleration, true)
+					}
+				}
+				if cfg.MaxVAcceleration > 0 {
+					if a := abs(acc[2]); a > cfg.MaxVAcceleration {
+						b.add(CheckVAcceleration, i, -1, at, a, cfg.MaxVAcceleration, true)
+					}
+				}
+			}
+			lastVel[i] = vel
+			if cfg.MaxAltitude > 0 && pos[2] > cfg.MaxAltitude {
+				b.add(CheckCeiling, i, -1, at, pos[2], cfg.MaxAltitude, true)
+			}
+			if pos[2] < cfg.MinAltitude {
+				b.add(CheckFloor, i, -1, at, pos[2], cfg.MinAltitude, false)
+			}
+			if fence != nil {
+				x, y := (float64)(pos[0]), (float64)(pos[1])
+				if !pointInPolygon(fence, x, y) {
+					b.add(CheckGeofence, i, -1, at, (float32)(distanceToPolygon(fence, x, y)), 0, true)
+				}
+			}
+		}
+		if cfg.MinSeparation > 0 {
+			for i, ti := range trajs {
+				if ti == nil {
+					continue
+				}
+				for j := i + 1; j < len(trajs); j++ {
+					if trajs[j] == nil {
+						continue
+					}
+					if d := vec3.Distance(&positions[i], &positions[j]); d < cfg.MinSeparation {
+						b.add(CheckSeparation, i, j, at, d, cfg.MinSeparation, false)
+					}
+				}
+			}
+		}
+	}
+
+	report := &Report{
+		Drones:     len(tracks),
+		Duration:   end.Seconds(),
+		Violations: make([]*Violation, 0, len(b.worst)),
+	}
+	for _, v := range b.worst {
+		report.Violations = append(report.Violations, v)
+	}
+	sort.Slice(report.Violations, func(i, j int) bool {
+		a, c := report.Violations[i], report.Violations[j]
+		if a.Time != c.Time {
+			return a.Time < c.Time
+		}
+		if a.Drone != c.Drone {
+			return a.Drone < c.Drone
+		}
+		return a.Check < c.Check
+	})
+	report.Passed = len(report.Violations) == 0
+	return report
+}
+
+// validateSpots checks the drones take off from their home slot and land on a slot of the home grid
+func validateSpots(b *reportBuilder, show *Show, cfg ValidateConfig) {
+	if cfg.HomeTolerance <= 0 {
+		return
+	}
+	origin := cfg.Origin
+	if origin == nil {
+		origin = new(drone.Gps)
+	}
+	toGps := func(p vec3.T) *drone.Gps {
+		return origin.FromRelatives([]*vec3.T{&p}, cfg.Heading)[0]
+	}
+	homes := show.GenerateHomeGPSList(origin, cfg.Heading)
+	for i, t := range show.Tracks {
+		traj := t.Trajectory
+		if traj == nil || len(traj.Points) == 0 {
+			continue
+		}
+		first := traj.Points[0]
+		if dist := toGps(first.Pos).DistanceToNoAlt(homes[i]); dist > cfg.HomeTolerance {
+			b.add(CheckTakeoffSpot, i, -1, traj.StartTime(), dist, cfg.HomeTolerance, true)
+		}
+		land := t.Landat
+		if land == (vec3.T{}) {
+			land = traj.Points[len(traj.Points)-1].Pos
+		}
+		landGps := toGps(land)
+		nearest := (float32)(math.Inf(1))
+		for _, h := range homes {
+			nearest = min(nearest, landGps.DistanceToNoAlt(h))
+		}
+		if nearest > cfg.HomeTolerance {
+			b.add(CheckLandingSpot, i, -1, traj.EndTime(), nearest, cfg.HomeTolerance, true)
+		}
+	}
+}
+
+// toLocal converts a GPS position to the show's horizontal coordinate, it's the inverse of Gps.FromRelatives
+func toLocal(origin *drone.Gps, heading float32, p *drone.Gps) [2]float64 {
+	east := (float64)((p.Lon - origin.Lon) * origin.LonUnit())
+	north := (float64)((p.Lat - origin.Lat) * origin.LatUnit())
+	s, c := math.Sincos((float64)(heading) * math.Pi / 180)
+	return [2]float64{east*s - north*c, east*c + north*s}
+}
+
+// pointInPolygon uses ray casting to test if (x, y) is inside the polygon
+func pointInPolygon(poly [][2]float64, x, y float64) bool {
+	inside := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		xi, yi := poly[i][0], poly[i][1]
+		xj, yj := poly[j][0], poly[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// distanceToPolygon returns the distance from (x, y) to the nearest edge of the polygon
+func distanceToPolygon(poly [][2]float64, x, y float64) float64 {
+	best := math.Inf(1)
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		ax, ay := poly[j][0], poly[j][1]
+		dx, dy := poly[i][0]-ax, poly[i][1]-ay
+		t := 0.0
+		if l := dx*dx + dy*dy; l > 0 {
+			t = max(0, min(1, ((x-ax)*dx+(y-ay)*dy)/l))
+		}
+		best = min(best, math.Hypot(x-ax-t*dx, y-ay-t*dy))
+	}
+	return best
+}
+
+func hypot(a, b float32) float32 {
+	return (float32)(math.Hypot((float64)(a), (float64)(b)))
+}
+
+func abs(a float32) float32 {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
@@ -0,0 +1,92 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package show_test
+
+import (
+	"testing"
+
+	"github.com/ungerik/go3d/vec3"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/show"
+	"github.com/zyxkad/drone/ext/skybrush"
+)
+
+func newTestTrack(home, mid vec3.T) *show.Track {
+	top := home
+	top[2] = 10
+	return &show.Track{
+		Home:   home,
+		Landat: home,
+		Trajectory: &skybrush.Trajectory{
+			Version: 1,
+			Points: []skybrush.TrajectoryPoint{
+				{Time: 0, Pos: home},
+				{Time: 5, Pos: top},
+				{Time: 10, Pos: mid},
+				{Time: 15, Pos: top},
+				{Time: 20, Pos: home},
+			},
+		},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := &show.Show{
+		Tracks: []*show.Track{
+			newTestTrack(vec3.T{0, 0, 0}, vec3.T{2, 0, 10}),
+			newTestTrack(vec3.T{4, 0, 0}, vec3.T{2.5, 0, 10}),
+		},
+	}
+	cfg := show.ValidateConfig{
+		MinSeparation: 1,
+		MaxHVelocity:  3,
+		MaxVVelocity:  3,
+		MaxAltitude:   20,
+		HomeTolerance: 0.5,
+		Origin:        &drone.Gps{Lat: 30, Lon: 120, Alt: 10},
+		Heading:       30,
+	}
+	cfg.Fence = cfg.Origin.FromRelatives([]*vec3.T{{-5, -5, 0}, {10, -5, 0}, {10, 5, 0}, {-5, 5, 0}}, cfg.Heading)
+
+	report := show.Validate(s, cfg)
+	if report.Passed || len(report.Violations) != 1 {
+		t.Fatalf("Expected only one violation, got %d", len(report.Violations))
+	}
+	v := report.Violations[0]
+	if v.Check != show.CheckSeparation || v.Drone != 0 || v.Other != 1 || v.Time != 10 {
+		t.Errorf("Unexpected violation %#v", v)
+	}
+	if diff := v.Value - 0.5; diff < -1e-4 || diff > 1e-4 {
+		t.Errorf("Expected separation is 0.5, got %f", v.Value)
+	}
+
+	cfg.MinSeparation = 0.1
+	cfg.MaxAltitude = 8
+	cfg.Fence = cfg.Origin.FromRelatives([]*vec3.T{{-5, -5, 0}, {3, -5, 0}, {3, 5, 0}, {-5, 5, 0}}, cfg.Heading)
+	report = show.Validate(s, cfg)
+	checks := make(map[string]int)
+	for _, v := range report.Violations {
+		checks[v.Check]++
+	}
+	if checks[show.CheckCeiling] != 2 {
+		t.Errorf("Expected 2 ceiling violations, got %d", checks[show.CheckCeiling])
+	}
+	if checks[show.CheckGeofence] != 1 {
+		t.Errorf("Expected 1 geofence violation, got %d", checks[show.CheckGeofence])
+	}
+}
@@ -0,0 +1,426 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package skybrush
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/zyxkad/drone"
+)
+
+// LightProgram is the Skybrush light program bytecode of a single drone
+type LightProgram struct {
+	Version int    `json:"version"`
+	Data    []byte `json:"data"` // base64 encoded in JSON
+}
+
+// Light program opcodes
+const (
+	lightCmdEnd         = 0x00
+	lightCmdNop         = 0x01
+	lightCmdSleep       = 0x02
+	lightCmdWaitUntil   = 0x03
+	lightCmdSetColor    = 0x04
+	lightCmdSetGray     = 0x05
+	lightCmdSetBlack    = 0x06
+	lightCmdSetWhite    = 0x07
+	lightCmdFadeToColor = 0x08
+	lightCmdFadeToGray  = 0x09
+	lightCmdFadeToBlack = 0x0a
+	lightCmdFadeToWhite = 0x0b
+	lightCmdLoopBegin   = 0x0c
+	lightCmdLoopEnd     = 0x0d
+	lightCmdResetClock  = 0x0e
+	lightCmdJump        = 0x12
+)
+
+// lightFrameDuration is the time unit of the durations in the bytecode
+const lightFrameDuration = time.Second / 50
+
+// maxLightProgramDuration limits the expansion of infinite loops and backward jumps
+const maxLightProgramDuration = time.Hour
+
+var ErrLightProgramTruncated = errors.New("Light program is truncated")
+
+// LightKeyframe is a color change in a light timeline
+// If Fade is true, the color changes linearly from the previous keyframe to this one,
+// otherwise the color is set at Time and holds until the next keyframe
+type LightKeyframe struct {
+	Time  time.Duration `json:"time"`
+	Color drone.Color   `json:"color"`
+	Fade  bool          `json:"fade"`
+}
+
+// LightTimeline is the decoded form of a light program
+type LightTimeline struct {
+	Keyframes []LightKeyframe `json:"keyframes"`
+	Duration  time.Duration   `json:"duration"`
+}
+
+type lightDecoder struct {
+	data  []byte
+	pc    int
+	now   time.Duration
+	clock time.Duration // the time when the clock was reset
+	color drone.Color
+	tl    *LightTimeline
+}
+
+func (d *lightDecoder) readByte() (byte, error) {
+	if d.pc >= len(d.data) {
+		return 0, ErrLightProgramTruncated
+	}
+	b := d.data[d.pc]
+	d.pc++
+	return b, nil
+}
+
+func (d *lightDecoder) readVarint() (uint64, error) {
+	var (
+		v     uint64
+		shift uint
+	)
+	for {
+		b, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		v |= (uint64)(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, nil
+		}
+		shift += 7
+		if shift >= 64 {
+			return 0, errors.New("Light program varint overflow")
+		}
+	}
+}
+
+func (d *lightDecoder) readDuration() (time.Duration, error) {
+	v, err := d.readVarint()
+	if err != nil {
+		return 0, err
+	}
+	return (time.Duration)(v) * lightFrameDuration, nil
+}
+
+func (d *lightDecoder) readColor() (c drone.Color, err error) {
+	if c.R, err = d.readByte(); err != nil {
+		return
+	}
+	if c.G, err = d.readByte(); err != nil {
+		return
+	}
+	c.B, err = d.readByte()
+	return
+}
+
+func (d *lightDecoder) set(c drone.Color, dur time.Duration) {
+	d.tl.Keyframes = append(d.tl.Keyframes, LightKeyframe{Time: d.now, Color: c})
+	d.color = c
+	d.now += dur
+}
+
+func (d *lightDecoder) fade(c drone.Color, dur time.Duration) {
+	if dur <= 0 {
+		d.set(c, 0)
+		return
+	}
+	// pin the start color so the fade always begins from the current color
+	d.tl.Keyframes = append(d.tl.Keyframes, LightKeyframe{Time: d.now, Color: d.color})
+	d.now += dur
+	d.tl.Keyframes = append(d.tl.Keyframes, LightKeyframe{Time: d.now, Color: c, Fade: true})
+	d.color = c
+}
+
+type lightLoop struct {
+	start     int
+	remaining int // -1 means infinite
+	startTime time.Duration
+}
+
+// Timeline decodes the bytecode into a color timeline
+// Infinite loops are expanded until maxLightProgramDuration
+func (p *LightProgram) Timeline() (*LightTimeline, error) {
+	d := &lightDecoder{
+		data: p.Data,
+		tl:   new(LightTimeline),
+	}
+	var loops []lightLoop
+	lastJumpAt := (time.Duration)(-1)
+DECODE:
+	for d.pc < len(d.data) && d.now < maxLightProgramDuration {
+		op, _ := d.readByte()
+		switch op {
+		case lightCmdEnd:
+			break DECODE
+		case lightCmdNop:
+		case lightCmdSleep:
+			dur, err := d.readDuration()
+			if err != nil {
+				return nil, err
+			}
+			d.now += dur
+		case lightCmdWaitUntil:
+			at, err := d.readDuration()
+			if err != nil {
+				return nil, err
+			}
+			if t := d.clock + at; t > d.now {
+				d.now = t
+			}
+		case lightCmdSetColor, lightCmdFadeToColor:
+			c, err := d.readColor()
+			if err != nil {
+				return nil, err
+			}
+			dur, err := d.readDuration()
+			if err != nil {
+				return nil, err
+			}
+			if op == lightCmdSetColor {
+				d.set(c, dur)
+			} else {
+				d.fade(c, dur)
+			}
+		case lightCmdSetGray, lightCmdFadeToGray:
+			v, err := d.readByte()
+			if err != nil {
+				return nil, err
+			}
+			dur, err := d.readDuration()
+			if err != nil {
+				return nil, err
+			}
+			c := drone.Color{R: v, G: v, B: v}
+			if op == lightCmdSetGray {
+				d.set(c, dur)
+			} else {
+				d.fade(c, dur)
+			}
+		case lightCmdSetBlack, lightCmdSetWhite, lightCmdFadeToBlack, lightCmdFadeToWhite:
+			dur, err := d.readDuration()
+			if err != nil {
+				return nil, err
+			}
+			var c drone.Color
+			if op == lightCmdSetWhite || op == lightCmdFadeToWhite {
+				c = drone.Color{R: 0xff, G: 0xff, B: 0xff}
+			}
+			if op == lightCmdSetBlack || op == lightCmdSetWhite {
+				d.set(c, dur)
+			} else {
+				d.fade(c, dur)
+			}
+		case lightCmdLoopBegin:
+			n, err := d.readByte()
+			if err != nil {
+				return nil, err
+			}
+			remaining := (int)(n)
+			if n == 0 {
+				remaining = -1
+			}
+			loops = append(loops, lightLoop{start: d.pc, remaining: remaining, startTime: d.now})
+		case lightCmdLoopEnd:
+			if len(loops) == 0 {
+				return nil, fmt.Errorf("Unexpected loop end at %d", d.pc-1)
+			}
+			loop := &loops[len(loops)-1]
+			if loop.remaining > 0 {
+				loop.remaining--
+			}
+			if loop.remaining == 0 || d.now == loop.startTime {
+				// finished, or an empty infinite loop which would never end
+				loops = loops[:len(loops)-1]
+				break
+			}
+			loop.startTime = d.now
+			d.pc = loop.start
+		case lightCmdResetClock:
+			d.clock = d.now
+		case lightCmdJump:
+			addr, err := d.readVarint()
+			if err != nil {
+				return nil, err
+			}
+			if addr >= (uint64)(len(d.data)) {
+				return nil, fmt.Errorf("Jump address %d out of range", addr)
+			}
+			if (int)(addr) < d.pc {
+				if d.now == lastJumpAt {
+					// the program jumps back without time elapsed, it would never end
+					break DECODE
+				}
+				lastJumpAt = d.now
+			}
+			d.pc = (int)(addr)
+		default:
+			return nil, fmt.Errorf("Unsupported light program command 0x%02x at %d", op, d.pc-1)
+		}
+	}
+	d.tl.Duration = d.now
+	return d.tl, nil
+}
+
+// ColorAt returns the LED color at given show time
+// The color before the first keyframe is black
+func (t *LightTimeline) ColorAt(at time.Duration) drone.Color {
+	i := sort.Search(len(t.Keyframes), func(i int) bool {
+		return t.Keyframes[i].Time > at
+	})
+	if i == 0 {
+		return drone.Color{}
+	}
+	cur := t.Keyframes[i-1]
+	if i < len(t.Keyframes) {
+		if next := t.Keyframes[i]; next.Fade && next.Time > cur.Time {
+			r := (float32)(at-cur.Time) / (float32)(next.Time-cur.Time)
+			return lerpColor(cur.Color, next.Color, r)
+		}
+	}
+	return cur.Color
+}
+
+// nextChange returns the show time after at when the color will change
+// During a fade, the color is considered to change every step
+func (t *LightTimeline) nextChange(at time.Duration, step time.Duration) (time.Duration, bool) {
+	i := sort.Search(len(t.Keyframes), func(i int) bool {
+		return t.Keyframes[i].Time > at
+	})
+	if i >= len(t.Keyframes) {
+		return 0, false
+	}
+	if next := t.Keyframes[i]; next.Fade && i > 0 {
+		return min(at+step, next.Time), true
+	}
+	return t.Keyframes[i].Time, true
+}
+
+// Play drives the LED along the timeline until the timeline ends or ctx is done
+// clock returns the current show time, and whether the show time is advancing
+// The LED keeps its color while the clock is not running, fades are sampled every step
+func (t *LightTimeline) Play(ctx context.Context, led drone.LEDAbility, clock func() (time.Duration, bool), step time.Duration) error {
+	const (
+		// ActiveLED can only hold a color for about a minute, so colors are refreshed periodically
+		maxHold = time.Second * 30
+		// the clock is checked at least once per recheck, in case it jumps
+		recheck = time.Second
+	)
+	var (
+		sent     bool
+		lastSent time.Time
+		last     drone.Color
+	)
+	for {
+		now, running := clock()
+		if now > t.Duration {
+			return nil
+		}
+		wait := recheck
+		if now >= 0 {
+			color := last
+			if running || !sent {
+				color = t.ColorAt(now)
+			}
+			if !sent || color != last || time.Since(lastSent) >= maxHold {
+				if err := led.ActiveLED(ctx, color, maxHold+recheck+step); err != nil {
+					return err
+				}
+				sent, lastSent, last = true, time.Now(), color
+			}
+			if next, ok := t.nextChange(now, step); ok && running {
+				wait = min(wait, next-now)
+			}
+		} else if running {
+			wait = min(wait, -now)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+type lightEncoder struct {
+	data  []byte
+	frame int64 // the current time in frames
+}
+
+func (e *lightEncoder) writeVarint(v uint64) {
+	for v >= 0x80 {
+		e.data = append(e.data, (byte)(v)|0x80)
+		v >>= 7
+	}
+	e.data = append(e.data, (byte)(v))
+}
+
+// frames returns the frames from the encoder's time to at, and moves the encoder to at
+// The time is rounded as a whole, so the rounding error does not accumulate
+func (e *lightEncoder) frames(at time.Duration) uint64 {
+	frame := (int64)((at + lightFrameDuration/2) / lightFrameDuration)
+	if frame <= e.frame {
+		return 0
+	}
+	n := frame - e.frame
+	e.frame = frame
+	return (uint64)(n)
+}
+
+func (e *lightEncoder) sleepUntil(at time.Duration) {
+	if n := e.frames(at); n > 0 {
+		e.data = append(e.data, lightCmdSleep)
+		e.writeVarint(n)
+	}
+}
+
+// Program encodes the timeline back to light program bytecode
+// Time is rounded to the bytecode's frame of 20ms
+func (t *LightTimeline) Program() *LightProgram {
+	e := new(lightEncoder)
+	for _, k := range t.Keyframes {
+		if k.Fade {
+			e.data = append(e.data, lightCmdFadeToColor, k.Color.R, k.Color.G, k.Color.B)
+			e.writeVarint(e.frames(k.Time))
+		} else {
+			e.sleepUntil(k.Time)
+			e.data = append(e.data, lightCmdSetColor, k.Color.R, k.Color.G, k.Color.B, 0)
+		}
+	}
+	e.sleepUntil(t.Duration)
+	e.data = append(e.data, lightCmdEnd)
+	return &LightProgram{
+		Version: 1,
+		Data:    e.data,
+	}
+}
+
+func lerpColor(a, b drone.Color, r float32) drone.Color {
+	lerp := func(x, y byte) byte {
+		return (byte)((float32)(x) + ((float32)(y)-(float32)(x))*r + 0.5)
+	}
+	return drone.Color{
+		R: lerp(a.R, b.R),
+		G: lerp(a.G, b.G),
+		B: lerp(a.B, b.B),
+	}
+}
@@ -0,0 +1,73 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package skybrush_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/zyxkad/drone"
+	"github.com/zyxkad/drone/ext/skybrush"
+)
+
+func TestLightProgram(t *testing.T) {
+	// SET_COLOR red 1s; FADE_TO_COLOR blue 2s; LOOP 2 { SET_WHITE 0.5s; SET_BLACK 0.5s }; END
+	const data = `{"version": 1, "data": "BP8AADIIAAD/ZAwCBxkGGQ0A"}`
+	var prog skybrush.LightProgram
+	if err := json.Unmarshal(([]byte)(data), &prog); err != nil {
+		t.Fatalf("Cannot parse light program: %v", err)
+	}
+	tl, err := prog.Timeline()
+	if err != nil {
+		t.Fatalf("Cannot decode light program: %v", err)
+	}
+	if want := time.Second * 5; tl.Duration != want {
+		t.Errorf("Expected duration is %v, got %v", want, tl.Duration)
+	}
+	colors := []struct {
+		t time.Duration
+		c drone.Color
+	}{
+		{-time.Second, drone.Color{}},
+		{0, drone.Color{R: 0xff}},
+		{time.Second / 2, drone.Color{R: 0xff}},
+		{time.Second * 2, drone.Color{R: 0x80, B: 0x80}},
+		{time.Second*3 - time.Millisecond, drone.Color{B: 0xff}},
+		{time.Second*3 + time.Second/4, drone.Color{R: 0xff, G: 0xff, B: 0xff}},
+		{time.Second*3 + time.Second*3/4, drone.Color{}},
+		{time.Second*4 + time.Second/4, drone.Color{R: 0xff, G: 0xff, B: 0xff}},
+		{time.Second * 6, drone.Color{}},
+	}
+	check := func(tl *skybrush.LightTimeline) {
+		for _, v := range colors {
+			if got := tl.ColorAt(v.t); got != v.c {
+				t.Errorf("Expected color at %v is %s, got %s", v.t, v.c.String(), got.String())
+			}
+		}
+	}
+	check(tl)
+
+	tl2, err := tl.Program().Timeline()
+	if err != nil {
+		t.Fatalf("Cannot decode encoded light program: %v", err)
+	}
+	if tl2.Duration != tl.Duration {
+		t.Errorf("Expected encoded duration is %v, got %v", tl.Duration, tl2.Duration)
+	}
+	check(tl2)
+}
@@ -21,12 +21,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
+	"time"
 
 	"github.com/ungerik/go3d/vec3"
 
 	"github.com/zyxkad/drone"
 )
 
+// MaxSkyCVersion is the newest skyc version ReadSkyC accepts
+// Version 2 keeps the layout of the fields used here, the fields it adds are ignored
+const MaxSkyCVersion = 2
+
 type SkyC struct {
 	Data *ShowDataV1
 }
@@ -46,14 +52,15 @@ type DroneData struct {
 }
 
 type DroneSettings struct {
-	Name       string `json:"name"`
-	Home       vec3.T `json:"home"`
-	Landat     vec3.T `json:"landAt"`
-	Trajectory any    `json:"trajectory"`
-	Lights     any    `json:"lights"`
+	Name       string        `json:"name"`
+	Home       vec3.T        `json:"home"`
+	Landat     vec3.T        `json:"landAt"`
+	Trajectory *Trajectory   `json:"trajectory"`
+	Lights     *LightProgram `json:"lights"`
 }
 
-func ReadSkyC(r *zip.Reader) (*SkyC, error) {
+// ReadSkyC reads the show from an opened skyc archive, or any file system which contains show.json
+func ReadSkyC(r fs.FS) (*SkyC, error) {
 	fd, err := r.Open("show.json")
 	if err != nil {
 		return nil, err
@@ -67,14 +74,27 @@ func ReadSkyC(r *zip.Reader) (*SkyC, error) {
 	if err := json.Unmarshal(buf, d); err != nil {
 		return nil, err
 	}
-	if d.Version != 1 {
-		return nil, fmt.Errorf("Unexpected skyc version %d, only supports version %d", d.Version, 1)
+	if d.Version < 1 || d.Version > MaxSkyCVersion {
+		return nil, fmt.Errorf("Unexpected skyc version %d, only supports version 1 to %d", d.Version, MaxSkyCVersion)
 	}
 	return &SkyC{
 		Data: d,
 	}, nil
 }
 
+// WriteSkyC writes the show as a skyc archive
+func WriteSkyC(w io.Writer, s *SkyC) error {
+	zw := zip.NewWriter(w)
+	fd, err := zw.Create("show.json")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(fd).Encode(s.Data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
 // GenerateHomeGPSList generates the drone swarm's home GPS list
 // origin is the origin position of the swarm
 // heading is the heading of the swarm in degrees
@@ -85,3 +105,14 @@ func (s *SkyC) GenerateHomeGPSList(origin *drone.Gps, heading float32) []*drone.
 	}
 	return origin.FromRelatives(rels, heading)
 }
+
+// Duration returns the show time when the last trajectory ends
+func (s *SkyC) Duration() time.Duration {
+	var dur time.Duration
+	for _, d := range s.Data.Swarm.Drones {
+		if t := d.Settings.Trajectory; t != nil {
+			dur = max(dur, t.EndTime())
+		}
+	}
+	return dur
+}
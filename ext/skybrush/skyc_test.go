@@ -19,6 +19,8 @@ package skybrush_test
 import (
 	"archive/zip"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/zyxkad/drone"
 	"github.com/zyxkad/drone/ext/skybrush"
@@ -42,3 +44,45 @@ func TestSkyc(t *testing.T) {
 		t.Logf(" - %v", g)
 	}
 }
+
+func TestSkycVersion(t *testing.T) {
+	for _, version := range []string{"0", "3"} {
+		fsys := fstest.MapFS{
+			"show.json": {Data: ([]byte)(`{"version": ` + version + `, "swarm": {"drones": []}}`)},
+		}
+		if _, err := skybrush.ReadSkyC(fsys); err == nil {
+			t.Errorf("skyc version %s should be rejected", version)
+		}
+	}
+}
+
+func TestSkycV2(t *testing.T) {
+	const data = `{
+	"version": 2,
+	"meta": {"title": "v2 show"},
+	"settings": {"cues": {"items": []}},
+	"swarm": {"drones": [{
+		"type": "generic",
+		"settings": {
+			"name": "d1",
+			"home": [1, 2, 0],
+			"landAt": [1, 2, 0],
+			"trajectory": {"version": 1, "points": [[0, [1, 2, 0], []], [10, [1, 2, 10], []]], "takeoffTime": 0}
+		}
+	}]}
+}`
+	skyc, err := skybrush.ReadSkyC(fstest.MapFS{"show.json": {Data: ([]byte)(data)}})
+	if err != nil {
+		t.Fatalf("Cannot parse skyc v2: %v", err)
+	}
+	if skyc.Data.Version != 2 || len(skyc.Data.Swarm.Drones) != 1 {
+		t.Fatalf("Unexpected show %#v", skyc.Data)
+	}
+	settings := skyc.Data.Swarm.Drones[0].Settings
+	if settings.Name != "d1" || settings.Home[0] != 1 || settings.Home[1] != 2 {
+		t.Errorf("Unexpected settings %#v", settings)
+	}
+	if d := skyc.Duration(); d != 10*time.Second {
+		t.Errorf("Duration is %v, want 10s", d)
+	}
+}
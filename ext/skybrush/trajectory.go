@@ -0,0 +1,257 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package skybrush
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/ungerik/go3d/vec3"
+)
+
+// Trajectory is the flight path of a single drone in a skyc show
+// The path is made of Bézier segments between adjacent points
+type Trajectory struct {
+	Version     int               `json:"version"`
+	TakeoffTime float64           `json:"takeoffTime"`           // In seconds
+	LandingTime float64           `json:"landingTime,omitempty"` // In seconds
+	Points      []TrajectoryPoint `json:"points"`
+}
+
+// TrajectoryPoint is a keyframe of a trajectory
+// Controls are the inner Bézier control points of the segment which ends at this point
+type TrajectoryPoint struct {
+	Time     float64 // In seconds
+	Pos      vec3.T
+	Controls []vec3.T
+}
+
+var (
+	_ json.Marshaler   = TrajectoryPoint{}
+	_ json.Unmarshaler = (*TrajectoryPoint)(nil)
+)
+
+// MarshalJSON encodes the point as skyc's `[time, [x, y, z], [[x, y, z], ...]]` tuple
+func (p TrajectoryPoint) MarshalJSON() ([]byte, error) {
+	controls := p.Controls
+	if controls == nil {
+		controls = []vec3.T{}
+	}
+	return json.Marshal([]any{p.Time, p.Pos, controls})
+}
+
+func (p *TrajectoryPoint) UnmarshalJSON(buf []byte) error {
+	var data []json.RawMessage
+	if err := json.Unmarshal(buf, &data); err != nil {
+		return err
+	}
+	if len(data) < 2 {
+		return fmt.Errorf("Unexpected trajectory point length %d", len(data))
+	}
+	if err := json.Unmarshal(data[0], &p.Time); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data[1], &p.Pos); err != nil {
+		return err
+	}
+	p.Controls = nil
+	if len(data) > 2 {
+		if err := json.Unmarshal(data[2], &p.Controls); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return (time.Duration)(s * (float64)(time.Second))
+}
+
+// StartTime returns the time of the first point
+func (t *Trajectory) StartTime() time.Duration {
+	if len(t.Points) == 0 {
+		return 0
+	}
+	return secondsToDuration(t.Points[0].Time)
+}
+
+// EndTime returns the time of the last point
+func (t *Trajectory) EndTime() time.Duration {
+	if len(t.Points) == 0 {
+		return 0
+	}
+	return secondsToDuration(t.Points[len(t.Points)-1].Time)
+}
+
+// Duration returns the time between the first and the last point
+func (t *Trajectory) Duration() time.Duration {
+	return t.EndTime() - t.StartTime()
+}
+
+// segmentAt returns the index of the point which ends the segment containing ts
+// 0 means ts is before the first point, len(Points) means ts is after the last point
+func (t *Trajectory) segmentAt(ts float64) int {
+	return sort.Search(len(t.Points), func(i int) bool {
+		return t.Points[i].Time > ts
+	})
+}
+
+// segment returns the Bézier control polygon of the segment ending at index i
+func (t *Trajectory) segment(i int) []vec3.T {
+	end := &t.Points[i]
+	poly := make([]vec3.T, 0, len(end.Controls)+2)
+	poly = append(poly, t.Points[i-1].Pos)
+	poly = append(poly, end.Controls...)
+	poly = append(poly, end.Pos)
+	return poly
+}
+
+// PositionAt returns the position of the drone at given show time
+// Time before the first point or after the last point will be clamped
+func (t *Trajectory) PositionAt(at time.Duration) vec3.T {
+	if len(t.Points) == 0 {
+		return vec3.Zero
+	}
+	ts := at.Seconds()
+	i := t.segmentAt(ts)
+	if i == 0 {
+		return t.Points[0].Pos
+	}
+	if i >= len(t.Points) {
+		return t.Points[len(t.Points)-1].Pos
+	}
+	start, end := t.Points[i-1].Time, t.Points[i].Time
+	if end <= start {
+		return t.Points[i].Pos
+	}
+	return bezierAt(t.segment(i), (float32)((ts-start)/(end-start)))
+}
+
+// VelocityAt returns the velocity of the drone at given show time, in m/s
+// The velocity is zero outside of the trajectory
+func (t *Trajectory) VelocityAt(at time.Duration) vec3.T {
+	if len(t.Points) == 0 {
+		return vec3.Zero
+	}
+	ts := at.Seconds()
+	i := t.segmentAt(ts)
+	if i == 0 || i >= len(t.Points) {
+		return vec3.Zero
+	}
+	start, end := t.Points[i-1].Time, t.Points[i].Time
+	if end <= start {
+		return vec3.Zero
+	}
+	poly := t.segment(i)
+	n := len(poly) - 1
+	deriv := make([]vec3.T, n)
+	for j := range n {
+		deriv[j] = vec3.Sub(&poly[j+1], &poly[j])
+		deriv[j].Scale((float32)(n))
+	}
+	v := bezierAt(deriv, (float32)((ts-start)/(end-start)))
+	v.Scale((float32)(1 / (end - start)))
+	return v
+}
+
+// BoundingBox returns the smallest box which contains the whole trajectory
+func (t *Trajectory) BoundingBox() vec3.Box {
+	if len(t.Points) == 0 {
+		return vec3.Box{}
+	}
+	box := vec3.Box{Min: t.Points[0].Pos, Max: t.Points[0].Pos}
+	for i := 1; i < len(t.Points); i++ {
+		poly := t.segment(i)
+		for axis := range 3 {
+			lo, hi := bezierAxisRange(poly, axis)
+			box.Min[axis] = min(box.Min[axis], lo)
+			box.Max[axis] = max(box.Max[axis], hi)
+		}
+	}
+	return box
+}
+
+// bezierAt evaluates a Bézier curve with de Casteljau's algorithm
+func bezierAt(poly []vec3.T, u float32) vec3.T {
+	if len(poly) == 0 {
+		return vec3.Zero
+	}
+	work := make([]vec3.T, len(poly))
+	copy(work, poly)
+	for n := len(work) - 1; n > 0; n-- {
+		for j := range n {
+			work[j] = vec3.Interpolate(&work[j], &work[j+1], u)
+		}
+	}
+	return work[0]
+}
+
+// bezierAxisRange returns the extent of a Bézier curve on one axis
+// Curves up to cubic are solved exactly, higher degrees fall back to the control polygon's extent
+func bezierAxisRange(poly []vec3.T, axis int) (lo, hi float32) {
+	first, last := poly[0][axis], poly[len(poly)-1][axis]
+	lo, hi = min(first, last), max(first, last)
+	var roots []float64
+	switch len(poly) {
+	case 3:
+		// B'(u) is linear: (p1-p0) + u*(p0-2p1+p2)
+		p0, p1, p2 := (float64)(poly[0][axis]), (float64)(poly[1][axis]), (float64)(poly[2][axis])
+		if a := p0 - 2*p1 + p2; a != 0 {
+			roots = append(roots, (p0-p1)/a)
+		}
+	case 4:
+		// B'(u)/3 = a*u^2 + b*u + c
+		p0, p1 := (float64)(poly[0][axis]), (float64)(poly[1][axis])
+		p2, p3 := (float64)(poly[2][axis]), (float64)(poly[3][axis])
+		a := -p0 + 3*p1 - 3*p2 + p3
+		b := 2 * (p0 - 2*p1 + p2)
+		c := p1 - p0
+		roots = quadraticRoots(a, b, c)
+	default:
+		if len(poly) > 4 {
+			for _, p := range poly[1 : len(poly)-1] {
+				lo, hi = min(lo, p[axis]), max(hi, p[axis])
+			}
+		}
+		return
+	}
+	for _, u := range roots {
+		if 0 < u && u < 1 {
+			v := bezierAt(poly, (float32)(u))[axis]
+			lo, hi = min(lo, v), max(hi, v)
+		}
+	}
+	return
+}
+
+func quadraticRoots(a, b, c float64) []float64 {
+	if a == 0 {
+		if b == 0 {
+			return nil
+		}
+		return []float64{-c / b}
+	}
+	d := b*b - 4*a*c
+	if d < 0 {
+		return nil
+	}
+	sq := math.Sqrt(d)
+	return []float64{(-b + sq) / (2 * a), (-b - sq) / (2 * a)}
+}
@@ -0,0 +1,74 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package skybrush_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ungerik/go3d/vec3"
+	"github.com/zyxkad/drone/ext/skybrush"
+)
+
+const testTrajectory = `{
+	"version": 1,
+	"takeoffTime": 2,
+	"points": [
+		[0, [0, 0, 0], []],
+		[2, [0, 0, 4], []],
+		[4, [4, 0, 4], [[1, 0, 4], [3, 0, 4]]],
+		[6, [4, 0, 4], [[4, 2, 4]]]
+	]
+}`
+
+func TestTrajectory(t *testing.T) {
+	const maxError = 0.0001
+	var traj skybrush.Trajectory
+	if err := json.Unmarshal(([]byte)(testTrajectory), &traj); err != nil {
+		t.Fatalf("Cannot parse trajectory: %v", err)
+	}
+	if got := traj.Duration(); got != time.Second*6 {
+		t.Errorf("Expected duration is %v, got %v", time.Second*6, got)
+	}
+	positions := []struct {
+		t time.Duration
+		p vec3.T
+		v vec3.T
+	}{
+		{-time.Second, vec3.T{0, 0, 0}, vec3.T{0, 0, 0}},
+		{time.Second, vec3.T{0, 0, 2}, vec3.T{0, 0, 2}},
+		{time.Second * 3, vec3.T{2, 0, 4}, vec3.T{2.25, 0, 0}},
+		{time.Second * 5, vec3.T{4, 1, 4}, vec3.T{0, 0, 0}},
+		{time.Second * 7, vec3.T{4, 0, 4}, vec3.T{0, 0, 0}},
+	}
+	for _, v := range positions {
+		if got := traj.PositionAt(v.t); !got.PracticallyEquals(&v.p, maxError) {
+			t.Errorf("Expected position at %v is %v, got %v", v.t, v.p, got)
+		}
+		if got := traj.VelocityAt(v.t); !got.PracticallyEquals(&v.v, maxError) {
+			t.Errorf("Expected velocity at %v is %v, got %v", v.t, v.v, got)
+		}
+	}
+	box := traj.BoundingBox()
+	if want := (vec3.T{0, 0, 0}); !box.Min.PracticallyEquals(&want, maxError) {
+		t.Errorf("Expected box min is %v, got %v", want, box.Min)
+	}
+	if want := (vec3.T{4, 1, 4}); !box.Max.PracticallyEquals(&want, maxError) {
+		t.Errorf("Expected box max is %v, got %v", want, box.Max)
+	}
+}
@@ -0,0 +1,130 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package drone
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// GroupAction is an action executed by several drones at the same instant
+type GroupAction struct {
+	Action DroneAction
+	// At is the station time when the drones should execute the action
+	At time.Time
+	// Deadline is when to stop waiting acknowledges, default is one second after At
+	Deadline time.Time
+}
+
+// GroupActionResult reports which drones acknowledged the action before the deadline
+type GroupActionResult struct {
+	At      time.Time      `json:"at"`
+	Targets int            `json:"targets"`
+	Acked   []int          `json:"acked"`
+	Missed  []int          `json:"missed"` // the drones which did not reply before the deadline
+	Errors  map[int]string `json:"errors"` // the drones which rejected the action
+	// Broadcast is true if the action is sent by a single broadcast message
+	Broadcast bool `json:"broadcast"`
+	// Uncertainty is the max estimated error of when a drone executed the action
+	Uncertainty Duration `json:"uncertainty"`
+}
+
+// GroupActionAbility is implemented by controllers which can synchronize an action among drones
+type GroupActionAbility interface {
+	ExecuteGroupAction(ctx context.Context, drones []Drone, action *GroupAction) (*GroupActionResult, error)
+}
+
+var (
+	ErrUnsupportedAction = errors.New("Unsupported action")
+	ErrActionTooLate     = errors.New("Action is scheduled in the past")
+)
+
+// NewGroupActionResult creates an empty result of the action
+func NewGroupActionResult(action *GroupAction, targets int) *GroupActionResult {
+	return &GroupActionResult{
+		At:      action.At,
+		Targets: targets,
+		Acked:   make([]int, 0, targets),
+		Missed:  make([]int, 0),
+		Errors:  make(map[int]string),
+	}
+}
+
+// Latency returns the estimated one way latency from the station to the drone
+func Latency(d Drone) time.Duration {
+	if ca, ok := d.(ClockAbility); ok {
+		if c := ca.GetClock(); c.Ready() {
+			return (time.Duration)(c.Estimate().RTT) / 2
+		}
+	}
+	return d.GetPing()
+}
+
+// ExecuteGroupAction executes an action on the drones at action.At
+// The controller's implementation is used if it implements GroupActionAbility,
+// otherwise each drone's action is sent one latency ahead of action.At
+func ExecuteGroupAction(ctx context.Context, c Controller, drones []Drone, action *GroupAction) (*GroupActionResult, error) {
+	fn := action.Action.AsFunc()
+	if fn == nil {
+		return nil, ErrUnsupportedAction
+	}
+	if action.Deadline.IsZero() {
+		action.Deadline = action.At.Add(time.Second)
+	}
+	if ga, ok := c.(GroupActionAbility); ok {
+		return ga.ExecuteGroupAction(ctx, drones, action)
+	}
+	if time.Until(action.At) < 0 {
+		return nil, ErrActionTooLate
+	}
+	ctx, cancel := context.WithDeadline(ctx, action.Deadline)
+	defer cancel()
+
+	res := NewGroupActionResult(action, len(drones))
+	var (
+		mux sync.Mutex
+		wg  sync.WaitGroup
+	)
+	for _, d := range drones {
+		latency := Latency(d)
+		res.Uncertainty = max(res.Uncertainty, (Duration)(latency))
+		wg.Add(1)
+		go func(d Drone) {
+			defer wg.Done()
+			timer := time.NewTimer(time.Until(action.At.Add(-latency)))
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+			}
+			err := fn(d, ctx)
+			mux.Lock()
+			defer mux.Unlock()
+			if err == nil {
+				res.Acked = append(res.Acked, d.ID())
+			} else if ctx.Err() != nil {
+				res.Missed = append(res.Missed, d.ID())
+			} else {
+				res.Errors[d.ID()] = err.Error()
+			}
+		}(d)
+	}
+	wg.Wait()
+	return res, nil
+}
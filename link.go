@@ -0,0 +1,173 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package drone
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MavlinkFrameOverhead is the MAVLink v2 header and checksum size
+const MavlinkFrameOverhead = 12
+
+// LinkStats is the quality of the link to a drone
+type LinkStats struct {
+	ChannelLinkStats
+	// Errors counts the frames dropped because of checksum or re-encoding failures
+	Errors uint64 `json:"errors"`
+	// Radio is the last RADIO_STATUS reported by the drone's radio, nil if never received
+	Radio    *RadioStatus        `json:"radio,omitempty"`
+	Channels []*ChannelLinkStats `json:"channels"`
+}
+
+// ChannelLinkStats is the quality of a channel, or the sum of all channels
+type ChannelLinkStats struct {
+	Channel    string    `json:"channel,omitempty"`
+	Received   uint64    `json:"received"`
+	Lost       uint64    `json:"lost"`       // the frames skipped in the sequence
+	Duplicated uint64    `json:"duplicated"` // the frames repeated or out of order
+	Bytes      uint64    `json:"bytes"`
+	Rate       float64   `json:"rate"`     // bytes per second
+	LossRate   float64   `json:"lossRate"` // the lost ratio in the last rate period, in [0, 1]
+	LastRecv   time.Time `json:"lastRecv"`
+}
+
+type RadioStatus struct {
+	RSSI        uint8     `json:"rssi"`
+	RemoteRSSI  uint8     `json:"remrssi"`
+	Noise       uint8     `json:"noise"`
+	RemoteNoise uint8     `json:"remnoise"`
+	TxBuf       uint8     `json:"txbuf"` // remaining transmit buffer in percent
+	RxErrors    uint16    `json:"rxerrors"`
+	Fixed       uint16    `json:"fixed"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// linkRatePeriod is the min period to update the rates
+const linkRatePeriod = time.Second
+
+type channelTracker struct {
+	stats   ChannelLinkStats
+	lastSeq byte
+
+	// the counters when the rates are updated last time
+	rateAt       time.Time
+	rateBytes    uint64
+	rateReceived uint64
+	rateLost     uint64
+}
+
+// LinkTracker counts the frames of a sender from the MAVLink sequence numbers
+type LinkTracker struct {
+	mux      sync.Mutex
+	channels map[string]*channelTracker
+	errors   uint64
+	radio    *RadioStatus
+}
+
+func NewLinkTracker() *LinkTracker {
+	return &LinkTracker{
+		channels: make(map[string]*channelTracker),
+	}
+}
+
+// Observe records a frame of size bytes with the sequence number received from the channel
+func (t *LinkTracker) Observe(channel string, seq byte, size int, now time.Time) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	c, ok := t.channels[channel]
+	if !ok {
+		c = &channelTracker{
+			stats:   ChannelLinkStats{Channel: channel},
+			lastSeq: seq - 1,
+			rateAt:  now,
+		}
+		t.channels[channel] = c
+	}
+	s := &c.stats
+	s.Received++
+	s.Bytes += (uint64)(size)
+	s.LastRecv = now
+	// a backward jump is treated as repeated or reordered rather than a loss of more than half of the sequence
+	if diff := seq - c.lastSeq; diff == 0 || diff >= 0x80 {
+		s.Duplicated++
+	} else {
+		s.Lost += (uint64)(diff - 1)
+		c.lastSeq = seq
+	}
+	if dt := now.Sub(c.rateAt); dt >= linkRatePeriod {
+		s.Rate = (float64)(s.Bytes-c.rateBytes) / dt.Seconds()
+		received, lost := s.Received-c.rateReceived, s.Lost-c.rateLost
+		s.LossRate = (float64)(lost) / (float64)(received+lost)
+		c.rateAt, c.rateBytes, c.rateReceived, c.rateLost = now, s.Bytes, s.Received, s.Lost
+	}
+}
+
+// AddError records a frame which is dropped
+func (t *LinkTracker) AddError() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.errors++
+}
+
+func (t *LinkTracker) SetRadio(radio *RadioStatus) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.radio = radio
+}
+
+// Stats returns the sum and each channel's statistics
+// The rate of a channel which stops receiving is decayed to zero
+func (t *LinkTracker) Stats(now time.Time) *LinkStats {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	stats := &LinkStats{
+		Errors:   t.errors,
+		Channels: make([]*ChannelLinkStats, 0, len(t.channels)),
+	}
+	if t.radio != nil {
+		radio := *t.radio
+		stats.Radio = &radio
+	}
+	sum := &stats.ChannelLinkStats
+	var lossRate float64
+	for _, c := range t.channels {
+		s := c.stats
+		if idle := now.Sub(s.LastRecv); idle > linkRatePeriod*2 {
+			s.Rate = 0
+		}
+		stats.Channels = append(stats.Channels, &s)
+		sum.Received += s.Received
+		sum.Lost += s.Lost
+		sum.Duplicated += s.Duplicated
+		sum.Bytes += s.Bytes
+		sum.Rate += s.Rate
+		lossRate += s.LossRate * s.Rate
+		if s.LastRecv.After(sum.LastRecv) {
+			sum.LastRecv = s.LastRecv
+		}
+	}
+	if sum.Rate > 0 {
+		sum.LossRate = lossRate / sum.Rate
+	}
+	slices.SortFunc(stats.Channels, func(a, b *ChannelLinkStats) int {
+		return strings.Compare(a.Channel, b.Channel)
+	})
+	return stats
+}
@@ -0,0 +1,58 @@
+// Drone controller framework
+// Copyright (C) 2024  Kevin Z <zyxkad@gmail.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package drone_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zyxkad/drone"
+)
+
+func TestLinkTracker(t *testing.T) {
+	tr := drone.NewLinkTracker()
+	now := time.Unix(1000, 0)
+	// seq 250..255, 0..9 with 3 and 4 lost, then 8 repeated
+	var seqs []byte
+	for i := 250; i < 266; i++ {
+		if s := (byte)(i); s != 3 && s != 4 {
+			seqs = append(seqs, s)
+		}
+	}
+	seqs = append(seqs, 8)
+	for i, s := range seqs {
+		tr.Observe("serial:/dev/ttyUSB0", s, 20, now.Add((time.Duration)(i)*time.Millisecond*100))
+	}
+	tr.Observe("udp:1", 0, 30, now)
+	tr.AddError()
+
+	st := tr.Stats(now.Add(time.Second))
+	if st.Received != 16 || st.Lost != 2 || st.Duplicated != 1 || st.Bytes != 15*20+30 || st.Errors != 1 {
+		t.Fatalf("Unexpected stats %#v", st.ChannelLinkStats)
+	}
+	if len(st.Channels) != 2 || st.Channels[0].Channel != "serial:/dev/ttyUSB0" {
+		t.Fatalf("Unexpected channels %#v", st.Channels)
+	}
+	c := st.Channels[0]
+	// the rate is updated at the 11th frame, which is 1s after the first one
+	if c.Rate != 220 || c.LossRate < 0.15 || c.LossRate > 0.16 {
+		t.Fatalf("Unexpected rate %f, loss rate %f", c.Rate, c.LossRate)
+	}
+	if st := tr.Stats(now.Add(time.Second * 5)); st.Rate != 0 {
+		t.Fatalf("Rate should decay after idle, got %f", st.Rate)
+	}
+}
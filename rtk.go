@@ -213,6 +213,17 @@ func (r *RTK) StartSurveyIn(minDur time.Duration, accLimit float32) error {
 	return nil
 }
 
+// SetFixedPosition configures the RTK as a base at a known position instead of running survey-in
+// acc: the 3D accuracy of the position, in meters
+func (r *RTK) SetFixedPosition(pos rtk.ECEF, acc float64) error {
+	return r.sendUBXMessage(rtk.FixedTmode3(pos, acc))
+}
+
+// EnableSatelliteReport enables UBX-NAV-SAT every rate navigation solutions, 0 disables it
+func (r *RTK) EnableSatelliteReport(rate byte) error {
+	return r.configureMessageRate(0x01, 0x35, rate)
+}
+
 type SatelliteCfg struct {
 	GPS     bool `json:"GPS"`
 	GLONASS bool `json:"GLONASS"`
@@ -83,6 +83,8 @@ const (
 	ActionHold    DroneAction = "HOLD"
 	ActionSleep   DroneAction = "SLEEP"
 	ActionWakeup  DroneAction = "WAKEUP"
+	// ActionStartMission starts the whole uploaded mission
+	ActionStartMission DroneAction = "MISSION"
 )
 
 func (a DroneAction) AsFunc() func(d Drone, ctx context.Context) error {
@@ -99,6 +101,10 @@ func (a DroneAction) AsFunc() func(d Drone, ctx context.Context) error {
 		return Drone.Takeoff
 	case ActionHold:
 		return Drone.Hold
+	case ActionStartMission:
+		return func(d Drone, ctx context.Context) error {
+			return d.StartMission(ctx, 0, 0)
+		}
 	default:
 		return nil
 	}